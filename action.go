@@ -2,6 +2,8 @@ package debos
 
 import (
 	"bytes"
+	"os"
+
 	"github.com/go-debos/fakemachine"
 )
 
@@ -18,24 +20,35 @@ const (
 type Partition struct {
 	Name       string
 	DevicePath string
+	Number     int
 }
 
 type CommonContext struct {
-	Scratchdir      string
-	Rootdir         string
-	Artifactdir     string
-	Downloaddir     string
-	Image           string
-	ImagePartitions []Partition
-	ImageMntDir     string
-	ImageFSTab      bytes.Buffer // Fstab as per partitioning
-	ImageKernelRoot string       // Kernel cmdline root= snippet for the / of the image
-	DebugShell      string
-	Origins         map[string]string
-	State           DebosState
-	EnvironVars     map[string]string
-	PrintRecipe     bool
-	Verbose         bool
+	Scratchdir         string
+	Rootdir            string
+	Artifactdir        string
+	Downloaddir        string
+	Image              string
+	ImagePartitions    []Partition
+	ImageMntDir        string
+	ImageFSTab         bytes.Buffer // Fstab as per partitioning
+	ImageKernelRoot    string       // Kernel cmdline root= snippet for the / of the image
+	DebugShell         string
+	Origins            map[string]string
+	State              DebosState
+	EnvironVars        map[string]string
+	PrintRecipe        bool
+	Verbose            bool
+	Manifest           *Manifest // nil unless a manifest is written
+	AptProxy           string    // APT proxy URL or "auto", used during the build only
+	Lock               *Lock     // nil unless --update-lock or --locked is used
+	NormalizeOwnership bool      // Copy the content of origins as root:root, with modes masked by Umask
+	Umask              os.FileMode
+	Registered         map[string]string  // Outputs of the run actions with 'register'
+	BuildID            string             // Identifier telling concurrent builds apart
+	Sandbox            *Sandbox           // Sandbox of the running action, nil if none
+	Integrity          *IntegrityManifest // nil unless filesystem-deploy writes an integrity manifest
+	AptCache           AptCacheStats      // Packages installed by APT from its cache or downloaded
 }
 
 type DebosContext struct {
@@ -43,6 +56,7 @@ type DebosContext struct {
 	RecipeDir       string
 	Architecture    string
 	SectorSize      int
+	Target          *Target
 }
 
 func (c *DebosContext) Origin(o string) (string, bool) {
@@ -70,9 +84,22 @@ type Action interface {
 	String() string
 }
 
+/*
+FinalizingAction is implemented by actions turning their output into its final
+form, e.g. compressing an image, which has to wait for the PostMachine of all
+the actions as later ones may still modify the output. Finalize runs on the
+host once they all succeeded.
+*/
+type FinalizingAction interface {
+	Finalize(context *DebosContext) error
+}
+
 type BaseAction struct {
 	Action      string
 	Description string
+	When        string        // Condition to run the action, handled by the recipe
+	WithItems   []interface{} `yaml:"with-items"` // Items to repeat the action for, handled by the recipe
+	Sandbox     string        // Name of the sandbox of the commands, handled by the recipe
 }
 
 func (b *BaseAction) Verify(context *DebosContext) error { return nil }
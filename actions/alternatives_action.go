@@ -0,0 +1,129 @@
+/*
+Alternatives Action
+
+Select the default implementation of commands (editor, iptables backend, java,
+etc) in the target rootfs with 'update-alternatives'.
+
+ # Yaml syntax:
+ - action: alternatives
+   set:
+     name: path
+   auto:
+     - name
+
+Optional properties:
+
+- set -- map of alternative names to the path of the alternative to select.
+The alternative has to be registered (e.g. by installing the package providing
+it) before running this action.
+
+- auto -- list of alternative names to put back in automatic mode, selecting
+the alternative with the highest priority.
+
+At least one of 'set' or 'auto' has to be given.
+
+ # Example:
+ - action: alternatives
+   set:
+     editor: /usr/bin/vim.basic
+     iptables: /usr/sbin/iptables-legacy
+*/
+package actions
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/go-debos/debos"
+)
+
+const alternativesAdminDir = "/var/lib/dpkg/alternatives"
+
+type AlternativesAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Set              map[string]string
+	Auto             []string
+}
+
+func (alt *AlternativesAction) Verify(context *debos.DebosContext) error {
+	if len(alt.Set) == 0 && len(alt.Auto) == 0 {
+		return errors.New("At least one of 'set' or 'auto' properties is needed for alternatives action")
+	}
+
+	for _, name := range alt.Auto {
+		if _, found := alt.Set[name]; found {
+			return fmt.Errorf("Alternative %s can't be both set and automatic", name)
+		}
+	}
+
+	for name, p := range alt.Set {
+		if !path.IsAbs(p) {
+			return fmt.Errorf("Path for alternative %s must be absolute", name)
+		}
+	}
+
+	return nil
+}
+
+// Check the alternative is registered using the dpkg administrative file
+func (alt *AlternativesAction) checkRegistered(context *debos.DebosContext, name, choice string) error {
+	admin := path.Join(context.Rootdir, alternativesAdminDir, name)
+	data, err := ioutil.ReadFile(admin)
+	if err != nil {
+		return fmt.Errorf("Alternative %s is not registered", name)
+	}
+
+	if choice == "" {
+		return nil
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == choice {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%s is not a registered alternative for %s", choice, name)
+}
+
+func (alt *AlternativesAction) Run(context *debos.DebosContext) error {
+	names := make([]string, 0, len(alt.Set))
+	for name := range alt.Set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := alt.checkRegistered(context, name, alt.Set[name]); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range alt.Auto {
+		if err := alt.checkRegistered(context, name, ""); err != nil {
+			return err
+		}
+	}
+
+	c := debos.NewChrootCommandForContext(*context)
+
+	for _, name := range names {
+		err := c.Run("alternatives", "update-alternatives", "--set", name, alt.Set[name])
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, name := range alt.Auto {
+		err := c.Run("alternatives", "update-alternatives", "--auto", name)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -8,13 +8,25 @@ Install packages and their dependencies to the target rootfs with 'apt'.
    recommends: bool
    unauthenticated: bool
    update: bool
+   allow-downgrades: bool
    packages:
      - package1
      - package2
+   preferences:
+     - package: "*"
+       pin: release a=bookworm-backports
+       pin-priority: 500
+   preferences-name: name
+   snapshot: timestamp
+   proxy: url
+   probe-mirrors: bool
 
 Mandatory properties:
 
-- packages -- list of packages to install
+- packages -- list of packages to install. A specific version can be
+requested with 'package=version' and a target release with
+'package/release', e.g. 'linux-image-amd64/bookworm-backports'. The build
+fails if the requested version or release isn't available.
 
 Optional properties:
 
@@ -23,73 +35,425 @@ Optional properties:
 - unauthenticated -- boolean indicating if unauthenticated packages can be installed. Default 'false'.
 
 - update -- boolean indicating if `apt update` will be run. Default 'true'.
+
+- allow-downgrades -- boolean indicating if packages can be downgraded, e.g. to
+install a requested 'package=version' older than the installed one, or the
+version of a 'local-repository' over a newer one from the archive. Apt refuses
+downgrades otherwise. Default 'false'.
+
+- preferences -- list of APT preferences written before running apt, see
+apt_preferences(5). Each entry has a 'package' (package names or patterns),
+a 'pin' (e.g. 'release a=bookworm-backports' or 'origin "vendor.example.com"')
+and a 'pin-priority'. An optional 'explanation' is written as comment.
+
+- preferences-name -- name of the preferences file written to
+'/etc/apt/preferences.d/<name>.pref'. Default 'debos'. Preferences of
+successive apt actions using the same name replace each other.
+
+- snapshot -- install the packages as they were available at the given date
+from snapshot.debian.org, for reproducible package sets. The timestamp is
+either in the snapshot.debian.org format, e.g. '20240115T000000Z', or a date
+like '2024-01-15' or '2024-01-15T12:00:00Z'. The Debian sources of the rootfs
+(deb.debian.org, security.debian.org and other *.debian.org mirrors) are
+rewritten to the snapshot, and '/etc/apt/apt.conf.d/80debos-snapshot' disables
+the validity check of the release files, which have expired for past dates,
+while APT runs. Other sources are left untouched. The package lists are always
+updated.
+
+- proxy -- URL of the HTTP proxy used by APT for this action, 'auto' to
+use an apt-cacher-ng running on the host if any, or 'none' to disable the
+proxy. Defaults to the '--apt-proxy' command line option. The proxy is only
+used for the http sources, the https sources are fetched directly or through
+the 'https_proxy' of the environment. It is only configured while APT runs
+and isn't kept in the image.
+
+- probe-mirrors -- check the HTTP sources of the rootfs serve their suite
+before updating the package lists, fetching their Release file and verifying
+the checksum of the Release file of their first component. The build fails
+early with the reason if a source is broken. Default 'false', the probes can't
+pass authenticating proxies or use the credentials of APT's auth.conf.
 */
 package actions
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/docker/go-units"
 	"github.com/go-debos/debos"
 )
 
+type AptPreference struct {
+	Package     string
+	Pin         string
+	PinPriority *int `yaml:"pin-priority"`
+	Explanation string
+}
+
 type AptAction struct {
 	debos.BaseAction `yaml:",inline"`
 	Recommends       bool
 	Unauthenticated  bool
 	Update           bool
+	AllowDowngrades  bool `yaml:"allow-downgrades"`
 	Packages         []string
+	Preferences      []AptPreference
+	PreferencesName  string `yaml:"preferences-name"`
+	Snapshot         string
+	Proxy            string
+	ProbeMirrors     bool `yaml:"probe-mirrors"`
+}
+
+// APT configuration of the proxy, only present while APT runs
+const aptProxyConf = "/etc/apt/apt.conf.d/00debos-proxy"
+
+// Time formats accepted for the snapshot property
+var snapshotFormats = []string{
+	"20060102T150405Z",
+	time.RFC3339,
+	"2006-01-02",
 }
 
 func NewAptAction() *AptAction {
-	a := &AptAction{Update: true}
+	a := &AptAction{Update: true, PreferencesName: "debos"}
 	return a
 }
 
-func (apt *AptAction) Run(context *debos.DebosContext) error {
-	aptConfig := []string{}
+func (apt *AptAction) Verify(context *debos.DebosContext) error {
+	if apt.PreferencesName == "" || strings.Contains(apt.PreferencesName, "/") {
+		return errors.New("Property 'preferences-name' must be a valid file name")
+	}
 
-	/* Don't show progress update percentages */
-	aptConfig = append(aptConfig, "-o=quiet::NoUpdate=1")
+	for _, p := range apt.Packages {
+		if isAptPath(p) {
+			continue
+		}
+		name, version, release := parseAptPackage(p)
+		if name == "" || strings.ContainsAny(name, "=/") {
+			return fmt.Errorf("Invalid package '%s'", p)
+		}
+		if strings.HasSuffix(p, "=") && version == "" {
+			return fmt.Errorf("Missing version for package '%s'", name)
+		}
+		if strings.HasSuffix(p, "/") && release == "" {
+			return fmt.Errorf("Missing release for package '%s'", name)
+		}
+	}
 
-	aptOptions := []string{"apt-get", "-y"}
-	aptOptions = append(aptOptions, aptConfig...)
+	for _, p := range apt.Preferences {
+		if p.Package == "" || p.Pin == "" || p.PinPriority == nil {
+			return errors.New("APT preferences need 'package', 'pin' and 'pin-priority'")
+		}
+	}
 
-	if !apt.Recommends {
-		aptOptions = append(aptOptions, "--no-install-recommends")
+	if apt.Snapshot != "" {
+		if _, err := apt.snapshotTimestamp(); err != nil {
+			return err
+		}
 	}
 
-	if apt.Unauthenticated {
-		aptOptions = append(aptOptions, "--allow-unauthenticated")
+	return debos.VerifyAptProxy(apt.Proxy)
+}
+
+/*
+Configure the APT proxy in the rootfs, the global one if proxy is empty. The
+returned function removes the configuration again.
+*/
+func setupAptProxy(context *debos.DebosContext, proxy string) (func(), error) {
+	proxy = debos.ResolveAptProxy(*context, proxy)
+	if proxy == "" {
+		return func() {}, nil
 	}
 
-	aptOptions = append(aptOptions, "install")
-	aptOptions = append(aptOptions, apt.Packages...)
+	log.Printf("Using APT proxy %s", proxy)
+	// A caching proxy like apt-cacher-ng can't see through https sources
+	conf := fmt.Sprintf("Acquire::http::Proxy \"%s\";\n", proxy)
+	if err := writeRootfsFile(context, aptProxyConf, []byte(conf), 0644); err != nil {
+		return nil, err
+	}
 
-	c := debos.NewChrootCommandForContext(*context)
-	c.AddEnv("DEBIAN_FRONTEND=noninteractive")
+	return func() {
+		os.Remove(path.Join(context.Rootdir, aptProxyConf))
+	}, nil
+}
 
-	if apt.Update {
-		cmd := []string{"apt-get"}
-		cmd = append(cmd, aptConfig...)
-		cmd = append(cmd, "update")
+// Snapshot timestamp in the snapshot.debian.org format
+func (apt *AptAction) snapshotTimestamp() (string, error) {
+	for _, format := range snapshotFormats {
+		t, err := time.Parse(format, apt.Snapshot)
+		if err == nil {
+			return t.UTC().Format(snapshotFormats[0]), nil
+		}
+	}
+
+	return "", fmt.Errorf("Invalid snapshot timestamp '%s'", apt.Snapshot)
+}
+
+// Rewrite a Debian archive URI to its snapshot, other URIs are returned as is
+func snapshotURI(uri string, timestamp string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Host == "snapshot.debian.org" ||
+		(u.Host != "debian.org" && !strings.HasSuffix(u.Host, ".debian.org")) {
+		return uri
+	}
+
+	archive := strings.Split(strings.Trim(u.Path, "/"), "/")[0]
+	if archive == "" && u.Host == "security.debian.org" {
+		archive = "debian-security"
+	}
+	if !strings.HasPrefix(archive, "debian") {
+		return uri
+	}
+
+	u.Host = "snapshot.debian.org"
+	u.Path = fmt.Sprintf("/archive/%s/%s/", archive, timestamp)
+	return u.String()
+}
+
+// APT configuration of the snapshot, only present while APT runs
+const aptSnapshotConf = "/etc/apt/apt.conf.d/80debos-snapshot"
+
+// Whitespace separated words of the APT sources, to find their URIs
+var aptSourceWordRegex = regexp.MustCompile(`\S+`)
+
+/*
+Rewrite the Debian sources of the rootfs to snapshot.debian.org and configure
+APT for the snapshot. Returns the function removing the configuration once APT
+is done.
+*/
+func (apt *AptAction) useSnapshot(context *debos.DebosContext) (func(), error) {
+	timestamp, err := apt.snapshotTimestamp()
+	if err != nil {
+		return nil, err
+	}
+
+	changed, err := editAptSources(context, func(text string, s AptSource, deb822 bool) string {
+		return aptSourceWordRegex.ReplaceAllStringFunc(text, func(word string) string {
+			for _, uri := range s.URIs {
+				if word == uri {
+					return snapshotURI(uri, timestamp)
+				}
+			}
+			return word
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range changed {
+		log.Printf("Using snapshot %s in %s", timestamp, file)
+	}
+
+	// Release files of past snapshots are expired
+	conf := "Acquire::Check-Valid-Until \"false\";\n"
+	if err := writeRootfsFile(context, aptSnapshotConf, []byte(conf), 0644); err != nil {
+		return nil, err
+	}
 
-		err := c.Run("apt", cmd...)
+	return func() {
+		os.Remove(path.Join(context.Rootdir, aptSnapshotConf))
+	}, nil
+}
+
+// Local packages, given as paths to .deb files as apt accepts them
+func isAptPath(p string) bool {
+	return strings.HasPrefix(p, "/") || strings.HasPrefix(p, "./") || strings.HasPrefix(p, "../") ||
+		strings.HasSuffix(p, ".deb")
+}
+
+/*
+Split a package of the form name[=version] or name[/release], paths to .deb
+files are returned as the name.
+*/
+func parseAptPackage(p string) (name, version, release string) {
+	if isAptPath(p) {
+		return p, "", ""
+	}
+	if idx := strings.Index(p, "="); idx >= 0 {
+		return p[:idx], p[idx+1:], ""
+	}
+	if idx := strings.Index(p, "/"); idx >= 0 {
+		return p[:idx], "", p[idx+1:]
+	}
+	return p, "", ""
+}
+
+// Check the requested versions and releases of packages are available
+func (apt *AptAction) checkVersions(c debos.Command) error {
+	for _, p := range apt.Packages {
+		name, version, release := parseAptPackage(p)
+		if version == "" && release == "" {
+			continue
+		}
+
+		// Only the exit code matters, not the package record
+		err := c.Run("apt", "sh", "-c",
+			fmt.Sprintf("apt-cache show --no-all-versions %s > /dev/null", escape(p)))
+		if err == nil {
+			continue
+		}
+
+		if version != "" {
+			return fmt.Errorf("Version %s of package %s is not available", version, name)
+		}
+		return fmt.Errorf("Package %s is not available from release %s", name, release)
+	}
+
+	return nil
+}
+
+func (apt *AptAction) writePreferences(context *debos.DebosContext) error {
+	var b bytes.Buffer
+
+	for idx, p := range apt.Preferences {
+		if idx > 0 {
+			b.WriteString("\n")
+		}
+		if p.Explanation != "" {
+			b.WriteString(fmt.Sprintf("Explanation: %s\n", p.Explanation))
+		}
+		b.WriteString(fmt.Sprintf("Package: %s\n", p.Package))
+		b.WriteString(fmt.Sprintf("Pin: %s\n", p.Pin))
+		b.WriteString(fmt.Sprintf("Pin-Priority: %d\n", *p.PinPriority))
+	}
+
+	file := path.Join("/etc/apt/preferences.d", apt.PreferencesName+".pref")
+	return writeRootfsFile(context, file, b.Bytes(), 0644)
+}
+
+// Check the HTTP sources of the rootfs before updating the package lists
+func probeAptSources(context *debos.DebosContext) error {
+	files, err := aptSourcesFiles(context)
+	if err != nil {
+		return err
+	}
+
+	probed := make(map[string]bool)
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		var sources []AptSource
+		if strings.HasSuffix(file, ".sources") {
+			sources = parseSources(data)
+		} else if sources, err = parseSourcesList(data); err != nil {
+			log.Printf("Warning: not probing the sources of %s: %v", file, err)
+			continue
+		}
+
+		for _, s := range sources {
+			binary := false
+			for _, t := range s.Types {
+				binary = binary || t == "deb"
+			}
+			if !binary || (s.Enabled != nil && !*s.Enabled) {
+				continue
+			}
+
+			component := "main"
+			if len(s.Components) > 0 {
+				component = s.Components[0]
+			}
+			arch := context.Architecture
+			if len(s.Architectures) > 0 {
+				arch = s.Architectures[0]
+			}
+
+			for _, uri := range s.URIs {
+				if !strings.HasPrefix(uri, "http://") && !strings.HasPrefix(uri, "https://") {
+					continue
+				}
+				for _, suite := range s.Suites {
+					// Flat repositories have no dists directory
+					if strings.HasSuffix(suite, "/") || probed[uri+" "+suite] {
+						continue
+					}
+					probed[uri+" "+suite] = true
+
+					if err := debos.ProbeMirror(uri, suite, component, arch); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func (apt *AptAction) Run(context *debos.DebosContext) error {
+	if apt.Snapshot != "" {
+		removeSnapshotConf, err := apt.useSnapshot(context)
 		if err != nil {
 			return err
 		}
+		defer removeSnapshotConf()
+	}
+
+	if len(apt.Preferences) > 0 {
+		if err := apt.writePreferences(context); err != nil {
+			return err
+		}
+	}
+
+	// Install the locked versions, only during the build
+	if context.Lock != nil && context.Lock.Enforced() {
+		file := "/etc/apt/preferences.d/00debos-lock.pref"
+		if err := writeRootfsFile(context, file, context.Lock.AptPreferences(), 0644); err != nil {
+			return err
+		}
+		defer os.Remove(path.Join(context.Rootdir, file))
 	}
 
-	err := c.Run("apt", aptOptions...)
+	removeProxy, err := setupAptProxy(context, apt.Proxy)
 	if err != nil {
 		return err
 	}
+	defer removeProxy()
+
+	aptCmd := debos.NewAptCommand(*context, "apt")
 
-	cmd := []string{"apt-get"}
-	cmd = append(cmd, aptConfig...)
-	cmd = append(cmd, "clean")
+	// The package lists have to match the snapshot
+	if apt.Update || apt.Snapshot != "" {
+		if apt.ProbeMirrors {
+			if err := probeAptSources(context); err != nil {
+				return err
+			}
+		}
 
-	err = c.Run("apt", cmd...)
+		if err := aptCmd.Update(); err != nil {
+			return err
+		}
+	}
+
+	c := debos.NewChrootCommandForContext(*context)
+	if err := apt.checkVersions(c); err != nil {
+		return err
+	}
+
+	options := debos.AptInstallOptions{
+		Recommends:      apt.Recommends,
+		Unauthenticated: apt.Unauthenticated,
+		AllowDowngrades: apt.AllowDowngrades,
+	}
+	result, err := aptCmd.Install(apt.Packages, options)
 	if err != nil {
 		return err
 	}
+	log.Printf("Installed or changed %d packages, %s downloaded", len(result.Packages), units.HumanSize(float64(result.DownloadSize)))
 
-	return nil
+	return aptCmd.Clean()
 }
@@ -0,0 +1,102 @@
+package actions
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAptPackage(t *testing.T) {
+	tests := []struct {
+		pkg, name, version, release string
+	}{
+		{"bash", "bash", "", ""},
+		{"bash=5.2-1", "bash", "5.2-1", ""},
+		{"bash/bookworm-backports", "bash", "", "bookworm-backports"},
+		{"./foo.deb", "./foo.deb", "", ""},
+		{"/tmp/foo_1.0=1_amd64.deb", "/tmp/foo_1.0=1_amd64.deb", "", ""},
+		{"../debs/foo", "../debs/foo", "", ""},
+	}
+
+	for _, test := range tests {
+		name, version, release := parseAptPackage(test.pkg)
+		assert.Equal(t, test.name, name, test.pkg)
+		assert.Equal(t, test.version, version, test.pkg)
+		assert.Equal(t, test.release, release, test.pkg)
+	}
+}
+
+func TestAptVerify_packages(t *testing.T) {
+	context := debos.DebosContext{CommonContext: &debos.CommonContext{}}
+
+	apt := NewAptAction()
+	apt.Packages = []string{"bash=5.2-1", "./foo.deb", "/tmp/foo.deb"}
+	assert.Empty(t, apt.Verify(&context))
+
+	apt.Packages = []string{"bash="}
+	assert.EqualError(t, apt.Verify(&context), "Missing version for package 'bash'")
+
+	apt.Packages = []string{"=5.2-1"}
+	assert.EqualError(t, apt.Verify(&context), "Invalid package '=5.2-1'")
+}
+
+func TestUseSnapshot(t *testing.T) {
+	rootdir := t.TempDir()
+	context := debos.DebosContext{CommonContext: &debos.CommonContext{Rootdir: rootdir}}
+	assert.NoError(t, os.MkdirAll(path.Join(rootdir, "etc/apt/sources.list.d"), 0755))
+
+	sourcesList := `# Debian
+deb [ signed-by=/usr/share/keyrings/debian-archive-keyring.gpg ] http://deb.debian.org/debian bookworm main
+deb-src http://deb.debian.org/debian bookworm main # sources
+deb http://example.com/debian bookworm main
+`
+	sources := `Types: deb
+URIs: http://deb.debian.org/debian
+Suites: bookworm bookworm-updates
+Components: main
+
+# Security
+Types: deb
+URIs: http://security.debian.org/debian-security
+Suites: bookworm-security
+Components: main
+`
+	assert.NoError(t, ioutil.WriteFile(path.Join(rootdir, "etc/apt/sources.list"), []byte(sourcesList), 0644))
+	assert.NoError(t, ioutil.WriteFile(path.Join(rootdir, "etc/apt/sources.list.d/debian.sources"), []byte(sources), 0644))
+
+	apt := NewAptAction()
+	apt.Snapshot = "2024-01-15"
+	cleanup, err := apt.useSnapshot(&context)
+	assert.NoError(t, err)
+
+	data, _ := ioutil.ReadFile(path.Join(rootdir, "etc/apt/sources.list"))
+	assert.Equal(t, `# Debian
+deb [ signed-by=/usr/share/keyrings/debian-archive-keyring.gpg ] http://snapshot.debian.org/archive/debian/20240115T000000Z/ bookworm main
+deb-src http://snapshot.debian.org/archive/debian/20240115T000000Z/ bookworm main # sources
+deb http://example.com/debian bookworm main
+`, string(data))
+
+	data, _ = ioutil.ReadFile(path.Join(rootdir, "etc/apt/sources.list.d/debian.sources"))
+	assert.Equal(t, `Types: deb
+URIs: http://snapshot.debian.org/archive/debian/20240115T000000Z/
+Suites: bookworm bookworm-updates
+Components: main
+
+# Security
+Types: deb
+URIs: http://snapshot.debian.org/archive/debian-security/20240115T000000Z/
+Suites: bookworm-security
+Components: main
+`, string(data))
+
+	conf := path.Join(rootdir, aptSnapshotConf)
+	_, err = os.Stat(conf)
+	assert.NoError(t, err)
+	cleanup()
+	_, err = os.Stat(conf)
+	assert.True(t, os.IsNotExist(err))
+}
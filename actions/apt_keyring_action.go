@@ -0,0 +1,212 @@
+/*
+AptKeyring Action
+
+Install an OpenPGP key trusted by APT into the target rootfs, from a file, an
+URL or a keyserver, optionally verifying its fingerprint. This replaces the
+deprecated 'apt-key adv' in run actions.
+
+ # Yaml syntax:
+ - action: apt-keyring
+   name: name
+   origin: name
+   file: key.asc
+   url: https://example.com/key.asc
+   keyserver: hkps://keyserver.ubuntu.com
+   fingerprint: fingerprint
+   directory: path
+
+Mandatory properties:
+
+- name -- name of the keyring, the key is written to '<directory>/<name>.gpg'.
+
+- one of 'file', 'url' or 'fingerprint' giving where the key comes from.
+
+Optional properties:
+
+- origin -- reference to a named file or directory containing 'file'.
+Defaults to the recipe directory.
+
+- file -- file of the key, armored or binary, relative to 'origin'.
+
+- url -- URL to download the key from.
+
+- keyserver -- keyserver to receive the key from, by 'fingerprint'. Default
+'hkps://keyserver.ubuntu.com'. Only used if neither 'file' nor 'url' is given.
+
+- fingerprint -- full fingerprint of the key. The build fails if the key
+from 'file' or 'url' has another fingerprint, or if they contain several keys.
+Spaces are ignored. Highly recommended for keys from an URL.
+
+- directory -- directory of the keyring in the target rootfs. Default
+'/etc/apt/trusted.gpg.d', where keys are trusted for all the sources. Use
+'/usr/share/keyrings' or '/etc/apt/keyrings' for keys only trusted by the
+sources referring to them with 'signed-by', e.g. from the 'apt-sources' action.
+
+The key is imported on the host with 'gpg'.
+*/
+package actions
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/go-debos/debos"
+	"github.com/go-debos/fakemachine"
+)
+
+type AptKeyringAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Name             string
+	Origin           string
+	File             string
+	Url              string
+	Keyserver        string
+	Fingerprint      string
+	Directory        string
+}
+
+func NewAptKeyringAction() *AptKeyringAction {
+	return &AptKeyringAction{
+		Keyserver: "hkps://keyserver.ubuntu.com",
+		Directory: "/etc/apt/trusted.gpg.d",
+	}
+}
+
+// Fingerprint without spaces, as listed by gpg
+func (k *AptKeyringAction) fingerprint() string {
+	return strings.ToUpper(strings.Join(strings.Fields(k.Fingerprint), ""))
+}
+
+func (k *AptKeyringAction) Verify(context *debos.DebosContext) error {
+	if k.Name == "" || strings.Contains(k.Name, "/") {
+		return errors.New("Property 'name' must be a valid file name")
+	}
+
+	if k.File != "" && k.Url != "" {
+		return errors.New("Properties 'file' and 'url' are mutually exclusive")
+	}
+
+	if k.File == "" && k.Url == "" && k.Fingerprint == "" {
+		return errors.New("One of 'file', 'url' or 'fingerprint' properties is needed")
+	}
+
+	if k.Fingerprint != "" {
+		fpr := k.fingerprint()
+		if len(fpr) != 40 || strings.Trim(fpr, "0123456789ABCDEF") != "" {
+			return fmt.Errorf("Invalid fingerprint '%s', a full fingerprint is needed", k.Fingerprint)
+		}
+	}
+
+	if !path.IsAbs(k.Directory) {
+		return fmt.Errorf("Property 'directory' must be an absolute path: %s", k.Directory)
+	}
+
+	return nil
+}
+
+func (k *AptKeyringAction) PreMachine(context *debos.DebosContext, m *fakemachine.Machine, args *[]string) error {
+	if k.Origin == "" && path.IsAbs(k.File) {
+		m.AddVolume(path.Dir(k.File))
+	}
+
+	return nil
+}
+
+// Fingerprints of the primary keys of the keyring
+func gpgFingerprints(gnupghome string) ([]string, error) {
+	cmd := debos.Command{}
+	cmd.AddEnvKey("GNUPGHOME", gnupghome)
+
+	out, err := cmd.Output("gpg", "gpg", "--batch", "--with-colons", "--fingerprint")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list keys: %v", err)
+	}
+
+	var fingerprints []string
+	primary := false
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Split(line, ":")
+		switch fields[0] {
+		case "pub":
+			primary = true
+		case "sub":
+			primary = false
+		case "fpr":
+			if primary && len(fields) > 9 {
+				fingerprints = append(fingerprints, fields[9])
+				primary = false
+			}
+		}
+	}
+
+	return fingerprints, nil
+}
+
+func (k *AptKeyringAction) Run(context *debos.DebosContext) error {
+	gnupghome, err := ioutil.TempDir(context.Scratchdir, "apt-keyring-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(gnupghome)
+
+	gpg := debos.Command{}
+	gpg.AddEnvKey("GNUPGHOME", gnupghome)
+
+	switch {
+	case k.File != "":
+		origin := context.RecipeDir
+		if k.Origin != "" {
+			var found bool
+			if origin, found = context.Origin(k.Origin); !found {
+				return fmt.Errorf("Origin not found '%s'", k.Origin)
+			}
+		}
+		err = gpg.Run("gpg", "gpg", "--batch", "--import", debos.CleanPathAt(k.File, origin))
+	case k.Url != "":
+		key := path.Join(gnupghome, "download")
+		if err := context.Lock.Fetch(k.Url, key); err != nil {
+			return err
+		}
+		err = gpg.Run("gpg", "gpg", "--batch", "--import", key)
+	default:
+		err = gpg.Run("gpg", "gpg", "--batch", "--keyserver", k.Keyserver, "--recv-keys", k.fingerprint())
+	}
+	if err != nil {
+		return err
+	}
+
+	fingerprints, err := gpgFingerprints(gnupghome)
+	if err != nil {
+		return err
+	}
+	if len(fingerprints) == 0 {
+		return errors.New("No key imported")
+	}
+
+	if k.Fingerprint != "" {
+		if len(fingerprints) != 1 || fingerprints[0] != k.fingerprint() {
+			return fmt.Errorf("Key fingerprint mismatch, expected %s but got %s",
+				k.fingerprint(), strings.Join(fingerprints, ", "))
+		}
+	} else {
+		log.Printf("Warning: installing keys without verifying their fingerprint: %s",
+			strings.Join(fingerprints, ", "))
+	}
+
+	keyring := path.Join(gnupghome, "keyring.gpg")
+	if err := gpg.Run("gpg", "gpg", "--batch", "--output", keyring, "--export"); err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(keyring)
+	if err != nil {
+		return err
+	}
+
+	return writeRootfsFile(context, path.Join(k.Directory, k.Name+".gpg"), data, 0644)
+}
@@ -0,0 +1,484 @@
+/*
+AptSources Action
+
+Write APT repositories to the target rootfs in the deb822 '.sources' format,
+see sources.list(5), and optionally convert the existing one-line style
+sources to it.
+
+ # Yaml syntax:
+ - action: apt-sources
+   name: name
+   convert: bool
+   sources:
+     - types:
+         - deb
+       uris:
+         - http://deb.debian.org/debian
+       suites:
+         - bookworm
+       components:
+         - main
+       architectures:
+         - amd64
+       signed-by: path
+       enabled: bool
+
+Optional properties:
+
+- name -- name of the written file '/etc/apt/sources.list.d/<name>.sources'.
+Default 'debos'. The file is replaced if it exists already.
+
+- sources -- list of repositories, the properties of the entries are described
+below.
+
+- convert -- convert the one-line style entries of '/etc/apt/sources.list' and
+'/etc/apt/sources.list.d/*.list' to deb822 files and remove the original
+files. Entries of '/etc/apt/sources.list' go to '<name>.sources', before the
+'sources' of the action, as do the ones of '<name>.list'. The other files are
+converted to a '.sources' file of the same name. The options of the entries,
+e.g. '[ trusted=yes lang=en ]', become the matching deb822 fields. Default
+'false'.
+
+At least one of 'sources' or 'convert' has to be given.
+
+   # Yaml syntax for sources:
+   sources:
+     - types:
+         - deb
+       uris:
+         - http://deb.debian.org/debian
+       suites:
+         - bookworm
+
+Mandatory properties:
+
+- uris -- list of URIs of the repository.
+
+- suites -- list of suites, or a path ending with '/' for flat repositories.
+
+Optional properties:
+
+- types -- list of 'deb' and 'deb-src'. Default 'deb'.
+
+- components -- list of components, mandatory unless the suite is a path.
+
+- architectures -- list of architectures to fetch. Defaults to the APT
+configuration of the rootfs.
+
+- signed-by -- absolute path in the target rootfs of the keyring used to
+check the repository, e.g. '/usr/share/keyrings/debian-archive-keyring.gpg'.
+
+- enabled -- set to 'false' to write a disabled entry. Default 'true'.
+*/
+package actions
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-debos/debos"
+)
+
+type AptSource struct {
+	Types         []string
+	URIs          []string `yaml:"uris"`
+	Suites        []string
+	Components    []string
+	Architectures []string
+	SignedBy      string `yaml:"signed-by"`
+	Enabled       *bool
+
+	options [][2]string // Other deb822 fields, from the options of converted sources
+}
+
+// deb822 fields of the one-line source options not named after the option
+var aptSourceOptionFields = map[string]string{
+	"arch":           "Architectures",
+	"lang":           "Languages",
+	"target":         "Targets",
+	"pdiffs":         "PDiffs",
+	"inrelease-path": "InRelease-Path",
+}
+
+/*
+deb822 field and value of a one-line source option, see sources.list(5), e.g.
+'check-valid-until=no' is 'Check-Valid-Until: no' and 'arch-=i386' is
+'Architectures-Remove: i386'.
+*/
+func aptSourceOption(name, value string) (string, string) {
+	suffix := ""
+	if strings.HasSuffix(name, "+") {
+		name, suffix = strings.TrimSuffix(name, "+"), "-Add"
+	} else if strings.HasSuffix(name, "-") {
+		name, suffix = strings.TrimSuffix(name, "-"), "-Remove"
+	}
+
+	field, ok := aptSourceOptionFields[name]
+	if ok {
+		// Multivalue options are comma separated in the one-line style
+		value = strings.ReplaceAll(value, ",", " ")
+	} else {
+		words := strings.Split(name, "-")
+		for i, w := range words {
+			if w != "" {
+				words[i] = strings.ToUpper(w[:1]) + w[1:]
+			}
+		}
+		field = strings.Join(words, "-")
+	}
+
+	return field + suffix, value
+}
+
+type AptSourcesAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Name             string
+	Convert          bool
+	Sources          []AptSource
+}
+
+func NewAptSourcesAction() *AptSourcesAction {
+	return &AptSourcesAction{Name: "debos"}
+}
+
+func (s AptSource) verify() error {
+	if len(s.URIs) == 0 || len(s.Suites) == 0 {
+		return errors.New("APT sources need 'uris' and 'suites'")
+	}
+
+	for _, t := range s.Types {
+		if t != "deb" && t != "deb-src" {
+			return fmt.Errorf("Invalid APT source type '%s'", t)
+		}
+	}
+
+	flat := strings.HasSuffix(s.Suites[0], "/")
+	if !flat && len(s.Components) == 0 {
+		return errors.New("APT sources need 'components' unless the suite is a path")
+	}
+	if flat && len(s.Components) > 0 {
+		return errors.New("APT sources with a path as suite can't have 'components'")
+	}
+
+	if s.SignedBy != "" && !path.IsAbs(s.SignedBy) {
+		return fmt.Errorf("Property 'signed-by' must be an absolute path: %s", s.SignedBy)
+	}
+
+	return nil
+}
+
+// Stanza of the source in deb822 format
+func (s AptSource) stanza() string {
+	var b bytes.Buffer
+
+	types := s.Types
+	if len(types) == 0 {
+		types = []string{"deb"}
+	}
+
+	if s.Enabled != nil && !*s.Enabled {
+		b.WriteString("Enabled: no\n")
+	}
+	b.WriteString(fmt.Sprintf("Types: %s\n", strings.Join(types, " ")))
+	b.WriteString(fmt.Sprintf("URIs: %s\n", strings.Join(s.URIs, " ")))
+	b.WriteString(fmt.Sprintf("Suites: %s\n", strings.Join(s.Suites, " ")))
+	if len(s.Components) > 0 {
+		b.WriteString(fmt.Sprintf("Components: %s\n", strings.Join(s.Components, " ")))
+	}
+	if len(s.Architectures) > 0 {
+		b.WriteString(fmt.Sprintf("Architectures: %s\n", strings.Join(s.Architectures, " ")))
+	}
+	if s.SignedBy != "" {
+		b.WriteString(fmt.Sprintf("Signed-By: %s\n", s.SignedBy))
+	}
+	for _, o := range s.options {
+		b.WriteString(fmt.Sprintf("%s: %s\n", o[0], o[1]))
+	}
+
+	return b.String()
+}
+
+func (a *AptSourcesAction) Verify(context *debos.DebosContext) error {
+	if a.Name == "" || strings.Contains(a.Name, "/") {
+		return errors.New("Property 'name' must be a valid file name")
+	}
+
+	if len(a.Sources) == 0 && !a.Convert {
+		return errors.New("At least one of 'sources' or 'convert' properties is needed")
+	}
+
+	for _, s := range a.Sources {
+		if err := s.verify(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+Parse the one-line style entries of a sources.list file, entries only
+differing by their type are merged.
+*/
+func parseSourcesList(data []byte) ([]AptSource, error) {
+	var sources []AptSource
+	keys := make(map[string]int)
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if idx := strings.Index(line, "#"); idx >= 0 {
+			line = line[:idx]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] != "deb" && fields[0] != "deb-src" {
+			return nil, fmt.Errorf("Invalid APT source: %s", scanner.Text())
+		}
+
+		s := AptSource{Types: []string{fields[0]}}
+		idx := 1
+
+		// Options, e.g. [ arch=amd64 signed-by=/path ]
+		if idx < len(fields) && strings.HasPrefix(fields[idx], "[") {
+			var options []string
+			for ; idx < len(fields); idx++ {
+				end := strings.HasSuffix(fields[idx], "]")
+				options = append(options, strings.Trim(fields[idx], "[]"))
+				if end {
+					break
+				}
+			}
+			idx++
+
+			for _, o := range strings.Fields(strings.Join(options, " ")) {
+				kv := strings.SplitN(o, "=", 2)
+				if len(kv) != 2 {
+					return nil, fmt.Errorf("Invalid APT source option '%s'", o)
+				}
+				switch kv[0] {
+				case "arch":
+					s.Architectures = strings.Split(kv[1], ",")
+				case "signed-by":
+					s.SignedBy = kv[1]
+				default:
+					field, value := aptSourceOption(kv[0], kv[1])
+					s.options = append(s.options, [2]string{field, value})
+				}
+			}
+		}
+
+		if idx+2 > len(fields) {
+			return nil, fmt.Errorf("Invalid APT source: %s", scanner.Text())
+		}
+		s.URIs = []string{fields[idx]}
+		s.Suites = []string{fields[idx+1]}
+		s.Components = fields[idx+2:]
+
+		key := strings.Join(append([]string{s.URIs[0], s.Suites[0], s.SignedBy,
+			strings.Join(s.Architectures, ","), fmt.Sprint(s.options)}, s.Components...), " ")
+		if existing, found := keys[key]; found {
+			if sources[existing].Types[0] != s.Types[0] {
+				sources[existing].Types = []string{"deb", "deb-src"}
+			}
+			continue
+		}
+
+		keys[key] = len(sources)
+		sources = append(sources, s)
+	}
+
+	return sources, nil
+}
+
+// Parse the deb822 style sources, only the fields known by AptSource are kept
+func parseSources(data []byte) []AptSource {
+	var sources []AptSource
+
+	for _, stanza := range strings.Split(string(data), "\n\n") {
+		var s AptSource
+		for _, line := range strings.Split(stanza, "\n") {
+			kv := strings.SplitN(line, ":", 2)
+			if len(kv) != 2 || strings.HasPrefix(line, " ") || strings.HasPrefix(line, "#") {
+				continue
+			}
+
+			value := strings.TrimSpace(kv[1])
+			switch strings.ToLower(kv[0]) {
+			case "types":
+				s.Types = strings.Fields(value)
+			case "uris":
+				s.URIs = strings.Fields(value)
+			case "suites":
+				s.Suites = strings.Fields(value)
+			case "components":
+				s.Components = strings.Fields(value)
+			case "architectures":
+				s.Architectures = strings.Fields(value)
+			case "signed-by":
+				s.SignedBy = value
+			case "enabled":
+				enabled := value != "no"
+				s.Enabled = &enabled
+			}
+		}
+
+		if len(s.URIs) > 0 {
+			sources = append(sources, s)
+		}
+	}
+
+	return sources
+}
+
+// Render the sources in deb822 format
+func sourcesFile(sources []AptSource) []byte {
+	var stanzas []string
+	for _, s := range sources {
+		stanzas = append(stanzas, s.stanza())
+	}
+
+	return []byte(strings.Join(stanzas, "\n"))
+}
+
+// List the APT sources files of the rootfs, in both one-line and deb822 styles
+func aptSourcesFiles(context *debos.DebosContext) ([]string, error) {
+	files := []string{path.Join(context.Rootdir, "etc/apt/sources.list")}
+	for _, pattern := range []string{"*.list", "*.sources"} {
+		matches, err := filepath.Glob(path.Join(context.Rootdir, "etc/apt/sources.list.d", pattern))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, matches...)
+	}
+
+	return files, nil
+}
+
+/*
+Edit the APT sources of the rootfs in place. The edit function gets the text of
+each entry of the one-line style files or of each stanza of the deb822 style
+files, with the source parsed from it, and returns the updated text. The rest
+of the files, e.g. the comments, is kept as is. Returns the files changed.
+*/
+func editAptSources(context *debos.DebosContext, edit func(text string, s AptSource, deb822 bool) string) ([]string, error) {
+	files, err := aptSourcesFiles(context)
+	if err != nil {
+		return nil, err
+	}
+
+	var changed []string
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		deb822 := strings.HasSuffix(file, ".sources")
+		separator := "\n"
+		if deb822 {
+			separator = "\n\n"
+		}
+
+		parts := strings.Split(string(data), separator)
+		for idx, part := range parts {
+			var sources []AptSource
+			if deb822 {
+				sources = parseSources([]byte(part))
+			} else if sources, err = parseSourcesList([]byte(part)); err != nil {
+				// Left for APT to report
+				continue
+			}
+			if len(sources) == 1 {
+				parts[idx] = edit(part, sources[0], deb822)
+			}
+		}
+
+		updated := []byte(strings.Join(parts, separator))
+		if bytes.Equal(data, updated) {
+			continue
+		}
+
+		if err := ioutil.WriteFile(file, updated, 0644); err != nil {
+			return nil, err
+		}
+		changed = append(changed, strings.TrimPrefix(file, context.Rootdir))
+	}
+
+	return changed, nil
+}
+
+// Convert the one-line style sources, returning the ones of sources.list
+func (a *AptSourcesAction) convert(context *debos.DebosContext) ([]AptSource, error) {
+	var main []AptSource
+
+	sourcesList := path.Join(context.Rootdir, "etc/apt/sources.list")
+	files, err := filepath.Glob(path.Join(context.Rootdir, "etc/apt/sources.list.d/*.list"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range append([]string{sourcesList}, files...) {
+		data, err := ioutil.ReadFile(file)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		sources, err := parseSourcesList(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", strings.TrimPrefix(file, context.Rootdir), err)
+		}
+
+		converted := strings.TrimSuffix(strings.TrimPrefix(file, context.Rootdir), ".list") + ".sources"
+		if file == sourcesList || path.Base(converted) == a.Name+".sources" {
+			// Written along the sources of the action
+			main = append(main, sources...)
+		} else if len(sources) > 0 {
+			if err := writeRootfsFile(context, converted, sourcesFile(sources), 0644); err != nil {
+				return nil, err
+			}
+		}
+
+		log.Printf("Removing %s", strings.TrimPrefix(file, context.Rootdir))
+		if err := os.Remove(file); err != nil {
+			return nil, err
+		}
+	}
+
+	return main, nil
+}
+
+func (a *AptSourcesAction) Run(context *debos.DebosContext) error {
+	var sources []AptSource
+
+	if a.Convert {
+		converted, err := a.convert(context)
+		if err != nil {
+			return err
+		}
+		sources = append(sources, converted...)
+	}
+
+	sources = append(sources, a.Sources...)
+	if len(sources) == 0 {
+		log.Printf("No APT sources to write")
+		return nil
+	}
+
+	file := path.Join("/etc/apt/sources.list.d", a.Name+".sources")
+	return writeRootfsFile(context, file, sourcesFile(sources), 0644)
+}
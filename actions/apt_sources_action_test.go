@@ -0,0 +1,52 @@
+package actions
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSourcesList(t *testing.T) {
+	list := `# Debian
+deb http://deb.debian.org/debian bookworm main contrib
+deb-src http://deb.debian.org/debian bookworm main contrib
+
+deb [ arch=amd64,arm64 signed-by=/usr/share/keyrings/debian.gpg ] http://deb.debian.org/debian-security bookworm-security main
+deb [trusted=yes lang=en,de target=Contents-deb check-valid-until=no arch-=i386] http://snapshot.example.com/debian bookworm main # pinned
+deb file:/srv/repo ./
+`
+	sources, err := parseSourcesList([]byte(list))
+	assert.Empty(t, err)
+	assert.Equal(t, 4, len(sources))
+
+	assert.Equal(t, []string{"deb", "deb-src"}, sources[0].Types)
+	assert.Equal(t, []string{"main", "contrib"}, sources[0].Components)
+
+	assert.Equal(t, []string{"amd64", "arm64"}, sources[1].Architectures)
+	assert.Equal(t, "/usr/share/keyrings/debian.gpg", sources[1].SignedBy)
+
+	assert.Equal(t, `Types: deb
+URIs: http://snapshot.example.com/debian
+Suites: bookworm
+Components: main
+Trusted: yes
+Languages: en de
+Targets: Contents-deb
+Check-Valid-Until: no
+Architectures-Remove: i386
+`, sources[2].stanza())
+
+	assert.Equal(t, []string{"./"}, sources[3].Suites)
+	assert.Empty(t, sources[3].Components)
+}
+
+func TestParseSourcesList_invalid(t *testing.T) {
+	for _, list := range []string{
+		"deb-foo http://deb.debian.org/debian bookworm main",
+		"deb http://deb.debian.org/debian",
+		"deb [ trusted ] http://deb.debian.org/debian bookworm main",
+	} {
+		_, err := parseSourcesList([]byte(list))
+		assert.Error(t, err, list)
+	}
+}
@@ -0,0 +1,331 @@
+/*
+ArmFirmware Action
+
+Assemble ARM boot firmware, e.g. Trusted Firmware-A (ATF), OP-TEE and U-Boot,
+into a single image and optionally write it to the output image at the offset
+expected by the SoC boot ROM.
+
+ # Yaml syntax:
+ - action: arm-firmware
+   format: fip
+   origin: name
+   bl2: filename
+   bl31: filename
+   bl32: filename
+   bl32-extra1: filename
+   bl32-extra2: filename
+   bl33: filename
+   fw-config: filename
+   hw-config: filename
+   its: filename
+   file: filename
+   soc: name
+   offset: bytes
+
+Mandatory properties:
+
+- format -- format of the firmware image: 'fip' to create a TF-A Firmware
+Image Package with 'fiptool', or 'fit' to create a U-Boot FIT image with
+'mkimage' from an image tree source ('its').
+
+- origin -- reference to the named directory holding the firmware components,
+e.g. 'recipe' or the origin of a previous download or unpack action.
+
+Properties for the 'fip' format, at least one is mandatory:
+
+- bl2 -- trusted boot firmware (BL2).
+
+- bl31 -- EL3 runtime firmware (BL31), e.g. TF-A.
+
+- bl32 -- secure payload (BL32), e.g. OP-TEE 'tee-header_v2.bin'.
+
+- bl32-extra1 -- first extra secure payload, e.g. OP-TEE 'tee-pager_v2.bin'.
+
+- bl32-extra2 -- second extra secure payload, e.g. OP-TEE 'tee-pageable_v2.bin'.
+
+- bl33 -- non-trusted firmware (BL33), e.g. 'u-boot.bin' or 'u-boot-nodtb.bin'.
+
+- fw-config -- firmware configuration device tree.
+
+- hw-config -- hardware configuration device tree.
+
+Properties for the 'fit' format:
+
+- its -- image tree source, mandatory. Paths in the image tree source are
+relative to 'origin'.
+
+Optional properties:
+
+- file -- name of the firmware image in the artifact directory. If unset the
+firmware image isn't kept as artifact.
+
+- soc -- write the firmware image to the output image at the offset of the SoC
+preset. Supported presets are:
+ 'sunxi' -- 8KiB, e.g. 'u-boot-sunxi-with-spl.bin'
+ 'imx6', 'imx7' -- 1KiB, e.g. 'u-boot-dtb.imx'
+ 'imx8mq', 'imx8mm' -- 33KiB, e.g. 'flash.bin'
+ 'imx8mn', 'imx8mp' -- 32KiB, e.g. 'flash.bin'
+ 'rockchip' -- 8MiB, e.g. 'u-boot.itb'
+
+- offset -- write the firmware image to the output image at the given offset
+in bytes or in sectors e.g. '256s', overriding the offset of the SoC preset.
+
+At least one of 'file', 'soc' or 'offset' has to be given. Before writing to
+the output image, the firmware image is checked not to overlap the partition
+table or any partition.
+*/
+package actions
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+
+	"github.com/go-debos/debos"
+)
+
+// Offsets of the boot firmware expected by the boot ROM of SoCs
+type socPreset struct {
+	Firmware int64   // Firmware image holding all the boot stages
+	SPL      []int64 // SPL, followed by the locations of redundant copies
+	UBoot    int64   // U-Boot proper loaded by the SPL, 0 if part of the SPL image
+}
+
+var socPresets = map[string]socPreset{
+	"sunxi":    {Firmware: 8 * 1024, SPL: []int64{8 * 1024, 128 * 1024}},
+	"imx6":     {Firmware: 1024, SPL: []int64{1024}, UBoot: 69 * 1024},
+	"imx7":     {Firmware: 1024, SPL: []int64{1024}, UBoot: 69 * 1024},
+	"imx8mq":   {Firmware: 33 * 1024, SPL: []int64{33 * 1024}, UBoot: 384 * 1024},
+	"imx8mm":   {Firmware: 33 * 1024, SPL: []int64{33 * 1024}, UBoot: 384 * 1024},
+	"imx8mn":   {Firmware: 32 * 1024, SPL: []int64{32 * 1024}, UBoot: 384 * 1024},
+	"imx8mp":   {Firmware: 32 * 1024, SPL: []int64{32 * 1024}, UBoot: 384 * 1024},
+	"rockchip": {Firmware: 8 * 1024 * 1024, SPL: []int64{32 * 1024, 544 * 1024}, UBoot: 8 * 1024 * 1024},
+}
+
+type ArmFirmwareAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Format           string
+	Origin           string
+	BL2              string `yaml:"bl2"`
+	BL31             string `yaml:"bl31"`
+	BL32             string `yaml:"bl32"`
+	BL32Extra1       string `yaml:"bl32-extra1"`
+	BL32Extra2       string `yaml:"bl32-extra2"`
+	BL33             string `yaml:"bl33"`
+	FwConfig         string `yaml:"fw-config"`
+	HwConfig         string `yaml:"hw-config"`
+	ITS              string `yaml:"its"`
+	File             string
+	Soc              string
+	Offset           string
+}
+
+// fiptool options for each of the components
+func (a *ArmFirmwareAction) fipComponents() [][2]string {
+	return [][2]string{
+		{"--tb-fw", a.BL2},
+		{"--soc-fw", a.BL31},
+		{"--tos-fw", a.BL32},
+		{"--tos-fw-extra1", a.BL32Extra1},
+		{"--tos-fw-extra2", a.BL32Extra2},
+		{"--nt-fw", a.BL33},
+		{"--fw-config", a.FwConfig},
+		{"--hw-config", a.HwConfig},
+	}
+}
+
+func (a *ArmFirmwareAction) Verify(context *debos.DebosContext) error {
+	if len(a.Origin) == 0 {
+		return errors.New("Property 'origin' is mandatory for arm-firmware action")
+	}
+
+	switch a.Format {
+	case "fip":
+		found := false
+		for _, c := range a.fipComponents() {
+			if c[1] != "" {
+				found = true
+			}
+		}
+		if !found {
+			return errors.New("At least one firmware component is needed for 'fip' format")
+		}
+	case "fit":
+		if a.ITS == "" {
+			return errors.New("Property 'its' is mandatory for 'fit' format")
+		}
+	default:
+		return fmt.Errorf("Unsupported firmware format '%s'", a.Format)
+	}
+
+	if a.Soc != "" {
+		if _, found := socPresets[a.Soc]; !found {
+			return fmt.Errorf("Unsupported SoC preset '%s'", a.Soc)
+		}
+	}
+
+	if a.File == "" && a.Soc == "" && a.Offset == "" {
+		return errors.New("At least one of 'file', 'soc' or 'offset' properties is needed")
+	}
+
+	return nil
+}
+
+func (a *ArmFirmwareAction) assemble(origin, output string) error {
+	if a.Format == "fit" {
+		its, err := debos.RestrictedPath(origin, a.ITS)
+		if err != nil {
+			return err
+		}
+
+		// mkimage resolves the paths in the image tree source from the
+		// current directory
+		script := fmt.Sprintf("cd %s && mkimage -f %s %s",
+			escape(origin), escape(its), escape(output))
+		return debos.Command{}.Run("mkimage", "sh", "-c", script)
+	}
+
+	cmdline := []string{"fiptool", "create"}
+	for _, c := range a.fipComponents() {
+		if c[1] == "" {
+			continue
+		}
+
+		component, err := debos.RestrictedPath(origin, c[1])
+		if err != nil {
+			return err
+		}
+		cmdline = append(cmdline, c[0], component)
+	}
+	cmdline = append(cmdline, output)
+
+	return debos.Command{}.Run("fiptool", cmdline...)
+}
+
+/*
+checkBootFirmwareArea checks data of the given size written at offset of the
+image doesn't overwrite the partition table or any partition.
+*/
+func checkBootFirmwareArea(image string, offset, size int64) error {
+	out, err := debos.Command{}.Output("sfdisk", "sfdisk", "--json", image)
+	if err != nil {
+		// No partition table to be checked against
+		return nil
+	}
+
+	var dump struct {
+		PartitionTable struct {
+			Label      string
+			FirstLBA   int64 `json:"firstlba"`
+			SectorSize int64 `json:"sectorsize"`
+			Partitions []struct {
+				Node  string
+				Start int64
+				Size  int64
+			}
+		} `json:"partitiontable"`
+	}
+
+	if err := json.Unmarshal(out, &dump); err != nil {
+		return fmt.Errorf("Failed to parse partition table: %v", err)
+	}
+
+	pt := dump.PartitionTable
+	if pt.SectorSize == 0 {
+		pt.SectorSize = 512
+	}
+
+	end := offset + size
+	// The MBR (or protective MBR) is always in the first sector
+	tableEnd := int64(512)
+	if pt.Label == "gpt" {
+		tableEnd = pt.FirstLBA * pt.SectorSize
+	}
+	if offset < tableEnd {
+		return fmt.Errorf("Data at 0x%x-0x%x overlaps the %s partition table", offset, end, pt.Label)
+	}
+
+	for _, p := range pt.Partitions {
+		start := p.Start * pt.SectorSize
+		if offset < start+p.Size*pt.SectorSize && start < end {
+			return fmt.Errorf("Data at 0x%x-0x%x overlaps partition %s", offset, end, p.Node)
+		}
+	}
+
+	return nil
+}
+
+// Write content to the image at offset after checking the boot firmware area
+func writeBootFirmware(image string, content []byte, offset int64) error {
+	if err := checkBootFirmwareArea(image, offset, int64(len(content))); err != nil {
+		return err
+	}
+
+	target, err := os.OpenFile(image, os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("Failed to open %s: %v", image, err)
+	}
+	defer target.Close()
+
+	log.Printf("Writing %d bytes to %s at 0x%x", len(content), image, offset)
+	bytes, err := target.WriteAt(content, offset)
+	if bytes != len(content) {
+		return fmt.Errorf("Couldn't write complete data %v", err)
+	}
+
+	return target.Sync()
+}
+
+func (a *ArmFirmwareAction) Run(context *debos.DebosContext) error {
+	origin, found := context.Origin(a.Origin)
+	if !found {
+		return fmt.Errorf("Origin not found '%s'", a.Origin)
+	}
+
+	dir, err := ioutil.TempDir(context.Scratchdir, "arm-firmware-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	output := path.Join(dir, "firmware.bin")
+	if err := a.assemble(origin, output); err != nil {
+		return err
+	}
+
+	if a.File != "" {
+		err := debos.CopyFile(output, path.Join(context.Artifactdir, a.File), 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	if a.Soc == "" && a.Offset == "" {
+		return nil
+	}
+
+	if context.Image == "" {
+		return errors.New("Writing the firmware requires an image")
+	}
+
+	var offset int64
+	if a.Offset != "" {
+		offset, err = parseOffset(a.Offset, context.SectorSize)
+		if err != nil {
+			return err
+		}
+	} else {
+		offset = socPresets[a.Soc].Firmware
+	}
+
+	content, err := ioutil.ReadFile(output)
+	if err != nil {
+		return err
+	}
+
+	return writeBootFirmware(context.Image, content, offset)
+}
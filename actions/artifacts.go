@@ -0,0 +1,345 @@
+package actions
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-debos/debos"
+)
+
+// Artifact of the build declared in the recipe header
+type RecipeArtifact struct {
+	File        string          // As written by the actions, may be a glob pattern
+	Name        string          // Final name, relative to the artifact directory
+	Keep        *bool           // Whether the artifact is kept once the build succeeded, default true
+	PostProcess []ArtifactStage `yaml:"post-process"`
+}
+
+// Stage of the post-processing of an artifact, only one of the fields is set
+type ArtifactStage struct {
+	Compress string // gz, xz or zstd
+	Checksum string // sha256 or sha512
+	Sign     string // gpg key signing the artifact
+	Rename   string // New name, as the name of the artifact
+	Upload   string // URL the artifact is PUT to
+	Command  string // Host command run on the artifact
+}
+
+var artifactChecksums = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+var artifactPlaceholderRegex = regexp.MustCompile(`\$\{(date|time|arch|build-id)\}`)
+
+func (a RecipeArtifact) keep() bool {
+	return a.Keep == nil || *a.Keep
+}
+
+func (a RecipeArtifact) renamed() bool {
+	for _, s := range a.PostProcess {
+		if s.Rename != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (a RecipeArtifact) verify() error {
+	if a.File == "" {
+		return fmt.Errorf("Artifact without a file")
+	}
+
+	if _, err := filepath.Match(a.File, ""); err != nil {
+		return fmt.Errorf("Invalid artifact file pattern '%s'", a.File)
+	}
+
+	for _, p := range []string{a.File, a.Name} {
+		if path.IsAbs(p) || strings.HasPrefix(path.Clean(p), "..") {
+			return fmt.Errorf("Artifact '%s' has to be relative to the artifact directory", p)
+		}
+	}
+
+	if a.Name != "" && !a.keep() {
+		return fmt.Errorf("Artifact %s can't be both renamed and removed", a.File)
+	}
+
+	if len(a.PostProcess) == 0 {
+		return nil
+	}
+
+	if !a.keep() {
+		return fmt.Errorf("Artifact %s can't be both post-processed and removed", a.File)
+	}
+	if a.Name != "" {
+		return fmt.Errorf("Artifact %s can't have both a name and a post-process, use a rename stage", a.File)
+	}
+
+	digested := false
+	for _, s := range a.PostProcess {
+		if err := s.verify(); err != nil {
+			return fmt.Errorf("Artifact %s: %v", a.File, err)
+		}
+		switch {
+		case s.Checksum != "" || s.Sign != "":
+			digested = true
+		case s.Compress != "" && digested:
+			return fmt.Errorf("Artifact %s can't be compressed once checksummed or signed", a.File)
+		}
+	}
+
+	return nil
+}
+
+func (s ArtifactStage) verify() error {
+	set := 0
+	for _, v := range []string{s.Compress, s.Checksum, s.Sign, s.Rename, s.Upload, s.Command} {
+		if v != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		return fmt.Errorf("Post-process stages need exactly one of compress, checksum, sign, rename, upload or command")
+	}
+
+	switch {
+	case s.Compress != "":
+		if _, err := debos.CompressedFileName("", s.Compress); err != nil {
+			return err
+		}
+	case s.Checksum != "":
+		if _, ok := artifactChecksums[s.Checksum]; !ok {
+			return fmt.Errorf("Unsupported checksum '%s'", s.Checksum)
+		}
+	case s.Rename != "":
+		if path.IsAbs(s.Rename) || strings.HasPrefix(path.Clean(s.Rename), "..") {
+			return fmt.Errorf("Artifact '%s' has to be relative to the artifact directory", s.Rename)
+		}
+	case s.Upload != "":
+		u, err := url.Parse(s.Upload)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("Upload URL has to be a http or https one")
+		}
+	}
+
+	return nil
+}
+
+/*
+Time of the build for the names of the artifacts, SOURCE_DATE_EPOCH if set so
+rebuilds get the same names.
+*/
+func artifactTime() time.Time {
+	if epoch, err := strconv.ParseInt(os.Getenv("SOURCE_DATE_EPOCH"), 10, 64); err == nil {
+		return time.Unix(epoch, 0).UTC()
+	}
+
+	return time.Now().UTC()
+}
+
+// Name of the artifact with its placeholders substituted
+func artifactName(name string, context *debos.DebosContext, now time.Time) string {
+	values := map[string]string{
+		"date":     now.Format("20060102"),
+		"time":     now.Format("150405"),
+		"arch":     context.Architecture,
+		"build-id": context.BuildID,
+	}
+
+	return artifactPlaceholderRegex.ReplaceAllStringFunc(name, func(p string) string {
+		return values[artifactPlaceholderRegex.FindStringSubmatch(p)[1]]
+	})
+}
+
+/*
+FinalizeArtifacts renames the artifacts declared in the recipe header and
+removes the ones which aren't kept, once the build succeeded.
+*/
+func (r *Recipe) FinalizeArtifacts(context *debos.DebosContext) error {
+	now := artifactTime()
+
+	for _, a := range r.Artifacts {
+		files, _ := filepath.Glob(path.Join(context.Artifactdir, a.File))
+
+		if !a.keep() {
+			for _, f := range files {
+				log.Printf("Removing intermediate artifact %s", strings.TrimPrefix(f, context.Artifactdir+"/"))
+				if err := os.RemoveAll(f); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		if len(a.PostProcess) > 0 {
+			if a.renamed() && len(files) != 1 {
+				return fmt.Errorf("Artifact %s matches %d files, only one can be renamed", a.File, len(files))
+			}
+			for _, f := range files {
+				p := processedArtifact{file: f, checksums: map[string]string{}}
+				if err := p.process(a.PostProcess, context, now); err != nil {
+					return fmt.Errorf("Failed to post-process %s: %v", a.File, err)
+				}
+			}
+			continue
+		}
+
+		if a.Name == "" {
+			continue
+		}
+
+		if len(files) != 1 {
+			return fmt.Errorf("Artifact %s matches %d files, only one can be renamed", a.File, len(files))
+		}
+
+		name := artifactName(a.Name, context, now)
+		target := path.Join(context.Artifactdir, name)
+		if err := os.MkdirAll(path.Dir(target), 0755); err != nil {
+			return err
+		}
+
+		log.Printf("Renaming artifact %s to %s", a.File, name)
+		if err := os.Rename(files[0], target); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Artifact going through the post-process stages
+type processedArtifact struct {
+	file      string
+	checksums map[string]string // Checksum of the file for each algorithm
+	signed    bool
+}
+
+// Checksum and signature files, named after the artifact
+func (p processedArtifact) sidecars() []string {
+	var files []string
+	for algorithm := range p.checksums {
+		files = append(files, p.file+"."+algorithm)
+	}
+	if p.signed {
+		files = append(files, p.file+".asc")
+	}
+
+	return files
+}
+
+// Write the checksum file, as checked by e.g. 'sha256sum -c'
+func (p processedArtifact) writeChecksum(algorithm string) error {
+	line := fmt.Sprintf("%s  %s\n", p.checksums[algorithm], path.Base(p.file))
+	return ioutil.WriteFile(p.file+"."+algorithm, []byte(line), 0644)
+}
+
+func (p *processedArtifact) checksum(algorithm string) error {
+	f, err := os.Open(p.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := artifactChecksums[algorithm]()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	p.checksums[algorithm] = fmt.Sprintf("%x", h.Sum(nil))
+
+	return p.writeChecksum(algorithm)
+}
+
+func (p *processedArtifact) rename(target string) error {
+	if err := os.MkdirAll(path.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	for _, f := range p.sidecars() {
+		if err := os.Rename(f, target+strings.TrimPrefix(f, p.file)); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(p.file, target); err != nil {
+		return err
+	}
+	p.file = target
+
+	// The checksum files name the artifact
+	for algorithm := range p.checksums {
+		if err := p.writeChecksum(algorithm); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *processedArtifact) upload(location string) error {
+	for _, f := range append([]string{p.file}, p.sidecars()...) {
+		target := location + strings.TrimPrefix(f, p.file)
+		if strings.HasSuffix(location, "/") {
+			target = location + path.Base(f)
+		}
+		if err := debos.UploadHttpUrl(f, target); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *processedArtifact) process(stages []ArtifactStage, context *debos.DebosContext, now time.Time) error {
+	for _, s := range stages {
+		var err error
+		name := strings.TrimPrefix(p.file, context.Artifactdir+"/")
+
+		switch {
+		case s.Compress != "":
+			log.Printf("Compressing artifact %s with %s", name, s.Compress)
+			p.file, err = debos.CompressFile(p.file, s.Compress)
+		case s.Checksum != "":
+			log.Printf("Computing %s checksum of artifact %s", s.Checksum, name)
+			err = p.checksum(s.Checksum)
+		case s.Sign != "":
+			log.Printf("Signing artifact %s with key %s", name, s.Sign)
+			err = debos.Command{}.Run("gpg", "gpg", "--batch", "--yes", "--local-user", s.Sign,
+				"--armor", "--detach-sign", "--output", p.file+".asc", p.file)
+			p.signed = err == nil
+		case s.Rename != "":
+			target := artifactName(s.Rename, context, now)
+			log.Printf("Renaming artifact %s to %s", name, target)
+			err = p.rename(path.Join(context.Artifactdir, target))
+		case s.Upload != "":
+			location := artifactName(s.Upload, context, now)
+			if u, perr := url.Parse(location); perr == nil {
+				log.Printf("Uploading artifact %s to %s", name, u.Redacted())
+			}
+			err = p.upload(location)
+		case s.Command != "":
+			cmd := debos.Command{Dir: context.RecipeDir}
+			cmd.AddEnvKey("ARTIFACT", p.file)
+			cmd.AddEnvKey("ARTIFACTDIR", context.Artifactdir)
+			err = cmd.Run(s.Command, "sh", "-c", s.Command)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
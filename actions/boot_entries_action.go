@@ -0,0 +1,262 @@
+/*
+BootEntries Action
+
+Generate the boot menu entries of GRUB or systemd-boot from a list, e.g. for
+A/B kernels, recovery or factory reset entries, instead of relying on the
+distribution tooling.
+
+ # Yaml syntax:
+ - action: boot-entries
+   bootloader: grub
+   config: path
+   esp: path
+   default: id
+   timeout: seconds
+   entries:
+     - id: id
+       title: title
+       kernel: path
+       initrd:
+         - path
+       devicetree: path
+       cmdline: arguments
+
+Mandatory properties:
+
+- bootloader -- either 'grub' or 'systemd-boot'.
+
+- entries -- list of boot entries, at least one entry is needed.
+Entry properties are described below.
+
+Optional properties:
+
+- config -- path of the generated GRUB configuration in the target rootfs.
+Defaults to '/boot/grub/grub.cfg'. Only used for 'grub'.
+
+- esp -- mount point of the EFI system partition in the target rootfs, the
+loader configuration and the entries are written below it. Defaults to
+'/boot/efi'. Only used for 'systemd-boot'.
+
+- default -- id of the default entry. Defaults to the first entry.
+
+- timeout -- time in seconds the menu is shown. Defaults to 5.
+
+   # Yaml syntax for entries:
+   entries:
+     - id: id
+       title: title
+       kernel: path
+       initrd:
+         - path
+       devicetree: path
+       cmdline: arguments
+
+Mandatory properties:
+
+- id -- unique identifier of the entry.
+
+- kernel -- path of the kernel as seen by the bootloader.
+
+Optional properties:
+
+- title -- title shown in the boot menu. Defaults to the id.
+
+- initrd -- list of initrd paths as seen by the bootloader.
+
+- devicetree -- path of the device tree as seen by the bootloader.
+
+- cmdline -- kernel command line of the entry.
+
+As recipes are templates, entries can be generated with the template
+language, e.g.:
+
+ entries:
+ {{- range $slot := list "a" "b" }}
+   - id: system-{{ $slot }}
+     kernel: /vmlinuz-{{ $slot }}
+     cmdline: root=PARTLABEL=rootfs-{{ $slot }} ro
+ {{- end }}
+*/
+package actions
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+
+	"github.com/go-debos/debos"
+)
+
+type BootEntry struct {
+	ID         string
+	Title      string
+	Kernel     string
+	Initrd     []string
+	DeviceTree string
+	Cmdline    string
+}
+
+type BootEntriesAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Bootloader       string
+	Config           string
+	ESP              string
+	Default          string
+	Timeout          int
+	Entries          []BootEntry
+}
+
+func NewBootEntriesAction() *BootEntriesAction {
+	b := BootEntriesAction{}
+	b.Config = "/boot/grub/grub.cfg"
+	b.ESP = "/boot/efi"
+	b.Timeout = 5
+
+	return &b
+}
+
+func (b *BootEntriesAction) Verify(context *debos.DebosContext) error {
+	switch b.Bootloader {
+	case "grub", "systemd-boot":
+	default:
+		return fmt.Errorf("Unsupported bootloader '%s'", b.Bootloader)
+	}
+
+	if len(b.Entries) == 0 {
+		return errors.New("At least one entry is needed for boot-entries action")
+	}
+
+	ids := make(map[string]bool)
+	for idx := range b.Entries {
+		e := &b.Entries[idx]
+		if e.ID == "" {
+			return errors.New("Boot entry without an id")
+		}
+		if ids[e.ID] {
+			return fmt.Errorf("Boot entry %s already exists", e.ID)
+		}
+		ids[e.ID] = true
+
+		if e.Kernel == "" {
+			return fmt.Errorf("Boot entry %s missing kernel", e.ID)
+		}
+		if e.Title == "" {
+			e.Title = e.ID
+		}
+	}
+
+	if b.Default == "" {
+		b.Default = b.Entries[0].ID
+	} else if !ids[b.Default] {
+		return fmt.Errorf("Default boot entry %s doesn't exist", b.Default)
+	}
+
+	if b.Timeout < 0 {
+		return errors.New("Timeout can't be negative")
+	}
+
+	return nil
+}
+
+func grubQuote(s string) string {
+	var b bytes.Buffer
+
+	b.WriteString("'")
+	for _, c := range s {
+		if c == '\'' {
+			b.WriteString(`'\''`)
+		} else {
+			b.WriteRune(c)
+		}
+	}
+	b.WriteString("'")
+
+	return b.String()
+}
+
+func (b *BootEntriesAction) grubConfig() []byte {
+	var c bytes.Buffer
+
+	c.WriteString("# Generated by debos\n")
+	c.WriteString(fmt.Sprintf("set default=%s\n", grubQuote(b.Default)))
+	c.WriteString(fmt.Sprintf("set timeout=%d\n", b.Timeout))
+
+	for _, e := range b.Entries {
+		c.WriteString(fmt.Sprintf("\nmenuentry %s --id %s {\n", grubQuote(e.Title), grubQuote(e.ID)))
+		c.WriteString(fmt.Sprintf("\tlinux %s %s\n", e.Kernel, e.Cmdline))
+		for _, initrd := range e.Initrd {
+			c.WriteString(fmt.Sprintf("\tinitrd %s\n", initrd))
+		}
+		if e.DeviceTree != "" {
+			c.WriteString(fmt.Sprintf("\tdevicetree %s\n", e.DeviceTree))
+		}
+		c.WriteString("}\n")
+	}
+
+	return c.Bytes()
+}
+
+func (b *BootEntriesAction) loaderConfig() []byte {
+	var c bytes.Buffer
+
+	c.WriteString(fmt.Sprintf("default %s.conf\n", b.Default))
+	c.WriteString(fmt.Sprintf("timeout %d\n", b.Timeout))
+
+	return c.Bytes()
+}
+
+func (e *BootEntry) loaderEntry() []byte {
+	var c bytes.Buffer
+
+	c.WriteString(fmt.Sprintf("title %s\n", e.Title))
+	c.WriteString(fmt.Sprintf("linux %s\n", e.Kernel))
+	for _, initrd := range e.Initrd {
+		c.WriteString(fmt.Sprintf("initrd %s\n", initrd))
+	}
+	if e.DeviceTree != "" {
+		c.WriteString(fmt.Sprintf("devicetree %s\n", e.DeviceTree))
+	}
+	if e.Cmdline != "" {
+		c.WriteString(fmt.Sprintf("options %s\n", e.Cmdline))
+	}
+
+	return c.Bytes()
+}
+
+func writeRootfsFile(context *debos.DebosContext, file string, data []byte, perm os.FileMode) error {
+	target, err := debos.RestrictedPath(context.Rootdir, file)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(path.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	log.Printf("Writing %s", file)
+	return ioutil.WriteFile(target, data, perm)
+}
+
+func (b *BootEntriesAction) Run(context *debos.DebosContext) error {
+	if b.Bootloader == "grub" {
+		return writeRootfsFile(context, b.Config, b.grubConfig(), 0644)
+	}
+
+	err := writeRootfsFile(context, path.Join(b.ESP, "loader/loader.conf"), b.loaderConfig(), 0644)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range b.Entries {
+		entry := path.Join(b.ESP, "loader/entries", e.ID+".conf")
+		if err := writeRootfsFile(context, entry, e.loaderEntry(), 0644); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,177 @@
+/*
+CheckBinaries Action
+
+Run binaries of the target in the filesystem, under qemu user emulation if the
+architecture differs from the host one, and check the libraries they link
+against are installed. It catches the packaging errors of cross-compiled
+software, e.g. a missing dependency or a binary built for the wrong CPU,
+before booting the image.
+
+ # Yaml syntax:
+ - action: check-binaries
+   commands:
+     - application --version
+   ldd:
+     - /usr/bin/application
+     - /usr/lib/aarch64-linux-gnu/libapplication.so.*
+   timeout: 60s
+
+Optional properties:
+
+- commands -- list of command lines run in the filesystem with 'sh -c', the
+check fails if the command exits with an error, crashes or times out.
+
+- ldd -- list of binaries or libraries of the filesystem, or glob patterns of
+them, checked with 'ldd' for missing libraries. The check fails if a pattern
+doesn't match any file.
+
+- timeout -- time a command or ldd check may take, as a duration like '30s'
+or '2m'. Default '60s'.
+
+At least one of 'commands' or 'ldd' has to be given. All the checks are run
+and the failed ones are reported together.
+*/
+package actions
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-debos/debos"
+)
+
+type CheckBinariesAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Commands         []string
+	Ldd              []string
+	Timeout          string
+	timeout          time.Duration
+}
+
+func (c *CheckBinariesAction) Verify(context *debos.DebosContext) error {
+	if len(c.Commands) == 0 && len(c.Ldd) == 0 {
+		return errors.New("At least one of 'commands' or 'ldd' properties is needed")
+	}
+
+	c.timeout = 60 * time.Second
+	if c.Timeout != "" {
+		timeout, err := time.ParseDuration(c.Timeout)
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("Invalid timeout '%s'", c.Timeout)
+		}
+		c.timeout = timeout
+	}
+
+	for _, l := range c.Ldd {
+		if !filepath.IsAbs(l) {
+			return fmt.Errorf("ldd path '%s' must be absolute", l)
+		}
+		if _, err := filepath.Match(l, ""); err != nil {
+			return fmt.Errorf("Invalid ldd pattern '%s'", l)
+		}
+	}
+
+	return nil
+}
+
+// Reason of the failure of a check, from its exit status and output
+func checkFailure(err error, out []byte) string {
+	if strings.Contains(string(out), "qemu: uncaught target signal") {
+		return "crashed under qemu user emulation"
+	}
+
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		status, _ := exitErr.Sys().(syscall.WaitStatus)
+		switch {
+		case status.ExitStatus() == 124:
+			return "timed out"
+		case status.Signaled():
+			return fmt.Sprintf("killed by signal %s", status.Signal())
+		case status.ExitStatus() > 128:
+			return fmt.Sprintf("crashed with signal %d", status.ExitStatus()-128)
+		}
+	}
+
+	return err.Error()
+}
+
+func (c *CheckBinariesAction) run(context *debos.DebosContext, label string, cmdline ...string) ([]byte, string) {
+	cmd := debos.NewChrootCommandForContext(*context)
+
+	args := []string{"timeout", "--kill-after=5", fmt.Sprintf("%gs", c.timeout.Seconds())}
+	out, err := cmd.CombinedOutput(label, append(args, cmdline...)...)
+	if err != nil {
+		return out, checkFailure(err, out)
+	}
+
+	return out, ""
+}
+
+// Files of the filesystem matching the ldd patterns, as paths in the filesystem
+func (c *CheckBinariesAction) lddFiles(context *debos.DebosContext) ([]string, []string) {
+	var files, failures []string
+
+	for _, pattern := range c.Ldd {
+		matches, _ := filepath.Glob(filepath.Join(context.Rootdir, pattern))
+		if len(matches) == 0 {
+			failures = append(failures, fmt.Sprintf("%s: no such file", pattern))
+			continue
+		}
+		for _, m := range matches {
+			files = append(files, "/"+strings.TrimPrefix(m, context.Rootdir+"/"))
+		}
+	}
+
+	return files, failures
+}
+
+func (c *CheckBinariesAction) Run(context *debos.DebosContext) error {
+	var failures []string
+
+	for _, command := range c.Commands {
+		out, failure := c.run(context, command, "sh", "-c", command)
+		if failure == "" {
+			log.Printf("%s: ok", command)
+			continue
+		}
+
+		log.Printf("%s: %s\n%s", command, failure, strings.TrimRight(string(out), "\n"))
+		failures = append(failures, fmt.Sprintf("%s: %s", command, failure))
+	}
+
+	files, missing := c.lddFiles(context)
+	failures = append(failures, missing...)
+
+	for _, file := range files {
+		out, failure := c.run(context, "ldd "+file, "ldd", file)
+		if failure != "" {
+			log.Printf("ldd %s: %s\n%s", file, failure, strings.TrimRight(string(out), "\n"))
+			failures = append(failures, fmt.Sprintf("ldd %s: %s", file, failure))
+			continue
+		}
+
+		var libs []string
+		for _, line := range strings.Split(string(out), "\n") {
+			if strings.Contains(line, "=> not found") {
+				libs = append(libs, strings.TrimSpace(strings.Split(line, "=>")[0]))
+			}
+		}
+		if len(libs) > 0 {
+			failures = append(failures, fmt.Sprintf("%s: missing %s", file, strings.Join(libs, ", ")))
+		} else {
+			log.Printf("ldd %s: ok", file)
+		}
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("%d checks failed:\n%s", len(failures), strings.Join(failures, "\n"))
+	}
+
+	return nil
+}
@@ -0,0 +1,270 @@
+/*
+ConvertPartitionTable Action
+
+Convert the partition table of an existing image between MBR and GPT, e.g. to
+retarget a product image to firmware expecting the other one. The content of
+the partitions isn't changed.
+
+ # Yaml syntax:
+ - action: convert-partition-table
+   origin: name
+   file: image.img
+   to: gpt
+
+Mandatory properties:
+
+- file -- file name of the image, located in 'origin'. The image is converted
+in place.
+
+- to -- type of the new partition table, 'gpt' or 'msdos'.
+
+Optional properties:
+
+- origin -- reference to a named file or directory. The default value is
+'artifacts'.
+
+The action runs on the host after the fakemachine, so the image built by an
+'image-partition' action of the recipe can be converted, if it's not
+compressed.
+
+The partition numbers, types, and the bootable flag, stored as the
+'LegacyBIOSBootable' attribute of GPT, are kept; partition types without an
+equivalent are converted to Linux filesystem ones. The boot code of the MBR is
+kept, but the GPT overwrites the sectors following the MBR, e.g. the core image
+of a GRUB installed for BIOS on an MBR image, so the bootloader has to be
+installed again. The filesystem UUIDs and labels are kept, while the PARTUUIDs
+change.
+
+A GPT image is grown if there is no room for the backup GPT after the last
+partition. Only GPT images with up to 4 partitions below 2TiB can be converted
+to MBR.
+*/
+package actions
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/go-debos/debos"
+)
+
+// MBR partition types and their GPT equivalent
+var mbrToGptTypes = map[string]string{
+	"83": "0FC63DAF-8483-4772-8E79-3D69D8477DE4", // Linux filesystem
+	"82": "0657FD6D-A4AB-43C4-84E5-0933C84B4F4F", // Linux swap
+	"8e": "E6D6D379-F507-44C2-A23C-238F2A3DF928", // Linux LVM
+	"fd": "A19D880F-05FC-4D3B-A006-743F0F84911E", // Linux RAID
+	"ef": "C12A7328-F81F-11D2-BA4B-00A0C93EC93B", // EFI System
+	"c":  "EBD0A0A2-B9E5-4433-87C0-68B6B72699C7", // FAT32 (LBA)
+	"b":  "EBD0A0A2-B9E5-4433-87C0-68B6B72699C7", // FAT32
+	"e":  "EBD0A0A2-B9E5-4433-87C0-68B6B72699C7", // FAT16 (LBA)
+	"6":  "EBD0A0A2-B9E5-4433-87C0-68B6B72699C7", // FAT16
+	"7":  "EBD0A0A2-B9E5-4433-87C0-68B6B72699C7", // NTFS/exFAT
+}
+
+var gptToMbrTypes = map[string]string{
+	"0FC63DAF-8483-4772-8E79-3D69D8477DE4": "83",
+	"0657FD6D-A4AB-43C4-84E5-0933C84B4F4F": "82",
+	"E6D6D379-F507-44C2-A23C-238F2A3DF928": "8e",
+	"A19D880F-05FC-4D3B-A006-743F0F84911E": "fd",
+	"C12A7328-F81F-11D2-BA4B-00A0C93EC93B": "ef",
+	"EBD0A0A2-B9E5-4433-87C0-68B6B72699C7": "c",
+}
+
+// Partition table as dumped by sfdisk
+type sfdiskTable struct {
+	Label      string
+	Partitions []struct {
+		Node     string
+		Start    int64
+		Size     int64
+		Type     string
+		Bootable bool
+		Attrs    string
+	}
+}
+
+type ConvertPartitionTableAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Origin           string
+	File             string
+	To               string
+}
+
+func (c *ConvertPartitionTableAction) Verify(context *debos.DebosContext) error {
+	if c.File == "" {
+		return errors.New("Property 'file' is mandatory")
+	}
+
+	if c.To != "gpt" && c.To != "msdos" {
+		return fmt.Errorf("Unsupported partition table '%s', expected 'gpt' or 'msdos'", c.To)
+	}
+
+	return nil
+}
+
+// Read the partition table of the image
+func readPartitionTable(image string, sectorSize int) (*sfdiskTable, error) {
+	out, err := debos.Command{}.Output("sfdisk", "sfdisk", "--sector-size", strconv.Itoa(sectorSize), "--json", image)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the partition table of %s: %v", image, err)
+	}
+
+	var dump struct {
+		PartitionTable sfdiskTable `json:"partitiontable"`
+	}
+	if err := json.Unmarshal(out, &dump); err != nil {
+		return nil, fmt.Errorf("Failed to parse partition table: %v", err)
+	}
+
+	return &dump.PartitionTable, nil
+}
+
+// Script for sfdisk creating the converted partition table
+func (c *ConvertPartitionTableAction) script(table *sfdiskTable, sectorSize int) (string, error) {
+	var script strings.Builder
+	fmt.Fprintf(&script, "label: %s\nunit: sectors\nsector-size: %d\n\n", c.To, sectorSize)
+
+	for _, p := range table.Partitions {
+		var ptype string
+		var flags string
+		var found bool
+
+		if c.To == "gpt" {
+			if p.Type == "5" || p.Type == "f" || p.Type == "85" {
+				// Only holds the logical partitions, converted on their own
+				continue
+			}
+			ptype, found = mbrToGptTypes[p.Type]
+			if !found {
+				ptype = mbrToGptTypes["83"]
+			}
+			if p.Bootable {
+				flags = `, attrs="LegacyBIOSBootable"`
+			}
+		} else {
+			if p.Start+p.Size > 1<<32 {
+				return "", fmt.Errorf("Partition %s ends beyond the limit of MBR", p.Node)
+			}
+			ptype, found = gptToMbrTypes[strings.ToUpper(p.Type)]
+			if !found {
+				ptype = "83"
+			}
+			if strings.Contains(p.Attrs, "LegacyBIOSBootable") {
+				flags = ", bootable"
+			}
+		}
+
+		if !found {
+			log.Printf("Partition %s: no equivalent of type %s, using Linux filesystem", p.Node, p.Type)
+		}
+
+		// The partition number is taken from the node name
+		fmt.Fprintf(&script, "%s : start=%d, size=%d, type=%s%s\n", p.Node, p.Start, p.Size, ptype, flags)
+	}
+
+	return script.String(), nil
+}
+
+func (c *ConvertPartitionTableAction) PostMachine(context *debos.DebosContext) error {
+	origin := context.Artifactdir
+	if c.Origin != "" {
+		var found bool
+		if origin, found = context.Origin(c.Origin); !found {
+			return fmt.Errorf("Origin not found '%s'", c.Origin)
+		}
+	}
+	image := path.Join(origin, c.File)
+
+	table, err := readPartitionTable(image, context.SectorSize)
+	if err != nil {
+		return err
+	}
+
+	label := c.To
+	if label == "msdos" {
+		label = "dos"
+	}
+	if table.Label == label {
+		log.Printf("%s already has a %s partition table", c.File, c.To)
+		return nil
+	}
+
+	sectorSize := int64(context.SectorSize)
+	// Partition entries and header of GPT
+	gptSectors := int64(16384)/sectorSize + 1
+
+	f, err := os.OpenFile(image, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	bootcode := make([]byte, 440)
+	if _, err := io.ReadFull(f, bootcode); err != nil {
+		return err
+	}
+
+	if c.To == "gpt" {
+		var end int64
+		for _, p := range table.Partitions {
+			if p.Start <= gptSectors {
+				return fmt.Errorf("Partition %s starts in the room needed by the GPT", p.Node)
+			}
+			if p.Start+p.Size > end {
+				end = p.Start + p.Size
+			}
+		}
+
+		gap := make([]byte, gptSectors*sectorSize)
+		if _, err := f.ReadAt(gap, sectorSize); err != nil {
+			return err
+		}
+		for _, b := range gap {
+			if b != 0 {
+				log.Printf("WARNING: %s has data after the MBR, e.g. a bootloader, overwritten by the GPT", c.File)
+				break
+			}
+		}
+
+		// Room for the backup GPT, aligned on 1MiB
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		size := (end + gptSectors) * sectorSize
+		if size > info.Size() {
+			size = (size + 1<<20 - 1) &^ (1<<20 - 1)
+			log.Printf("Growing %s for the backup GPT", c.File)
+			if err := f.Truncate(size); err != nil {
+				return err
+			}
+		}
+	} else if len(table.Partitions) > 4 {
+		return fmt.Errorf("%s has %d partitions, MBR holds 4 primary partitions", c.File, len(table.Partitions))
+	}
+
+	script, err := c.script(table, context.SectorSize)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Converting the partition table of %s to %s", c.File, c.To)
+	cmd := debos.Command{Stdin: strings.NewReader(script)}
+	if out, err := cmd.CombinedOutput("sfdisk", "sfdisk", "--wipe", "always", image); err != nil {
+		return fmt.Errorf("Failed to convert the partition table: %v: %s", err, out)
+	}
+
+	if _, err := f.WriteAt(bootcode, 0); err != nil {
+		return err
+	}
+
+	return f.Sync()
+}
@@ -0,0 +1,148 @@
+/*
+Debconf Action
+
+Preseed debconf selections in the target rootfs with 'debconf-set-selections',
+so packages installed later, e.g. locales, tzdata or keyboard-configuration,
+are configured non-interactively with the desired answers.
+
+ # Yaml syntax:
+ - action: debconf
+   origin: name
+   file: selections
+   selections:
+     - package: tzdata
+       question: tzdata/Areas
+       type: select
+       value: Europe
+
+Optional properties:
+
+- origin -- reference to a named file or directory containing 'file'.
+Defaults to the recipe directory.
+
+- file -- file of selections in the 'debconf-set-selections' format, relative to
+'origin'.
+
+- selections -- list of selections, each with the 'package' owning the
+question, the 'question', its 'type' (e.g. 'select', 'string', 'boolean') and
+the 'value'. Set 'seen' to 'false' to still ask the question when the package
+is configured interactively.
+
+At least one of 'file' or 'selections' has to be given, the selections of the
+file are loaded first. The rootfs has to contain debconf, which is the case
+after debootstrap or mmdebstrap.
+*/
+package actions
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/go-debos/debos"
+	"github.com/go-debos/fakemachine"
+)
+
+type DebconfSelection struct {
+	Package  string
+	Question string
+	Type     string
+	Value    string
+	Seen     *bool
+}
+
+type DebconfAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Origin           string
+	File             string
+	Selections       []DebconfSelection
+}
+
+func (d *DebconfAction) Verify(context *debos.DebosContext) error {
+	if d.File == "" && len(d.Selections) == 0 {
+		return errors.New("At least one of 'file' or 'selections' properties is needed")
+	}
+
+	for _, s := range d.Selections {
+		if s.Package == "" || s.Question == "" || s.Type == "" {
+			return errors.New("Debconf selections need 'package', 'question' and 'type'")
+		}
+		if strings.ContainsAny(s.Value, "\n") {
+			return fmt.Errorf("Value of debconf question %s can't span several lines", s.Question)
+		}
+	}
+
+	return nil
+}
+
+func (d *DebconfAction) PreMachine(context *debos.DebosContext, m *fakemachine.Machine, args *[]string) error {
+	if d.Origin == "" && path.IsAbs(d.File) {
+		m.AddVolume(path.Dir(d.File))
+	}
+
+	return nil
+}
+
+func (d *DebconfAction) WatchPaths(context *debos.DebosContext) []string {
+	if d.File == "" || (d.Origin != "" && d.Origin != "recipe") {
+		return nil
+	}
+
+	return []string{debos.CleanPathAt(d.File, context.RecipeDir)}
+}
+
+func (d *DebconfAction) Run(context *debos.DebosContext) error {
+	var b bytes.Buffer
+
+	if d.File != "" {
+		origin := context.RecipeDir
+		if d.Origin != "" {
+			var found bool
+			if origin, found = context.Origin(d.Origin); !found {
+				return fmt.Errorf("Origin not found '%s'", d.Origin)
+			}
+		}
+
+		data, err := ioutil.ReadFile(debos.CleanPathAt(d.File, origin))
+		if err != nil {
+			return err
+		}
+		b.Write(data)
+		if len(data) > 0 && data[len(data)-1] != '\n' {
+			b.WriteString("\n")
+		}
+	}
+
+	for _, s := range d.Selections {
+		b.WriteString(fmt.Sprintf("%s %s %s %s\n", s.Package, s.Question, s.Type, s.Value))
+	}
+
+	file := "/var/cache/debconf/debos-selections"
+	if err := writeRootfsFile(context, file, b.Bytes(), 0600); err != nil {
+		return err
+	}
+	defer os.Remove(path.Join(context.Rootdir, file))
+
+	c := debos.NewChrootCommandForContext(*context)
+	c.AddEnv("DEBIAN_FRONTEND=noninteractive")
+	if err := c.Run("debconf", "debconf-set-selections", "--verbose", file); err != nil {
+		return err
+	}
+
+	// Selections are marked as seen by default
+	for _, s := range d.Selections {
+		if s.Seen != nil && !*s.Seen {
+			err := c.Run("debconf", "sh", "-c",
+				fmt.Sprintf("echo %s | debconf-communicate %s", escape("FSET "+s.Question+" seen false"), escape(s.Package)))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
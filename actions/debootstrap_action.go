@@ -10,13 +10,17 @@ and this may lead to incorrect configuration when becoming part of the created r
  # Yaml syntax:
  - action: debootstrap
    mirror: URL
+   mirrors: <list of URLs>
    suite: "name"
    components: <list of components>
    variant: "name"
    keyring-package:
    keyring-file:
+   keyring-origin:
    certificate:
    private-key:
+   debootstrap-opts: <list of options>
+   probe-mirrors: bool
 
 Mandatory properties:
 
@@ -28,6 +32,12 @@ Optional properties:
 
 - mirror -- URL with Debian-compatible repository
  If no mirror is specified debos will use http://deb.debian.org/debian as default.
+ The http mirrors are fetched through the '--apt-proxy' command line option if set.
+
+- mirrors -- list of URLs with Debian-compatible repositories, the first one is
+ the primary mirror and the following ones are fallbacks tried in order if
+ bootstrapping from the previous one fails. All the mirrors are added to
+ '/etc/apt/sources.list'. Can't be used together with 'mirror'.
 
 - variant -- name of the bootstrap script variant to use
 
@@ -41,17 +51,31 @@ Example:
 
 - keyring-file -- keyring file for repository validation.
 
+- keyring-origin -- reference to a named file or directory holding the
+'keyring-file', e.g. the origin of a download action fetching the keyring
+from an URL. By default 'keyring-file' is relative to the recipe directory.
+
 - merged-usr -- use merged '/usr' filesystem, true by default.
 
 - certificate -- client certificate stored in file to be used for downloading packages from the server.
 
 - private-key -- provide the client's private key in a file separate from the certificate.
+
+- debootstrap-opts -- list of additional options passed to debootstrap,
+ e.g. '--exclude=nano'.
+
+- probe-mirrors -- check the HTTP mirrors serve the suite before bootstrapping,
+ fetching their Release file and verifying the checksum of the Release file of
+ the first component. Unhealthy mirrors are skipped, and the build fails early
+ with the reasons if none is healthy. False by default, the probes can't pass
+ authenticating proxies or use the credentials of APT's auth.conf.
 */
 package actions
 
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"path"
@@ -66,14 +90,18 @@ type DebootstrapAction struct {
 	debos.BaseAction `yaml:",inline"`
 	Suite            string
 	Mirror           string
+	Mirrors          []string
 	Variant          string
 	KeyringPackage   string `yaml:"keyring-package"`
 	KeyringFile      string `yaml:"keyring-file"`
+	KeyringOrigin    string `yaml:"keyring-origin"`
 	Certificate      string
 	PrivateKey       string `yaml:"private-key"`
 	Components       []string
 	MergedUsr        bool `yaml:"merged-usr"`
 	CheckGpg         bool `yaml:"check-gpg"`
+	DebootstrapOpts  []string `yaml:"debootstrap-opts"`
+	ProbeMirrors     bool     `yaml:"probe-mirrors"`
 }
 
 func NewDebootstrapAction() *DebootstrapAction {
@@ -84,12 +112,22 @@ func NewDebootstrapAction() *DebootstrapAction {
 	d.CheckGpg = true
 	// Use main as default component
 	d.Components = []string{"main"}
-	// Set generic default mirror
-	d.Mirror = "http://deb.debian.org/debian"
 
 	return &d
 }
 
+// Mirrors to bootstrap from, in order of preference
+func (d *DebootstrapAction) mirrors() []string {
+	if d.Mirror != "" {
+		return []string{d.Mirror}
+	}
+	if len(d.Mirrors) > 0 {
+		return d.Mirrors
+	}
+	// Generic default mirror
+	return []string{"http://deb.debian.org/debian"}
+}
+
 func (d *DebootstrapAction) listOptionFiles(context *debos.DebosContext) []string {
 	files := []string{}
 	if d.Certificate != "" {
@@ -102,7 +140,8 @@ func (d *DebootstrapAction) listOptionFiles(context *debos.DebosContext) []strin
 		files = append(files, d.PrivateKey)
 	}
 
-	if d.KeyringFile != "" {
+	// Keyring files from origins are only known at run time
+	if d.KeyringFile != "" && d.KeyringOrigin == "" {
 		d.KeyringFile = debos.CleanPathAt(d.KeyringFile, context.RecipeDir)
 		files = append(files, d.KeyringFile)
 	}
@@ -115,6 +154,14 @@ func (d *DebootstrapAction) Verify(context *debos.DebosContext) error {
 		return fmt.Errorf("suite property not specified")
 	}
 
+	if d.Mirror != "" && len(d.Mirrors) > 0 {
+		return fmt.Errorf("Can't use both 'mirror' and 'mirrors' properties")
+	}
+
+	if d.KeyringOrigin != "" && d.KeyringFile == "" {
+		return fmt.Errorf("'keyring-origin' requires the 'keyring-file' property")
+	}
+
 	files := d.listOptionFiles(context)
 
 	// Check if all needed files exists
@@ -152,6 +199,8 @@ func (d *DebootstrapAction) RunSecondStage(context debos.DebosContext) error {
 	c := debos.NewChrootCommandForContext(context)
 	// Can't use nspawn for debootstrap as it wants to create device nodes
 	c.ChrootMethod = debos.CHROOT_METHOD_CHROOT
+	// The second stage sets up the /dev it populated and mounts /proc and /sys
+	c.RootfsDev = true
 
 	err := c.Run("Debootstrap (stage 2)", cmdline...)
 
@@ -181,9 +230,39 @@ func (d *DebootstrapAction) isLikelyOldSuite() bool {
 	}
 }
 
+// Remove the content of a partially bootstrapped rootfs
+func cleanRootfs(rootdir string) error {
+	entries, err := ioutil.ReadDir(rootdir)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if err := os.RemoveAll(path.Join(rootdir, e.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func (d *DebootstrapAction) Run(context *debos.DebosContext) error {
 	cmdline := []string{"debootstrap"}
 
+	keyring := d.KeyringFile
+	if d.KeyringOrigin != "" {
+		origin, found := context.Origin(d.KeyringOrigin)
+		if !found {
+			return fmt.Errorf("Origin not found '%s'", d.KeyringOrigin)
+		}
+
+		var err error
+		keyring, err = debos.RestrictedPath(origin, d.KeyringFile)
+		if err != nil {
+			return err
+		}
+	}
+
 	if d.MergedUsr {
 		cmdline = append(cmdline, "--merged-usr")
 	} else {
@@ -192,8 +271,8 @@ func (d *DebootstrapAction) Run(context *debos.DebosContext) error {
 
 	if !d.CheckGpg {
 		cmdline = append(cmdline, fmt.Sprintf("--no-check-gpg"))
-	} else if d.KeyringFile != "" {
-		cmdline = append(cmdline, fmt.Sprintf("--keyring=%s", d.KeyringFile))
+	} else if keyring != "" {
+		cmdline = append(cmdline, fmt.Sprintf("--keyring=%s", keyring))
 	}
 
 	if d.KeyringPackage != "" {
@@ -232,10 +311,10 @@ func (d *DebootstrapAction) Run(context *debos.DebosContext) error {
 		cmdline = append(cmdline, "--exclude=usr-is-merged")
 	}
 
+	cmdline = append(cmdline, d.DebootstrapOpts...)
+
 	cmdline = append(cmdline, d.Suite)
 	cmdline = append(cmdline, context.Rootdir)
-	cmdline = append(cmdline, d.Mirror)
-	cmdline = append(cmdline, "/usr/share/debootstrap/scripts/unstable")
 
 	/* Make sure /etc/apt/apt.conf.d exists inside the fakemachine otherwise
 	   debootstrap prints a warning about the path not existing. */
@@ -245,12 +324,43 @@ func (d *DebootstrapAction) Run(context *debos.DebosContext) error {
 		}
 	}
 
-	err := debos.Command{}.Run("Debootstrap", cmdline...)
+	var err error
+	mirrors := d.mirrors()
+	if d.ProbeMirrors {
+		component := "main"
+		if len(d.Components) > 0 {
+			component = d.Components[0]
+		}
+		mirrors, err = debos.HealthyMirrors(mirrors, d.Suite, component, context.Architecture)
+		if err != nil {
+			return err
+		}
+	}
 
-	if err != nil {
-		log := path.Join(context.Rootdir, "debootstrap/debootstrap.log")
-		_ = debos.Command{}.Run("debootstrap.log", "cat", log)
-		return err
+	bootstrap := debos.Command{}
+	// debootstrap downloads with wget, which honours http_proxy
+	if proxy := debos.ResolveAptProxy(*context, ""); proxy != "" {
+		bootstrap.AddEnvKey("http_proxy", proxy)
+	}
+
+	for idx, mirror := range mirrors {
+		mirrorCmdline := append(cmdline, mirror, "/usr/share/debootstrap/scripts/unstable")
+		err = bootstrap.Run("Debootstrap", mirrorCmdline...)
+		if err == nil {
+			break
+		}
+
+		debootstrapLog := path.Join(context.Rootdir, "debootstrap/debootstrap.log")
+		_ = debos.Command{}.Run("debootstrap.log", "cat", debootstrapLog)
+
+		if idx == len(mirrors)-1 {
+			return err
+		}
+
+		log.Printf("Debootstrap from %s failed, falling back to %s", mirror, mirrors[idx+1])
+		if err := cleanRootfs(context.Rootdir); err != nil {
+			return err
+		}
 	}
 
 	if foreign {
@@ -266,12 +376,14 @@ func (d *DebootstrapAction) Run(context *debos.DebosContext) error {
 	if err != nil {
 		return err
 	}
-	_, err = io.WriteString(srclist, fmt.Sprintf("deb %s %s %s\n",
-		d.Mirror,
-		d.Suite,
-		strings.Join(d.Components, " ")))
-	if err != nil {
-		return err
+	for _, mirror := range d.mirrors() {
+		_, err = io.WriteString(srclist, fmt.Sprintf("deb %s %s %s\n",
+			mirror,
+			d.Suite,
+			strings.Join(d.Components, " ")))
+		if err != nil {
+			return err
+		}
 	}
 	srclist.Close()
 
@@ -139,8 +139,7 @@ func (d *DownloadAction) Run(context *debos.DebosContext) error {
 
 	switch url.Scheme {
 	case "http", "https":
-		err := debos.DownloadHttpUrl(url.String(), filename)
-		if err != nil {
+		if err := context.Lock.Fetch(url.String(), filename); err != nil {
 			return err
 		}
 	default:
@@ -0,0 +1,174 @@
+/*
+Erofs Action
+
+Create an EROFS image of the filesystem, a compressed read-only filesystem
+for immutable root or '/usr' partitions, with a better random access
+performance than squashfs. The image can then be written to a partition with
+the 'raw' action.
+
+ # Yaml syntax:
+ - action: erofs
+   file: filename.erofs
+   compression: lz4hc
+   compression-level: 12
+   pcluster-size: 64KiB
+   label: label
+   fsuuid: string
+   extended-options:
+     - dedupe
+   exclude:
+     - /boot
+
+Mandatory properties:
+
+- file -- name of the output image, relative to the artifact directory.
+
+Optional properties:
+
+- compression -- compression algorithm, one of 'lz4', 'lz4hc', 'lzma',
+'deflate', 'zstd' or 'none'. 'lz4' decompresses the fastest while 'lzma'
+gives the smallest images. Default 'lz4hc'.
+
+- compression-level -- level of the compression algorithm, e.g. 0 to 12 for
+'lz4hc'. Default is the one of mkfs.erofs.
+
+- pcluster-size -- maximum size of the compressed physical clusters, in human
+readable form, a multiple of 4KiB. Bigger clusters compress better at the
+expense of random reads. Default is a single 4KiB block.
+
+- label -- label of the filesystem, up to 16 characters.
+
+- fsuuid -- UUID of the filesystem. Default is a random one.
+
+- extended-options -- list of mkfs.erofs extended options, e.g. 'dedupe',
+'ztailpacking' or 'all-fragments', see mkfs.erofs(1).
+
+- exclude -- list of paths of the filesystem which aren't put in the image,
+e.g. '/boot' when it's a partition on its own.
+
+The timestamps of the files are set to SOURCE_DATE_EPOCH when it's set, so
+rebuilds of the same filesystem give the same image.
+
+ # Example writing the image to a partition:
+ - action: erofs
+   file: root.erofs
+   compression: lz4hc
+   compression-level: 12
+
+ - action: raw
+   origin: artifacts
+   source: root.erofs
+   partition: root
+*/
+package actions
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/google/uuid"
+
+	"github.com/go-debos/debos"
+)
+
+var erofsCompressions = []string{"lz4", "lz4hc", "lzma", "deflate", "zstd", "none"}
+
+type ErofsAction struct {
+	debos.BaseAction `yaml:",inline"`
+	File             string
+	Compression      string
+	CompressionLevel *int   `yaml:"compression-level"`
+	PclusterSize     string `yaml:"pcluster-size"`
+	Label            string
+	FSUUID           string   `yaml:"fsuuid"`
+	ExtendedOptions  []string `yaml:"extended-options"`
+	Exclude          []string
+	pclusterSize     int64
+}
+
+func NewErofsAction() *ErofsAction {
+	return &ErofsAction{Compression: "lz4hc"}
+}
+
+func (e *ErofsAction) Verify(context *debos.DebosContext) error {
+	if e.File == "" {
+		return fmt.Errorf("Property 'file' is mandatory")
+	}
+
+	supported := false
+	for _, c := range erofsCompressions {
+		supported = supported || c == e.Compression
+	}
+	if !supported {
+		return fmt.Errorf("Unsupported compression '%s', possible ones are %s",
+			e.Compression, strings.Join(erofsCompressions, ", "))
+	}
+
+	if e.CompressionLevel != nil && e.Compression == "none" {
+		return fmt.Errorf("compression-level requires a compression")
+	}
+
+	if e.PclusterSize != "" {
+		size, err := parseImageSize(e.PclusterSize)
+		if err != nil || size <= 0 || size%4096 != 0 {
+			return fmt.Errorf("Invalid pcluster-size '%s', has to be a multiple of 4KiB", e.PclusterSize)
+		}
+		e.pclusterSize = size
+	}
+
+	if len(e.Label) > 16 {
+		return fmt.Errorf("Label '%s' is too long", e.Label)
+	}
+
+	if e.FSUUID != "" {
+		if _, err := uuid.Parse(e.FSUUID); err != nil {
+			return fmt.Errorf("Incorrect UUID %s", e.FSUUID)
+		}
+	}
+
+	for _, p := range e.Exclude {
+		if !path.IsAbs(p) {
+			return fmt.Errorf("Excluded path '%s' must be absolute", p)
+		}
+	}
+
+	return nil
+}
+
+func (e *ErofsAction) Run(context *debos.DebosContext) error {
+	outfile := path.Join(context.Artifactdir, e.File)
+
+	command := []string{"mkfs.erofs"}
+	if e.Compression != "none" {
+		compression := e.Compression
+		if e.CompressionLevel != nil {
+			compression = fmt.Sprintf("%s,%d", compression, *e.CompressionLevel)
+		}
+		command = append(command, "-z", compression)
+	}
+	if e.pclusterSize > 0 {
+		command = append(command, fmt.Sprintf("-C%d", e.pclusterSize))
+	}
+	if e.Label != "" {
+		command = append(command, "-L", e.Label)
+	}
+	if e.FSUUID != "" {
+		command = append(command, "-U", e.FSUUID)
+	}
+	if len(e.ExtendedOptions) > 0 {
+		command = append(command, "-E", strings.Join(e.ExtendedOptions, ","))
+	}
+	if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" {
+		command = append(command, "-T", epoch)
+	}
+	for _, p := range e.Exclude {
+		command = append(command, "--exclude-path="+strings.TrimPrefix(p, "/"))
+	}
+	command = append(command, outfile, context.Rootdir)
+
+	log.Printf("Creating EROFS image %s\n", outfile)
+	return debos.Command{}.Run("mkfs.erofs", command...)
+}
@@ -12,25 +12,60 @@ image.
  # Yaml syntax:
  - action: filesystem-deploy
    setup-fstab: bool
+   fstab-source: uuid
    setup-kernel-cmdline: bool
    append-kernel-cmdline: arguments
+   integrity-manifest: filename
+   integrity-block-size: size
 
 Optional properties:
 
 - setup-fstab -- generate '/etc/fstab' file according to information provided
 by 'image-partition' action. By default is 'true'.
 
+- fstab-source -- how the fstab entries reference the filesystems, 'uuid' for
+their filesystem UUID, 'label' for their filesystem label or 'partuuid' for
+the UUID of their partition. The mount points of 'image-partition' setting
+their own 'fstab-source' to 'label' or 'partuuid' keep it. By default is
+'uuid'.
+
 - setup-kernel-cmdline -- add location of root partition to '/etc/kernel/cmdline'
 file on target image. By default is 'true'.
 
 - append-kernel-cmdline -- additional kernel command line arguments passed to kernel.
+
+- integrity-manifest -- name of a JSON file written in the artifact directory
+with the sha256 of each block of every partition of the image, along with
+their offset, size and the sha256 of the whole partition. Bootloaders and
+updaters can verify the flashed content range by range with it. The hashes
+are computed once the build succeeded and the partitions are unmounted, so
+they match the content of the image, each partition being read once for both
+this file and the '--manifest' hashes.
+
+- integrity-block-size -- size of the hashed blocks, in human readable form,
+e.g. '64KiB', a multiple of 512 bytes. By default is '1MiB'.
+
+ # Manifest format:
+ {
+   "hash": "sha256",
+   "block-size": 1048576,
+   "partitions": [
+     {
+       "name": "root",
+       "number": 2,
+       "offset": 268435456,
+       "size": 1879048192,
+       "sha256": "...",
+       "blocks": [ "...", "..." ]
+     }
+   ]
+ }
 */
 package actions
 
 import (
 	"errors"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
 	"os"
@@ -43,17 +78,74 @@ import (
 type FilesystemDeployAction struct {
 	debos.BaseAction    `yaml:",inline"`
 	SetupFSTab          bool   `yaml:"setup-fstab"`
+	FSTabSource         string `yaml:"fstab-source"`
 	SetupKernelCmdline  bool   `yaml:"setup-kernel-cmdline"`
 	AppendKernelCmdline string `yaml:"append-kernel-cmdline"`
+	IntegrityManifest   string `yaml:"integrity-manifest"`
+	IntegrityBlockSize  string `yaml:"integrity-block-size"`
+	blockSize           int64
 }
 
 func NewFilesystemDeployAction() *FilesystemDeployAction {
-	fd := &FilesystemDeployAction{SetupFSTab: true, SetupKernelCmdline: true}
+	fd := &FilesystemDeployAction{SetupFSTab: true, FSTabSource: "uuid", SetupKernelCmdline: true}
 	fd.Description = "Deploying filesystem"
 
 	return fd
 }
 
+func (fd *FilesystemDeployAction) Verify(context *debos.DebosContext) error {
+	if fd.IntegrityManifest == "" {
+		if fd.IntegrityBlockSize != "" {
+			return errors.New("integrity-block-size requires integrity-manifest")
+		}
+		return nil
+	}
+
+	if path.IsAbs(fd.IntegrityManifest) || strings.HasPrefix(path.Clean(fd.IntegrityManifest), "..") {
+		return fmt.Errorf("Integrity manifest '%s' has to be relative to the artifact directory", fd.IntegrityManifest)
+	}
+
+	if _, ok := fstabSources[fd.FSTabSource]; !ok {
+		return fmt.Errorf("Unknown fstab-source '%s', has to be 'uuid', 'label' or 'partuuid'", fd.FSTabSource)
+	}
+
+	fd.blockSize = 1024 * 1024
+	if fd.IntegrityBlockSize != "" {
+		size, err := parseImageSize(fd.IntegrityBlockSize)
+		if err != nil || size <= 0 || size%512 != 0 {
+			return fmt.Errorf("Invalid integrity block size '%s', has to be a multiple of 512 bytes", fd.IntegrityBlockSize)
+		}
+		fd.blockSize = size
+	}
+
+	return nil
+}
+
+// Reference the filesystems of the entries by UUID with the fstab source
+func (fd *FilesystemDeployAction) fstabEntries(fstab string) (string, error) {
+	lines := strings.Split(fstab, "\n")
+	for idx, line := range lines {
+		fields := strings.SplitN(line, "\t", 2)
+		if len(fields) < 2 || !strings.HasPrefix(fields[0], "UUID=") {
+			continue
+		}
+
+		uuid := strings.TrimPrefix(fields[0], "UUID=")
+		out, err := debos.Command{}.Output("blkid", "blkid", "-U", uuid)
+		if err != nil {
+			return "", fmt.Errorf("Failed to find the filesystem %s: %v", uuid, err)
+		}
+
+		spec, err := fstabSpec(strings.TrimSpace(string(out)), fstabSources[fd.FSTabSource])
+		if err != nil {
+			return "", err
+		}
+		lines[idx] = spec + "\t" + fields[1]
+	}
+
+	return strings.Join(lines, "\n"), nil
+}
+
 func (fd *FilesystemDeployAction) setupFSTab(context *debos.DebosContext) error {
 	if context.ImageFSTab.Len() == 0 {
 		return errors.New("Fstab not generated, missing image-partition action?")
@@ -74,7 +166,14 @@ func (fd *FilesystemDeployAction) setupFSTab(context *debos.DebosContext) error
 		return fmt.Errorf("Couldn't open /etc/fstab: %v", err)
 	}
 
-	_, err = io.Copy(f, &context.ImageFSTab)
+	entries := context.ImageFSTab.String()
+	if fd.FSTabSource != "uuid" {
+		entries, err = fd.fstabEntries(entries)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = f.WriteString(entries)
 
 	if err != nil {
 		return fmt.Errorf("Couldn't write /etc/fstab: %v", err)
@@ -127,6 +226,14 @@ func (fd *FilesystemDeployAction) Run(context *debos.DebosContext) error {
 	context.Rootdir = context.ImageMntDir
 	context.Origins["filesystem"] = context.ImageMntDir
 
+	if fd.IntegrityManifest != "" {
+		context.Integrity = &debos.IntegrityManifest{
+			File:      fd.IntegrityManifest,
+			Hash:      "sha256",
+			BlockSize: fd.blockSize,
+		}
+	}
+
 	if fd.SetupFSTab {
 		err = fd.setupFSTab(context)
 		if err != nil {
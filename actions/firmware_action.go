@@ -0,0 +1,263 @@
+/*
+Firmware Action
+
+Enable the non-free firmware components of the APT sources and install the
+firmware packages needed by the listed hardware. A report of the non-free
+packages ending up in the image can be written for compliance review.
+
+ # Yaml syntax:
+ - action: firmware
+   hardware:
+     - iwlwifi
+     - amdgpu
+   packages:
+     - package
+   components:
+     - non-free-firmware
+   report: filename
+
+Optional properties:
+
+- hardware -- list of hardware (drivers or vendors) to install the firmware
+for. Known hardware is:
+ 'amdgpu', 'radeon' -- firmware-amd-graphics
+ 'iwlwifi', 'intel-bluetooth' -- firmware-iwlwifi
+ 'i915', 'nouveau', 'mediatek' -- firmware-misc-nonfree
+ 'brcmfmac', 'broadcom' -- firmware-brcm80211
+ 'ath9k', 'ath10k', 'ath11k', 'atheros' -- firmware-atheros
+ 'realtek' -- firmware-realtek
+ 'qcom' -- firmware-qcom-soc
+ 'ti-connectivity' -- firmware-ti-connectivity
+ 'libertas' -- firmware-libertas
+ 'sof' -- firmware-sof-signed
+ 'intel-microcode' -- intel-microcode
+ 'amd-microcode' -- amd64-microcode
+
+- packages -- list of additional firmware packages to install.
+
+- components -- list of components to enable in the APT sources. Defaults to
+'non-free-firmware'. Use 'non-free' for distributions older than Debian 12.
+
+- report -- name of the report file in the artifact directory, listing the
+installed packages of the 'non-free' and 'non-free-firmware' sections.
+
+At least one of 'hardware', 'packages' or 'report' has to be given. Both the
+'/etc/apt/sources.list' one-line style and the '*.sources' deb822 style
+sources are updated.
+*/
+package actions
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/go-debos/debos"
+)
+
+// Packages providing the firmware for known hardware
+var firmwarePackages = map[string]string{
+	"amdgpu":          "firmware-amd-graphics",
+	"radeon":          "firmware-amd-graphics",
+	"iwlwifi":         "firmware-iwlwifi",
+	"intel-bluetooth": "firmware-iwlwifi",
+	"i915":            "firmware-misc-nonfree",
+	"nouveau":         "firmware-misc-nonfree",
+	"mediatek":        "firmware-misc-nonfree",
+	"brcmfmac":        "firmware-brcm80211",
+	"broadcom":        "firmware-brcm80211",
+	"ath9k":           "firmware-atheros",
+	"ath10k":          "firmware-atheros",
+	"ath11k":          "firmware-atheros",
+	"atheros":         "firmware-atheros",
+	"realtek":         "firmware-realtek",
+	"qcom":            "firmware-qcom-soc",
+	"ti-connectivity": "firmware-ti-connectivity",
+	"libertas":        "firmware-libertas",
+	"sof":             "firmware-sof-signed",
+	"intel-microcode": "intel-microcode",
+	"amd-microcode":   "amd64-microcode",
+}
+
+type FirmwareAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Hardware         []string
+	Packages         []string
+	Components       []string
+	Report           string
+}
+
+func NewFirmwareAction() *FirmwareAction {
+	return &FirmwareAction{Components: []string{"non-free-firmware"}}
+}
+
+func (f *FirmwareAction) Verify(context *debos.DebosContext) error {
+	if len(f.Hardware) == 0 && len(f.Packages) == 0 && f.Report == "" {
+		return errors.New("At least one of 'hardware', 'packages' or 'report' properties is needed")
+	}
+
+	for _, h := range f.Hardware {
+		if _, found := firmwarePackages[h]; !found {
+			return fmt.Errorf("Unknown hardware '%s'", h)
+		}
+	}
+
+	return nil
+}
+
+// List of packages to install, without duplicates
+func (f *FirmwareAction) packages() []string {
+	seen := make(map[string]bool)
+	var packages []string
+
+	for _, h := range f.Hardware {
+		p := firmwarePackages[h]
+		if !seen[p] {
+			seen[p] = true
+			packages = append(packages, p)
+		}
+	}
+
+	for _, p := range f.Packages {
+		if !seen[p] {
+			seen[p] = true
+			packages = append(packages, p)
+		}
+	}
+
+	return packages
+}
+
+// Components of the action missing from the source
+func (f *FirmwareAction) missingComponents(s AptSource) []string {
+	var missing []string
+	for _, c := range f.Components {
+		found := false
+		for _, existing := range s.Components {
+			found = found || existing == c
+		}
+		if !found {
+			missing = append(missing, c)
+		}
+	}
+
+	return missing
+}
+
+/*
+Add the missing components to a source, at the end of the entry for the
+one-line style, before its comment if any, or to the 'Components' field for
+the deb822 style. Sources with a path as suite have no components.
+*/
+func (f *FirmwareAction) addComponents(text string, s AptSource, deb822 bool) string {
+	missing := f.missingComponents(s)
+	if len(s.Components) == 0 || len(missing) == 0 {
+		return text
+	}
+	added := " " + strings.Join(missing, " ")
+
+	if !deb822 {
+		entry, comment := text, ""
+		if idx := strings.Index(text, "#"); idx >= 0 {
+			entry, comment = text[:idx], " "+text[idx:]
+		}
+		return strings.TrimRight(entry, " \t") + added + comment
+	}
+
+	lines := strings.Split(text, "\n")
+	for idx, line := range lines {
+		if strings.HasPrefix(strings.ToLower(line), "components:") {
+			lines[idx] = strings.TrimRight(line, " \t") + added
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func (f *FirmwareAction) enableComponents(context *debos.DebosContext) error {
+	changed, err := editAptSources(context, f.addComponents)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range changed {
+		log.Printf("Enabling %s in %s", strings.Join(f.Components, ", "), file)
+	}
+
+	return nil
+}
+
+// List the installed non-free packages from the dpkg status database
+func nonFreePackages(context *debos.DebosContext) ([]string, error) {
+	installed, err := debos.InstalledPackages(context.Rootdir)
+	if err != nil {
+		return nil, err
+	}
+
+	var packages []string
+	for _, p := range installed {
+		if strings.HasPrefix(p.Section, "non-free") {
+			packages = append(packages, fmt.Sprintf("%s %s %s", p.Package, p.Version, p.Section))
+		}
+	}
+	sort.Strings(packages)
+
+	return packages, nil
+}
+
+func (f *FirmwareAction) Run(context *debos.DebosContext) error {
+	packages := f.packages()
+
+	if len(packages) > 0 {
+		if err := f.enableComponents(context); err != nil {
+			return err
+		}
+
+		removeProxy, err := setupAptProxy(context, "")
+		if err != nil {
+			return err
+		}
+		defer removeProxy()
+
+		apt := debos.NewAptCommand(*context, "apt")
+		if err := apt.Update(); err != nil {
+			return err
+		}
+
+		if _, err := apt.Install(packages, debos.AptInstallOptions{Recommends: true}); err != nil {
+			return err
+		}
+
+		if err := apt.Clean(); err != nil {
+			return err
+		}
+	}
+
+	nonfree, err := nonFreePackages(context)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("%d non-free packages installed", len(nonfree))
+	for _, p := range nonfree {
+		log.Printf("  %s", p)
+	}
+
+	if f.Report != "" {
+		report := "# Non-free packages: name version section\n"
+		for _, p := range nonfree {
+			report += p + "\n"
+		}
+
+		err := ioutil.WriteFile(path.Join(context.Artifactdir, f.Report), []byte(report), 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
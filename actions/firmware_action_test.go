@@ -0,0 +1,50 @@
+package actions
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFirmwareAddComponents(t *testing.T) {
+	f := FirmwareAction{Components: []string{"contrib", "non-free-firmware"}}
+
+	tests := []struct {
+		text, expected string
+		deb822         bool
+	}{
+		{
+			"deb [ arch=amd64 ] http://deb.debian.org/debian bookworm main # base",
+			"deb [ arch=amd64 ] http://deb.debian.org/debian bookworm main contrib non-free-firmware # base",
+			false,
+		},
+		{
+			"deb http://deb.debian.org/debian bookworm main contrib non-free-firmware",
+			"deb http://deb.debian.org/debian bookworm main contrib non-free-firmware",
+			false,
+		},
+		{
+			"deb http://example.com/repo ./",
+			"deb http://example.com/repo ./",
+			false,
+		},
+		{
+			"Types: deb\nURIs: http://deb.debian.org/debian\nSuites: bookworm\nComponents: main\n",
+			"Types: deb\nURIs: http://deb.debian.org/debian\nSuites: bookworm\nComponents: main contrib non-free-firmware\n",
+			true,
+		},
+	}
+
+	for _, test := range tests {
+		var sources []AptSource
+		if test.deb822 {
+			sources = parseSources([]byte(test.text))
+		} else {
+			var err error
+			sources, err = parseSourcesList([]byte(test.text))
+			assert.NoError(t, err)
+		}
+		assert.Len(t, sources, 1)
+		assert.Equal(t, test.expected, f.addComponents(test.text, sources[0], test.deb822))
+	}
+}
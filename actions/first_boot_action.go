@@ -0,0 +1,239 @@
+/*
+FirstBoot Action
+
+Install scripts to be run once on the first boot of the image. The scripts
+are run in order by a systemd service, each successful script is recorded so
+it isn't run again, and the service isn't started anymore once all scripts
+completed.
+
+ # Yaml syntax:
+ - action: first-boot
+   scripts:
+     - name: resize-rootfs
+       priority: 10
+       script: script name
+       command: command line
+       ignore-failure: bool
+
+Mandatory properties:
+
+- scripts -- list of scripts to run on first boot.
+
+   # Yaml syntax for scripts:
+   scripts:
+     - name: resize-rootfs
+       priority: 10
+       script: script name
+       command: command line
+       ignore-failure: bool
+
+Properties 'script' and 'command' are mutually exclusive, one of them is
+mandatory.
+
+- script -- script located in the recipe directory, it's copied into the
+target filesystem. The script needs to be executable.
+
+- command -- command line run with 'sh -e -c'.
+
+Optional properties:
+
+- name -- name of the script. Defaults to the base name of 'script'. Mandatory
+when 'command' is used.
+
+- priority -- scripts are run by increasing priority, then by name. Defaults
+to 50. Scripts from all first-boot actions of a recipe are run together.
+
+- ignore-failure -- continue with the following scripts if this one fails. By
+default a failure stops the first boot service, the failed script and the ones
+following it are retried on the next boot.
+
+The scripts are installed to '/usr/lib/debos-firstboot/scripts' and the
+completion markers are written to '/var/lib/debos-firstboot'. The
+'debos-firstboot.service' unit runs the scripts, it requires systemd in the
+target filesystem.
+*/
+package actions
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/go-debos/debos"
+	"github.com/go-debos/fakemachine"
+)
+
+const (
+	firstBootDir     = "/usr/lib/debos-firstboot"
+	firstBootService = "debos-firstboot.service"
+)
+
+const firstBootRunner = `#!/bin/sh
+# Generated by debos
+SCRIPTS=` + firstBootDir + `/scripts
+STATE=/var/lib/debos-firstboot
+
+mkdir -p "$STATE"
+for script in "$SCRIPTS"/*; do
+	[ -x "$script" ] || continue
+	name=$(basename "$script")
+	[ -e "$STATE/$name.done" ] && continue
+
+	echo "Running $name"
+	if "$script"; then
+		touch "$STATE/$name.done"
+		continue
+	fi
+
+	case "$name" in
+	*.ignore-failure)
+		echo "$name failed, ignoring"
+		touch "$STATE/$name.failed" "$STATE/$name.done"
+		;;
+	*)
+		echo "$name failed, retrying on next boot"
+		exit 1
+		;;
+	esac
+done
+
+touch "$STATE/done"
+`
+
+const firstBootUnit = `# Generated by debos
+[Unit]
+Description=Run first boot scripts
+ConditionPathExists=!/var/lib/debos-firstboot/done
+After=local-fs.target
+Before=getty.target
+
+[Service]
+Type=oneshot
+ExecStart=` + firstBootDir + `/run
+RemainAfterExit=yes
+StandardOutput=journal+console
+
+[Install]
+WantedBy=multi-user.target
+`
+
+type FirstBootScript struct {
+	Name          string
+	Priority      *int
+	Script        string
+	Command       string
+	IgnoreFailure bool `yaml:"ignore-failure"`
+}
+
+type FirstBootAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Scripts          []FirstBootScript
+}
+
+func (fb *FirstBootAction) Verify(context *debos.DebosContext) error {
+	if len(fb.Scripts) == 0 {
+		return errors.New("At least one script is needed for first-boot action")
+	}
+
+	names := make(map[string]bool)
+	for idx := range fb.Scripts {
+		s := &fb.Scripts[idx]
+
+		if (s.Script == "") == (s.Command == "") {
+			return errors.New("Exactly one of 'script' or 'command' is needed for first boot scripts")
+		}
+
+		if s.Name == "" {
+			if s.Script == "" {
+				return errors.New("Property 'name' is mandatory for first boot commands")
+			}
+			s.Name = path.Base(s.Script)
+		}
+
+		if strings.Contains(s.Name, "/") {
+			return fmt.Errorf("Invalid first boot script name '%s'", s.Name)
+		}
+		if names[s.Name] {
+			return fmt.Errorf("First boot script %s already exists", s.Name)
+		}
+		names[s.Name] = true
+
+		if s.Priority == nil {
+			priority := 50
+			s.Priority = &priority
+		} else if *s.Priority < 0 || *s.Priority > 99 {
+			return fmt.Errorf("Priority of first boot script %s must be between 0 and 99", s.Name)
+		}
+	}
+
+	return nil
+}
+
+func (fb *FirstBootAction) PreMachine(context *debos.DebosContext, m *fakemachine.Machine,
+	args *[]string) error {
+
+	for _, s := range fb.Scripts {
+		if s.Script != "" {
+			m.AddVolume(path.Dir(debos.CleanPathAt(s.Script, context.RecipeDir)))
+		}
+	}
+
+	return nil
+}
+
+func (fb *FirstBootAction) WatchPaths(context *debos.DebosContext) []string {
+	var paths []string
+
+	for _, s := range fb.Scripts {
+		if s.Script != "" {
+			paths = append(paths, debos.CleanPathAt(s.Script, context.RecipeDir))
+		}
+	}
+
+	return paths
+}
+
+// File name of the script, encoding its order and failure handling
+func (s *FirstBootScript) fileName() string {
+	name := fmt.Sprintf("%02d-%s", *s.Priority, s.Name)
+	if s.IgnoreFailure {
+		name += ".ignore-failure"
+	}
+	return name
+}
+
+func (fb *FirstBootAction) Run(context *debos.DebosContext) error {
+	for _, s := range fb.Scripts {
+		var data []byte
+		if s.Script != "" {
+			var err error
+			data, err = ioutil.ReadFile(debos.CleanPathAt(s.Script, context.RecipeDir))
+			if err != nil {
+				return err
+			}
+		} else {
+			data = []byte(fmt.Sprintf("#!/bin/sh -e\n%s\n", s.Command))
+		}
+
+		file := path.Join(firstBootDir, "scripts", s.fileName())
+		if err := writeRootfsFile(context, file, data, 0755); err != nil {
+			return err
+		}
+	}
+
+	// The runner and unit are identical for all first-boot actions
+	err := writeRootfsFile(context, path.Join(firstBootDir, "run"), []byte(firstBootRunner), 0755)
+	if err != nil {
+		return err
+	}
+
+	unit := path.Join("/usr/lib/systemd/system", firstBootService)
+	if err := writeRootfsFile(context, unit, []byte(firstBootUnit), 0644); err != nil {
+		return err
+	}
+
+	c := debos.NewChrootCommandForContext(*context)
+	return c.Run("first-boot", "systemctl", "enable", firstBootService)
+}
@@ -0,0 +1,147 @@
+/*
+FlashKernel Action
+
+Run flash-kernel in the target filesystem to install the boot script, device
+tree and kernel images expected by the board's bootloader.
+
+ # Yaml syntax:
+ - action: flash-kernel
+   machine: machine name
+   kernel-version: version
+   boot-partition: partition name
+   boot-path: path
+
+Optional properties:
+
+- machine -- name of the machine as listed in flash-kernel's database. It is
+written to '/etc/flash-kernel/machine' so later kernel upgrades on the device
+keep working. If unset, the machine file already present in the target
+filesystem is used.
+
+- kernel-version -- version of the kernel to install. By default flash-kernel
+picks the most recent kernel installed.
+
+- boot-partition -- name of a partition created by the image-partition action
+to mount on 'boot-path' while flash-kernel runs, in case it isn't already
+mounted there.
+
+- boot-path -- path in the target filesystem to mount 'boot-partition' on.
+Defaults to '/boot'.
+
+flash-kernel needs the 'flash-kernel' package to be installed in the target
+filesystem.
+*/
+package actions
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/go-debos/debos"
+)
+
+type FlashKernelAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Machine          string
+	KernelVersion    string `yaml:"kernel-version"`
+	BootPartition    string `yaml:"boot-partition"`
+	BootPath         string `yaml:"boot-path"`
+	mounted          string
+}
+
+func NewFlashKernelAction() *FlashKernelAction {
+	return &FlashKernelAction{BootPath: "/boot"}
+}
+
+func (fk *FlashKernelAction) Verify(context *debos.DebosContext) error {
+	if !path.IsAbs(fk.BootPath) {
+		return errors.New("Property 'boot-path' must be an absolute path")
+	}
+
+	return nil
+}
+
+func (fk *FlashKernelAction) mountBootPartition(context *debos.DebosContext) error {
+	var dev string
+	for _, p := range context.ImagePartitions {
+		if p.Name == fk.BootPartition {
+			dev = p.DevicePath
+			break
+		}
+	}
+
+	if dev == "" {
+		return fmt.Errorf("Partition %s not found", fk.BootPartition)
+	}
+
+	mntpath, err := debos.RestrictedPath(context.Rootdir, fk.BootPath)
+	if err != nil {
+		return err
+	}
+
+	fsType, err := debos.Command{}.Output("blkid", "blkid", "-o", "value", "-s", "TYPE", "-p", "-c", "none", dev)
+	if err != nil {
+		return fmt.Errorf("Failed to detect filesystem of %s: %v", fk.BootPartition, err)
+	}
+
+	os.MkdirAll(mntpath, 0755)
+	err = syscall.Mount(dev, mntpath, strings.TrimSpace(string(fsType)), 0, "")
+	if err != nil {
+		return fmt.Errorf("%s mount failed: %v", fk.BootPartition, err)
+	}
+	fk.mounted = mntpath
+
+	return nil
+}
+
+func (fk *FlashKernelAction) Run(context *debos.DebosContext) error {
+	if fk.Machine != "" {
+		machine := path.Join(context.Rootdir, "/etc/flash-kernel/machine")
+		if err := os.MkdirAll(path.Dir(machine), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(machine, []byte(fk.Machine+"\n"), 0644); err != nil {
+			return err
+		}
+	}
+
+	if fk.BootPartition != "" {
+		if err := fk.mountBootPartition(context); err != nil {
+			return err
+		}
+	}
+
+	c := debos.NewChrootCommandForContext(*context)
+	c.AddEnv("DEBIAN_FRONTEND=noninteractive")
+	// flash-kernel refuses to do anything in a chroot unless forced
+	c.AddEnv("FK_FORCE=yes")
+	if fk.Machine != "" {
+		c.AddEnvKey("FK_MACHINE", fk.Machine)
+	}
+
+	cmdline := []string{"flash-kernel"}
+	if fk.KernelVersion != "" {
+		cmdline = append(cmdline, fk.KernelVersion)
+	}
+
+	return c.Run("flash-kernel", cmdline...)
+}
+
+func (fk *FlashKernelAction) Cleanup(context *debos.DebosContext) error {
+	if fk.mounted == "" {
+		return nil
+	}
+
+	if err := syscall.Unmount(fk.mounted, 0); err != nil {
+		log.Printf("Warning: Failed to unmount %s: %s", fk.mounted, err)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,227 @@
+/*
+Git Action
+
+Clone a git repository and make its working tree available to the following
+actions as a named origin, e.g. for overlays, kernel sources or configuration
+trees maintained in git.
+
+ # Yaml syntax:
+ - action: git
+   name: name
+   url: https://example.com/repo.git
+   ref: main
+   commit: sha1
+   depth: 1
+   submodules: bool
+   token-env: GIT_TOKEN
+   token-user: x-access-token
+   keep-git-dir: bool
+
+Mandatory properties:
+
+- name -- string which allows to use the working tree in other actions via
+the 'origin' property.
+
+- url -- URL of the repository.
+
+Optional properties:
+
+- ref -- branch or tag to check out. Defaults to the default branch of the
+repository.
+
+- commit -- full commit ID to check out, the server has to allow fetching
+commits by ID, as GitHub and GitLab do. Takes precedence over 'ref'.
+
+- depth -- number of commits of the history to fetch, 0 for the complete
+history. Default 1.
+
+- submodules -- check out the submodules as well, recursively. Default 'false'.
+
+- token-env -- name of the environment variable holding a token to
+authenticate to the server over HTTPS. Pass it with '--environ-var' when
+running in fakemachine. The token isn't written to the command lines and is
+only sent to the URLs starting with 'url', so submodules hosted elsewhere
+don't get it.
+
+- token-user -- user name sent with the token. Defaults to 'x-access-token'
+as used by GitHub, GitLab expects 'oauth2'.
+
+- keep-git-dir -- keep the '.git' directory in the working tree. By default
+it's removed, so overlays of the working tree don't copy it to the image.
+
+With '--update-lock' the commit the reference resolved to is recorded in the
+lock file, and with '--locked' that commit is checked out.
+*/
+package actions
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/go-debos/debos"
+)
+
+type GitAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Name             string
+	Url              string
+	Ref              string
+	Commit           string
+	Depth            int
+	Submodules       bool
+	TokenEnv         string `yaml:"token-env"`
+	TokenUser        string `yaml:"token-user"`
+	KeepGitDir       bool   `yaml:"keep-git-dir"`
+}
+
+func NewGitAction() *GitAction {
+	return &GitAction{Depth: 1, TokenUser: "x-access-token"}
+}
+
+func (g *GitAction) Verify(context *debos.DebosContext) error {
+	if g.Name == "" || strings.Contains(g.Name, "/") {
+		return errors.New("Property 'name' must be a valid file name")
+	}
+
+	if g.Url == "" {
+		return errors.New("Property 'url' is mandatory")
+	}
+
+	if g.Commit != "" && (len(g.Commit) != 40 || strings.Trim(strings.ToLower(g.Commit), "0123456789abcdef") != "") {
+		return fmt.Errorf("Invalid commit '%s', a full commit ID is needed", g.Commit)
+	}
+
+	if g.Depth < 0 {
+		return errors.New("Property 'depth' can't be negative")
+	}
+
+	return nil
+}
+
+// Git command authenticating with the token, if any
+func (g *GitAction) command(context *debos.DebosContext) (debos.Command, error) {
+	cmd := debos.Command{}
+	if g.TokenEnv == "" {
+		return cmd, nil
+	}
+
+	token, found := context.EnvironVars[g.TokenEnv]
+	if !found {
+		token, found = os.LookupEnv(g.TokenEnv)
+	}
+	if !found || token == "" {
+		return cmd, fmt.Errorf("Environment variable %s holding the token isn't set", g.TokenEnv)
+	}
+
+	// Passed through the environment to stay out of the logs, and only sent
+	// to the repository, not to the other hosts of the submodules
+	credentials := base64.StdEncoding.EncodeToString([]byte(g.TokenUser + ":" + token))
+	cmd.AddEnvKey("GIT_CONFIG_COUNT", "1")
+	cmd.AddEnvKey("GIT_CONFIG_KEY_0", "http."+g.Url+".extraHeader")
+	cmd.AddEnvKey("GIT_CONFIG_VALUE_0", "Authorization: Basic "+credentials)
+
+	return cmd, nil
+}
+
+func (g *GitAction) Run(context *debos.DebosContext) error {
+	git, err := g.command(context)
+	if err != nil {
+		return err
+	}
+
+	commit := g.Commit
+	if commit == "" && context.Lock != nil {
+		if commit, err = context.Lock.LockedCommit(g.Url, g.Ref); err != nil {
+			return err
+		}
+		if !context.Lock.Enforced() {
+			commit = ""
+		}
+	}
+
+	dir := path.Join(context.Scratchdir, "git-"+g.Name)
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+
+	fetch := []string{"git", "-C", dir, "fetch"}
+	if g.Depth > 0 {
+		fetch = append(fetch, "--depth", strconv.Itoa(g.Depth))
+	}
+	fetch = append(fetch, "origin")
+
+	switch {
+	case commit != "":
+		fetch = append(fetch, commit)
+	case g.Ref != "":
+		fetch = append(fetch, g.Ref)
+	default:
+		fetch = append(fetch, "HEAD")
+	}
+
+	steps := [][]string{
+		{"git", "init", "--quiet", dir},
+		{"git", "-C", dir, "remote", "add", "origin", g.Url},
+		fetch,
+		{"git", "-C", dir, "checkout", "--quiet", "--detach", "FETCH_HEAD"},
+	}
+
+	if g.Submodules {
+		submodules := []string{"git", "-C", dir, "submodule", "update", "--init", "--recursive"}
+		if g.Depth > 0 {
+			submodules = append(submodules, "--depth", strconv.Itoa(g.Depth))
+		}
+		steps = append(steps, submodules)
+	}
+
+	for _, step := range steps {
+		if err := git.Run("git", step...); err != nil {
+			return err
+		}
+	}
+
+	out, err := debos.Command{}.Output("git rev-parse", "git", "-C", dir, "rev-parse", "HEAD")
+	if err != nil {
+		return fmt.Errorf("Failed to get the checked out commit: %v", err)
+	}
+	head := strings.TrimSpace(string(out))
+	log.Printf("Checked out %s at %s", g.Url, head)
+
+	if commit != "" && head != strings.ToLower(commit) {
+		return fmt.Errorf("Checked out commit %s instead of %s", head, commit)
+	}
+
+	if context.Lock != nil && !context.Lock.Enforced() {
+		context.Lock.Checkout(g.Url, g.Ref, head)
+	}
+
+	// Submodules have their own .git files
+	if !g.KeepGitDir {
+		err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+			if err != nil || info.Name() != ".git" {
+				return err
+			}
+			if err := os.RemoveAll(p); err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	context.Origins[g.Name] = dir
+
+	return nil
+}
@@ -0,0 +1,161 @@
+/*
+GrubInstall Action
+
+Install GRUB to the image and generate its configuration. For BIOS targets
+GRUB is embedded in the image's boot sector and partition gap, for EFI targets
+it's installed to the EFI system partition. This action requires
+'image-partition' action to be executed before it, the GRUB packages for the
+target have to be installed in the target filesystem.
+
+ # Yaml syntax:
+ - action: grub-install
+   target: x86_64-efi
+   efi-directory: path
+   bootloader-id: name
+   removable: bool
+   modules:
+     - module
+   setup-kernel-root: bool
+   cmdline: arguments
+   timeout: seconds
+
+Mandatory properties:
+
+- target -- GRUB platform to install, e.g. 'i386-pc' for BIOS or
+'x86_64-efi', 'i386-efi', 'arm64-efi', 'arm-efi', 'riscv64-efi' for EFI.
+
+Optional properties:
+
+- efi-directory -- mount point of the EFI system partition in the target
+filesystem. Defaults to '/boot/efi'. Only used for EFI targets.
+
+- bootloader-id -- name of the bootloader directory on the EFI system
+partition. Defaults to 'debian'. Only used for EFI targets.
+
+- removable -- install GRUB to the removable media path of the EFI system
+partition (e.g. '/EFI/BOOT/BOOTX64.EFI') so no NVRAM entry is needed. Defaults
+to 'true'. Only used for EFI targets.
+
+- modules -- list of additional GRUB modules to preload, e.g. when GRUB can't
+probe the partition table of the build device.
+
+- setup-kernel-root -- add location of root partition as given by the
+'image-partition' action to the kernel command line. By default is 'true'.
+
+- cmdline -- additional kernel command line arguments.
+
+- timeout -- time in seconds the GRUB menu is shown.
+
+The kernel command line and timeout are written to
+'/etc/default/grub.d/debos.cfg' before generating '/boot/grub/grub.cfg' with
+'grub-mkconfig', so they are kept when the configuration is regenerated on the
+device.
+*/
+package actions
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/go-debos/debos"
+)
+
+type GrubInstallAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Target           string
+	EFIDirectory     string `yaml:"efi-directory"`
+	BootloaderID     string `yaml:"bootloader-id"`
+	Removable        bool
+	Modules          []string
+	SetupKernelRoot  bool `yaml:"setup-kernel-root"`
+	Cmdline          string
+	Timeout          *int
+}
+
+func NewGrubInstallAction() *GrubInstallAction {
+	g := GrubInstallAction{}
+	g.EFIDirectory = "/boot/efi"
+	g.BootloaderID = "debian"
+	g.Removable = true
+	g.SetupKernelRoot = true
+
+	return &g
+}
+
+func (g *GrubInstallAction) isEFI() bool {
+	return strings.HasSuffix(g.Target, "-efi")
+}
+
+func (g *GrubInstallAction) Verify(context *debos.DebosContext) error {
+	switch g.Target {
+	case "i386-pc":
+	case "x86_64-efi", "i386-efi", "arm64-efi", "arm-efi", "riscv64-efi":
+		if !path.IsAbs(g.EFIDirectory) {
+			return errors.New("Property 'efi-directory' must be an absolute path")
+		}
+	default:
+		return fmt.Errorf("Unsupported GRUB target '%s'", g.Target)
+	}
+
+	if g.Timeout != nil && *g.Timeout < 0 {
+		return errors.New("Timeout can't be negative")
+	}
+
+	return nil
+}
+
+func (g *GrubInstallAction) defaults(context *debos.DebosContext) []byte {
+	var cmdline []string
+
+	if g.SetupKernelRoot && context.ImageKernelRoot != "" {
+		cmdline = append(cmdline, context.ImageKernelRoot)
+	}
+	if g.Cmdline != "" {
+		cmdline = append(cmdline, strings.TrimSpace(g.Cmdline))
+	}
+
+	config := "# Generated by debos\n"
+	// grub-mkconfig adds the root of the build device, the last root= wins
+	config += fmt.Sprintf("GRUB_CMDLINE_LINUX=\"$GRUB_CMDLINE_LINUX %s\"\n",
+		strings.Replace(strings.Join(cmdline, " "), `"`, `\"`, -1))
+	if g.Timeout != nil {
+		config += fmt.Sprintf("GRUB_TIMEOUT=%d\n", *g.Timeout)
+	}
+
+	return []byte(config)
+}
+
+func (g *GrubInstallAction) Run(context *debos.DebosContext) error {
+	if context.Image == "" {
+		return errors.New("grub-install action requires an image")
+	}
+
+	cmdline := []string{"grub-install", "--target=" + g.Target}
+	if len(g.Modules) > 0 {
+		cmdline = append(cmdline, "--modules="+strings.Join(g.Modules, " "))
+	}
+
+	if g.isEFI() {
+		cmdline = append(cmdline, "--efi-directory="+g.EFIDirectory,
+			"--bootloader-id="+g.BootloaderID, "--no-nvram")
+		if g.Removable {
+			cmdline = append(cmdline, "--removable")
+		}
+	} else {
+		cmdline = append(cmdline, context.Image)
+	}
+
+	c := debos.NewChrootCommandForContext(*context)
+	if err := c.Run("grub-install", cmdline...); err != nil {
+		return err
+	}
+
+	err := writeRootfsFile(context, "/etc/default/grub.d/debos.cfg", g.defaults(context), 0644)
+	if err != nil {
+		return err
+	}
+
+	return c.Run("grub-mkconfig", "grub-mkconfig", "-o", "/boot/grub/grub.cfg")
+}
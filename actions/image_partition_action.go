@@ -14,6 +14,15 @@ order in the recipe does not matter.
    partitiontype: gpt
    diskid: string
    gpt_gap: offset
+   compression: zstd
+   uuid-seed: string
+   sector-size: 4096
+   shrink: bool
+   shrink-margin: size
+   sparse: bool
+   bmap: bool
+   android-sparse: filename
+   layout-file: file
    partitions:
      <list of partitions>
    mountpoints:
@@ -45,6 +54,73 @@ should be in GUID format (e.g.: '00002222-4444-6666-AAAA-BBBBCCCCFFFF' where eac
 character is an hexadecimal digit). For 'msdos' partition table, 'diskid' should be
 a 32 bits hexadecimal number (e.g. '1234ABCD' without any dash separator).
 
+- compression -- compress the image once the build is done, with 'gz', 'xz'
+or 'zstd', or 'none'. Default 'none'. The compressed image is named after the
+compression, e.g. 'image.img.zst'. The raw image is released while it's
+compressed, so the disk only has to hold about one image, and it's lost if
+the compression fails. The image is compressed once the post-processing
+stages of all the actions are done, so they see the raw image.
+
+- sector-size -- logical sector size of the image in bytes, '512', '1024',
+'2048' or '4096', e.g. '4096' for the NVMe or UFS storages whose firmware
+rejects a GPT laid out for 512 bytes sectors. The loop device, the partition
+table and the offsets given in sectors, e.g. '2048s', use it. It sets the
+'sectorsize' of the recipe, which can be omitted, both have to agree if given.
+Default is the 'sectorsize' of the recipe, '512' by default.
+
+- shrink -- once the build is done, shrink all the ext2, ext3 and ext4
+partitions to their content plus 'shrink-margin' as the 'shrink' property of
+the partitions does, move the partitions following the first shrunk one back
+so they are contiguous, aligned on 1MiB, and truncate the image after the last
+one. 'imagesize' is then only the size the image has during the build. The
+partitions expected at fixed offsets, e.g. by the firmware, have to precede
+the shrunk ones. Not supported with logical partitions. Default 'false'.
+
+- shrink-margin -- free space left in the partitions shrunk by the image
+'shrink' property, in human readable form, e.g. '256MB', overridden by the
+'shrink-margin' of the partitions. Default '0'.
+
+- sparse -- turn the zeroed blocks of the image into holes once the build is
+done, so the image only takes the space of its content on disk. Tools copying
+it have to preserve the holes, e.g. 'cp --sparse=always', 'rsync --sparse' or
+'bmaptool copy'. Not supported with 'compression', which already drops the
+zeroes. Default 'false'.
+
+- bmap -- create the block map of the image with 'bmaptool create', named
+after the image with the '.bmap' suffix, e.g. 'image.img.bmap', so
+'bmaptool copy' only writes the blocks holding data when flashing the image,
+compressed or not. The zeroed blocks of the image are turned into holes first,
+as with 'sparse', so they aren't part of the map. Default 'false'.
+
+- android-sparse -- name of an Android sparse image of the whole image to
+create with 'img2simg', relative to the artifact directory, e.g.
+'image.simg' for flashing it with fastboot. The raw image is kept.
+
+- layout-file -- take the partitions and their mount points from an existing
+layout definition instead of 'partitions', relative to the recipe directory:
+a Yocto wic kickstart file, named '*.wks', or a systemd-repart directory of
+'*.conf' files. The partitions are laid out one after the other from their
+sizes, aligned on 1MiB or on the wks '--align', starting at 1MiB unless a wks
+'--offset' is given, only the last partition can lack a size to fill the
+image. The wks partition table is the one of the 'bootloader --ptable'
+option, 'msdos' by default, repart uses 'gpt'. The wic sources and the
+repart 'CopyFiles', 'Encrypt' or 'Verity' aren't supported, the content comes
+from the recipe, and the sizes computed from the content aren't either, the
+repart partitions use 'SizeMinBytes', or 'SizeMaxBytes'. The recipe
+'mountpoints' are added to the imported ones.
+
+- uuid-seed -- derive the disk identifier, the partitions UUIDs and the
+filesystems UUIDs which aren't set explicitly from this string, so they are
+the same on every build, e.g. '{{ $suite }}-{{ $board }}'. The UUIDs of
+filesystems which can't be set, e.g. 'hfs', stay random.
+
+Once the partitions are created, their identifiers are registered as
+'<partition>_fsuuid', '<partition>_partuuid' and '<partition>_partlabel' for
+the later actions, with the characters other than letters, digits and '_' of
+the partition name replaced by '_', e.g. '{{ registered "root_partuuid" }}'
+for a kernel command line 'root=PARTUUID=...'. The partition UUID and label
+are only registered for GPT partition tables.
+
    # Yaml syntax for partitions:
    partitions:
      - name: partition name
@@ -55,11 +131,16 @@ a 32 bits hexadecimal number (e.g. '1234ABCD' without any dash separator).
 	   end: offset
 	   features: list of filesystem features
 	   extendedoptions: list of filesystem extended options
+	   mkfs-options: list of mkfs arguments
 	   flags: list of flags
 	   fsck: bool
 	   fsuuid: string
 	   partuuid: string
 	   partattrs: list of partition attribute bits to set
+	   shrink: bool
+	   shrink-margin: size
+	   logical: bool
+	   android-sparse: filename
 
 Mandatory properties:
 
@@ -86,8 +167,8 @@ to the `name` property of the partition. May only be used for GPT partitions.
 - fslabel -- label for the filesystem. Defaults
 to the `name` property of the partition. The filesystem label can be up to 11
 characters long for {v}fat{12|16|32}, 16 characters long for ext2/3/4, 255
-characters long for btrfs, 512 characters long for hfs/hfsplus and 12 characters
-long for xfs.
+characters long for btrfs, 512 characters long for f2fs, 255 characters long for
+hfs/hfsplus and 12 characters long for xfs.
 
 - parttype -- set the partition type in the partition table. The string should
 be in a hexadecimal format (2-characters) for msdos partition tables and GUID format
@@ -97,8 +178,16 @@ GPT sets the partition type to Linux Swap.
 For msdos partition types hex codes see: https://en.wikipedia.org/wiki/Partition_type
 For gpt partition type GUIDs see: https://systemd.io/DISCOVERABLE_PARTITIONS/
 
+For GPT partition tables, the types of the Discoverable Partitions
+Specification can also be given by name, so systemd-gpt-auto-generator finds
+the partitions without an fstab: 'esp', 'xbootldr', 'swap', 'home', 'srv',
+'var', 'tmp' and 'linux-generic', and 'root', 'usr', 'root-verity' and
+'usr-verity' for the architecture of the recipe. The latter can be suffixed
+with another Debian architecture, e.g. 'root-arm64'.
+
 - features -- list of additional filesystem features which need to be enabled
-for partition.
+for partition. For f2fs, e.g. 'extra_attr', 'inode_checksum', 'sb_checksum' or
+'compression', see mkfs.f2fs(8).
 
 - flags -- list of additional flags for partition compatible with parted(8)
 'set' command.
@@ -112,12 +201,16 @@ ChromeOS Kernel partitions (GUID=fe3a2a5d-4f32-41a7-b725-accc3285a309) use bit
 bootable, thus bits 56 and 48 need to be set through this property in order to
 be able to boot a ChromeOS Kernel partition on a Chromebook, like so:
 'partattrs: [56, 48]'.
+The attributes can also be given by name: 'required' (bit 0), 'no-block-io'
+(bit 1), 'legacy-bios-bootable' (bit 2), and the ones of the Discoverable
+Partitions Specification 'grow-file-system' (bit 59), 'read-only' (bit 60) and
+'no-auto' (bit 63), e.g. 'partattrs: [ read-only, no-auto ]'.
 
 - fsck -- if set to `false` -- then set fs_passno (man fstab) to 0 meaning no filesystem
 checks in boot time. By default is set to `true` allowing checks on boot.
 
 - fsuuid -- file system UUID string. This option is only supported for btrfs,
-ext2, ext3, ext4 and xfs.
+ext2, ext3, ext4, f2fs and xfs.
 
 - partuuid -- GPT partition UUID string.
 A version 5 UUID can be easily generated using the uuid5 template function
@@ -126,13 +219,48 @@ any string, to generate reproducible UUID value pass a fixed value of namespace
 and data.
 
 - extendedoptions -- list of additional filesystem extended options which need
-to be enabled for the partition.
+to be enabled for the partition. Not supported for f2fs, which has no extended
+options.
+
+- mkfs-options -- list of additional arguments of the mkfs command formatting
+the partition, passed as is after the ones set by debos, for the options debos
+doesn't provide, e.g. '[ "-O", "^metadata_csum", "-I", "128" ]' for ext4 read
+by old bootloaders, '[ "-s", "8" ]' for the cluster size of vfat or
+'[ "-d", "single", "-m", "dup" ]' for the profiles of btrfs. See the man page
+of the mkfs command of the filesystem.
+
+- shrink -- once the build is done, check the filesystem with 'e2fsck -fy',
+shrink it to its minimal size plus 'shrink-margin' with 'resize2fs' and shrink
+the partition to the filesystem, aligned on 1MiB. If it's the last partition,
+the image is truncated after it, giving the smallest image to flash. The
+partition and the filesystem can be grown on the device, e.g. with
+'systemd-repart' and the 'x-systemd.growfs' mount option, or 'growpart' and
+'resize2fs'. Only supported for ext2, ext3 and ext4.
+
+- shrink-margin -- free space left in the shrunk filesystem, in human readable
+form, e.g. '64MB'. Default '0'.
+
+- logical -- create the partition as a logical partition of the extended
+partition, for msdos partition tables. The logical partitions have to follow
+the primary partitions, at most 3, and an extended partition named 'extended'
+is added from the start of the first logical partition to the end of the last
+one. Logical partitions are numbered from 5, whatever the number of primary
+partitions. Without any logical partition, the partitions after the third one
+are logical if there are more than 4 partitions.
+
+- android-sparse -- name of an Android sparse image of the partition to create
+with 'img2simg' once the build succeeded, relative to the artifact directory,
+e.g. 'rootfs.simg' for 'fastboot flash rootfs rootfs.simg'.
 
    # Yaml syntax for mount points:
    mountpoints:
      - mountpoint: path
 	   partition: partition label
 	   options: list of options
+	   x-systemd: list of systemd options
+	   fstab-source: uuid
+	   dump: 0
+	   pass: 2
 	   buildtime: bool
 
 Mandatory properties:
@@ -147,6 +275,21 @@ Optional properties:
 
 - options -- list of options to be added to appropriate entry in fstab file.
 
+- x-systemd -- list of systemd mount options added to the fstab entry without
+their 'x-systemd.' prefix, e.g. '[ growfs, "device-timeout=10s" ]'. See
+systemd.mount(5).
+
+- fstab-source -- how the fstab entry references the filesystem, 'uuid' for
+its filesystem UUID, 'label' for its filesystem label or 'partuuid' for the
+UUID of its partition. By default the filesystem UUID is used, which the
+'fstab-source' property of 'filesystem-deploy' can change.
+
+- dump -- dump field of the fstab entry. Default '0'.
+
+- pass -- fsck pass field of the fstab entry, overriding the one derived from
+the 'fsck' property of the partition, '1' for the root and '2' for the other
+mount points of the partitions checked.
+
 - buildtime -- if set to true then the mountpoint only used during the debos run.
 No entry in `/etc/fstab` will be created.
 The mountpoints directory will be removed from the image, so it is recommended
@@ -175,6 +318,11 @@ Defaults to false.
        start: 64MB
        end: 100%
        flags: [ boot ]
+
+When debos is run with '--manifest', the sha256 of each partition and of the
+logical content of each mounted filesystem are recorded in the manifest, so
+'--verify-manifest' can tell which partitions of a rebuild aren't
+reproducible.
 */
 package actions
 
@@ -186,6 +334,8 @@ import (
 	"github.com/go-debos/fakemachine"
 	"github.com/google/uuid"
 	"github.com/freddierice/go-losetup/v2"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
@@ -215,16 +365,26 @@ type Partition struct {
 	Flags           []string
 	Features        []string
 	ExtendedOptions []string
+	MkfsOptions     []string `yaml:"mkfs-options"`
 	Fsck            bool "fsck"
 	FSUUID          string
+	Shrink          bool
+	ShrinkMargin    string `yaml:"shrink-margin"`
+	Logical         bool
+	AndroidSparse   string `yaml:"android-sparse"`
+	extended        bool
 }
 
 type Mountpoint struct {
-	Mountpoint string
-	Partition  string
-	Options    []string
-	Buildtime  bool
-	part       *Partition
+	Mountpoint  string
+	Partition   string
+	Options     []string
+	XSystemd    []string `yaml:"x-systemd"`
+	FSTabSource string   `yaml:"fstab-source"`
+	Dump        int
+	Pass        *int
+	Buildtime   bool
+	part        *Partition
 }
 
 type imageLocker struct {
@@ -251,6 +411,15 @@ type ImagePartitionAction struct {
 	PartitionType    string
 	DiskID           string
 	GptGap           string "gpt_gap"
+	Compression      string
+	UUIDSeed         string `yaml:"uuid-seed"`
+	SectorSize       int    `yaml:"sector-size"`
+	Shrink           bool
+	ShrinkMargin     string `yaml:"shrink-margin"`
+	Sparse           bool
+	Bmap             bool
+	AndroidSparse    string `yaml:"android-sparse"`
+	LayoutFile       string `yaml:"layout-file"`
 	Partitions       []Partition
 	Mountpoints      []Mountpoint
 	size             int64
@@ -258,6 +427,259 @@ type ImagePartitionAction struct {
 	usingLoop        bool
 }
 
+// GPT partition types of the Discoverable Partitions Specification
+var gptTypes = map[string]string{
+	"esp":           "C12A7328-F81F-11D2-BA4B-00A0C93EC93B",
+	"xbootldr":      "BC13C2FF-59E6-4262-A352-B275FD6F7172",
+	"swap":          "0657FD6D-A4AB-43C4-84E5-0933C84B4F4F",
+	"home":          "933AC7E1-2EB4-4F13-B844-0E14E2AEF915",
+	"srv":           "3B8F8425-20E0-4F3B-907F-1A25A76F98E8",
+	"var":           "4D21B016-B534-45C2-A9FB-5C16E091FD2D",
+	"tmp":           "7EC6F557-3BC5-4ACA-B293-16EF5DF639D1",
+	"linux-generic": "0FC63DAF-8483-4772-8E79-3D69D8477DE4",
+}
+
+// Architecture specific GPT partition types, by Debian architecture
+var gptArchTypes = map[string]map[string]string{
+	"root": {
+		"amd64":   "4F68BCE3-E8CD-4DB1-96E7-FBCAF984B709",
+		"i386":    "44479540-F297-41B2-9AF7-D131D5F0458A",
+		"arm64":   "B921B045-1DF0-41C3-AF44-4C6F280D3FAE",
+		"armhf":   "69DAD710-2CE4-4E3C-B16C-21A1D49ABED3",
+		"armel":   "69DAD710-2CE4-4E3C-B16C-21A1D49ABED3",
+		"riscv64": "72EC70A6-CF74-40E6-BD49-4BDA08E8F224",
+		"ppc64el": "C31C45E6-3F39-412E-80FB-4809C4980599",
+		"s390x":   "5EEAD9A9-FE09-4A1E-A1D7-520D00531306",
+		"loong64": "77055800-792C-4F94-B39A-98C91B762BB6",
+	},
+	"usr": {
+		"amd64":   "8484680C-9521-48C6-9C11-B0720656F69E",
+		"i386":    "75250D76-8CC6-458E-BD66-BD47CC81A812",
+		"arm64":   "B0E01050-EE5F-4390-949A-9101B17104E9",
+		"armhf":   "7D0359A3-02B3-4F0A-865C-654403E70625",
+		"armel":   "7D0359A3-02B3-4F0A-865C-654403E70625",
+		"riscv64": "BEAEC34B-8442-439B-A40B-984381ED097D",
+		"ppc64el": "15BB03AF-77E7-4D4A-B12B-C0D084F7491C",
+		"s390x":   "8A4F5770-50AA-4ED3-874A-99B710DB6FEA",
+		"loong64": "E611C702-575C-4CBE-9A46-434FA0BF7E3F",
+	},
+	"root-verity": {
+		"amd64":   "2C7357ED-EBD2-46D9-AEC1-23D437EC2BF5",
+		"i386":    "D13C5D3B-B5D1-422A-B29F-9454FDC89D76",
+		"arm64":   "DF3300CE-D69F-4C92-978C-9BFB0F38D820",
+		"armhf":   "7386CDF2-203C-47A9-A498-F2ECCE45A2D6",
+		"armel":   "7386CDF2-203C-47A9-A498-F2ECCE45A2D6",
+		"riscv64": "B6ED5582-440B-4209-B8DA-5FF7C419EA3D",
+		"ppc64el": "906BD944-4589-4AAE-A4E4-DD983917446A",
+		"s390x":   "B325BFBE-C7BE-4AB8-8357-139E652D2F6B",
+		"loong64": "F3393B22-E9AF-4613-A948-9D3BFBD0C535",
+	},
+	"usr-verity": {
+		"amd64":   "77FF5F63-E7B6-4633-ACF4-1565B864C0E6",
+		"i386":    "8F461B0D-14EE-4E81-9AA9-049B6FB97ABD",
+		"arm64":   "6E11A4E7-FBCA-4DED-B9E9-E1A512BB664E",
+		"armhf":   "C215D751-7BCD-4649-BE90-6627490A4C05",
+		"armel":   "C215D751-7BCD-4649-BE90-6627490A4C05",
+		"riscv64": "8F1056BE-9B05-47C4-81D6-BE53128E5B54",
+		"ppc64el": "EE2B9983-21E8-4153-86D9-B6901A54D1CE",
+		"s390x":   "31741CC4-1A2A-4111-A581-E00B447D2D06",
+		"loong64": "F46B2C26-59AE-48F0-9106-C50ED47F673D",
+	},
+}
+
+// Named GPT partition attributes and their bit
+var gptAttrs = map[string]string{
+	"required":             "0",
+	"no-block-io":          "1",
+	"legacy-bios-bootable": "2",
+	"grow-file-system":     "59",
+	"read-only":            "60",
+	"no-auto":              "63",
+}
+
+/*
+GUID of a named GPT partition type, e.g. 'esp', 'root' for the architecture
+of the recipe or 'root-arm64' for another one.
+*/
+func gptPartType(name string, arch string) (string, bool) {
+	if t, ok := gptTypes[name]; ok {
+		return t, true
+	}
+
+	if types, ok := gptArchTypes[name]; ok {
+		t, ok := types[arch]
+		return t, ok
+	}
+
+	for kind, types := range gptArchTypes {
+		if t, ok := types[strings.TrimPrefix(name, kind+"-")]; ok && strings.HasPrefix(name, kind+"-") {
+			return t, true
+		}
+	}
+
+	return "", false
+}
+
+// Calculate the size based on the unit (binary or decimal)
+// binary units are multiples of 1024 - KiB, MiB, GiB, TiB, PiB
+// decimal units are multiples of 1000 - KB, MB, GB, TB, PB
+func parseImageSize(size string) (int64, error) {
+	if regexp.MustCompile(`^[0-9.]+[kmgtp]ib+$`).MatchString(strings.ToLower(size)) {
+		return units.RAMInBytes(size)
+	}
+
+	return units.FromHumanSize(size)
+}
+
+// Estimated offset of a partition start or end, e.g. '0%', '2048s' or '256MiB'
+func (i ImagePartitionAction) offset(value string, sectorSize int) (int64, error) {
+	value = strings.TrimSpace(value)
+	switch {
+	case strings.HasSuffix(value, "%"):
+		pct, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+		return int64(pct * float64(i.size) / 100), err
+	case strings.HasSuffix(value, "s"):
+		sectors, err := strconv.ParseInt(strings.TrimSuffix(value, "s"), 10, 64)
+		return sectors * int64(sectorSize), err
+	}
+
+	// Plain numbers are megabytes for parted
+	if n, err := strconv.ParseFloat(value, 64); err == nil {
+		return int64(n * 1000 * 1000), nil
+	}
+
+	return parseImageSize(value)
+}
+
+// Problems of the partitions layout: overlapping, empty or past the image end
+func (i ImagePartitionAction) layoutProblems(sectorSize int) []string {
+	var problems []string
+
+	size, err := parseImageSize(i.ImageSize)
+	if err != nil {
+		return []string{fmt.Sprintf("Invalid image size '%s'", i.ImageSize)}
+	}
+	i.size = size
+
+	type extent struct {
+		name       string
+		start, end int64
+	}
+	var extents []extent
+	for _, p := range i.Partitions {
+		start, serr := i.offset(p.Start, sectorSize)
+		end, eerr := i.offset(p.End, sectorSize)
+		if serr != nil || eerr != nil {
+			continue
+		}
+
+		switch {
+		case start >= end:
+			problems = append(problems, fmt.Sprintf("Partition %s ends before it starts", p.Name))
+		case end > size:
+			problems = append(problems, fmt.Sprintf("Partition %s ends after the end of the image", p.Name))
+		}
+
+		for _, e := range extents {
+			if start < e.end && e.start < end {
+				problems = append(problems, fmt.Sprintf("Partitions %s and %s overlap", e.name, p.Name))
+			}
+		}
+		extents = append(extents, extent{p.Name, start, end})
+	}
+
+	return problems
+}
+
+/*
+Layout describes the image and its partitions with their estimated offsets, as
+planned by a verified action.
+*/
+func (i ImagePartitionAction) Layout(context *debos.DebosContext) []string {
+	layout := []string{fmt.Sprintf("%s: %s, %s partition table", i.ImageName,
+		units.BytesSize(float64(i.size)), i.PartitionType)}
+
+	for _, p := range i.Partitions {
+		line := fmt.Sprintf("%s: %s - %s", p.Name, p.Start, p.End)
+
+		start, serr := i.offset(p.Start, context.SectorSize)
+		end, eerr := i.offset(p.End, context.SectorSize)
+		if serr == nil && eerr == nil {
+			line += fmt.Sprintf(" (%s)", units.BytesSize(float64(end-start)))
+		}
+
+		line += ", " + p.FS
+		for _, m := range i.Mountpoints {
+			if m.Partition == p.Name {
+				line += ", mounted on " + m.Mountpoint
+			}
+		}
+		layout = append(layout, line)
+	}
+
+	return layout
+}
+
+var registeredPartitionRegex = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// Derive the identifiers not set from the seed, in the format of the table and filesystem
+func (i *ImagePartitionAction) deriveUUIDs() {
+	namespace := uuid.NewSHA1(uuid.NameSpaceOID, []byte(i.UUIDSeed))
+	derive := func(kind string, name string) string {
+		return uuid.NewSHA1(namespace, []byte(kind+"/"+name)).String()
+	}
+
+	if i.DiskID == "" {
+		i.DiskID = derive("diskid", "")
+		if i.PartitionType == "msdos" {
+			i.DiskID = i.DiskID[:8]
+		}
+	}
+
+	for idx := range i.Partitions {
+		p := &i.Partitions[idx]
+
+		if p.PartUUID == "" && i.PartitionType == "gpt" {
+			p.PartUUID = derive("partuuid", p.Name)
+		}
+
+		if p.FSUUID == "" {
+			switch p.FS {
+			case "btrfs", "ext2", "ext3", "ext4", "f2fs", "xfs":
+				p.FSUUID = derive("fsuuid", p.Name)
+			case "fat", "fat12", "fat16", "fat32", "msdos", "vfat":
+				p.FSUUID = derive("fsuuid", p.Name)[:8]
+			}
+		}
+	}
+}
+
+// Register the identifiers of the partition for the later actions
+func (i ImagePartitionAction) registerPartition(p *Partition, context *debos.DebosContext) error {
+	if i.PartitionType == "gpt" && p.PartUUID == "" {
+		out, err := debos.Command{}.Output("sfdisk", "sfdisk", "--part-uuid", context.Image, strconv.Itoa(p.number))
+		if err != nil {
+			return fmt.Errorf("Failed to get partition UUID of %s: %v", p.Name, err)
+		}
+		p.PartUUID = strings.ToLower(strings.TrimSpace(string(out)))
+	}
+
+	if context.Registered == nil {
+		context.Registered = make(map[string]string)
+	}
+
+	name := registeredPartitionRegex.ReplaceAllString(p.Name, "_")
+	if p.FSUUID != "" {
+		context.Registered[name+"_fsuuid"] = p.FSUUID
+	}
+	if i.PartitionType == "gpt" {
+		context.Registered[name+"_partuuid"] = p.PartUUID
+		context.Registered[name+"_partlabel"] = p.PartLabel
+	}
+
+	return nil
+}
+
 func (p *Partition) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	type rawPartition Partition
 	part := rawPartition{Fsck: true}
@@ -268,12 +690,33 @@ func (p *Partition) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	return nil
 }
 
+// blkid tags of the fstab sources
+var fstabSources = map[string]string{
+	"uuid":     "UUID",
+	"label":    "LABEL",
+	"partuuid": "PARTUUID",
+}
+
+// fstab reference of the filesystem of the device by the blkid tag
+func fstabSpec(device, tag string) (string, error) {
+	value := blkidValue(device, tag)
+	if value == "" {
+		return "", fmt.Errorf("No %s for %s", tag, device)
+	}
+
+	// Spaces are escaped in fstab, e.g. in labels
+	return tag + "=" + strings.Replace(value, " ", "\\040", -1), nil
+}
+
 func (i *ImagePartitionAction) generateFSTab(context *debos.DebosContext) error {
 	context.ImageFSTab.Reset()
 
 	for _, m := range i.Mountpoints {
 		options := []string{"defaults"}
 		options = append(options, m.Options...)
+		for _, o := range m.XSystemd {
+			options = append(options, "x-systemd."+o)
+		}
 		if m.Buildtime == true {
 			/* Do not need to add mount point into fstab */
 			continue
@@ -282,6 +725,15 @@ func (i *ImagePartitionAction) generateFSTab(context *debos.DebosContext) error
 			return fmt.Errorf("Missing fs UUID for partition %s!?!", m.part.Name)
 		}
 
+		spec := "UUID=" + m.part.FSUUID
+		if m.FSTabSource != "" && m.FSTabSource != "uuid" {
+			var err error
+			spec, err = fstabSpec(i.getPartitionDevice(m.part.number, *context), fstabSources[m.FSTabSource])
+			if err != nil {
+				return fmt.Errorf("Failed to reference partition %s in fstab: %v", m.part.Name, err)
+			}
+		}
+
 		fs_passno := 0
 
 		if m.part.Fsck {
@@ -291,6 +743,9 @@ func (i *ImagePartitionAction) generateFSTab(context *debos.DebosContext) error
 				fs_passno = 2
 			}
 		}
+		if m.Pass != nil {
+			fs_passno = *m.Pass
+		}
 
 		fsType := m.part.FS
 		switch m.part.FS {
@@ -300,9 +755,9 @@ func (i *ImagePartitionAction) generateFSTab(context *debos.DebosContext) error
 				break
 		}
 
-		context.ImageFSTab.WriteString(fmt.Sprintf("UUID=%s\t%s\t%s\t%s\t0\t%d\n",
-			m.part.FSUUID, m.Mountpoint, fsType,
-			strings.Join(options, ","), fs_passno))
+		context.ImageFSTab.WriteString(fmt.Sprintf("%s\t%s\t%s\t%s\t%d\t%d\n",
+			spec, m.Mountpoint, fsType,
+			strings.Join(options, ","), m.Dump, fs_passno))
 	}
 
 	return nil
@@ -400,10 +855,14 @@ func (i ImagePartitionAction) formatPartition(p *Partition, context debos.DebosC
 			cmdline = append(cmdline, "-U", p.FSUUID)
 		}
 	case "f2fs":
-		cmdline = append(cmdline, "mkfs.f2fs", "-l", p.FSLabel)
+		// Force formatting to prevent failure in case if partition was formatted already
+		cmdline = append(cmdline, "mkfs.f2fs", "-l", p.FSLabel, "-f")
 		if len(p.Features) > 0 {
 			cmdline = append(cmdline, "-O", strings.Join(p.Features, ","))
 		}
+		if len(p.FSUUID) > 0 {
+			cmdline = append(cmdline, "-U", p.FSUUID)
+		}
 	case "hfs":
 		cmdline = append(cmdline, "mkfs.hfs", "-h", "-v", p.FSLabel)
 	case "hfsplus":
@@ -434,6 +893,7 @@ func (i ImagePartitionAction) formatPartition(p *Partition, context debos.DebosC
 	}
 
 	if len(cmdline) != 0 {
+		cmdline = append(cmdline, p.MkfsOptions...)
 		cmdline = append(cmdline, path)
 
 		cmd := debos.Command{}
@@ -456,7 +916,7 @@ func (i ImagePartitionAction) formatPartition(p *Partition, context debos.DebosC
 	}
 
 	if p.FS != "none" && p.FSUUID == "" {
-		uuid, err := exec.Command("blkid", "-o", "value", "-s", "UUID", "-p", "-c", "none", path).Output()
+		uuid, err := debos.Command{}.Output("blkid", "blkid", "-o", "value", "-s", "UUID", "-p", "-c", "none", path)
 		if err != nil {
 			return fmt.Errorf("Failed to get uuid: %s", err)
 		}
@@ -505,6 +965,8 @@ func (i *ImagePartitionAction) PreNoMachine(context *debos.DebosContext) error {
 		}
 	}
 
+	// Loop devices are shared by the builds of the host, the log tells whose it is
+	log.Printf("Attached %s to %s", i.ImageName, i.loopDev.Path())
 	context.Image = i.loopDev.Path()
 	i.usingLoop = true
 
@@ -545,16 +1007,13 @@ func (i ImagePartitionAction) Run(context *debos.DebosContext) error {
 
 		var name string
 		if i.PartitionType == "msdos" {
-			if len(i.Partitions) <= 4 {
+			switch {
+			case p.extended:
+				name = "extended"
+			case p.Logical:
+				name = "logical"
+			default:
 				name = "primary"
-			} else {
-				if idx < 3 {
-					name = "primary"
-				} else if idx == 3 {
-					name = "extended"
-				} else {
-					name = "logical"
-				}
 			}
 		} else {
 			name = p.PartLabel
@@ -639,9 +1098,13 @@ func (i ImagePartitionAction) Run(context *debos.DebosContext) error {
 		}
 		lock.unlock()
 
+		if err := i.registerPartition(p, context); err != nil {
+			return err
+		}
+
 		devicePath := i.getPartitionDevice(p.number, *context)
 		context.ImagePartitions = append(context.ImagePartitions,
-			debos.Partition{p.Name, devicePath})
+			debos.Partition{p.Name, devicePath, p.number})
 	}
 
 	context.ImageMntDir = path.Join(context.Scratchdir, "mnt")
@@ -704,7 +1167,116 @@ func (i ImagePartitionAction) Run(context *debos.DebosContext) error {
 	return nil
 }
 
+// Record the hashes of the partitions and of their content in the manifest
+func (i ImagePartitionAction) recordHashes(context *debos.DebosContext, mounted bool) error {
+	if context.Manifest == nil || context.State != debos.Success {
+		return nil
+	}
+
+	if mounted {
+		for _, m := range i.Mountpoints {
+			if m.Buildtime {
+				continue
+			}
+
+			mntpath := path.Join(context.ImageMntDir, m.Mountpoint)
+			sum, err := debos.HashTree(mntpath)
+			if err != nil {
+				return fmt.Errorf("Failed to hash content of %s: %v", m.part.Name, err)
+			}
+			context.Manifest.Partition(m.part.Name).ContentSHA256 = sum
+		}
+
+		return nil
+	}
+
+	for _, p := range i.Partitions {
+		if context.Integrity != nil && !p.extended {
+			// Hashed along with its blocks for the integrity manifest
+			continue
+		}
+
+		sum, err := debos.HashFile(i.getPartitionDevice(p.number, *context))
+		if err != nil {
+			return fmt.Errorf("Failed to hash partition %s: %v", p.Name, err)
+		}
+		context.Manifest.Partition(p.Name).SHA256 = sum
+	}
+
+	return nil
+}
+
+// Offset of the partition device in the image, from sysfs
+func partitionOffset(device string) (int64, error) {
+	device, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return 0, err
+	}
+
+	start, err := ioutil.ReadFile(path.Join("/sys/class/block", path.Base(device), "start"))
+	if err != nil {
+		return 0, err
+	}
+
+	// sysfs counts in 512 bytes sectors whatever the sector size
+	sectors, err := strconv.ParseInt(strings.TrimSpace(string(start)), 10, 64)
+	return sectors * 512, err
+}
+
+/*
+Write the integrity manifest requested by filesystem-deploy, the partitions
+hashes of the manifest being computed from the same read.
+*/
+func (i ImagePartitionAction) recordIntegrity(context *debos.DebosContext) error {
+	integrity := context.Integrity
+	if integrity == nil || context.State != debos.Success {
+		return nil
+	}
+
+	integrity.Partitions = nil
+	for _, p := range i.Partitions {
+		if p.extended {
+			continue
+		}
+
+		dev := i.getPartitionDevice(p.number, *context)
+		offset, err := partitionOffset(dev)
+		if err != nil {
+			return fmt.Errorf("Failed to get offset of partition %s: %v", p.Name, err)
+		}
+
+		sum, blocks, size, err := debos.HashBlocks(dev, integrity.BlockSize)
+		if err != nil {
+			return fmt.Errorf("Failed to hash partition %s: %v", p.Name, err)
+		}
+
+		if context.Manifest != nil {
+			context.Manifest.Partition(p.Name).SHA256 = sum
+		}
+		integrity.Partitions = append(integrity.Partitions, debos.PartitionIntegrity{
+			Name:   p.Name,
+			Number: p.number,
+			Offset: offset,
+			Size:   size,
+			SHA256: sum,
+			Blocks: blocks,
+		})
+	}
+
+	log.Printf("Writing integrity manifest %s", integrity.File)
+	file := path.Join(context.Artifactdir, integrity.File)
+	if err := os.MkdirAll(path.Dir(file), 0755); err != nil {
+		return err
+	}
+
+	return integrity.Save(file)
+}
+
 func (i ImagePartitionAction) Cleanup(context *debos.DebosContext) error {
+	if err := i.recordHashes(context, true); err != nil {
+		log.Printf("WARNING: %v", err)
+	}
+
 	for idx := len(i.Mountpoints) - 1; idx >= 0; idx-- {
 		m := i.Mountpoints[idx]
 		mntpath := path.Join(context.ImageMntDir, m.Mountpoint)
@@ -727,6 +1299,15 @@ func (i ImagePartitionAction) Cleanup(context *debos.DebosContext) error {
 		}
 	}
 
+	// The loop device is detached even if processing the partitions failed
+	processErr := i.processPartitions(context)
+
+	if processErr == nil {
+		if err := i.recordHashes(context, false); err != nil {
+			log.Printf("WARNING: %v", err)
+		}
+	}
+
 	if i.usingLoop {
 		err := i.loopDev.Detach()
 		if err != nil {
@@ -748,49 +1329,415 @@ func (i ImagePartitionAction) Cleanup(context *debos.DebosContext) error {
 		}
 	}
 
+	return processErr
+}
+
+// Shrink the partitions and record their images once the build succeeded
+func (i ImagePartitionAction) processPartitions(context *debos.DebosContext) error {
+	if context.State == debos.Success {
+		for idx := range i.Partitions {
+			p := &i.Partitions[idx]
+			if !p.Shrink {
+				continue
+			}
+			if err := i.shrinkPartition(p, *context); err != nil {
+				return err
+			}
+		}
+
+		if i.Shrink {
+			if err := i.compactPartitions(*context); err != nil {
+				return err
+			}
+		}
+
+		for _, p := range i.Partitions {
+			if p.AndroidSparse == "" {
+				continue
+			}
+			sparse := path.Join(context.Artifactdir, p.AndroidSparse)
+			log.Printf("Creating Android sparse image %s of partition %s", p.AndroidSparse, p.Name)
+			err := debos.Command{}.Run("img2simg", "img2simg", i.getPartitionDevice(p.number, *context), sparse)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := i.recordIntegrity(context); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Field of the output of an e2fsprogs tool, e.g. "Block size:   4096"
+func e2fsField(out []byte, field string) (int64, error) {
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.HasPrefix(line, field) {
+			return strconv.ParseInt(strings.TrimSpace(strings.TrimPrefix(line, field)), 10, 64)
+		}
+	}
+
+	return 0, fmt.Errorf("No '%s' in the output", field)
+}
+
+/*
+shrinkPartition shrinks the ext filesystem of the partition to its minimal
+size plus the margin, and the partition to the filesystem.
+*/
+func (i ImagePartitionAction) shrinkPartition(p *Partition, context debos.DebosContext) error {
+	dev := i.getPartitionDevice(p.number, context)
+
+	// e2fsck exits with 1 once it fixed the filesystem
+	err := debos.Command{}.Run("e2fsck", "e2fsck", "-fy", dev)
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+		err = nil
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to check %s before shrinking it: %v", p.Name, err)
+	}
+
+	out, err := debos.Command{}.Output("resize2fs", "resize2fs", "-P", dev)
+	if err != nil {
+		return fmt.Errorf("Failed to get the minimal size of %s: %v", p.Name, err)
+	}
+	blocks, err := e2fsField(out, "Estimated minimum size of the filesystem:")
+	if err != nil {
+		return fmt.Errorf("Failed to get the minimal size of %s: %v", p.Name, err)
+	}
+
+	out, err = debos.Command{}.Output("dumpe2fs", "dumpe2fs", "-h", dev)
+	if err != nil {
+		return fmt.Errorf("Failed to get the block size of %s: %v", p.Name, err)
+	}
+	blockSize, err := e2fsField(out, "Block size:")
+	if err != nil {
+		return fmt.Errorf("Failed to get the block size of %s: %v", p.Name, err)
+	}
+
+	var margin int64
+	if p.ShrinkMargin != "" {
+		margin, _ = units.FromHumanSize(p.ShrinkMargin)
+	}
+
+	const alignment = 1 << 20
+	size := (blocks*blockSize + margin + alignment - 1) / alignment * alignment
+
+	device, err := os.Open(dev)
+	if err != nil {
+		return err
+	}
+	current, err := device.Seek(0, io.SeekEnd)
+	device.Close()
+	if err != nil {
+		return err
+	}
+
+	if size >= current {
+		log.Printf("Partition %s is already at its minimal size", p.Name)
+		return nil
+	}
+
+	log.Printf("Shrinking partition %s from %s to %s", p.Name, units.BytesSize(float64(current)), units.BytesSize(float64(size)))
+	err = debos.Command{}.Run("resize2fs", "resize2fs", dev, fmt.Sprintf("%dK", size/1024))
+	if err != nil {
+		return err
+	}
+
+	// Keep the start and the type of the partition, only change its size
+	cmd := debos.Command{Stdin: strings.NewReader(fmt.Sprintf(",%d\n", size/int64(context.SectorSize)))}
+	if out, err := cmd.CombinedOutput("sfdisk", "sfdisk", "--no-reread", "--no-tell-kernel", "-N",
+		strconv.Itoa(p.number), context.Image); err != nil {
+		return fmt.Errorf("Failed to shrink partition %s: %v: %s", p.Name, err, out)
+	}
+
 	return nil
 }
 
-func (i ImagePartitionAction) PostMachineCleanup(context *debos.DebosContext) error {
+// Number of the partition from its node in the dump of the image
+func partitionNodeNumber(image, node string) string {
+	return strings.TrimLeft(strings.TrimPrefix(node, image), "p")
+}
+
+/*
+compactPartitions moves the partitions following the first shrunk one back,
+so the partitions are contiguous up to the last one.
+*/
+func (i ImagePartitionAction) compactPartitions(context debos.DebosContext) error {
+	table, err := readPartitionTable(context.Image, context.SectorSize)
+	if err != nil {
+		return err
+	}
+	sort.Slice(table.Partitions, func(a, b int) bool {
+		return table.Partitions[a].Start < table.Partitions[b].Start
+	})
+
+	shrunk := map[string]bool{}
+	for _, p := range i.Partitions {
+		if p.Shrink {
+			shrunk[strconv.Itoa(p.number)] = true
+		}
+	}
+
+	alignment := int64(1<<20) / int64(context.SectorSize)
+	moved := false
+	moving := false
+	var end int64
+	for _, p := range table.Partitions {
+		number := partitionNodeNumber(context.Image, p.Node)
+		start := (end + alignment - 1) / alignment * alignment
+
+		if moving && start < p.Start {
+			log.Printf("Moving partition %s from sector %d to %d", number, p.Start, start)
+			cmd := debos.Command{Stdin: strings.NewReader(fmt.Sprintf("%d,\n", start))}
+			out, err := cmd.CombinedOutput("sfdisk", "sfdisk", "--no-reread", "--no-tell-kernel",
+				"--move-data="+path.Join(context.Scratchdir, "sfdisk.move"), "-N", number, context.Image)
+			if err != nil {
+				return fmt.Errorf("Failed to move partition %s: %v: %s", number, err, out)
+			}
+			p.Start = start
+			moved = true
+		}
+
+		moving = moving || shrunk[number]
+		end = p.Start + p.Size
+	}
+
+	if !moved {
+		return nil
+	}
+
+	// Update the partition devices for the hashes of the partitions
+	return debos.Command{}.Run("partx", "partx", "-u", context.Image)
+}
+
+/*
+truncateImage truncates the image after its last partition if it's a shrunk
+one, or if the image is shrunk, keeping room for the backup GPT header.
+*/
+func (i ImagePartitionAction) truncateImage(image string, sectorSize int64) error {
+	sectors := strconv.FormatInt(sectorSize, 10)
+	table, err := readPartitionTable(image, int(sectorSize))
+	if err != nil {
+		return err
+	}
+
+	var last string
+	var end int64
+	for _, p := range table.Partitions {
+		if p.Start+p.Size > end {
+			last = p.Node
+			end = p.Start + p.Size
+		}
+	}
+
+	shrunk := i.Shrink
+	for _, p := range i.Partitions {
+		if p.Shrink && partitionNodeNumber(image, last) == strconv.Itoa(p.number) {
+			shrunk = true
+		}
+	}
+	if !shrunk {
+		return nil
+	}
+
+	size := end * sectorSize
+	gpt := table.Label == "gpt"
+	if gpt {
+		// Partition entries and header
+		size += 33 * sectorSize
+	}
+
+	info, err := os.Stat(image)
+	if err != nil {
+		return err
+	}
+	if size >= info.Size() {
+		return nil
+	}
+
+	log.Printf("Truncating %s to %s", path.Base(image), units.BytesSize(float64(size)))
+	if err := os.Truncate(image, size); err != nil {
+		return err
+	}
+
+	if gpt {
+		return debos.Command{}.Run("sfdisk", "sfdisk", "--sector-size", sectors, "--relocate", "gpt-bak-std", image)
+	}
+
+	return nil
+}
+
+func (i *ImagePartitionAction) PostMachine(context *debos.DebosContext) error {
+	image := path.Join(context.Artifactdir, i.ImageName)
+
+	for _, p := range i.Partitions {
+		if p.Shrink || i.Shrink {
+			if err := i.truncateImage(image, int64(context.SectorSize)); err != nil {
+				return err
+			}
+			break
+		}
+	}
+
+	return nil
+}
+
+// Sparse, block map, Android sparse and compressed forms of the final image
+func (i *ImagePartitionAction) Finalize(context *debos.DebosContext) error {
 	image := path.Join(context.Artifactdir, i.ImageName)
+
+	if i.Sparse || i.Bmap {
+		log.Printf("Turning the zeroed blocks of %s into holes", i.ImageName)
+		if err := (debos.Command{}).Run("fallocate", "fallocate", "--dig-holes", image); err != nil {
+			return err
+		}
+	}
+
+	if i.AndroidSparse != "" {
+		log.Printf("Creating Android sparse image %s", i.AndroidSparse)
+		sparse := path.Join(context.Artifactdir, i.AndroidSparse)
+		if err := (debos.Command{}).Run("img2simg", "img2simg", image, sparse); err != nil {
+			return err
+		}
+	}
+
+	// The map is of the raw image, bmaptool uncompresses the image on the fly
+	if i.Bmap {
+		log.Printf("Creating the block map of %s", i.ImageName)
+		err := debos.Command{}.Run("bmaptool", "bmaptool", "create", "-o", image+".bmap", image)
+		if err != nil {
+			return err
+		}
+	}
+
+	if i.Compression == "" || i.Compression == "none" {
+		return nil
+	}
+
+	log.Printf("Compressing %s with %s", i.ImageName, i.Compression)
+	_, err := debos.CompressFile(image, i.Compression)
+
+	return err
+}
+
+func (i ImagePartitionAction) PostMachineCleanup(context *debos.DebosContext) error {
+	images := []string{path.Join(context.Artifactdir, i.ImageName)}
+	images = append(images, images[0]+".bmap")
+	if i.AndroidSparse != "" {
+		images = append(images, path.Join(context.Artifactdir, i.AndroidSparse))
+	}
+	for _, p := range i.Partitions {
+		if p.AndroidSparse != "" {
+			images = append(images, path.Join(context.Artifactdir, p.AndroidSparse))
+		}
+	}
+	if compressed, err := debos.CompressedFileName(images[0], i.Compression); err == nil {
+		images = append(images, compressed)
+	}
+
 	/* Remove the image in case of any action failure */
 	if context.State != debos.Success {
-		if _, err := os.Stat(image); !os.IsNotExist(err) {
-			if err = os.Remove(image); err != nil {
-				return err
+		for _, image := range images {
+			if _, err := os.Stat(image); !os.IsNotExist(err) {
+				if err = os.Remove(image); err != nil {
+					return err
+				}
 			}
 		}
 	}
 	return nil
 }
 
+/*
+Add the extended partition holding the logical partitions of a msdos table.
+Without explicit logical partitions, the partitions after the third one are
+logical if there are more than 4 partitions.
+*/
+func (i *ImagePartitionAction) msdosLayout() error {
+	first := -1
+	for idx, p := range i.Partitions {
+		if p.Logical && first < 0 {
+			first = idx
+		} else if !p.Logical && first >= 0 {
+			return fmt.Errorf("Primary partition %s can't follow the logical partitions", p.Name)
+		}
+	}
+
+	if first < 0 && len(i.Partitions) > 4 {
+		first = 3
+		for idx := first; idx < len(i.Partitions); idx++ {
+			i.Partitions[idx].Logical = true
+		}
+	}
+
+	if first < 0 {
+		return nil
+	}
+	if first > 3 {
+		return fmt.Errorf("At most 3 primary partitions can precede the logical partitions, %d given", first)
+	}
+
+	extended := Partition{
+		Name:     "extended",
+		Start:    i.Partitions[first].Start,
+		End:      i.Partitions[len(i.Partitions)-1].End,
+		FS:       "none",
+		extended: true,
+	}
+
+	partitions := append([]Partition{}, i.Partitions[:first]...)
+	partitions = append(partitions, extended)
+	i.Partitions = append(partitions, i.Partitions[first:]...)
+
+	return nil
+}
+
 func (i *ImagePartitionAction) Verify(context *debos.DebosContext) error {
+	if i.LayoutFile != "" {
+		if err := i.importLayout(debos.CleanPathAt(i.LayoutFile, context.RecipeDir)); err != nil {
+			return err
+		}
+	}
+
+	switch i.Compression {
+	case "", "none", "gz", "xz", "zstd":
+	default:
+		return fmt.Errorf("Unsupported compression '%s'", i.Compression)
+	}
+
+	if i.UUIDSeed != "" {
+		i.deriveUUIDs()
+	}
 
 	if i.PartitionType == "msdos" {
-		for idx, _ := range i.Partitions {
-			p := &i.Partitions[idx]
+		if err := i.msdosLayout(); err != nil {
+			return err
+		}
+	}
 
-			if idx == 3 && len(i.Partitions) > 4 {
-				var name string
-				var part Partition
+	if i.Sparse && i.Compression != "" && i.Compression != "none" {
+		return fmt.Errorf("'sparse' and 'compression' can't be used together")
+	}
 
-				name = "extended"
-				part.number = idx + 1
-				part.Name = name
-				part.Start = p.Start
-				tmp_n := len(i.Partitions) - 1
-				tmp := &i.Partitions[tmp_n]
-				part.End = tmp.End
-				part.FS = "none"
-
-				i.Partitions = append(i.Partitions[:idx+1], i.Partitions[idx:]...)
-				i.Partitions[idx] = part
-
-				num := 1
-				for idx, _ := range i.Partitions {
-					p := &i.Partitions[idx]
-					p.number = num
-					num++
+	if i.Shrink {
+		if i.ShrinkMargin != "" {
+			if _, err := units.FromHumanSize(i.ShrinkMargin); err != nil {
+				return fmt.Errorf("Failed to parse shrink margin: %s", i.ShrinkMargin)
+			}
+		}
+
+		for idx := range i.Partitions {
+			p := &i.Partitions[idx]
+			if p.extended {
+				return fmt.Errorf("Shrinking the image isn't supported with logical partitions")
+			}
+			switch p.FS {
+			case "ext2", "ext3", "ext4":
+				p.Shrink = true
+				if p.ShrinkMargin == "" {
+					p.ShrinkMargin = i.ShrinkMargin
 				}
 			}
 		}
@@ -829,6 +1776,13 @@ func (i *ImagePartitionAction) Verify(context *debos.DebosContext) error {
 	for idx, _ := range i.Partitions {
 		var maxLength int = 0
 		p := &i.Partitions[idx]
+		if p.Logical && i.PartitionType != "msdos" {
+			return fmt.Errorf("Partition %s can only be logical on msdos partition tables", p.Name)
+		}
+		// The logical partitions are numbered after the 4 primary partitions slots
+		if p.Logical && num < 5 {
+			num = 5
+		}
 		p.number = num
 		num++
 		if p.Name == "" {
@@ -844,7 +1798,7 @@ func (i *ImagePartitionAction) Verify(context *debos.DebosContext) error {
 
 		if len(p.FSUUID) > 0 {
 			switch p.FS {
-			case "btrfs", "ext2", "ext3", "ext4", "xfs":
+			case "btrfs", "ext2", "ext3", "ext4", "f2fs", "xfs":
 				_, err := uuid.Parse(p.FSUUID)
 				if err != nil {
 					return fmt.Errorf("Incorrect UUID %s", p.FSUUID)
@@ -875,6 +1829,14 @@ func (i *ImagePartitionAction) Verify(context *debos.DebosContext) error {
 			}
 		}
 
+		if i.PartitionType == "gpt" && p.PartType != "" && len(p.PartType) != 36 {
+			t, ok := gptPartType(p.PartType, context.Architecture)
+			if !ok {
+				return fmt.Errorf("Unknown partition type '%s' of %s for architecture %s", p.PartType, p.Name, context.Architecture)
+			}
+			p.PartType = t
+		}
+
 		if p.PartType != "" {
 			var partTypeLen int
 			switch i.PartitionType {
@@ -888,6 +1850,11 @@ func (i *ImagePartitionAction) Verify(context *debos.DebosContext) error {
 			}
 		}
 
+		for idx, attr := range p.PartAttrs {
+			if bit, ok := gptAttrs[attr]; ok {
+				p.PartAttrs[idx] = bit
+			}
+		}
 		for _, bitStr := range p.PartAttrs {
 			bit, err := strconv.ParseInt(bitStr, 0, 0)
 			if err != nil || bit < 0 || bit > 2 && bit < 48 || bit > 63 {
@@ -910,6 +1877,27 @@ func (i *ImagePartitionAction) Verify(context *debos.DebosContext) error {
 			p.FSLabel = p.Name
 		}
 
+		if len(p.MkfsOptions) > 0 && p.FS == "none" {
+			return fmt.Errorf("mkfs-options of %s require a filesystem", p.Name)
+		}
+
+		if len(p.ExtendedOptions) > 0 && p.FS == "f2fs" {
+			return fmt.Errorf("Extended options aren't supported for filesystem %s of %s", p.FS, p.Name)
+		}
+
+		if p.Shrink {
+			switch p.FS {
+			case "ext2", "ext3", "ext4":
+			default:
+				return fmt.Errorf("Shrinking partition %s isn't supported for filesystem %s", p.Name, p.FS)
+			}
+		}
+		if p.ShrinkMargin != "" {
+			if _, err := units.FromHumanSize(p.ShrinkMargin); err != nil {
+				return fmt.Errorf("Failed to parse shrink margin of %s: %s", p.Name, p.ShrinkMargin)
+			}
+		}
+
 		switch p.FS {
 			case "fat", "fat12", "fat16", "fat32", "msdos", "vfat":
 				maxLength = 11
@@ -957,19 +1945,17 @@ func (i *ImagePartitionAction) Verify(context *debos.DebosContext) error {
 		if strings.ToLower(m.part.FS) == "none" {
 			return fmt.Errorf("Cannot mount %s: filesystem not present", m.Mountpoint)
 		}
-	}
 
-	// Calculate the size based on the unit (binary or decimal)
-	// binary units are multiples of 1024 - KiB, MiB, GiB, TiB, PiB
-	// decimal units are multiples of 1000 - KB, MB, GB, TB, PB
-	var getSizeValueFunc func(size string) (int64, error)
-	if regexp.MustCompile(`^[0-9.]+[kmgtp]ib+$`).MatchString(strings.ToLower(i.ImageSize)) {
-		getSizeValueFunc = units.RAMInBytes
-	} else {
-		getSizeValueFunc = units.FromHumanSize
+		if _, ok := fstabSources[m.FSTabSource]; m.FSTabSource != "" && !ok {
+			return fmt.Errorf("Unknown fstab-source '%s' for %s, has to be 'uuid', 'label' or 'partuuid'",
+				m.FSTabSource, m.Mountpoint)
+		}
+		if m.Dump < 0 || m.Pass != nil && *m.Pass < 0 {
+			return fmt.Errorf("Negative dump or pass field for %s", m.Mountpoint)
+		}
 	}
 
-	size, err := getSizeValueFunc(i.ImageSize)
+	size, err := parseImageSize(i.ImageSize)
 	if err != nil {
 		return fmt.Errorf("Failed to parse image size: %s", i.ImageSize)
 	}
@@ -0,0 +1,251 @@
+/*
+ImportImage Action
+
+Start the target rootfs from the root filesystem of an existing disk image,
+e.g. a vendor VM image, to customize it without manual extraction steps. The
+image is attached read-only, so the original is never modified.
+
+ # Yaml syntax:
+ - action: import-image
+   origin: name
+   file: image.qcow2
+   format: qcow2
+   partition: root
+   exclude:
+     - path
+
+Mandatory properties:
+
+- file -- file name of the disk image. It is possible to skip this property
+if 'origin' references the downloaded image.
+
+Optional properties:
+
+- origin -- reference to a named file or directory, e.g. from a 'download'
+action. Defaults to the recipe directory.
+
+- format -- format of the image, 'raw' or 'qcow2'. Detected by default.
+qcow2 images are converted to a temporary raw image first.
+
+- partition -- number, partition label or filesystem label of the root
+partition. By default the first partition containing an 'os-release' file is
+used. Images without partition table are used as a single filesystem.
+
+- exclude -- list of paths relative to the root filesystem not to import, see
+the 'import-rootfs' action.
+
+Only the root partition is imported; content of other partitions, e.g. a
+separate '/boot', has to be added with other actions.
+*/
+package actions
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/go-debos/debos"
+	"github.com/go-debos/fakemachine"
+)
+
+type ImportImageAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Origin           string
+	File             string
+	Format           string
+	Partition        string
+	Exclude          []string
+}
+
+func (i *ImportImageAction) Verify(context *debos.DebosContext) error {
+	if i.Origin == "" && i.File == "" {
+		return fmt.Errorf("Image can't be empty. Please add 'file' and/or 'origin' property.")
+	}
+
+	if i.Format != "" && i.Format != "raw" && i.Format != "qcow2" {
+		return fmt.Errorf("Unsupported image format '%s'", i.Format)
+	}
+
+	return nil
+}
+
+func (i *ImportImageAction) PreMachine(context *debos.DebosContext, m *fakemachine.Machine, args *[]string) error {
+	if i.Origin == "" && path.IsAbs(i.File) {
+		m.AddVolume(path.Dir(i.File))
+	}
+
+	return nil
+}
+
+// Detect the format of the image from its header
+func imageFormat(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	magic := make([]byte, 4)
+	if _, err := f.Read(magic); err != nil {
+		return "", err
+	}
+
+	if bytes.Equal(magic, []byte{'Q', 'F', 'I', 0xfb}) {
+		return "qcow2", nil
+	}
+	return "raw", nil
+}
+
+func blkidValue(device, tag string) string {
+	out, err := debos.Command{}.Output("blkid", "blkid", "-o", "value", "-s", tag, device)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// Mount a partition read-only, the returned function unmounts it
+func mountReadOnly(device, mntpath string) (func(), error) {
+	fstype := blkidValue(device, "TYPE")
+	if fstype == "" {
+		return nil, fmt.Errorf("No filesystem found on %s", device)
+	}
+
+	// The journal can't be replayed on the read-only loop device
+	data := ""
+	if fstype == "ext3" || fstype == "ext4" {
+		data = "noload"
+	}
+
+	if err := syscall.Mount(device, mntpath, fstype, syscall.MS_RDONLY, data); err != nil {
+		return nil, fmt.Errorf("Failed to mount %s: %v", device, err)
+	}
+
+	return func() { syscall.Unmount(mntpath, 0) }, nil
+}
+
+func hasOSRelease(root string) bool {
+	for _, f := range []string{"etc/os-release", "usr/lib/os-release"} {
+		if _, err := os.Lstat(path.Join(root, f)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+type imagePartition struct {
+	number int // 0 for images without partition table
+	device string
+}
+
+// Find the root partition among the partitions of the image and mount it
+func (i *ImportImageAction) mountRoot(partitions []imagePartition, mntpath string) (func(), error) {
+	for _, p := range partitions {
+		device := p.device
+		if i.Partition != "" {
+			if i.Partition != strconv.Itoa(p.number) && i.Partition != blkidValue(device, "PARTLABEL") &&
+				i.Partition != blkidValue(device, "LABEL") {
+				continue
+			}
+			log.Printf("Importing partition %s", device)
+			return mountReadOnly(device, mntpath)
+		}
+
+		if blkidValue(device, "TYPE") == "" {
+			continue
+		}
+		umount, err := mountReadOnly(device, mntpath)
+		if err != nil {
+			log.Printf("Skipping %s: %v", device, err)
+			continue
+		}
+		if hasOSRelease(mntpath) {
+			log.Printf("Importing partition %s", device)
+			return umount, nil
+		}
+		umount()
+	}
+
+	if i.Partition != "" {
+		return nil, fmt.Errorf("Partition '%s' not found in the image", i.Partition)
+	}
+	return nil, fmt.Errorf("No root partition found in the image")
+}
+
+func (i *ImportImageAction) Run(context *debos.DebosContext) error {
+	origin := context.RecipeDir
+	if i.Origin != "" {
+		var found bool
+		if origin, found = context.Origin(i.Origin); !found {
+			return fmt.Errorf("Origin not found '%s'", i.Origin)
+		}
+	}
+	image := debos.CleanPathAt(i.File, origin)
+
+	format := i.Format
+	if format == "" {
+		var err error
+		if format, err = imageFormat(image); err != nil {
+			return err
+		}
+	}
+
+	if format == "qcow2" {
+		raw := path.Join(context.Scratchdir, "import-image.raw")
+		err := debos.Command{}.Run("qemu-img", "qemu-img", "convert", "-O", "raw", image, raw)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(raw)
+		image = raw
+	}
+
+	out, err := debos.Command{}.Output("losetup", "losetup", "--find", "--show", "--partscan", "--read-only", image)
+	if err != nil {
+		return fmt.Errorf("Failed to setup loop device for %s: %v", image, err)
+	}
+	loop := strings.TrimSpace(string(out))
+	defer debos.Command{}.Run("losetup", "losetup", "-d", loop)
+
+	devices, err := filepath.Glob(loop + "p*")
+	if err != nil {
+		return err
+	}
+	var partitions []imagePartition
+	for _, d := range devices {
+		number, err := strconv.Atoi(strings.TrimPrefix(d, loop+"p"))
+		if err != nil {
+			return fmt.Errorf("Unexpected partition device %s", d)
+		}
+		partitions = append(partitions, imagePartition{number, d})
+	}
+	// loop0p10 comes after loop0p9
+	sort.Slice(partitions, func(a, b int) bool {
+		return partitions[a].number < partitions[b].number
+	})
+	if len(partitions) == 0 {
+		partitions = []imagePartition{{0, loop}}
+	}
+
+	mntpath, err := ioutil.TempDir(context.Scratchdir, "import-image-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(mntpath)
+
+	umount, err := i.mountRoot(partitions, mntpath)
+	if err != nil {
+		return err
+	}
+	defer umount()
+
+	return importTree(mntpath, context.Rootdir, i.Exclude)
+}
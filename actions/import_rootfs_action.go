@@ -0,0 +1,100 @@
+/*
+ImportRootfs Action
+
+Start the target rootfs from an existing unpacked rootfs directory on the host,
+e.g. produced by another tool, instead of bootstrapping it. The following
+actions only configure the tree and create images from it; the source
+directory itself is never modified.
+
+ # Yaml syntax:
+ - action: import-rootfs
+   source: directory
+   exclude:
+     - path
+
+Mandatory properties:
+
+- source -- directory containing the rootfs on the host. Relative paths are
+relative to the recipe directory.
+
+Optional properties:
+
+- exclude -- list of paths relative to the rootfs not to import, e.g.
+'./var/cache/apt/archives/*.deb'. Patterns are interpreted by tar.
+
+Files are copied with their numeric owners, permissions, ACLs and extended
+attributes, so the build has to run as root or in fakemachine.
+*/
+package actions
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/go-debos/debos"
+	"github.com/go-debos/fakemachine"
+)
+
+type ImportRootfsAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Source           string
+	Exclude          []string
+}
+
+func (i *ImportRootfsAction) Verify(context *debos.DebosContext) error {
+	if i.Source == "" {
+		return fmt.Errorf("Property 'source' is mandatory")
+	}
+
+	return nil
+}
+
+func (i *ImportRootfsAction) PreMachine(context *debos.DebosContext, m *fakemachine.Machine, args *[]string) error {
+	i.Source = debos.CleanPathAt(i.Source, context.RecipeDir)
+	m.AddVolume(i.Source)
+
+	return nil
+}
+
+func (i *ImportRootfsAction) Run(context *debos.DebosContext) error {
+	source := debos.CleanPathAt(i.Source, context.RecipeDir)
+
+	fi, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("Rootfs source %s is not a directory", source)
+	}
+
+	if _, err := os.Stat(path.Join(source, "etc/os-release")); err != nil {
+		if _, err := os.Stat(path.Join(source, "usr/lib/os-release")); err != nil {
+			log.Printf("Warning: %s doesn't look like a rootfs, no os-release found", source)
+		}
+	}
+
+	log.Printf("Importing rootfs from %s", source)
+	return importTree(source, context.Rootdir, i.Exclude)
+}
+
+// Copy a tree to the rootfs, preserving owners, permissions and attributes
+func importTree(source, rootdir string, exclude []string) error {
+	if err := os.MkdirAll(rootdir, 0755); err != nil {
+		return err
+	}
+
+	create := []string{"tar", "-C", escape(source), "--numeric-owner", "--acls", "--xattrs"}
+	for _, e := range exclude {
+		create = append(create, escape("--exclude="+e))
+	}
+	create = append(create, "-cf", "-", ".")
+
+	extract := []string{"tar", "-C", escape(rootdir), "--numeric-owner", "--acls",
+		"--xattrs", "--xattrs-include='*'", "-xpf", "-"}
+
+	script := fmt.Sprintf("set -o pipefail; %s | %s", strings.Join(create, " "), strings.Join(extract, " "))
+	return debos.Command{}.Run("import", "bash", "-c", script)
+}
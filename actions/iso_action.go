@@ -0,0 +1,311 @@
+/*
+Iso Action
+
+Create a bootable hybrid ISO9660 image of the filesystem with xorriso, e.g.
+for live or installer media. The filesystem is put in a squashfs image along
+with its kernel and initrd in the 'live' directory of the ISO, the layout
+expected by live-boot, which has to be installed in the filesystem for the
+default kernel command line. The ISO boots from optical media as well as when
+written to a USB stick, on BIOS with isolinux and on UEFI with GRUB.
+
+ # Yaml syntax:
+ - action: iso
+   file: filename.iso
+   volume-id: DEBOS
+   kernel: /boot/vmlinuz-version
+   initrd: /boot/initrd.img-version
+   compression: zstd
+   kernel-cmdline: boot=live
+   append-kernel-cmdline: arguments
+   bios: bool
+   uefi: bool
+
+Mandatory properties:
+
+- file -- name of the ISO image, relative to the artifact directory.
+
+Optional properties:
+
+- volume-id -- volume identifier of the ISO, up to 32 characters, also used
+by GRUB to find the ISO. Default 'DEBOS'.
+
+- kernel -- path of the kernel in the filesystem. Default is the latest
+'/boot/vmlinuz-*'.
+
+- initrd -- path of the initrd in the filesystem. Default is the initrd
+matching the kernel, e.g. '/boot/initrd.img-6.1.0-18-amd64'.
+
+- compression -- compression of the squashfs image, one of 'gzip', 'lzo',
+'lz4', 'xz' or 'zstd'. Default 'zstd'.
+
+- kernel-cmdline -- kernel command line of the boot entries. Default
+'boot=live'.
+
+- append-kernel-cmdline -- additional kernel command line arguments.
+
+- bios -- make the ISO bootable on BIOS with isolinux, only for the 'amd64'
+and 'i386' architectures. Default 'true' for these architectures.
+
+- uefi -- make the ISO bootable on UEFI with GRUB, only for the 'amd64' and
+'arm64' architectures. Default 'true'.
+
+The isolinux, syslinux-common, grub-efi-amd64-bin or grub-efi-arm64-bin,
+mtools, dosfstools, squashfs-tools and xorriso packages have to be installed
+on the host.
+
+ # Example:
+ - action: apt
+   packages: [ linux-image-amd64, live-boot, systemd-sysv ]
+
+ - action: iso
+   file: debian-live.iso
+   volume-id: DEBIAN_LIVE
+*/
+package actions
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-debos/debos"
+)
+
+// GRUB EFI platform and removable media loader of the architectures
+var isoEfiTargets = map[string][2]string{
+	"amd64": {"x86_64-efi", "BOOTX64.EFI"},
+	"arm64": {"arm64-efi", "BOOTAA64.EFI"},
+}
+
+const (
+	isolinuxDir = "/usr/lib/ISOLINUX"
+	syslinuxDir = "/usr/lib/syslinux/modules/bios"
+)
+
+type IsoAction struct {
+	debos.BaseAction    `yaml:",inline"`
+	File                string
+	VolumeID            string `yaml:"volume-id"`
+	Kernel              string
+	Initrd              string
+	Compression         string
+	KernelCmdline       string `yaml:"kernel-cmdline"`
+	AppendKernelCmdline string `yaml:"append-kernel-cmdline"`
+	Bios                *bool
+	Uefi                *bool
+}
+
+func NewIsoAction() *IsoAction {
+	return &IsoAction{
+		VolumeID:      "DEBOS",
+		Compression:   "zstd",
+		KernelCmdline: "boot=live",
+	}
+}
+
+func (iso *IsoAction) Verify(context *debos.DebosContext) error {
+	if iso.File == "" {
+		return fmt.Errorf("Property 'file' is mandatory")
+	}
+	if iso.VolumeID == "" || len(iso.VolumeID) > 32 {
+		return fmt.Errorf("Volume id '%s' has to be 1 to 32 characters long", iso.VolumeID)
+	}
+
+	supported := false
+	for _, c := range squashfsCompressions {
+		supported = supported || c == iso.Compression
+	}
+	if !supported {
+		return fmt.Errorf("Unsupported compression '%s', possible ones are %s",
+			iso.Compression, strings.Join(squashfsCompressions, ", "))
+	}
+
+	arch := context.Architecture
+	biosArch := arch == "amd64" || arch == "i386"
+	_, uefiArch := isoEfiTargets[arch]
+
+	if iso.Bios == nil {
+		iso.Bios = &biosArch
+	}
+	if iso.Uefi == nil {
+		iso.Uefi = &uefiArch
+	}
+
+	if *iso.Bios && !biosArch {
+		return fmt.Errorf("BIOS boot isn't supported for architecture %s", arch)
+	}
+	if *iso.Uefi && !uefiArch {
+		return fmt.Errorf("UEFI boot isn't supported for architecture %s", arch)
+	}
+	if !*iso.Bios && !*iso.Uefi {
+		return fmt.Errorf("The ISO has to be bootable on BIOS or UEFI")
+	}
+
+	return nil
+}
+
+// Kernel and initrd of the filesystem, the latest ones unless given
+func bootFiles(rootdir, kernel, initrd string) (string, string, error) {
+	if kernel == "" {
+		kernels, _ := filepath.Glob(path.Join(rootdir, "boot/vmlinuz-*"))
+		if len(kernels) == 0 {
+			return "", "", fmt.Errorf("No kernel found in /boot")
+		}
+		sort.Strings(kernels)
+		kernel = strings.TrimPrefix(kernels[len(kernels)-1], rootdir)
+	}
+
+	if initrd == "" {
+		version := strings.TrimPrefix(path.Base(kernel), "vmlinuz-")
+		initrd = path.Join("/boot", "initrd.img-"+version)
+	}
+
+	for _, f := range []string{kernel, initrd} {
+		if _, err := os.Stat(path.Join(rootdir, f)); err != nil {
+			return "", "", fmt.Errorf("Boot file %s not found in the filesystem", f)
+		}
+	}
+
+	return path.Join(rootdir, kernel), path.Join(rootdir, initrd), nil
+}
+
+func (iso *IsoAction) cmdline() string {
+	cmdline := iso.KernelCmdline
+	if iso.AppendKernelCmdline != "" {
+		cmdline += " " + iso.AppendKernelCmdline
+	}
+
+	return cmdline
+}
+
+func (iso *IsoAction) setupBios(staging string) error {
+	dir := path.Join(staging, "isolinux")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	files := []string{path.Join(isolinuxDir, "isolinux.bin"), path.Join(syslinuxDir, "ldlinux.c32")}
+	for _, f := range files {
+		if err := debos.CopyFile(f, path.Join(dir, path.Base(f)), 0644); err != nil {
+			return fmt.Errorf("Failed to copy %s, is isolinux installed? %v", f, err)
+		}
+	}
+
+	config := fmt.Sprintf("default live\nprompt 0\ntimeout 0\n\nlabel live\n"+
+		"  kernel /live/vmlinuz\n  append initrd=/live/initrd.img %s\n", iso.cmdline())
+
+	return ioutil.WriteFile(path.Join(dir, "isolinux.cfg"), []byte(config), 0644)
+}
+
+// Build the FAT image holding the GRUB EFI loader, which finds the ISO by its volume id
+func (iso *IsoAction) setupUefi(context *debos.DebosContext, staging string) error {
+	target := isoEfiTargets[context.Architecture]
+
+	grub := path.Join(staging, "boot/grub")
+	if err := os.MkdirAll(grub, 0755); err != nil {
+		return err
+	}
+
+	config := fmt.Sprintf("set timeout=0\n\nmenuentry \"Live\" {\n"+
+		"\tlinux /live/vmlinuz %s\n\tinitrd /live/initrd.img\n}\n", iso.cmdline())
+	if err := ioutil.WriteFile(path.Join(grub, "grub.cfg"), []byte(config), 0644); err != nil {
+		return err
+	}
+
+	embedded := path.Join(context.Scratchdir, "iso-grub.cfg")
+	config = fmt.Sprintf("search --no-floppy --set=root --label %s\n"+
+		"set prefix=($root)/boot/grub\nconfigfile $prefix/grub.cfg\n", iso.VolumeID)
+	if err := ioutil.WriteFile(embedded, []byte(config), 0644); err != nil {
+		return err
+	}
+	defer os.Remove(embedded)
+
+	loader := path.Join(context.Scratchdir, target[1])
+	defer os.Remove(loader)
+	err := debos.Command{}.Run("grub-mkstandalone", "grub-mkstandalone", "--format="+target[0],
+		"--output="+loader, "--locales=", "--fonts=", "boot/grub/grub.cfg="+embedded)
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(loader)
+	if err != nil {
+		return err
+	}
+
+	// Room for the FAT metadata, in KiB as mkfs.vfat counts
+	image := path.Join(grub, "efi.img")
+	blocks := info.Size()/1024 + 1024
+	err = debos.Command{}.Run("mkfs.vfat", "mkfs.vfat", "-C", image, fmt.Sprintf("%d", blocks))
+	if err != nil {
+		return err
+	}
+	if err := (debos.Command{}).Run("mmd", "mmd", "-i", image, "::/EFI", "::/EFI/BOOT"); err != nil {
+		return err
+	}
+
+	return debos.Command{}.Run("mcopy", "mcopy", "-i", image, loader, "::/EFI/BOOT/"+target[1])
+}
+
+func (iso *IsoAction) Run(context *debos.DebosContext) error {
+	kernel, initrd, err := bootFiles(context.Rootdir, iso.Kernel, iso.Initrd)
+	if err != nil {
+		return err
+	}
+
+	staging, err := ioutil.TempDir(context.Scratchdir, "iso")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+
+	live := path.Join(staging, "live")
+	if err := os.MkdirAll(live, 0755); err != nil {
+		return err
+	}
+	if err := debos.CopyFile(kernel, path.Join(live, "vmlinuz"), 0644); err != nil {
+		return err
+	}
+	if err := debos.CopyFile(initrd, path.Join(live, "initrd.img"), 0644); err != nil {
+		return err
+	}
+
+	err = debos.Command{}.Run("mksquashfs", "mksquashfs", context.Rootdir, path.Join(live, "filesystem.squashfs"),
+		"-noappend", "-comp", iso.Compression)
+	if err != nil {
+		return err
+	}
+
+	command := []string{"xorriso", "-as", "mkisofs", "-iso-level", "3", "-full-iso9660-filenames",
+		"-joliet", "-rational-rock", "-volid", iso.VolumeID}
+
+	if *iso.Bios {
+		if err := iso.setupBios(staging); err != nil {
+			return err
+		}
+		command = append(command, "-isohybrid-mbr", path.Join(isolinuxDir, "isohdpfx.bin"),
+			"-eltorito-boot", "isolinux/isolinux.bin", "-eltorito-catalog", "isolinux/boot.cat",
+			"-no-emul-boot", "-boot-load-size", "4", "-boot-info-table")
+	}
+
+	if *iso.Uefi {
+		if err := iso.setupUefi(context, staging); err != nil {
+			return err
+		}
+		if *iso.Bios {
+			command = append(command, "-eltorito-alt-boot")
+		}
+		command = append(command, "-e", "boot/grub/efi.img", "-no-emul-boot", "-isohybrid-gpt-basdat")
+	}
+
+	output := path.Join(context.Artifactdir, iso.File)
+	command = append(command, "-output", output, staging)
+
+	log.Printf("Creating ISO image %s", iso.File)
+	return debos.Command{}.Run("xorriso", command...)
+}
@@ -0,0 +1,292 @@
+package actions
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/go-debos/debos"
+	"gopkg.in/yaml.v2"
+)
+
+// Problem found in a recipe by Lint
+type Diagnostic struct {
+	File     string `json:"file"`
+	Line     int    `json:"line,omitempty"`
+	Action   string `json:"action,omitempty"`
+	Severity string `json:"severity"` // "error" or "warning"
+	Check    string `json:"check"`
+	Message  string `json:"message"`
+}
+
+func (d Diagnostic) String() string {
+	location := d.File
+	if d.Line > 0 {
+		location += ":" + strconv.Itoa(d.Line)
+	}
+	if d.Action != "" {
+		location += ": action " + d.Action
+	}
+
+	return fmt.Sprintf("%s: %s: %s [%s]", location, d.Severity, d.Message, d.Check)
+}
+
+var (
+	missingKeyRegex   = regexp.MustCompile(`^template: [^:]*:(\d+):\d+: .*map has no entry for key "([^"]*)"`)
+	templateLineRegex = regexp.MustCompile(`^template: [^:]*:(\d+):`)
+	unknownFieldRegex = regexp.MustCompile(`field (\S+) not found in type actions\.(\w+)`)
+	yamlLineRegex     = regexp.MustCompile(`line \d+: `)
+	sectorFuncRegex   = regexp.MustCompile(`\{\{-?\s*sector\s`)
+	aptKeyAdvRegex    = regexp.MustCompile(`apt-key\s+adv`)
+	builtinOrigins    = []string{"artifacts", "filesystem", "recipe"}
+)
+
+type linter struct {
+	file        string
+	diagnostics []Diagnostic
+}
+
+func (l *linter) add(line int, action string, severity string, check string, format string, args ...interface{}) {
+	l.diagnostics = append(l.diagnostics, Diagnostic{
+		File:     l.file,
+		Line:     line,
+		Action:   action,
+		Severity: severity,
+		Check:    check,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+/*
+Template the recipe, reporting the variables used but not given. They are
+templated as empty, as done by the declared variables.
+*/
+func (l *linter) template(templateVars map[string]string) ([]byte, map[string]string, bool) {
+	t := newTemplate(path.Base(l.file))
+	t.Funcs(fileFuncs(path.Dir(l.file)))
+	if _, err := t.ParseFiles(l.file); err != nil {
+		l.add(0, "", "error", "template", "%v", err)
+		return nil, nil, false
+	}
+
+	vars := make(map[string]string)
+	for k, v := range templateVars {
+		vars[k] = v
+	}
+
+	header := declarations(t, vars)
+	for _, apply := range []func() (map[string]string, error){
+		func() (map[string]string, error) { return applyParameters(header.Parameters, vars) },
+		func() (map[string]string, error) { return applyVariables(header.Variables, vars) },
+	} {
+		applied, err := apply()
+		if err != nil {
+			l.add(0, "", "error", "variables", "%v", err)
+			return nil, nil, false
+		}
+		vars = applied
+	}
+
+	t.Option("missingkey=error")
+	for {
+		data := new(bytes.Buffer)
+		err := t.Execute(data, vars)
+		if err == nil {
+			return data.Bytes(), vars, true
+		}
+
+		m := missingKeyRegex.FindStringSubmatch(err.Error())
+		if m == nil {
+			line := 0
+			if lm := templateLineRegex.FindStringSubmatch(err.Error()); lm != nil {
+				line, _ = strconv.Atoi(lm[1])
+			}
+			l.add(line, "", "error", "template", "%v", err)
+			return nil, nil, false
+		}
+
+		line, _ := strconv.Atoi(m[1])
+		l.add(line, "", "warning", "undefined-variable",
+			"Variable '%s' is not defined unless given with -t, declare it in 'variables' with a default", m[2])
+		vars[m[2]] = ""
+	}
+}
+
+// Keys of a struct in YAML, including the inlined structs
+func yamlKeys(t reflect.Type, keys map[string]bool) {
+	for idx := 0; idx < t.NumField(); idx++ {
+		f := t.Field(idx)
+		tag := strings.Split(f.Tag.Get("yaml"), ",")
+		if len(tag) > 1 && tag[1] == "inline" {
+			yamlKeys(f.Type, keys)
+			continue
+		}
+		if f.PkgPath != "" || tag[0] == "-" {
+			continue
+		}
+		if tag[0] != "" {
+			keys[tag[0]] = true
+		} else {
+			keys[strings.ToLower(f.Name)] = true
+		}
+	}
+}
+
+// Check the header and the actions don't have unknown properties
+func (l *linter) properties(data []byte) {
+	var recipe map[string]interface{}
+	if err := yaml.Unmarshal(data, &recipe); err != nil {
+		l.add(0, "", "error", "syntax", "%v", err)
+		return
+	}
+
+	known := make(map[string]bool)
+	yamlKeys(reflect.TypeOf(Recipe{}), known)
+	for key := range recipe {
+		if !known[key] {
+			l.add(0, "", "error", "unknown-property", "Unknown recipe property '%s'", key)
+		}
+	}
+
+	list, _ := recipe["actions"].([]interface{})
+	for idx, a := range list {
+		raw, err := yaml.Marshal(a)
+		if err != nil {
+			continue
+		}
+
+		var base debos.BaseAction
+		yaml.Unmarshal(raw, &base)
+		name := fmt.Sprintf("#%d (%s)", idx+1, base.Action)
+
+		action, err := newAction(base.Action)
+		if err != nil {
+			l.add(0, name, "error", "unknown-action", "%v", err)
+			continue
+		}
+
+		err = yaml.UnmarshalStrict(raw, action)
+		if err == nil {
+			continue
+		}
+		for _, line := range strings.Split(err.Error(), "\n")[1:] {
+			line = yamlLineRegex.ReplaceAllString(strings.TrimSpace(line), "")
+			if m := unknownFieldRegex.FindStringSubmatch(line); m != nil {
+				l.add(0, name, "error", "unknown-property", "Unknown property '%s' of %s", m[1], m[2])
+			} else {
+				l.add(0, name, "error", "invalid-property", "%s", line)
+			}
+		}
+	}
+}
+
+// Origins of the actions, e.g. of the artifacts of swupdate
+func actionOrigins(v reflect.Value, origins *[]string) {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if !v.IsNil() {
+			actionOrigins(v.Elem(), origins)
+		}
+	case reflect.Struct:
+		for idx := 0; idx < v.NumField(); idx++ {
+			f := v.Type().Field(idx)
+			if f.PkgPath != "" {
+				continue
+			}
+			if f.Name == "Origin" && f.Type.Kind() == reflect.String {
+				*origins = append(*origins, v.Field(idx).String())
+			} else if _, ok := v.Field(idx).Interface().(Recipe); !ok {
+				actionOrigins(v.Field(idx), origins)
+			}
+		}
+	case reflect.Slice:
+		for idx := 0; idx < v.Len(); idx++ {
+			actionOrigins(v.Index(idx), origins)
+		}
+	}
+}
+
+// Check the parsed actions: origins, partitions and deprecated syntax
+func (l *linter) actions(r *Recipe, data []byte) {
+	defined := append([]string{}, builtinOrigins...)
+
+	for _, a := range r.Actions {
+		var origins []string
+		actionOrigins(reflect.ValueOf(a.Action), &origins)
+		for _, o := range origins {
+			found := o == "" || strings.Contains(o, "${")
+			for _, d := range defined {
+				found = found || d == o
+			}
+			if !found {
+				l.add(0, a.String(), "error", "unknown-origin", "Origin '%s' isn't defined by a previous action", o)
+			}
+		}
+
+		switch action := a.Action.(type) {
+		case *DownloadAction:
+			if action.Name != "" {
+				defined = append(defined, action.Name)
+			}
+		case *GitAction:
+			if action.Name != "" {
+				defined = append(defined, action.Name)
+			}
+		case *OstreePullAction:
+			if action.Name != "" {
+				defined = append(defined, action.Name)
+			}
+		case *ImagePartitionAction:
+			for _, p := range action.layoutProblems(r.SectorSize) {
+				l.add(0, a.String(), "error", "partitions", "%s", p)
+			}
+		case *RawAction:
+			if action.Path != "" {
+				l.add(0, a.String(), "warning", "deprecated", "The 'path' property is deprecated, use 'origin' and 'source'")
+			}
+		case *RunAction:
+			if aptKeyAdvRegex.MatchString(action.Command) {
+				l.add(0, a.String(), "warning", "deprecated", "'apt-key adv' is deprecated, use the apt-keyring action")
+			}
+		}
+	}
+
+	for idx, line := range strings.Split(string(data), "\n") {
+		if sectorFuncRegex.MatchString(line) {
+			l.add(idx+1, "", "warning", "deprecated", "The 'sector' function is deprecated, use the 's' suffix, e.g. '256s'")
+		}
+	}
+}
+
+/*
+Lint checks the recipe for problems without building it: unknown properties,
+template variables not given, origins not defined by previous actions,
+overlapping partitions and deprecated syntax. Included recipes aren't checked,
+they have to be linted on their own.
+*/
+func Lint(file string, templateVars map[string]string) []Diagnostic {
+	l := linter{file: file}
+
+	data, vars, ok := l.template(templateVars)
+	if !ok {
+		return l.diagnostics
+	}
+
+	l.properties(data)
+
+	r := Recipe{}
+	if err := r.Parse(file, false, false, vars); err != nil {
+		l.add(0, "", "error", "recipe", "%v", err)
+		return l.diagnostics
+	}
+
+	source, _ := ioutil.ReadFile(file)
+	l.actions(&r, source)
+
+	return l.diagnostics
+}
@@ -0,0 +1,278 @@
+/*
+LocalRepository Action
+
+Build a signed APT repository in the target rootfs from a directory of .deb
+packages and add it to the APT sources, so the packages can be installed by
+the 'apt' action with full dependency resolution.
+
+ # Yaml syntax:
+ - action: local-repository
+   origin: name
+   source: directory
+   sources:
+     - origin: name
+       source: path
+   name: name
+   destination: path
+   signing-key: file
+
+Optional properties:
+
+- origin -- reference to a named file or directory, e.g. from a 'download'
+action. Defaults to the recipe directory.
+
+- source -- path relative to 'origin' of the directory containing the .deb
+packages, searched recursively, or of a single .deb package. Defaults to
+'origin' itself.
+
+- sources -- list of additional 'origin' and 'source' pairs, e.g. a
+downloaded .deb together with a directory of the recipe. The packages of all
+the sources end up in the same repository, so dependencies between them are
+resolved by a single 'apt' action.
+
+- name -- name of the repository, used for the '/etc/apt/sources.list.d/<name>.sources'
+and '/etc/apt/keyrings/<name>.gpg' files. Default 'debos-local'.
+
+- destination -- absolute path of the repository in the target rootfs.
+Defaults to '/var/lib/debos-repositories/<name>'. The repository is kept in
+the image, use a 'run' action to remove it and its sources once the packages
+are installed if needed.
+
+- signing-key -- file of the secret OpenPGP key used to sign the repository,
+relative to the recipe directory. By default a key is generated for the build
+and only its public part ends up in the image.
+
+At least one of 'origin', 'source' or 'sources' has to be given. The repository is
+generated on the host with 'apt-ftparchive' and signed with 'gpg'. The
+packages lists have to be updated before installing, e.g. with the default
+'update' of the 'apt' action.
+*/
+package actions
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-debos/debos"
+	"github.com/go-debos/fakemachine"
+)
+
+type LocalRepositorySource struct {
+	Origin string
+	Source string
+}
+
+type LocalRepositoryAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Origin           string
+	Source           string
+	Sources          []LocalRepositorySource
+	Name             string
+	Destination      string
+	SigningKey       string `yaml:"signing-key"`
+}
+
+func NewLocalRepositoryAction() *LocalRepositoryAction {
+	return &LocalRepositoryAction{Name: "debos-local"}
+}
+
+func (l *LocalRepositoryAction) Verify(context *debos.DebosContext) error {
+	if l.Origin == "" && l.Source == "" && len(l.Sources) == 0 {
+		return errors.New("At least one of 'origin', 'source' or 'sources' properties is needed")
+	}
+
+	for _, s := range l.Sources {
+		if s.Origin == "" && s.Source == "" {
+			return errors.New("Sources need at least one of 'origin' or 'source'")
+		}
+	}
+
+	if l.Name == "" || strings.Contains(l.Name, "/") {
+		return errors.New("Property 'name' must be a valid file name")
+	}
+
+	if l.Destination != "" && !path.IsAbs(l.Destination) {
+		return fmt.Errorf("Property 'destination' must be an absolute path: %s", l.Destination)
+	}
+
+	return nil
+}
+
+func (l *LocalRepositoryAction) PreMachine(context *debos.DebosContext, m *fakemachine.Machine, args *[]string) error {
+	if l.SigningKey != "" {
+		l.SigningKey = debos.CleanPathAt(l.SigningKey, context.RecipeDir)
+		m.AddVolume(path.Dir(l.SigningKey))
+	}
+
+	for _, s := range l.sources() {
+		if s.Origin == "" && path.IsAbs(s.Source) {
+			m.AddVolume(path.Dir(s.Source))
+		}
+	}
+
+	return nil
+}
+
+func (l *LocalRepositoryAction) WatchPaths(context *debos.DebosContext) []string {
+	var paths []string
+
+	for _, s := range l.sources() {
+		if s.Origin == "" || s.Origin == "recipe" {
+			paths = append(paths, debos.CleanPathAt(s.Source, context.RecipeDir))
+		}
+	}
+
+	return paths
+}
+
+// All the sources of packages, including the 'origin' and 'source' properties
+func (l *LocalRepositoryAction) sources() []LocalRepositorySource {
+	if l.Origin == "" && l.Source == "" {
+		return l.Sources
+	}
+
+	return append([]LocalRepositorySource{{l.Origin, l.Source}}, l.Sources...)
+}
+
+func (l *LocalRepositoryAction) destination() string {
+	if l.Destination != "" {
+		return l.Destination
+	}
+	return path.Join("/var/lib/debos-repositories", l.Name)
+}
+
+// Copy the packages to the pool of the repository
+func (l *LocalRepositoryAction) copyPackages(source, pool string) (int, error) {
+	count := 0
+
+	err := filepath.Walk(source, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || !strings.HasSuffix(p, ".deb") {
+			return nil
+		}
+
+		count++
+		return debos.CopyFile(p, path.Join(pool, path.Base(p)), 0644)
+	})
+
+	return count, err
+}
+
+// Sign the repository and return the public key
+func (l *LocalRepositoryAction) sign(context *debos.DebosContext, repository string) ([]byte, error) {
+	gnupghome, err := ioutil.TempDir(context.Scratchdir, "local-repository-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(gnupghome)
+
+	gpg := debos.Command{}
+	gpg.AddEnvKey("GNUPGHOME", gnupghome)
+
+	if l.SigningKey != "" {
+		err = gpg.Run("gpg", "gpg", "--batch", "--import", debos.CleanPathAt(l.SigningKey, context.RecipeDir))
+	} else {
+		err = gpg.Run("gpg", "gpg", "--batch", "--passphrase", "", "--quick-gen-key",
+			fmt.Sprintf("debos %s repository", l.Name), "default", "sign", "never")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = gpg.Run("gpg", "gpg", "--batch", "--yes", "--clearsign",
+		"-o", path.Join(repository, "InRelease"), path.Join(repository, "Release"))
+	if err != nil {
+		return nil, err
+	}
+
+	keyring := path.Join(gnupghome, "keyring.gpg")
+	if err := gpg.Run("gpg", "gpg", "--batch", "--output", keyring, "--export"); err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadFile(keyring)
+}
+
+func (l *LocalRepositoryAction) Run(context *debos.DebosContext) error {
+	repository, err := debos.RestrictedPath(context.Rootdir, l.destination())
+	if err != nil {
+		return err
+	}
+
+	pool := path.Join(repository, "pool")
+	if err := os.MkdirAll(pool, 0755); err != nil {
+		return err
+	}
+
+	count := 0
+	for _, s := range l.sources() {
+		origin := context.RecipeDir
+		if s.Origin != "" {
+			var found bool
+			if origin, found = context.Origin(s.Origin); !found {
+				return fmt.Errorf("Origin not found '%s'", s.Origin)
+			}
+		}
+		source := debos.CleanPathAt(s.Source, origin)
+
+		n, err := l.copyPackages(source, pool)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return fmt.Errorf("No .deb packages found in %s", source)
+		}
+		count += n
+	}
+	log.Printf("Building repository %s from %d packages", l.destination(), count)
+
+	ftparchive := debos.Command{Dir: repository}
+	packages, err := ftparchive.Output("local-repository", "apt-ftparchive", "packages", "pool")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path.Join(repository, "Packages"), packages, 0644); err != nil {
+		return err
+	}
+
+	// apt-ftparchive lists every index of the directory in the Release, so
+	// neither the Release being generated nor a stale one may be in there
+	for _, f := range []string{"Release", "InRelease"} {
+		if err := os.Remove(path.Join(repository, f)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	release, err := ftparchive.Output("local-repository", "apt-ftparchive", "release", ".")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path.Join(repository, "Release"), release, 0644); err != nil {
+		return err
+	}
+
+	key, err := l.sign(context, repository)
+	if err != nil {
+		return err
+	}
+
+	keyring := path.Join("/etc/apt/keyrings", l.Name+".gpg")
+	if err := writeRootfsFile(context, keyring, key, 0644); err != nil {
+		return err
+	}
+
+	source822 := AptSource{
+		URIs:     []string{"file:" + l.destination()},
+		Suites:   []string{"./"},
+		SignedBy: keyring,
+	}
+	file := path.Join("/etc/apt/sources.list.d", l.Name+".sources")
+	return writeRootfsFile(context, file, []byte(source822.stanza()), 0644)
+}
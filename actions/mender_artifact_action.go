@@ -0,0 +1,180 @@
+/*
+MenderArtifact Action
+
+Create a Mender artifact of the root filesystem with the 'mender-artifact'
+tool.
+
+ # Yaml syntax:
+ - action: mender-artifact
+   artifact: filename.mender
+   artifact-name: name
+   device-types:
+     - device-type1
+   partition: root
+   origin: name
+   file: filename
+   software-version: version
+   compression: gzip
+   signing-key: filename
+
+Mandatory properties:
+
+- artifact -- name of the output artifact, relative to the artifact directory.
+
+- artifact-name -- name of the artifact as reported by the Mender client.
+
+- device-types -- list of device types the artifact is compatible with.
+
+- partition -- name of the partition from the 'image-partition' action holding
+the root filesystem. As the partition is still mounted it is recommended to
+run this action after all other actions modifying it.
+
+- file -- the filesystem image file located in 'origin', mutually exclusive
+with 'partition'.
+
+One of 'partition' or 'file' has to be set.
+
+Optional properties:
+
+- origin -- reference to a named file or directory containing 'file'. The
+default value is 'artifacts'.
+
+- software-version -- value of the rootfs-image.version provide.
+
+- compression -- compression of the artifact payload, one of 'none',
+'gzip', 'lzma' or 'zstd_better' as supported by mender-artifact.
+
+- signing-key -- private key file, relative to the recipe directory, used to
+sign the artifact.
+*/
+package actions
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"syscall"
+
+	"github.com/go-debos/debos"
+	"github.com/go-debos/fakemachine"
+)
+
+type MenderArtifactAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Artifact         string
+	ArtifactName     string   `yaml:"artifact-name"`
+	DeviceTypes      []string `yaml:"device-types"`
+	Partition        string
+	Origin           string
+	File             string
+	SoftwareVersion  string `yaml:"software-version"`
+	Compression      string
+	SigningKey       string `yaml:"signing-key"`
+}
+
+func (m *MenderArtifactAction) Verify(context *debos.DebosContext) error {
+	if len(m.Artifact) == 0 {
+		return errors.New("Property 'artifact' is mandatory for mender-artifact action")
+	}
+
+	if len(m.ArtifactName) == 0 {
+		return errors.New("Property 'artifact-name' is mandatory for mender-artifact action")
+	}
+
+	if len(m.DeviceTypes) == 0 {
+		return errors.New("At least one device type is needed for mender-artifact action")
+	}
+
+	if (len(m.Partition) == 0) == (len(m.File) == 0) {
+		return errors.New("Exactly one of 'partition' and 'file' properties has to be set")
+	}
+
+	switch m.Compression {
+	case "", "none", "gzip", "lzma", "zstd_fastest", "zstd_default", "zstd_better", "zstd_best":
+	default:
+		return fmt.Errorf("Unsupported compression '%s'", m.Compression)
+	}
+
+	if m.SigningKey != "" {
+		m.SigningKey = debos.CleanPathAt(m.SigningKey, context.RecipeDir)
+		if _, err := os.Stat(m.SigningKey); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *MenderArtifactAction) PreMachine(context *debos.DebosContext, machine *fakemachine.Machine, args *[]string) error {
+	// Signing key may be kept outside of the recipe directory
+	if m.SigningKey != "" {
+		machine.AddVolume(path.Dir(m.SigningKey))
+	}
+
+	return nil
+}
+
+func (m *MenderArtifactAction) Run(context *debos.DebosContext) error {
+	var source string
+
+	if m.Partition != "" {
+		for _, p := range context.ImagePartitions {
+			if p.Name == m.Partition {
+				source = p.DevicePath
+				break
+			}
+		}
+
+		if source == "" {
+			return fmt.Errorf("Failed to find partition named %s", m.Partition)
+		}
+
+		// Make sure everything written so far ends up on the partition
+		syscall.Sync()
+	} else {
+		origin := context.Artifactdir
+		if m.Origin != "" {
+			var found bool
+			if origin, found = context.Origin(m.Origin); !found {
+				return fmt.Errorf("Origin not found '%s'", m.Origin)
+			}
+		}
+
+		var err error
+		source, err = debos.RestrictedPath(origin, m.File)
+		if err != nil {
+			return err
+		}
+	}
+
+	output := path.Join(context.Artifactdir, m.Artifact)
+
+	cmdline := []string{"mender-artifact"}
+
+	// Compression is a global option of mender-artifact
+	if m.Compression != "" {
+		cmdline = append(cmdline, "--compression", m.Compression)
+	}
+
+	cmdline = append(cmdline, "write", "rootfs-image",
+		"--file", source,
+		"--artifact-name", m.ArtifactName,
+		"--output-path", output)
+
+	for _, t := range m.DeviceTypes {
+		cmdline = append(cmdline, "--device-type", t)
+	}
+
+	if m.SoftwareVersion != "" {
+		cmdline = append(cmdline, "--software-version", m.SoftwareVersion)
+	}
+
+	if m.SigningKey != "" {
+		cmdline = append(cmdline, "--key", m.SigningKey)
+	}
+
+	log.Printf("Creating Mender artifact %s\n", output)
+	return debos.Command{}.Run("mender-artifact", cmdline...)
+}
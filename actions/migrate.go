@@ -0,0 +1,128 @@
+package actions
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Rewrite of a deprecated syntax to its current equivalent
+type migration struct {
+	description string
+	apply       func(lines []string) ([]string, bool)
+}
+
+var (
+	actionItemRegex  = regexp.MustCompile(`^(\s*)-\s+action:\s*(\S+)`)
+	sectorCallRegex  = regexp.MustCompile(`\{\{-?\s*sector\s+(\d+)\s*-?\}\}`)
+	propertyKeyRegex = regexp.MustCompile(`^(\s*)([a-zA-Z_-]+):`)
+)
+
+/*
+The migrations are applied in order on the lines of the recipe, before it's
+templated, so the comments, the formatting and the template directives are
+kept.
+*/
+var migrations = []migration{
+	{"Replace the deprecated 'sector' function by the 's' suffix", migrateSector},
+	{"Replace the deprecated 'source' and 'path' properties of raw by 'origin' and 'source'", migrateRawPath},
+}
+
+func migrateSector(lines []string) ([]string, bool) {
+	changed := false
+	for idx, line := range lines {
+		migrated := sectorCallRegex.ReplaceAllString(line, "${1}s")
+		changed = changed || migrated != line
+		lines[idx] = migrated
+	}
+
+	return lines, changed
+}
+
+/*
+Lines of the properties of each action of the given type, as the start and
+the end of the block and the indentation of the properties.
+*/
+func actionBlocks(lines []string, action string) [][3]int {
+	var blocks [][3]int
+
+	for start := 0; start < len(lines); start++ {
+		m := actionItemRegex.FindStringSubmatch(lines[start])
+		if m == nil || strings.Trim(m[2], `"'`) != action {
+			continue
+		}
+
+		indent := len(m[1])
+		end := start + 1
+		for ; end < len(lines); end++ {
+			trimmed := strings.TrimSpace(lines[end])
+			if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+				continue
+			}
+			if len(lines[end])-len(strings.TrimLeft(lines[end], " ")) <= indent {
+				break
+			}
+		}
+		blocks = append(blocks, [3]int{start, end, indent + 2})
+	}
+
+	return blocks
+}
+
+// Index of the line of the property of the block, -1 if not set
+func blockProperty(lines []string, block [3]int, name string) int {
+	for idx := block[0]; idx < block[1]; idx++ {
+		line := lines[idx]
+		if idx == block[0] {
+			// The first property shares its line with the '-'
+			line = strings.Replace(line, "-", " ", 1)
+		}
+		m := propertyKeyRegex.FindStringSubmatch(line)
+		if m != nil && len(m[1]) == block[2] && m[2] == name {
+			return idx
+		}
+	}
+
+	return -1
+}
+
+func renameProperty(lines []string, idx int, from, to string) {
+	lines[idx] = strings.Replace(lines[idx], from+":", to+":", 1)
+}
+
+func migrateRawPath(lines []string) ([]string, bool) {
+	changed := false
+
+	for _, block := range actionBlocks(lines, "raw") {
+		source := blockProperty(lines, block, "source")
+		path := blockProperty(lines, block, "path")
+		if path < 0 || source < 0 || blockProperty(lines, block, "origin") >= 0 {
+			continue
+		}
+
+		renameProperty(lines, source, "source", "origin")
+		renameProperty(lines, path, "path", "source")
+		changed = true
+	}
+
+	return lines, changed
+}
+
+/*
+Migrate rewrites the deprecated syntaxes of a recipe to their current
+equivalents, returning the new recipe and the descriptions of the migrations
+done.
+*/
+func Migrate(data []byte) ([]byte, []string) {
+	var done []string
+
+	lines := strings.Split(string(data), "\n")
+	for _, m := range migrations {
+		var changed bool
+		lines, changed = m.apply(lines)
+		if changed {
+			done = append(done, m.description)
+		}
+	}
+
+	return []byte(strings.Join(lines, "\n")), done
+}
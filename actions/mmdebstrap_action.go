@@ -18,6 +18,12 @@ and this may lead to incorrect configuration when becoming part of the created r
    include:
    dpkg-opts:
    apt-opts:
+   setup-hooks:
+   extract-hooks:
+   essential-hooks:
+   customize-hooks:
+   hook-dirs:
+   probe-mirrors: bool
 
 Mandatory properties:
 
@@ -27,6 +33,7 @@ Optional properties:
 
 - mirrors -- list of URLs with Debian-compatible repository
  If no mirror is specified debos will use http://deb.debian.org/debian as default.
+ The http mirrors are fetched through the '--apt-proxy' command line option if set.
 
 - variant -- name of the bootstrap script variant to use
 
@@ -48,6 +55,28 @@ Example:
 
 - apt-opts -- list of arbitrary options to apt.
 
+- setup-hooks -- list of shell commands run after the initial setup of the
+target directory, see mmdebstrap(1). The target directory is given as '$1'.
+
+- extract-hooks -- list of shell commands run after the essential packages are
+extracted.
+
+- essential-hooks -- list of shell commands run after the essential packages
+are installed.
+
+- customize-hooks -- list of shell commands run after all the packages are
+installed. Commands prefixed with 'chroot "$1"' run in the target directory.
+
+- hook-dirs -- list of directories relative to the recipe directory holding
+hook scripts, named after the hook they are run for (e.g. 'customize00.sh').
+
+- probe-mirrors -- check the HTTP mirrors given as URLs serve the suite before
+bootstrapping, fetching their Release file and verifying the checksum of the
+Release file of the first component. Unhealthy mirrors are skipped, and the
+build fails early with the reasons if none is healthy. False by default, the
+probes can't pass authenticating proxies or use the credentials of APT's
+auth.conf.
+
 */
 package actions
 
@@ -73,6 +102,12 @@ type MmdebstrapAction struct {
 	Include          []string
 	DpkgOpts         []string `yaml:"dpkg-opts"`
 	AptOpts          []string `yaml:"apt-opts"`
+	SetupHooks       []string `yaml:"setup-hooks"`
+	ExtractHooks     []string `yaml:"extract-hooks"`
+	EssentialHooks   []string `yaml:"essential-hooks"`
+	CustomizeHooks   []string `yaml:"customize-hooks"`
+	HookDirs         []string `yaml:"hook-dirs"`
+	ProbeMirrors     bool     `yaml:"probe-mirrors"`
 }
 
 func NewMmdebstrapAction() *MmdebstrapAction {
@@ -93,6 +128,10 @@ func (d *MmdebstrapAction) listOptionFiles(context *debos.DebosContext) []string
 		}
 	}
 
+	for _, dir := range d.HookDirs {
+		files = append(files, debos.CleanPathAt(dir, context.RecipeDir))
+	}
+
 	return files
 }
 
@@ -173,11 +212,44 @@ func (d *MmdebstrapAction) Run(context *debos.DebosContext) error {
 		}
 	}
 
+	hooks := []struct {
+		option   string
+		commands []string
+	}{
+		{"--setup-hook", d.SetupHooks},
+		{"--extract-hook", d.ExtractHooks},
+		{"--essential-hook", d.EssentialHooks},
+		{"--customize-hook", d.CustomizeHooks},
+	}
+	for _, hook := range hooks {
+		for _, command := range hook.commands {
+			cmdline = append(cmdline, fmt.Sprintf("%s=%s", hook.option, command))
+		}
+	}
+
+	for _, dir := range d.HookDirs {
+		dir = debos.CleanPathAt(dir, context.RecipeDir)
+		cmdline = append(cmdline, fmt.Sprintf("--hook-dir=%s", dir))
+	}
+
 	cmdline = append(cmdline, d.Suite)
 	cmdline = append(cmdline, context.Rootdir)
 
 	if d.Mirrors != nil {
-		cmdline = append(cmdline, d.Mirrors...)
+		mirrors := d.Mirrors
+		if d.ProbeMirrors {
+			component := "main"
+			if len(d.Components) > 0 {
+				component = d.Components[0]
+			}
+
+			var err error
+			mirrors, err = debos.HealthyMirrors(mirrors, d.Suite, component, context.Architecture)
+			if err != nil {
+				return err
+			}
+		}
+		cmdline = append(cmdline, mirrors...)
 	}
 
 	/* Make sure files in /etc/apt/ exist inside the fakemachine otherwise
@@ -191,7 +263,13 @@ func (d *MmdebstrapAction) Run(context *debos.DebosContext) error {
 		}
 	}
 
-	mmdebstrapErr := debos.Command{}.Run("Mmdebstrap", cmdline...)
+	bootstrap := debos.Command{}
+	// Passed through the environment so it doesn't end up in the image
+	if proxy := debos.ResolveAptProxy(*context, ""); proxy != "" {
+		bootstrap.AddEnvKey("http_proxy", proxy)
+	}
+
+	mmdebstrapErr := bootstrap.Run("Mmdebstrap", cmdline...)
 
 	/* Cleanup resolv.conf after mmdebstrap */
 	resolvconf := path.Join(context.Rootdir, "/etc/resolv.conf")
@@ -0,0 +1,320 @@
+/*
+Netboot Action
+
+Lay out a TFTP/HTTP boot directory to boot the filesystem over the network,
+with its kernel, its initrd configured for the network root and the pxelinux
+and GRUB netboot entries.
+
+ # Yaml syntax:
+ - action: netboot
+   directory: netboot
+   root: squashfs
+   root-source: location
+   url: http://server/netboot
+   kernel: /boot/vmlinuz-version
+   initrd: /boot/initrd.img-version
+   compression: zstd
+   label: Debian
+   append-kernel-cmdline: arguments
+   setup-initramfs: bool
+   pxelinux: bool
+   pxelinux-template: file
+   grub-template: file
+
+Mandatory properties:
+
+- directory -- boot directory, relative to the artifact directory, to serve
+with TFTP or HTTP.
+
+Optional properties:
+
+- root -- how the root filesystem is mounted, 'nfs' from the NFS export of
+'root-source', 'nbd' from the NBD export of 'root-source', or 'squashfs' where
+the filesystem is put in 'filesystem.squashfs' in the boot directory and
+fetched from 'url' at boot by live-boot, with the writes kept in memory.
+Default 'squashfs'.
+
+- root-source -- location of the root filesystem for 'nfs' and 'nbd', as
+given to the 'nfsroot' and 'nbdroot' kernel parameters, e.g.
+'192.168.0.1:/srv/nfs/root,vers=4' or '192.168.0.1,root'. Exporting the
+filesystem is left to the server.
+
+- url -- HTTP URL of the boot directory, mandatory for 'squashfs'.
+
+- kernel -- path of the kernel in the filesystem. Default is the latest
+'/boot/vmlinuz-*'.
+
+- initrd -- path of the initrd in the filesystem. Default is the initrd
+matching the kernel, e.g. '/boot/initrd.img-6.1.0-18-amd64'.
+
+- compression -- compression of the squashfs image, one of 'gzip', 'lzo',
+'lz4', 'xz' or 'zstd'. Default 'zstd'.
+
+- label -- label of the boot entries. Default 'debos'.
+
+- append-kernel-cmdline -- additional kernel command line arguments.
+
+- setup-initramfs -- configure initramfs-tools for the network root and
+update the initrd of the installed kernels before copying it. The filesystem
+needs initramfs-tools, plus nbd-client for 'nbd' and live-boot for
+'squashfs'. Default 'true'.
+
+- pxelinux -- copy 'pxelinux.0' and 'ldlinux.c32' of the pxelinux and
+syslinux-common packages of the host to the boot directory. Default 'true'
+for the 'amd64' and 'i386' architectures.
+
+- pxelinux-template -- Go template of 'pxelinux.cfg/default', relative to the
+recipe directory, replacing the default one.
+
+- grub-template -- Go template of 'grub/grub.cfg', relative to the recipe
+directory, replacing the default one. The GRUB netboot image itself, e.g.
+made with 'grub-mknetdir', is left to the boot server.
+
+The templates get the boot entry as '{{ .Label }}', '{{ .Kernel }}',
+'{{ .Initrd }}' and '{{ .Cmdline }}', the kernel and initrd being relative to
+the boot directory.
+
+ # Example:
+ - action: apt
+   packages: [ linux-image-amd64, initramfs-tools, live-boot ]
+
+ - action: netboot
+   directory: tftp
+   url: http://192.168.0.1/tftp
+*/
+package actions
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"text/template"
+
+	"github.com/go-debos/debos"
+)
+
+const netbootPxelinuxTemplate = `default {{ .Label }}
+prompt 0
+timeout 0
+
+label {{ .Label }}
+  kernel {{ .Kernel }}
+  append initrd={{ .Initrd }} {{ .Cmdline }}
+`
+
+const netbootGrubTemplate = `set timeout=0
+
+menuentry "{{ .Label }}" {
+	linux {{ .Kernel }} {{ .Cmdline }}
+	initrd {{ .Initrd }}
+}
+`
+
+const pxelinuxDir = "/usr/lib/PXELINUX"
+
+// Boot entry of the templates
+type netbootEntry struct {
+	Label   string
+	Kernel  string
+	Initrd  string
+	Cmdline string
+}
+
+type NetbootAction struct {
+	debos.BaseAction    `yaml:",inline"`
+	Directory           string
+	Root                string
+	RootSource          string `yaml:"root-source"`
+	URL                 string `yaml:"url"`
+	Kernel              string
+	Initrd              string
+	Compression         string
+	Label               string
+	AppendKernelCmdline string `yaml:"append-kernel-cmdline"`
+	SetupInitramfs      bool   `yaml:"setup-initramfs"`
+	Pxelinux            *bool
+	PxelinuxTemplate    string `yaml:"pxelinux-template"`
+	GrubTemplate        string `yaml:"grub-template"`
+}
+
+func NewNetbootAction() *NetbootAction {
+	return &NetbootAction{
+		Root:           "squashfs",
+		Compression:    "zstd",
+		Label:          "debos",
+		SetupInitramfs: true,
+	}
+}
+
+func (n *NetbootAction) Verify(context *debos.DebosContext) error {
+	if n.Directory == "" {
+		return fmt.Errorf("Property 'directory' is mandatory")
+	}
+
+	switch n.Root {
+	case "nfs", "nbd":
+		if n.RootSource == "" {
+			return fmt.Errorf("Property 'root-source' is mandatory for the %s root", n.Root)
+		}
+	case "squashfs":
+		if n.URL == "" {
+			return fmt.Errorf("Property 'url' is mandatory for the squashfs root")
+		}
+		supported := false
+		for _, c := range squashfsCompressions {
+			supported = supported || c == n.Compression
+		}
+		if !supported {
+			return fmt.Errorf("Unsupported compression '%s'", n.Compression)
+		}
+	default:
+		return fmt.Errorf("Unknown root '%s', has to be 'nfs', 'nbd' or 'squashfs'", n.Root)
+	}
+
+	if n.Pxelinux == nil {
+		pxelinux := context.Architecture == "amd64" || context.Architecture == "i386"
+		n.Pxelinux = &pxelinux
+	}
+
+	return nil
+}
+
+func (n *NetbootAction) cmdline() string {
+	var cmdline string
+
+	switch n.Root {
+	case "nfs":
+		cmdline = "boot=nfs root=/dev/nfs nfsroot=" + n.RootSource + " ip=dhcp rw"
+	case "nbd":
+		cmdline = "root=/dev/nbd0 nbdroot=" + n.RootSource + " ip=dhcp"
+	case "squashfs":
+		cmdline = "boot=live fetch=" + n.URL + "/filesystem.squashfs ip=dhcp"
+	}
+
+	if n.AppendKernelCmdline != "" {
+		cmdline += " " + n.AppendKernelCmdline
+	}
+
+	return cmdline
+}
+
+func (n *NetbootAction) setupInitramfs(context *debos.DebosContext) error {
+	// Files of the required packages, in /usr or not
+	required := map[string][]string{
+		"initramfs-tools": {"usr/sbin/update-initramfs"},
+	}
+	switch n.Root {
+	case "nbd":
+		required["nbd-client"] = []string{"usr/sbin/nbd-client", "sbin/nbd-client"}
+	case "squashfs":
+		required["live-boot"] = []string{"usr/lib/live/boot", "lib/live/boot"}
+	}
+	for pkg, files := range required {
+		found := false
+		for _, f := range files {
+			if _, err := os.Stat(path.Join(context.Rootdir, f)); err == nil {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s isn't installed in the filesystem", pkg)
+		}
+	}
+
+	if n.Root == "nfs" {
+		conf := "# Generated by debos: boot from the NFS root\nBOOT=nfs\n"
+		if err := writeRootfsFile(context, "/etc/initramfs-tools/conf.d/debos-netboot", []byte(conf), 0644); err != nil {
+			return err
+		}
+	}
+
+	cmd := debos.NewChrootCommandForContext(*context)
+	return cmd.Run("update-initramfs", "update-initramfs", "-u", "-k", "all")
+}
+
+// Render the template of the recipe, or the default one, to the file
+func (n *NetbootAction) render(context *debos.DebosContext, file, recipeTemplate, fallback string,
+	entry netbootEntry) error {
+	text := fallback
+	if recipeTemplate != "" {
+		data, err := ioutil.ReadFile(debos.CleanPathAt(recipeTemplate, context.RecipeDir))
+		if err != nil {
+			return err
+		}
+		text = string(data)
+	}
+
+	t, err := template.New(path.Base(file)).Parse(text)
+	if err != nil {
+		return fmt.Errorf("Failed to parse the template of %s: %v", path.Base(file), err)
+	}
+
+	var out bytes.Buffer
+	if err := t.Execute(&out, entry); err != nil {
+		return fmt.Errorf("Failed to render %s: %v", path.Base(file), err)
+	}
+
+	if err := os.MkdirAll(path.Dir(file), 0755); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(file, out.Bytes(), 0644)
+}
+
+func (n *NetbootAction) Run(context *debos.DebosContext) error {
+	if n.SetupInitramfs {
+		if err := n.setupInitramfs(context); err != nil {
+			return err
+		}
+	}
+
+	kernel, initrd, err := bootFiles(context.Rootdir, n.Kernel, n.Initrd)
+	if err != nil {
+		return err
+	}
+
+	dir := path.Join(context.Artifactdir, n.Directory)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err := debos.CopyFile(kernel, path.Join(dir, "vmlinuz"), 0644); err != nil {
+		return err
+	}
+	if err := debos.CopyFile(initrd, path.Join(dir, "initrd.img"), 0644); err != nil {
+		return err
+	}
+
+	if n.Root == "squashfs" {
+		err := debos.Command{}.Run("mksquashfs", "mksquashfs", context.Rootdir, path.Join(dir, "filesystem.squashfs"),
+			"-noappend", "-comp", n.Compression)
+		if err != nil {
+			return err
+		}
+	}
+
+	if *n.Pxelinux {
+		for _, f := range []string{path.Join(pxelinuxDir, "pxelinux.0"), path.Join(syslinuxDir, "ldlinux.c32")} {
+			if err := debos.CopyFile(f, path.Join(dir, path.Base(f)), 0644); err != nil {
+				return fmt.Errorf("Failed to copy %s, is pxelinux installed? %v", f, err)
+			}
+		}
+	}
+
+	entry := netbootEntry{
+		Label:   n.Label,
+		Kernel:  "vmlinuz",
+		Initrd:  "initrd.img",
+		Cmdline: n.cmdline(),
+	}
+
+	err = n.render(context, path.Join(dir, "pxelinux.cfg/default"), n.PxelinuxTemplate, netbootPxelinuxTemplate, entry)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Netboot directory %s ready for a %s root", n.Directory, n.Root)
+	return n.render(context, path.Join(dir, "grub/grub.cfg"), n.GrubTemplate, netbootGrubTemplate, entry)
+}
@@ -0,0 +1,136 @@
+/*
+OstreeCheckout Action
+
+Check out an OSTree commit as the rootfs, e.g. to layer packages and overlays
+on a previous release and commit the result back with the 'ostree-commit'
+action, instead of composing the rootfs from scratch.
+
+ # Yaml syntax:
+ - action: ostree-checkout
+   repository: repository name
+   origin: name
+   ref: branch name
+   usr-etc: bool
+
+Mandatory properties:
+
+- repository -- path to the repository, relative to the 'artifact' directory.
+Not needed if 'origin' is given.
+
+- ref -- branch or commit checksum to check out.
+
+Optional properties:
+
+- origin -- name of a repository pulled by the 'ostree-pull' action, used
+instead of 'repository'.
+
+- usr-etc -- move '/usr/etc' of the commit to '/etc', as committed by the
+'ostree-commit' action with 'usr-etc', so the packages and the configuration
+can be changed as in any rootfs. Default 'false'.
+
+The files are copied from the repository, so changing the rootfs doesn't
+change the repository. The commit is checked out over the content of the
+rootfs, which is usually empty at this point.
+
+Example of an incremental build of a release:
+
+ - action: ostree-pull
+   repository: repo
+   url: https://example.com/ostree/repo
+   refs:
+     - os/amd64/main
+   mirror: true
+
+ - action: ostree-checkout
+   repository: repo
+   ref: os/amd64/main
+   usr-etc: true
+
+ - action: apt
+   packages: [ htop ]
+
+ - action: ostree-commit
+   repository: repo
+   branch: os/amd64/main
+   usr-etc: true
+   static-delta: true
+*/
+package actions
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/go-debos/debos"
+)
+
+type OstreeCheckoutAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Repository       string
+	Origin           string
+	Ref              string
+	UsrEtc           bool `yaml:"usr-etc"`
+}
+
+func (ot *OstreeCheckoutAction) Verify(context *debos.DebosContext) error {
+	if ot.Repository == "" && ot.Origin == "" {
+		return errors.New("Property 'repository' or 'origin' is mandatory")
+	}
+
+	if ot.Ref == "" {
+		return errors.New("Property 'ref' is mandatory")
+	}
+
+	return nil
+}
+
+func (ot *OstreeCheckoutAction) Run(context *debos.DebosContext) error {
+	repoPath := path.Join(context.Artifactdir, ot.Repository)
+	if ot.Origin != "" {
+		var found bool
+		if repoPath, found = context.Origin(ot.Origin); !found {
+			return fmt.Errorf("Origin not found '%s'", ot.Origin)
+		}
+	}
+
+	out, err := debos.Command{}.Output("ostree rev-parse", "ostree", "rev-parse", "--repo="+repoPath, ot.Ref)
+	if err != nil {
+		return fmt.Errorf("Failed to resolve '%s' in %s: %v", ot.Ref, repoPath, err)
+	}
+	commit := strings.TrimSpace(string(out))
+	log.Printf("Checking out %s (%s)", ot.Ref, commit)
+
+	// Hard links to the objects of a bare repository would let the build change them
+	err = debos.Command{}.Run("ostree checkout", "ostree", "checkout",
+		"--repo="+repoPath, "--union", "--force-copy", commit, context.Rootdir)
+	if err != nil {
+		return err
+	}
+
+	if ot.UsrEtc {
+		return moveEtc(context.Rootdir, "usr/etc", "etc")
+	}
+
+	return nil
+}
+
+// Move the /etc of a rootfs between /etc and /usr/etc
+func moveEtc(rootdir, from, to string) error {
+	source := path.Join(rootdir, from)
+	destination := path.Join(rootdir, to)
+
+	if _, err := os.Stat(source); err != nil {
+		return fmt.Errorf("No /%s to move to /%s: %v", from, to, err)
+	}
+
+	// An empty directory is left by some tools, e.g. for the mount points
+	if err := os.Remove(destination); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Can't move /%s to /%s: %v", from, to, err)
+	}
+
+	return os.Rename(source, destination)
+}
@@ -15,6 +15,13 @@ Create OSTree commit from rootfs.
    metadata:
      key: value
      vendor.key: somevalue
+   static-delta: bool
+   static-delta-from:
+     - ref
+   static-delta-empty: bool
+   prune-depth: depth
+   parent: ref
+   usr-etc: bool
 
 Mandatory properties:
 
@@ -36,6 +43,28 @@ Optional properties:
   If 'collection-id' is set and 'ref-binding' is empty, will default to the branch name.
 
 - metadata -- key-value pairs of meta information to be added into commit.
+
+- static-delta -- generate a static delta from the previous commit of the
+branch (if any) to the new commit. Default 'false'.
+
+- static-delta-from -- list of refs or commit checksums to generate additional
+static deltas from to the new commit.
+
+- static-delta-empty -- generate a static delta from scratch to the new
+commit, useful for the initial installation. Default 'false'.
+
+- prune-depth -- prune the repository after the commit, only keeping the
+given number of parent commits for each ref. If unset the repository is not
+pruned.
+
+- parent -- branch or commit checksum used as the parent of the commit, and as
+the origin of the 'static-delta', e.g. the commit checked out by the
+'ostree-checkout' action when it's from another branch. Defaults to the
+previous commit of the branch.
+
+- usr-etc -- move '/etc' of the rootfs to '/usr/etc' before the commit, as
+expected by OSTree for deployments. The rootfs keeps '/usr/etc' afterwards.
+Default 'false'.
 */
 package actions
 
@@ -58,6 +87,12 @@ type OstreeCommitAction struct {
 	CollectionID     string   `yaml:"collection-id"`
 	RefBinding       []string `yaml:"ref-binding"`
 	Metadata         map[string]string
+	StaticDelta      bool     `yaml:"static-delta"`
+	StaticDeltaFrom  []string `yaml:"static-delta-from"`
+	StaticDeltaEmpty bool     `yaml:"static-delta-empty"`
+	PruneDepth       *int     `yaml:"prune-depth"`
+	Parent           string
+	UsrEtc           bool `yaml:"usr-etc"`
 }
 
 func emptyDir(dir string) {
@@ -77,6 +112,27 @@ func emptyDir(dir string) {
 	}
 }
 
+func (ot *OstreeCommitAction) Verify(context *debos.DebosContext) error {
+	if ot.PruneDepth != nil && *ot.PruneDepth < 0 {
+		return fmt.Errorf("prune-depth can't be negative")
+	}
+
+	return nil
+}
+
+func (ot *OstreeCommitAction) generateStaticDelta(repoPath string, from string, to string) error {
+	cmdline := []string{"ostree", "static-delta", "generate",
+		fmt.Sprintf("--repo=%s", repoPath), fmt.Sprintf("--to=%s", to)}
+
+	if from == "" {
+		cmdline = append(cmdline, "--empty")
+	} else {
+		cmdline = append(cmdline, fmt.Sprintf("--from=%s", from))
+	}
+
+	return debos.Command{}.Run("ostree static-delta", cmdline...)
+}
+
 func (ot *OstreeCommitAction) Run(context *debos.DebosContext) error {
 	repoPath := path.Join(context.Artifactdir, ot.Repository)
 
@@ -87,6 +143,23 @@ func (ot *OstreeCommitAction) Run(context *debos.DebosContext) error {
 		return err
 	}
 
+	// Previous commit of the branch, empty if there is none
+	parent, err := repo.ResolveRev(ot.Branch, true)
+	if err != nil {
+		return err
+	}
+	if ot.Parent != "" {
+		if parent, err = repo.ResolveRev(ot.Parent, false); err != nil {
+			return err
+		}
+	}
+
+	if ot.UsrEtc {
+		if err := moveEtc(context.Rootdir, "etc", "usr/etc"); err != nil {
+			return err
+		}
+	}
+
 	_, err = repo.PrepareTransaction()
 	if err != nil {
 		return err
@@ -94,6 +167,9 @@ func (ot *OstreeCommitAction) Run(context *debos.DebosContext) error {
 
 	opts := otbuiltin.NewCommitOptions()
 	opts.Subject = ot.Subject
+	if ot.Parent != "" {
+		opts.Parent = parent
+	}
 	for k, v := range ot.Metadata {
 		str := fmt.Sprintf("%s=%s", k, v)
 		opts.AddMetadataString = append(opts.AddMetadataString, str)
@@ -121,5 +197,35 @@ func (ot *OstreeCommitAction) Run(context *debos.DebosContext) error {
 		return err
 	}
 
+	/* The static-delta and prune commands need to lock the repository */
+	repo.Unref()
+
+	var deltaFrom []string
+	if ot.StaticDelta && parent != "" {
+		deltaFrom = append(deltaFrom, parent)
+	}
+	deltaFrom = append(deltaFrom, ot.StaticDeltaFrom...)
+
+	for _, from := range deltaFrom {
+		if err := ot.generateStaticDelta(repoPath, from, ret); err != nil {
+			return err
+		}
+	}
+
+	if ot.StaticDeltaEmpty {
+		if err := ot.generateStaticDelta(repoPath, "", ret); err != nil {
+			return err
+		}
+	}
+
+	if ot.PruneDepth != nil {
+		err = debos.Command{}.Run("ostree prune", "ostree", "prune",
+			fmt.Sprintf("--repo=%s", repoPath), "--refs-only",
+			fmt.Sprintf("--depth=%d", *ot.PruneDepth))
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
@@ -0,0 +1,168 @@
+/*
+OstreePull Action
+
+Pull commits from a remote OSTree repository into a local repository.
+
+ # Yaml syntax:
+ - action: ostree-pull
+   repository: repository name
+   mode: archive
+   remote: name
+   url: URL
+   refs:
+     - branch1
+   depth: 0
+   mirror: bool
+   check-gpg: bool
+   gpg-import: filename
+   name: name
+
+Mandatory properties:
+
+- repository -- path to the local repository, relative to the 'artifact'
+directory. The repository is created if it does not exist yet.
+
+- url -- URL of the remote OSTree repository.
+
+- refs -- list of refs to pull. May be omitted in 'mirror' mode to pull all
+refs of the remote.
+
+Optional properties:
+
+- mode -- mode of the local repository when it has to be created, one of
+'archive', 'bare', 'bare-user' or 'bare-user-only'. Defaults to 'archive'.
+
+- remote -- name of the remote configured in the local repository. Defaults
+to 'origin'.
+
+- depth -- number of parent commits to pull as well, -1 for the complete
+history. Defaults to 0 (only the commits the refs point to).
+
+- mirror -- write refs as they are on the remote instead of
+'remote:ref' local refs. Default 'false'.
+
+- check-gpg -- verify the GPG signatures of the commits. Default 'true'.
+
+- gpg-import -- keyring file, relative to the recipe directory, with the keys
+used to verify the commit signatures.
+
+- name -- string which allows to use the local repository in other actions
+via the 'origin' property.
+*/
+package actions
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/go-debos/debos"
+	"github.com/go-debos/fakemachine"
+)
+
+type OstreePullAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Repository       string
+	Mode             string
+	Remote           string
+	Url              string
+	Refs             []string
+	Depth            int
+	Mirror           bool
+	CheckGpg         bool   `yaml:"check-gpg"`
+	GpgImport        string `yaml:"gpg-import"`
+	Name             string
+}
+
+func NewOstreePullAction() *OstreePullAction {
+	ot := OstreePullAction{Mode: "archive", Remote: "origin"}
+	// Be secure by default
+	ot.CheckGpg = true
+
+	return &ot
+}
+
+func (ot *OstreePullAction) Verify(context *debos.DebosContext) error {
+	if len(ot.Repository) == 0 {
+		return errors.New("Property 'repository' is mandatory for ostree-pull action")
+	}
+
+	if len(ot.Url) == 0 {
+		return errors.New("Property 'url' is mandatory for ostree-pull action")
+	}
+
+	if len(ot.Refs) == 0 && !ot.Mirror {
+		return errors.New("Property 'refs' can only be omitted in mirror mode")
+	}
+
+	switch ot.Mode {
+	case "archive", "archive-z2", "bare", "bare-user", "bare-user-only":
+	default:
+		return fmt.Errorf("Unsupported repository mode '%s'", ot.Mode)
+	}
+
+	if ot.Depth < -1 {
+		return errors.New("Property 'depth' must be -1 or greater")
+	}
+
+	if ot.GpgImport != "" {
+		ot.GpgImport = debos.CleanPathAt(ot.GpgImport, context.RecipeDir)
+		if _, err := os.Stat(ot.GpgImport); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (ot *OstreePullAction) PreMachine(context *debos.DebosContext, m *fakemachine.Machine, args *[]string) error {
+	if ot.GpgImport != "" {
+		m.AddVolume(path.Dir(ot.GpgImport))
+	}
+
+	return nil
+}
+
+func (ot *OstreePullAction) Run(context *debos.DebosContext) error {
+	repoPath := path.Join(context.Artifactdir, ot.Repository)
+	repo := fmt.Sprintf("--repo=%s", repoPath)
+
+	if _, err := os.Stat(path.Join(repoPath, "config")); os.IsNotExist(err) {
+		err = debos.Command{}.Run("ostree init", "ostree", "init", repo, fmt.Sprintf("--mode=%s", ot.Mode))
+		if err != nil {
+			return err
+		}
+	}
+
+	remote := []string{"ostree", "remote", "add", repo, "--force"}
+	if !ot.CheckGpg {
+		remote = append(remote, "--no-gpg-verify")
+	} else if ot.GpgImport != "" {
+		remote = append(remote, fmt.Sprintf("--gpg-import=%s", ot.GpgImport))
+	}
+	remote = append(remote, ot.Remote, ot.Url)
+
+	err := debos.Command{}.Run("ostree remote", remote...)
+	if err != nil {
+		return err
+	}
+
+	pull := []string{"ostree", "pull", repo, fmt.Sprintf("--depth=%d", ot.Depth)}
+	if ot.Mirror {
+		pull = append(pull, "--mirror")
+	}
+	pull = append(pull, ot.Remote)
+	pull = append(pull, ot.Refs...)
+
+	err = debos.Command{}.Run("ostree pull", pull...)
+	if err != nil {
+		return err
+	}
+
+	if ot.Name != "" {
+		context.Origins[ot.Name] = repoPath
+	}
+
+	return nil
+}
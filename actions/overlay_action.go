@@ -8,6 +8,13 @@ Recursive copy of directory or file to target filesystem.
    origin: name
    source: directory
    destination: directory
+   owner: user
+   group: group
+   mode: "0644"
+   dir-mode: "0755"
+   permissions:
+     - path: etc/ssh/*_key
+       mode: "0600"
 
 Mandatory properties:
 
@@ -21,31 +28,128 @@ Optional properties:
 - destination -- absolute path in the target rootfs where 'source' will be copied.
 All existing files will be overwritten.
 If destination isn't set '/' of the rootfs will be used.
+
+- owner -- owner of the copied files and directories, as a user name of the
+target rootfs or a numeric ID. By default the files are owned by the user
+running debos, usually root.
+
+- group -- group of the copied files and directories, as a group name of the
+target rootfs or a numeric ID.
+
+- mode -- octal permissions of the copied files, e.g. "0644". By default the
+permissions of the source files are kept. Quote the mode so it's not read as a
+decimal number.
+
+- dir-mode -- octal permissions of the copied directories.
+
+- permissions -- list of 'owner', 'group', 'mode' and 'dir-mode' overrides for
+the files matching a 'path' pattern relative to 'source', e.g.
+'etc/ssh/*_key'. A pattern matching a directory applies to its content too.
+Entries are applied in order, after the global properties.
+
+When the recipe sets 'normalize-ownership', the copied files are first made
+owned by root:root with their permissions masked by the umask of the recipe.
 */
 package actions
 
 import (
 	"fmt"
 	"log"
+	"os"
 	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
 
 	"github.com/go-debos/debos"
 )
 
+type OverlayPermissions struct {
+	Path    string
+	Owner   string
+	Group   string
+	Mode    string
+	DirMode string `yaml:"dir-mode"`
+}
+
 type OverlayAction struct {
 	debos.BaseAction `yaml:",inline"`
 	Origin           string // origin of overlay, here the export from other action may be used
 	Source           string // external path there overlay is
 	Destination      string // path inside of rootfs
+	Owner            string
+	Group            string
+	Mode             string
+	DirMode          string `yaml:"dir-mode"`
+	Permissions      []OverlayPermissions
+}
+
+// Permissions to apply, the global ones first
+func (overlay *OverlayAction) permissions() []OverlayPermissions {
+	global := OverlayPermissions{
+		Owner:   overlay.Owner,
+		Group:   overlay.Group,
+		Mode:    overlay.Mode,
+		DirMode: overlay.DirMode,
+	}
+
+	return append([]OverlayPermissions{global}, overlay.Permissions...)
+}
+
+func parseMode(mode string) (os.FileMode, error) {
+	m, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || m > 07777 {
+		return 0, fmt.Errorf("Invalid mode '%s', an octal mode like \"0644\" is expected", mode)
+	}
+
+	// Special bits have their own flags in os.FileMode
+	perm := os.FileMode(m).Perm()
+	if m&04000 != 0 {
+		perm |= os.ModeSetuid
+	}
+	if m&02000 != 0 {
+		perm |= os.ModeSetgid
+	}
+	if m&01000 != 0 {
+		perm |= os.ModeSticky
+	}
+
+	return perm, nil
 }
 
 func (overlay *OverlayAction) Verify(context *debos.DebosContext) error {
 	if _, err := debos.RestrictedPath(context.Rootdir, overlay.Destination); err != nil {
 		return err
 	}
+
+	for idx, p := range overlay.permissions() {
+		if idx > 0 {
+			if _, err := filepath.Match(p.Path, ""); err != nil || p.Path == "" {
+				return fmt.Errorf("Invalid permissions path pattern '%s'", p.Path)
+			}
+		}
+		for _, mode := range []string{p.Mode, p.DirMode} {
+			if mode == "" {
+				continue
+			}
+			if _, err := parseMode(mode); err != nil {
+				return err
+			}
+		}
+	}
+
 	return nil
 }
 
+func (overlay *OverlayAction) WatchPaths(context *debos.DebosContext) []string {
+	// Only sources shipped along the recipe can be edited by the user
+	if len(overlay.Origin) > 0 && overlay.Origin != "recipe" {
+		return nil
+	}
+
+	return []string{path.Join(context.RecipeDir, overlay.Source)}
+}
+
 func (overlay *OverlayAction) Run(context *debos.DebosContext) error {
 	origin := context.RecipeDir
 
@@ -64,5 +168,132 @@ func (overlay *OverlayAction) Run(context *debos.DebosContext) error {
 	}
 
 	log.Printf("Overlaying %s on %s", sourcedir, destination)
-	return debos.CopyTree(sourcedir, destination)
+	if err := debos.CopyTree(sourcedir, destination); err != nil {
+		return err
+	}
+
+	return overlay.applyPermissions(context, sourcedir, destination)
+}
+
+// Resolve a user or group name to its ID, from the passwd or group file of the rootfs
+func rootfsID(context *debos.DebosContext, file, name string) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+
+	entries, err := rootfsEntries(context, file)
+	if err != nil {
+		return 0, err
+	}
+
+	entry, found := entries[name]
+	if !found {
+		return 0, fmt.Errorf("'%s' not found in %s of the rootfs", name, file)
+	}
+
+	return strconv.Atoi(entry[2])
+}
+
+// Whether the pattern matches the path or one of its parent directories
+func matchPermissions(pattern, rel string) bool {
+	for p := rel; p != "." && p != "/"; p = path.Dir(p) {
+		if matched, _ := filepath.Match(strings.TrimSuffix(pattern, "/"), p); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (overlay *OverlayAction) applyPermissions(context *debos.DebosContext, sourcedir, destination string) error {
+	type resolved struct {
+		pattern       string
+		uid, gid      int
+		mode, dirMode os.FileMode
+	}
+
+	var permissions []resolved
+	for idx, p := range overlay.permissions() {
+		r := resolved{pattern: p.Path, uid: -1, gid: -1}
+		var err error
+
+		if p.Owner != "" {
+			if r.uid, err = rootfsID(context, "/etc/passwd", p.Owner); err != nil {
+				return err
+			}
+		}
+		if p.Group != "" {
+			if r.gid, err = rootfsID(context, "/etc/group", p.Group); err != nil {
+				return err
+			}
+		}
+		if p.Mode != "" {
+			r.mode, _ = parseMode(p.Mode)
+		}
+		if p.DirMode != "" {
+			r.dirMode, _ = parseMode(p.DirMode)
+		}
+
+		if idx == 0 && r.uid == -1 && r.gid == -1 && r.mode == 0 && r.dirMode == 0 {
+			continue
+		}
+		permissions = append(permissions, r)
+	}
+
+	if len(permissions) == 0 && !context.NormalizeOwnership {
+		return nil
+	}
+
+	return filepath.Walk(sourcedir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, _ := filepath.Rel(sourcedir, p)
+		// The destination directory isn't part of the overlay
+		if rel == "." && info.IsDir() {
+			return nil
+		}
+
+		target := path.Join(destination, rel)
+		if rel == "." {
+			target = destination
+		}
+
+		if context.NormalizeOwnership {
+			if err := os.Lchown(target, 0, 0); err != nil {
+				return err
+			}
+			// chown clears the setuid and setgid bits
+			if info.Mode()&os.ModeSymlink == 0 {
+				special := os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+				mode := info.Mode()&special | info.Mode().Perm()&^context.Umask
+				if err := os.Chmod(target, mode); err != nil {
+					return err
+				}
+			}
+		}
+
+		for _, r := range permissions {
+			if r.pattern != "" && !matchPermissions(r.pattern, rel) {
+				continue
+			}
+
+			if err := os.Lchown(target, r.uid, r.gid); err != nil {
+				return err
+			}
+
+			mode := r.mode
+			if info.IsDir() {
+				mode = r.dirMode
+			}
+			if mode != 0 && info.Mode()&os.ModeSymlink == 0 {
+				if err := os.Chmod(target, mode); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
 }
@@ -7,33 +7,67 @@ Create tarball with filesystem.
  - action: pack
    file: filename.ext
    compression: gz
+   compression-level: 3
+   threads: 0
+   pipe: command
+   split-size: size
 
 Mandatory properties:
 
 - file -- name of the output tarball, relative to the artifact directory.
+Optional with 'pipe'.
 
 Optional properties:
 
-- compression -- compression type to use. Currently 'bzip2', 'gz', 'lzip', lzma', 'lzop',
+- compression -- compression type to use. Currently 'bzip2', 'gz', 'lz4', 'lzip', lzma', 'lzop',
 'xz' and 'zstd' compression types are supported. Use 'none' for uncompressed tarball.
 Use 'auto' to pick via file extension. The 'gz' compression type will be used by default.
+'zstd' compresses large filesystems much faster than 'xz' for a close ratio,
+and 'lz4' even faster for a larger tarball.
+
+- compression-level -- level of the compression, from '1' to '9' for 'gz',
+'0' to '9' for 'xz', '1' to '19' for 'zstd' and '1' to '12' for 'lz4'.
+Default is the one of the compressor.
+
+- threads -- number of threads compressing with 'gz', when pigz is installed,
+'xz' and 'zstd'. '0' uses all the CPUs. By default is '0' for 'zstd', the
+default of the compressor otherwise.
+
+- pipe -- shell command the tarball is streamed to instead of being written
+to 'file', e.g. 'curl -sf -T - https://storage.example.com/rootfs.tar.zst' to
+upload it without storing it. The command runs where the action runs, i.e.
+in the fakemachine unless '--disable-fakemachine' is used. The tarball can't
+be streamed to the standard output of debos, which carries the build log.
+
+- split-size -- split the tarball in chunks of this size, in human readable
+form, e.g. '4GB' for FAT32 media. The chunks are named after 'file' with a
+numbered suffix, e.g. 'rootfs.tar.gz.000', and listed in order with their
+sha256 in 'file' with the '.index' suffix, in the format of 'sha256sum', so
+'sha256sum -c' checks them and concatenating them gives back the tarball.
 
 */
 package actions
 
 import (
+	"crypto/sha256"
 	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
 	"log"
+	"os"
 	"path"
 	"strings"
 	"os/exec"
 
+	"github.com/docker/go-units"
 	"github.com/go-debos/debos"
 )
 
 var tarOpts = map[string]string{
 	"bzip2": "--bzip2",
 	"gz":    "--gzip",
+	"lz4":   "--use-compress-program=lz4",
 	"lzip":  "--lzip",
 	"lzma":  "--lzma",
 	"lzop":  "--lzop",
@@ -43,10 +77,86 @@ var tarOpts = map[string]string{
 	"none":  "",
 }
 
+// Range of the compression levels of the compressors
+var packLevels = map[string][2]int{
+	"gz":   {1, 9},
+	"xz":   {0, 9},
+	"zstd": {1, 19},
+	"lz4":  {1, 12},
+}
+
 type PackAction struct {
 	debos.BaseAction `yaml:",inline"`
 	Compression      string
+	CompressionLevel *int `yaml:"compression-level"`
+	Threads          *int
 	File             string
+	Pipe             string
+	SplitSize        string `yaml:"split-size"`
+	splitSize        int64
+}
+
+// Writer splitting the tarball in chunks, listed with their sha256 in its index
+type chunkWriter struct {
+	file    string
+	size    int64
+	chunk   *os.File
+	hash    hash.Hash
+	written int64
+	index   []string
+}
+
+func (w *chunkWriter) closeChunk() error {
+	if w.chunk == nil {
+		return nil
+	}
+
+	w.index = append(w.index, fmt.Sprintf("%x  %s", w.hash.Sum(nil), path.Base(w.chunk.Name())))
+	err := w.chunk.Close()
+	w.chunk = nil
+
+	return err
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	total := 0
+	for len(p) > 0 {
+		if w.chunk == nil || w.written == w.size {
+			if err := w.closeChunk(); err != nil {
+				return total, err
+			}
+			chunk, err := os.Create(fmt.Sprintf("%s.%03d", w.file, len(w.index)))
+			if err != nil {
+				return total, err
+			}
+			w.chunk, w.hash, w.written = chunk, sha256.New(), 0
+		}
+
+		n := int64(len(p))
+		if n > w.size-w.written {
+			n = w.size - w.written
+		}
+		written, err := w.chunk.Write(p[:n])
+		w.hash.Write(p[:written])
+		w.written += int64(written)
+		total += written
+		if err != nil {
+			return total, err
+		}
+		p = p[written:]
+	}
+
+	return total, nil
+}
+
+// Close the last chunk and write the index
+func (w *chunkWriter) Close() error {
+	if err := w.closeChunk(); err != nil {
+		return err
+	}
+
+	log.Printf("Split %s in %d chunks", path.Base(w.file), len(w.index))
+	return ioutil.WriteFile(w.file+".index", []byte(strings.Join(w.index, "\n")+"\n"), 0644)
 }
 
 func NewPackAction() *PackAction {
@@ -60,7 +170,20 @@ func NewPackAction() *PackAction {
 func (pf *PackAction) Verify(context *debos.DebosContext) error {
 	_, compressionAvailable := tarOpts[pf.Compression]
 	if compressionAvailable {
-		return nil
+		if pf.CompressionLevel != nil {
+			levels, ok := packLevels[pf.Compression]
+			if !ok {
+				return fmt.Errorf("Compression level isn't supported for '%s'", pf.Compression)
+			}
+			if *pf.CompressionLevel < levels[0] || *pf.CompressionLevel > levels[1] {
+				return fmt.Errorf("Compression level of '%s' has to be between %d and %d",
+					pf.Compression, levels[0], levels[1])
+			}
+		}
+		if pf.Threads != nil && *pf.Threads < 0 {
+			return fmt.Errorf("Number of threads can't be negative")
+		}
+		return pf.verifyOutput()
 	}
 
 	possibleTypes := make([]string, 0, len(tarOpts))
@@ -72,6 +195,90 @@ func (pf *PackAction) Verify(context *debos.DebosContext) error {
 		pf.Compression, strings.Join(possibleTypes, ", "))
 }
 
+func (pf *PackAction) verifyOutput() error {
+	if pf.File == "" && pf.Pipe == "" {
+		return fmt.Errorf("Property 'file' is mandatory")
+	}
+	if pf.Pipe != "" && pf.SplitSize != "" {
+		return fmt.Errorf("'pipe' and 'split-size' can't be used together")
+	}
+	if pf.SplitSize != "" && pf.File == "" {
+		return fmt.Errorf("Property 'file' is mandatory with 'split-size'")
+	}
+	if (pf.Pipe != "" || pf.SplitSize != "") && pf.Compression == "auto" {
+		return fmt.Errorf("The 'auto' compression needs the tarball to be written to 'file'")
+	}
+
+	if pf.SplitSize != "" {
+		size, err := units.FromHumanSize(pf.SplitSize)
+		if err != nil || size <= 0 {
+			return fmt.Errorf("Invalid split size '%s'", pf.SplitSize)
+		}
+		pf.splitSize = size
+	}
+
+	return nil
+}
+
+// Stream the tarball to the pipe command
+func (pf *PackAction) pipe(command []string) error {
+	reader, writer := io.Pipe()
+
+	pipeErr := make(chan error, 1)
+	go func() {
+		err := debos.Command{Stdin: reader}.Run("Pipe", "sh", "-c", pf.Pipe)
+		// Unblock the packing if the pipe command stopped reading
+		reader.CloseWithError(err)
+		pipeErr <- err
+	}()
+
+	log.Printf("Streaming to '%s'\n", pf.Pipe)
+	err := debos.Command{}.Stream("Packing", writer, command...)
+	writer.CloseWithError(err)
+
+	if perr := <-pipeErr; perr != nil && err == nil {
+		err = fmt.Errorf("'%s' failed: %v", pf.Pipe, perr)
+	}
+
+	return err
+}
+
+/*
+Compressor command with the level and the threads, empty to let tar pick the
+compressor.
+*/
+func (pf *PackAction) compressProgram(usePigz bool) string {
+	var program []string
+
+	switch {
+	case usePigz:
+		program = []string{"pigz"}
+		if pf.Threads != nil && *pf.Threads > 0 {
+			program = append(program, fmt.Sprintf("-p%d", *pf.Threads))
+		}
+	case pf.Compression == "zstd":
+		threads := 0
+		if pf.Threads != nil {
+			threads = *pf.Threads
+		}
+		program = []string{"zstd", fmt.Sprintf("-T%d", threads)}
+	case pf.Compression == "xz" && pf.Threads != nil:
+		program = []string{"xz", fmt.Sprintf("-T%d", *pf.Threads)}
+	case pf.Compression == "lz4":
+		program = []string{"lz4"}
+	case pf.CompressionLevel != nil:
+		program = []string{strings.TrimPrefix(tarOpts[pf.Compression], "--")}
+	default:
+		return ""
+	}
+
+	if pf.CompressionLevel != nil {
+		program = append(program, fmt.Sprintf("-%d", *pf.CompressionLevel))
+	}
+
+	return strings.Join(program, " ")
+}
+
 func (pf *PackAction) Run(context *debos.DebosContext) error {
 	usePigz := false
 	if pf.Compression == "gz" {
@@ -83,17 +290,35 @@ func (pf *PackAction) Run(context *debos.DebosContext) error {
 
 	command := []string{"tar"}
 	command = append(command, "cf")
-	command = append(command, outfile)
+	if pf.Pipe != "" || pf.splitSize > 0 {
+		command = append(command, "-")
+	} else {
+		command = append(command, outfile)
+	}
 	command = append(command, "--xattrs")
 	command = append(command, "--xattrs-include=*.*")
-	if usePigz == true {
-		command = append(command, "--use-compress-program=pigz")
+	if program := pf.compressProgram(usePigz); program != "" {
+		command = append(command, "--use-compress-program="+program)
 	} else if tarOpts[pf.Compression] != "" {
 		command = append(command, tarOpts[pf.Compression])
 	}
 	command = append(command, "-C", context.Rootdir)
 	command = append(command, ".")
 
+	if pf.Pipe != "" {
+		return pf.pipe(command)
+	}
+
+	if pf.splitSize > 0 {
+		log.Printf("Compressing to %s in chunks of %s\n", outfile, pf.SplitSize)
+		chunks := &chunkWriter{file: outfile, size: pf.splitSize}
+		err := debos.Command{}.Stream("Packing", chunks, command...)
+		if closeErr := chunks.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	}
+
 	log.Printf("Compressing to %s\n", outfile)
 	return debos.Command{}.Run("Packing", command...)
 }
@@ -0,0 +1,393 @@
+package actions
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/docker/go-units"
+)
+
+// Partitions laid out one after the other from their sizes, in bytes
+type layoutPartition struct {
+	Partition
+	offset     int64 // Explicit start, -1 to follow the previous partition
+	size       int64 // 0 to fill the rest of the image
+	align      int64
+	mountpoint string
+	options    []string
+}
+
+// Alignment of the imported partitions without an explicit one
+const layoutAlignment = 1 << 20
+
+var wksSizeRegex = regexp.MustCompile(`^([0-9]+)([sSkKmMgG]?)$`)
+
+/*
+Size of a wks option in bytes, with the unit given as suffix, 's' for 512
+bytes sectors, 'K', 'M' or 'G', or the default unit.
+*/
+func wksSize(value string, unit int64) (int64, error) {
+	m := wksSizeRegex.FindStringSubmatch(value)
+	if m == nil {
+		return 0, fmt.Errorf("Invalid size '%s'", value)
+	}
+
+	n, err := strconv.ParseInt(m[1], 10, 64)
+	switch strings.ToLower(m[2]) {
+	case "s":
+		unit = 512
+	case "k":
+		unit = 1 << 10
+	case "m":
+		unit = 1 << 20
+	case "g":
+		unit = 1 << 30
+	}
+
+	return n * unit, err
+}
+
+// Options of a wks line, '--name=value', '--name value' or '--flag'
+func wksOptions(fields []string) (map[string]string, error) {
+	options := map[string]string{}
+
+	for idx := 0; idx < len(fields); idx++ {
+		field := fields[idx]
+		if !strings.HasPrefix(field, "--") {
+			return nil, fmt.Errorf("Unexpected argument '%s'", field)
+		}
+
+		name := strings.TrimPrefix(field, "--")
+		value := ""
+		if split := strings.SplitN(name, "=", 2); len(split) == 2 {
+			name, value = split[0], split[1]
+		} else if idx+1 < len(fields) && !strings.HasPrefix(fields[idx+1], "--") {
+			idx++
+			value = fields[idx]
+		}
+		options[name] = strings.Trim(value, `"'`)
+	}
+
+	return options, nil
+}
+
+/*
+Parse a Yocto wic kickstart file: the 'part' lines and the partition table
+type of the 'bootloader' line. The wic sources and the sizes computed from the
+content aren't supported, the sizes are fixed.
+*/
+func parseWks(file string) (string, []layoutPartition, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+
+	table := "msdos"
+	var parts []layoutPartition
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		var options map[string]string
+		switch fields[0] {
+		case "bootloader":
+			options, err = wksOptions(fields[1:])
+			if err == nil && options["ptable"] != "" {
+				table = options["ptable"]
+			}
+		case "part", "partition":
+			if len(fields) < 2 {
+				err = fmt.Errorf("Missing mount point")
+				break
+			}
+			options, err = wksOptions(fields[2:])
+			if err != nil {
+				break
+			}
+			var p layoutPartition
+			p, err = wksPartition(fields[1], options, len(parts))
+			parts = append(parts, p)
+		default:
+			err = fmt.Errorf("Unsupported directive '%s'", fields[0])
+		}
+
+		if err != nil {
+			return "", nil, fmt.Errorf("%s:%d: %v", path.Base(file), line, err)
+		}
+	}
+
+	return table, parts, scanner.Err()
+}
+
+func wksPartition(mountpoint string, options map[string]string, index int) (layoutPartition, error) {
+	p := layoutPartition{offset: -1, align: layoutAlignment}
+	p.Fsck = true
+
+	for name, value := range options {
+		var err error
+		switch name {
+		case "fstype":
+			p.FS = value
+		case "label":
+			p.FSLabel = value
+		case "part-name":
+			p.PartLabel = value
+		case "part-type":
+			p.PartType = value
+		case "system-id":
+			p.PartType = strings.TrimPrefix(value, "0x")
+		case "uuid":
+			p.PartUUID = value
+		case "fsuuid":
+			p.FSUUID = value
+		case "size", "fixed-size":
+			p.size, err = wksSize(value, 1<<20)
+		case "offset":
+			p.offset, err = wksSize(value, 1<<10)
+		case "align":
+			p.align, err = wksSize(value, 1<<10)
+		case "active":
+			p.Flags = append(p.Flags, "boot")
+		case "fsoptions":
+			p.options = strings.Split(value, ",")
+		case "mkfs-extraopts":
+			p.MkfsOptions = strings.Fields(value)
+		case "ondisk", "ondrive", "source", "sourceparams", "rootfs-dir", "exclude-path",
+			"include-path", "use-uuid", "use-label", "extra-space", "overhead-factor", "no-fstab-update":
+			// Content and disk selection of wic
+		default:
+			err = fmt.Errorf("Unsupported option '--%s'", name)
+		}
+		if err != nil {
+			return p, err
+		}
+	}
+
+	switch p.FS {
+	case "":
+		p.FS = "none"
+	case "swap":
+		p.FS = "none"
+		if p.PartType == "" {
+			p.PartType = "swap"
+		}
+	}
+
+	p.Name = p.PartLabel
+	if p.Name == "" {
+		p.Name = p.FSLabel
+	}
+	if p.Name == "" {
+		p.Name = fmt.Sprintf("part%d", index+1)
+	}
+
+	if strings.HasPrefix(mountpoint, "/") {
+		p.mountpoint = mountpoint
+	}
+
+	return p, nil
+}
+
+// systemd architecture suffixes of the partition types and their Debian names
+var repartArchitectures = [][2]string{
+	{"x86-64", "amd64"},
+	{"x86", "i386"},
+	{"arm64", "arm64"},
+	{"arm", "armhf"},
+	{"riscv64", "riscv64"},
+	{"ppc64-le", "ppc64el"},
+	{"s390x", "s390x"},
+	{"loongarch64", "loong64"},
+}
+
+/*
+Parse the partition definitions of a systemd-repart directory, in the order
+of their file names. The partitions without a minimal or maximal size fill the
+rest of the image.
+*/
+func parseRepart(dir string) ([]layoutPartition, error) {
+	files, err := filepath.Glob(path.Join(dir, "*.conf"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("No partition definition in %s", dir)
+	}
+	sort.Strings(files)
+
+	var parts []layoutPartition
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		p, err := repartPartition(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path.Base(file), err)
+		}
+		if p.Name == "" {
+			p.Name = strings.TrimLeft(strings.TrimSuffix(path.Base(file), ".conf"), "0123456789-_")
+		}
+		parts = append(parts, p)
+	}
+
+	return parts, nil
+}
+
+func repartPartition(data string) (layoutPartition, error) {
+	p := layoutPartition{offset: -1, align: layoutAlignment}
+	p.Fsck = true
+	p.FS = "none"
+
+	section := ""
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			section = strings.Trim(line, "[]")
+			continue
+		}
+
+		kv := strings.SplitN(line, "=", 2)
+		if section != "Partition" || len(kv) != 2 {
+			continue
+		}
+
+		key, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		var err error
+		switch key {
+		case "Type":
+			p.PartType = value
+			for _, arch := range repartArchitectures {
+				if strings.HasSuffix(value, "-"+arch[0]) {
+					p.PartType = strings.TrimSuffix(value, arch[0]) + arch[1]
+					break
+				}
+			}
+		case "Label":
+			p.PartLabel = value
+			p.Name = value
+		case "UUID":
+			p.PartUUID = value
+		case "Format":
+			p.FS = value
+		case "SizeMinBytes", "SizeMaxBytes":
+			var size int64
+			size, err = units.RAMInBytes(value)
+			// The minimal size wins as the image is laid out statically
+			if p.size == 0 || key == "SizeMinBytes" {
+				p.size = size
+			}
+		case "MountPoint":
+			mount := strings.SplitN(value, ":", 2)
+			p.mountpoint = mount[0]
+			if len(mount) == 2 {
+				p.options = strings.Split(mount[1], ",")
+			}
+		case "Weight", "PaddingWeight", "PaddingMinBytes", "PaddingMaxBytes", "CopyFiles",
+			"CopyBlocks", "MakeDirectories", "Encrypt", "Verity", "VerityMatchKey",
+			"FactoryReset", "Flags", "ReadOnly", "GrowFileSystem", "Priority":
+			// Content and runtime properties of systemd-repart
+		default:
+			err = fmt.Errorf("Unsupported setting '%s'", key)
+		}
+		if err != nil {
+			return p, err
+		}
+	}
+
+	if p.PartType == "" {
+		return p, fmt.Errorf("Missing partition Type")
+	}
+	if p.FS == "swap" {
+		p.FS = "none"
+	}
+
+	// systemd-repart rounds the sizes to 4KiB
+	p.size = (p.size + 4095) / 4096 * 4096
+
+	return p, nil
+}
+
+/*
+importLayout replaces the partitions by the ones of the layout file, laid out
+one after the other, and adds their mount points.
+*/
+func (i *ImagePartitionAction) importLayout(file string) error {
+	var table string
+	var parts []layoutPartition
+
+	info, err := os.Stat(file)
+	switch {
+	case err != nil:
+		return err
+	case info.IsDir():
+		table = "gpt"
+		parts, err = parseRepart(file)
+	case strings.HasSuffix(file, ".wks") || strings.HasSuffix(file, ".wks.in"):
+		table, parts, err = parseWks(file)
+	default:
+		return fmt.Errorf("Unknown layout format of %s, expected a .wks file or a repart.d directory", file)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to import layout: %v", err)
+	}
+
+	if len(i.Partitions) > 0 {
+		return fmt.Errorf("'layout-file' and 'partitions' can't be used together")
+	}
+	if i.PartitionType != "" && i.PartitionType != table {
+		return fmt.Errorf("The partition table of the layout is %s, not %s", table, i.PartitionType)
+	}
+	i.PartitionType = table
+
+	var end int64
+	for idx, p := range parts {
+		start := p.offset
+		if start < 0 {
+			start = end
+			if start < layoutAlignment {
+				start = layoutAlignment
+			}
+			start = (start + p.align - 1) / p.align * p.align
+		}
+
+		p.Start = fmt.Sprintf("%dKiB", start/1024)
+		switch {
+		case p.size > 0:
+			end = start + p.size
+			p.End = fmt.Sprintf("%dKiB", end/1024)
+		case idx == len(parts)-1:
+			p.End = "100%"
+		default:
+			return fmt.Errorf("Partition %s needs a size, only the last one can fill the image", p.Name)
+		}
+
+		i.Partitions = append(i.Partitions, p.Partition)
+		if p.mountpoint != "" {
+			i.Mountpoints = append(i.Mountpoints, Mountpoint{
+				Mountpoint: p.mountpoint,
+				Partition:  p.Name,
+				Options:    p.options,
+			})
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,238 @@
+/*
+RaucBundle Action
+
+Create a RAUC update bundle from previously built filesystem images.
+The bundle manifest is generated from the action properties and the bundle
+is signed with the given certificate and key.
+
+ # Yaml syntax:
+ - action: rauc-bundle
+   bundle: filename.raucb
+   compatible: string
+   version: string
+   description: string
+   format: verity
+   origin: name
+   certificate: filename
+   key: filename
+   keyring: filename
+   images:
+     - slotclass: rootfs
+       origin: name
+       file: filename
+
+Mandatory properties:
+
+- bundle -- name of the output bundle, relative to the artifact directory.
+
+- compatible -- compatible string of the system the bundle is meant for.
+
+- certificate -- signing certificate file located in 'origin'.
+
+- key -- signing key file located in 'origin'.
+
+- images -- list of images to put in the bundle, at least one image is needed.
+Image properties are described below.
+
+Optional properties:
+
+- version -- version of the bundle.
+
+- description -- description of the bundle, also shown as the description of
+the action.
+
+- format -- bundle format, one of 'plain', 'verity' or 'crypt'. Defaults to
+'verity'.
+
+- origin -- reference to the named file or directory containing the
+certificate, key and keyring. The default value is 'recipe'.
+
+- keyring -- keyring file located in 'origin' used to verify the bundle
+signature after creation.
+
+   # Yaml syntax for images:
+   images:
+     - slotclass: name
+       origin: name
+       file: filename
+
+Mandatory properties:
+
+- slotclass -- the RAUC slot class the image has to be installed to.
+
+- file -- the image file name located in 'origin'.
+
+Optional properties:
+
+- origin -- reference to a named file or directory. The default value is
+'artifacts'.
+*/
+package actions
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+
+	"github.com/go-debos/debos"
+	"github.com/go-debos/fakemachine"
+)
+
+type RaucImage struct {
+	SlotClass string
+	Origin    string
+	File      string
+}
+
+type RaucBundleAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Bundle           string
+	Compatible       string
+	Version          string
+	Format           string
+	Origin           string
+	Certificate      string
+	Key              string
+	Keyring          string
+	Images           []RaucImage
+}
+
+func NewRaucBundleAction() *RaucBundleAction {
+	r := RaucBundleAction{}
+	r.Format = "verity"
+	r.Origin = "recipe"
+
+	return &r
+}
+
+func (r *RaucBundleAction) Verify(context *debos.DebosContext) error {
+	if len(r.Bundle) == 0 {
+		return fmt.Errorf("Property 'bundle' is mandatory for rauc-bundle action")
+	}
+
+	if len(r.Compatible) == 0 {
+		return fmt.Errorf("Property 'compatible' is mandatory for rauc-bundle action")
+	}
+
+	if len(r.Certificate) == 0 || len(r.Key) == 0 {
+		return fmt.Errorf("Properties 'certificate' and 'key' are mandatory for rauc-bundle action")
+	}
+
+	switch r.Format {
+	case "plain", "verity", "crypt":
+	default:
+		return fmt.Errorf("Unsupported bundle format '%s'", r.Format)
+	}
+
+	if len(r.Images) == 0 {
+		return fmt.Errorf("At least one image is needed for rauc-bundle action")
+	}
+
+	slots := make(map[string]bool)
+	for idx := range r.Images {
+		i := &r.Images[idx]
+		if len(i.SlotClass) == 0 || len(i.File) == 0 {
+			return fmt.Errorf("Images need both 'slotclass' and 'file' properties")
+		}
+		if slots[i.SlotClass] {
+			return fmt.Errorf("Slot class %s used for multiple images", i.SlotClass)
+		}
+		slots[i.SlotClass] = true
+
+		if len(i.Origin) == 0 {
+			i.Origin = "artifacts"
+		}
+	}
+
+	return nil
+}
+
+func (r *RaucBundleAction) PreMachine(context *debos.DebosContext, m *fakemachine.Machine, args *[]string) error {
+	// Signing material may be kept outside of the recipe directory
+	if origin, found := context.Origin(r.Origin); found {
+		m.AddVolume(origin)
+	}
+
+	return nil
+}
+
+func (r *RaucBundleAction) manifest() []byte {
+	var m bytes.Buffer
+
+	m.WriteString("[update]\n")
+	m.WriteString(fmt.Sprintf("compatible=%s\n", r.Compatible))
+	if r.Version != "" {
+		m.WriteString(fmt.Sprintf("version=%s\n", r.Version))
+	}
+	if r.Description != "" {
+		m.WriteString(fmt.Sprintf("description=%s\n", r.Description))
+	}
+
+	m.WriteString("\n[bundle]\n")
+	m.WriteString(fmt.Sprintf("format=%s\n", r.Format))
+
+	for _, i := range r.Images {
+		m.WriteString(fmt.Sprintf("\n[image.%s]\n", i.SlotClass))
+		m.WriteString(fmt.Sprintf("filename=%s\n", path.Base(i.File)))
+	}
+
+	return m.Bytes()
+}
+
+func (r *RaucBundleAction) Run(context *debos.DebosContext) error {
+	origin, found := context.Origin(r.Origin)
+	if !found {
+		return fmt.Errorf("Origin not found '%s'", r.Origin)
+	}
+
+	bundledir, err := ioutil.TempDir(context.Scratchdir, "rauc-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(bundledir)
+
+	for _, i := range r.Images {
+		imageOrigin, found := context.Origin(i.Origin)
+		if !found {
+			return fmt.Errorf("Origin not found '%s'", i.Origin)
+		}
+
+		src, err := debos.RestrictedPath(imageOrigin, i.File)
+		if err != nil {
+			return err
+		}
+
+		dst := path.Join(bundledir, path.Base(i.File))
+		// Images tend to be big, avoid copying them if possible
+		if err := os.Link(src, dst); err != nil {
+			if err := debos.CopyFile(src, dst, 0644); err != nil {
+				return fmt.Errorf("Failed to add image %s: %v", i.File, err)
+			}
+		}
+	}
+
+	err = ioutil.WriteFile(path.Join(bundledir, "manifest.raucm"), r.manifest(), 0644)
+	if err != nil {
+		return err
+	}
+
+	bundle := path.Join(context.Artifactdir, r.Bundle)
+	// rauc refuses to overwrite an existing bundle
+	if err := os.Remove(bundle); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	cmdline := []string{"rauc", "bundle",
+		"--cert", path.Join(origin, r.Certificate),
+		"--key", path.Join(origin, r.Key)}
+	if r.Keyring != "" {
+		cmdline = append(cmdline, "--keyring", path.Join(origin, r.Keyring))
+	}
+	cmdline = append(cmdline, bundledir, bundle)
+
+	log.Printf("Creating RAUC bundle %s\n", bundle)
+	return debos.Command{}.Run("rauc", cmdline...)
+}
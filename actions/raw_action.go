@@ -9,6 +9,7 @@ This is typically useful for bootloaders.
    origin: name
    source: filename
    offset: bytes
+   partition: name
 
 Mandatory properties:
 
@@ -20,18 +21,24 @@ Optional properties:
 
 - offset -- offset in bytes or in sector number e.g 256s.
 The sector size is either the recipe header 'sectorsize' or the default 512 sector
-size.
+size. The offset is relative to the start of the partition when 'partition' is
+set. A negative offset is relative to the end of the image or of the
+partition, e.g. '-8s' writes the file in the last 8 sectors.
 Internal templating mechanism will append the 's' suffix, for instance: '{{ sector 256 }}' will be converted to '256s'.
 Deprecated, use '256s' instead of '{{ sector 256 }}'.
 The default value is zero.
 
-- partition -- named partition to write to
+- partition -- partition to write to, instead of the whole image, so the
+file follows the partition if the layout changes. The partition is looked up
+by its name in 'image-partition', then by its GPT partition label and then by
+its filesystem label.
 */
 package actions
 
 import (
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
@@ -74,6 +81,26 @@ func (raw *RawAction) checkDeprecatedSyntax() error {
 	return nil
 }
 
+// Parse an offset given in bytes or in sectors with the 's' suffix
+func parseOffset(offset string, sectorSize int) (int64, error) {
+	sector := false
+	if strings.HasSuffix(offset, "s") {
+		sector = true
+		offset = strings.TrimSuffix(offset, "s")
+	}
+
+	o, err := strconv.ParseInt(offset, 0, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Couldn't parse offset %v", err)
+	}
+
+	if sector {
+		o = o * int64(sectorSize)
+	}
+
+	return o, nil
+}
+
 func (raw *RawAction) Verify(context *debos.DebosContext) error {
 	if err := raw.checkDeprecatedSyntax(); err != nil {
 		return err
@@ -86,6 +113,25 @@ func (raw *RawAction) Verify(context *debos.DebosContext) error {
 	return nil
 }
 
+// Device of the partition, by name, partition label or filesystem label
+func (raw *RawAction) partitionDevice(context *debos.DebosContext) (string, error) {
+	for _, p := range context.ImagePartitions {
+		if p.Name == raw.Partition {
+			return p.DevicePath, nil
+		}
+	}
+
+	for _, tag := range []string{"PARTLABEL", "LABEL"} {
+		for _, p := range context.ImagePartitions {
+			if blkidValue(p.DevicePath, tag) == raw.Partition {
+				return p.DevicePath, nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("Failed to find partition named %s", raw.Partition)
+}
+
 func (raw *RawAction) Run(context *debos.DebosContext) error {
 	origin, found := context.Origin(raw.Origin)
 	if !found {
@@ -98,20 +144,12 @@ func (raw *RawAction) Run(context *debos.DebosContext) error {
 		return fmt.Errorf("Failed to read %s", s)
 	}
 
-	var devicePath string
+	devicePath := context.Image
 	if raw.Partition != "" {
-		for _, p := range context.ImagePartitions {
-			if p.Name == raw.Partition {
-				devicePath = p.DevicePath
-				break
-			}
-		}
-
-		if devicePath == "" {
-			return fmt.Errorf("Failed to find partition named %s", raw.Partition)
+		devicePath, err = raw.partitionDevice(context)
+		if err != nil {
+			return err
 		}
-	} else {
-		devicePath = context.Image
 	}
 
 	target, err := os.OpenFile(devicePath, os.O_WRONLY, 0)
@@ -122,20 +160,22 @@ func (raw *RawAction) Run(context *debos.DebosContext) error {
 
 	var offset int64 = 0
 	if len(raw.Offset) > 0 {
-		sector := false
-		offs := raw.Offset
-		if strings.HasSuffix(offs, "s") {
-			sector = true
-			offs = strings.TrimSuffix(offs, "s")
-		}
-		offset, err = strconv.ParseInt(offs, 0, 64)
+		offset, err = parseOffset(raw.Offset, context.SectorSize)
 		if err != nil {
-			return fmt.Errorf("Couldn't parse offset %v", err)
+			return err
 		}
+	}
 
-		if sector {
-			offset = offset * int64(context.SectorSize)
-		}
+	size, err := target.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if offset < 0 {
+		offset += size
+	}
+	if offset < 0 || offset+int64(len(content)) > size {
+		return fmt.Errorf("%s of %d bytes at offset %d doesn't fit in %s of %d bytes",
+			raw.Source, len(content), offset, devicePath, size)
 	}
 
 	bytes, err := target.WriteAt(content, offset)
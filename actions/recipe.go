@@ -36,7 +36,177 @@ The following custom template functions are available:
 - sector: Returns the argument with 's' suffix for raw action` (Deprecated)
 - escape: Shell escape the  argument `{{ escape $var }}`
 - uuid5: Generates fixed UUID value `{{ uuid5 $random-uuid $text }}`
-- functions from [slim-sprig](https://go-task.github.io/slim-sprig/)
+- registered: Output of a previous run action with the 'register' property
+`{{ registered "name" }}`, substituted when the action using it runs
+- semverCompare: Whether a semantic version matches a constraint, a comma
+separated list of comparisons `{{ if semverCompare ">= 6.1, < 7" $kernel }}`
+- readFile: Content of a file, relative to the recipe directory
+`{{ readFile "version.txt" | trim }}`
+- fileExists: Whether a file exists, relative to the recipe directory
+`{{ if fileExists "overlays/local" }}`
+- sha256file: Checksum of a file, relative to the recipe directory
+`{{ sha256file "keys/archive.gpg" }}`
+- functions from [slim-sprig](https://go-task.github.io/slim-sprig/), e.g.
+string manipulation (`trimSuffix`, `replace`, `regexReplaceAll`, `splitList`,
+`join`), arithmetic (`add`, `mul`, `div`, `max`) and environment lookup (`env`)
+
+The template variables given with the '-t' option can be declared in the
+'variables' section of the header, so a missing or invalid value fails the
+build before it starts:
+
+ variables:
+   - name: suite
+     description: Debian release to build
+     default: bookworm
+     allowed: [ bookworm, trixie ]
+   - name: board
+     required: true
+   - name: imagesize
+     type: size
+     default: 4GB
+
+ architecture: arm64
+
+The properties of a variable are:
+
+- name -- name of the template variable.
+
+- description -- shown when a required variable is missing.
+
+- type -- 'string' (default), 'bool', 'int' or 'size', e.g. '4GB'.
+
+- default -- value of the variable if not given.
+
+- allowed -- list of the allowed values.
+
+- required -- fail if the variable isn't given, default 'false'. Variables
+neither required nor with a default are empty if not given.
+
+Recipes included by the recipe action can declare 'parameters' and 'exports',
+see https://godoc.org/github.com/go-debos/debos/actions#hdr-Recipe_Action
+
+Every action accepts a 'with-items' property, a list of items the action is
+repeated for. The 'item' template function is substituted by the item in the
+properties of each action, or by one of its keys if the items are maps:
+
+ - action: overlay
+   with-items: [ base, network, debug ]
+   source: overlays/{{ item }}
+
+ - action: run
+   with-items:
+     - { name: ssh, unit: ssh.service }
+     - { name: timesyncd, unit: systemd-timesyncd.service }
+   description: enable {{ item "name" }}
+   chroot: true
+   command: systemctl enable {{ item "unit" }}
+
+Every action accepts a 'when' property, so the action is skipped unless its
+condition holds. The condition is a boolean, e.g. the result of a template
+expression in the recipe, or a template expression evaluated with the template
+variables, without the braces:
+
+ - action: run
+   when: eq .flavour "debug"
+   command: echo debug build
+
+ - action: grub-install
+   when: {{ eq $architecture "amd64" }}
+
+Every action accepts a 'sandbox' property, the name of a sandbox declared in
+the 'sandboxes' section of the header, restricting the commands the action
+runs in the chroot, so what each step can touch is declared in one place:
+
+ sandboxes:
+   offline:
+     network: false
+   builder:
+     environment:
+       MAKEFLAGS: -j4
+     bind-mounts:
+       - /srv/sources:/src:ro
+     user: builder
+
+ actions:
+   - action: run
+     sandbox: builder
+     chroot: true
+     command: make -C /src
+
+The properties of a sandbox are:
+
+- environment -- environment variables, overriding the ones of the build.
+
+- bind-mounts -- list of host paths bound in the chroot, as
+'source[:target][:ro]' with absolute paths.
+
+- network -- whether the commands have network access, default 'true'.
+
+- chroot -- method to enter the chroot, 'nspawn' (default) or 'chroot', which
+doesn't support bind mounts.
+
+- user -- user running the commands instead of root, or 'user:group' with the
+'chroot' method.
+
+Commands run on the host, e.g. by the run action without 'chroot', aren't
+restricted.
+
+The 'artifacts' section of the header names the files the actions write to the
+artifact directory once the build succeeded, and removes the intermediate ones,
+so the outputs land with their release names without renaming scripts:
+
+ artifacts:
+   - file: rootfs.tar.gz
+     keep: false
+   - file: debian.img.zst
+     name: debian-{{ $suite }}-{{ $version }}-${date}-${arch}.img.zst
+
+The properties of an artifact are:
+
+- file -- file written by the actions, relative to the artifact directory. It
+can be a glob pattern, e.g. '*.tar.gz', for artifacts which aren't renamed.
+
+- name -- new name of the file, relative to the artifact directory. Besides
+the template variables, '${date}' (YYYYMMDD), '${time}' (HHMMSS), '${arch}'
+and '${build-id}' are substituted once the build is done. The date and time
+are the ones of SOURCE_DATE_EPOCH if set, in UTC.
+
+- keep -- whether the file is kept, default 'true'. Files not kept are
+removed once the build succeeded, e.g. the rootfs tarball an image is built
+from.
+
+- post-process -- list of stages the file goes through once the build
+succeeded, in order, instead of trailing run actions. Each stage is one of:
+
+  - compress -- compress the file with 'gz', 'xz' or 'zstd', replacing it
+    with e.g. 'image.img.zst'.
+  - checksum -- write the 'sha256' or 'sha512' checksum of the file next to
+    it, e.g. 'image.img.zst.sha256', in the format of 'sha256sum -c'.
+  - sign -- write a detached armored signature of the file next to it, e.g.
+    'image.img.zst.asc', with the given gpg key of the host.
+  - rename -- rename the file, along with its checksums and signature, as the
+    'name' property does.
+  - upload -- upload the file, its checksums and signature with a HTTP PUT
+    request to the URL, which can hold credentials. A URL ending with '/'
+    gets the names of the files appended. The placeholders of 'name' are
+    substituted.
+  - command -- run a command on the host with 'sh -c' in the recipe
+    directory, with the path of the file in 'ARTIFACT' and the artifact
+    directory in 'ARTIFACTDIR', for the stages debos doesn't provide.
+
+A file can't be compressed once checksummed or signed, and a post-processed
+artifact can't have a 'name', a rename stage does it:
+
+ artifacts:
+   - file: debian.img
+     post-process:
+       - compress: zstd
+       - checksum: sha256
+       - sign: release@example.org
+       - rename: debian-{{ $suite }}-${date}-${arch}.img.zst
+       - upload: https://{{ $credentials }}@images.example.org/{{ $suite }}/
+
+The artifacts of a failed build are left untouched.
 
 Mandatory properties for recipe:
 
@@ -47,14 +217,105 @@ Mandatory properties for recipe:
 Optional properties for recipe:
 
 - sectorsize: Overrides the default 512 bytes sectorsize, mandatory for device using 4k block size such as UFS or NVMe storage. Setting the sectorsize to an
-other value than '512' is not supported by the 'uml' fakemachine backend.
+other value than '512' is not supported by the 'uml' fakemachine backend. It can
+also be set with the 'sector-size' property of the 'image-partition' action.
+
+- umask -- octal umask set for the build, e.g. "0022", inherited by all the
+commands run by the actions, in and out of the chroot. By default the umask of
+the user running debos is used, which differs between users and hosts.
+
+- normalize-ownership -- copy the content of origins, e.g. the overlays of the
+recipe, as owned by root:root with their permissions masked by 'umask' (0022
+if not set), instead of keeping the permissions they have on the host, which
+depend on the umask of the user who checked them out. The 'owner', 'group' and
+'mode' properties of the overlay action are explicit exceptions applied
+afterwards.
+
+- target -- description of the target system, from which the architecture is
+derived if not given:
+
+ target:
+   arch: aarch64
+   abi: gnu
+   endian: little
+   cpu: cortex-a53
+
+'arch' and 'abi' are the CPU family and ABI as in GNU triplets (e.g. 'arm' and
+'gnueabihf' for 'armhf'), 'abi' defaults to 'gnu' and 'endian' to the usual
+endianness of 'arch'. 'cpu' is the optional baseline CPU. The
+'DEB_HOST_ARCH', 'DEB_HOST_GNU_TYPE', 'DEB_HOST_MULTIARCH', 'CROSS_COMPILE'
+and 'TARGET_CPU' environment variables are set accordingly for commands run by
+the actions, and sub-recipes get the 'target_arch', 'target_abi',
+'target_endian', 'target_cpu', 'target_triplet' and 'target_qemu' template
+variables.
+
+- resources -- resources the build needs in the fakemachine VM, used instead
+of the defaults of 2GB of memory and 2 CPUs when the '--memory' and '--cpus'
+options aren't given:
+
+ resources:
+   memory: 4G
+   cpus: 4
+
+The VM is sized down to the memory and CPUs available on the host, with a
+warning, when they can't be satisfied.
+
+- fakemachine -- requirements of the recipe on the fakemachine VM:
+
+ fakemachine:
+   backends: [ kvm, uml ]
+   kernel-modules: [ btrfs, dm-verity ]
+
+'backends' lists the acceptable backends, 'kvm', 'uml' or 'qemu' (also named
+'qemu-tcg'), in order of preference. The first one supported by the host, and
+whose kernel provides the 'kernel-modules', built in or loadable, is used
+unless '--fakemachine-backend' is given, which then has to be one of them. The
+build fails early when none is usable instead of running on the host.
 
 Supported actions
 
+- alternatives -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Alternatives_Action
+
 - apt -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Apt_Action
 
+- apt-keyring -- https://godoc.org/github.com/go-debos/debos/actions#hdr-AptKeyring_Action
+
+- apt-sources -- https://godoc.org/github.com/go-debos/debos/actions#hdr-AptSources_Action
+
+- arm-firmware -- https://godoc.org/github.com/go-debos/debos/actions#hdr-ArmFirmware_Action
+
+- boot-entries -- https://godoc.org/github.com/go-debos/debos/actions#hdr-BootEntries_Action
+
+- check-binaries -- https://godoc.org/github.com/go-debos/debos/actions#hdr-CheckBinaries_Action
+
+- convert-partition-table -- https://godoc.org/github.com/go-debos/debos/actions#hdr-ConvertPartitionTable_Action
+
+- debconf -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Debconf_Action
+
 - debootstrap -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Debootstrap_Action
 
+- erofs -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Erofs_Action
+
+- firmware -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Firmware_Action
+
+- first-boot -- https://godoc.org/github.com/go-debos/debos/actions#hdr-FirstBoot_Action
+
+- flash-kernel -- https://godoc.org/github.com/go-debos/debos/actions#hdr-FlashKernel_Action
+
+- git -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Git_Action
+
+- grub-install -- https://godoc.org/github.com/go-debos/debos/actions#hdr-GrubInstall_Action
+
+- import-image -- https://godoc.org/github.com/go-debos/debos/actions#hdr-ImportImage_Action
+
+- import-rootfs -- https://godoc.org/github.com/go-debos/debos/actions#hdr-ImportRootfs_Action
+
+- iso -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Iso_Action
+
+- local-repository -- https://godoc.org/github.com/go-debos/debos/actions#hdr-LocalRepository_Action
+
+- mender-artifact -- https://godoc.org/github.com/go-debos/debos/actions#hdr-MenderArtifact_Action
+
 - mmdebstrap -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Mmdebstrap_Action
 
 - download -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Download_Action
@@ -63,10 +324,16 @@ Supported actions
 
 - image-partition -- https://godoc.org/github.com/go-debos/debos/actions#hdr-ImagePartition_Action
 
+- netboot -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Netboot_Action
+
+- ostree-checkout -- https://godoc.org/github.com/go-debos/debos/actions#hdr-OstreeCheckout_Action
+
 - ostree-commit -- https://godoc.org/github.com/go-debos/debos/actions#hdr-OstreeCommit_Action
 
 - ostree-deploy -- https://godoc.org/github.com/go-debos/debos/actions#hdr-OstreeDeploy_Action
 
+- ostree-pull -- https://godoc.org/github.com/go-debos/debos/actions#hdr-OstreePull_Action
+
 - overlay -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Overlay_Action
 
 - pack -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Pack_Action
@@ -75,21 +342,49 @@ Supported actions
 
 - pacstrap -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Pacstrap_Action
 
+- rauc-bundle -- https://godoc.org/github.com/go-debos/debos/actions#hdr-RaucBundle_Action
+
 - raw -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Raw_Action
 
 - recipe -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Recipe_Action
 
 - run -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Run_Action
 
+- slim -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Slim_Action
+
+- squashfs-root -- https://godoc.org/github.com/go-debos/debos/actions#hdr-SquashfsRoot_Action
+
+- ssh -- https://godoc.org/github.com/go-debos/debos/actions#hdr-SSH_Action
+
+- swupdate -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Swupdate_Action
+
+- system-config -- https://godoc.org/github.com/go-debos/debos/actions#hdr-SystemConfig_Action
+
+- systemd-boot -- https://godoc.org/github.com/go-debos/debos/actions#hdr-SystemdBoot_Action
+
+- systemd-firstboot -- https://godoc.org/github.com/go-debos/debos/actions#hdr-SystemdFirstboot_Action
+
+- sysusers-tmpfiles -- https://godoc.org/github.com/go-debos/debos/actions#hdr-SysusersTmpfiles_Action
+
+- uboot-env -- https://godoc.org/github.com/go-debos/debos/actions#hdr-UbootEnv_Action
+
+- uboot-write -- https://godoc.org/github.com/go-debos/debos/actions#hdr-UbootWrite_Action
+
 - unpack -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Unpack_Action
+
+- users -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Users_Action
+
+- usr-merge -- https://godoc.org/github.com/go-debos/debos/actions#hdr-UsrMerge_Action
 */
 package actions
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"al.essio.dev/pkg/shellescape"
 	"github.com/go-debos/debos"
+	"github.com/go-debos/fakemachine"
 	"gopkg.in/yaml.v2"
 	"github.com/go-task/slim-sprig/v3"
 	"path"
@@ -98,7 +393,9 @@ import (
 	"strconv"
 	"strings"
 	"reflect"
+	"regexp"
 	"github.com/google/uuid"
+	"github.com/docker/go-units"
 )
 
 /* the YamlAction just embed the Action interface and implements the
@@ -106,67 +403,242 @@ import (
  * specific action at unmarshaling time */
 type YamlAction struct {
 	debos.Action
+	when        string
+	items       []interface{}
+	raw         map[interface{}]interface{} // Properties of the action to expand for each item
+	sandboxName string
+	sandbox     *debos.Sandbox
 }
 
-type Recipe struct {
-	Architecture string
-	SectorSize   int
-	Actions      []YamlAction
+type RecipeParameter struct {
+	Name        string
+	Description string
+	Default     *string
 }
 
-func (y *YamlAction) UnmarshalYAML(unmarshal func(interface{}) error) error {
-	var aux debos.BaseAction
+// Template variable declared in the recipe header
+type RecipeVariable struct {
+	Name        string
+	Description string
+	Type        string
+	Default     *string
+	Allowed     []string
+	Required    bool
+}
 
-	err := unmarshal(&aux)
-	if err != nil {
-		return err
-	}
+// Memory and CPUs hints for the fakemachine VM
+type RecipeResources struct {
+	Memory string
+	CPUs   int `yaml:"cpus"`
+}
 
-	switch aux.Action {
+// Backends and kernel modules acceptable for the fakemachine VM
+type RecipeFakemachine struct {
+	Backends      []string
+	KernelModules []string `yaml:"kernel-modules"`
+}
+
+type Recipe struct {
+	Architecture       string
+	SectorSize         int
+	Target             *debos.Target
+	Resources          *RecipeResources
+	Fakemachine        *RecipeFakemachine
+	Umask              string
+	NormalizeOwnership bool `yaml:"normalize-ownership"`
+	Parameters         []RecipeParameter
+	Variables          []RecipeVariable
+	Sandboxes          map[string]*debos.Sandbox
+	Artifacts          []RecipeArtifact
+	Exports            []string
+	Actions            []YamlAction
+}
+
+// New action of the given name, as in the 'action' property
+func newAction(name string) (debos.Action, error) {
+	var action debos.Action
+
+	switch name {
 	case "debootstrap":
-		y.Action = NewDebootstrapAction()
+		action = NewDebootstrapAction()
 	case "mmdebstrap":
-		y.Action = NewMmdebstrapAction()
+		action = NewMmdebstrapAction()
 	case "pacstrap":
-		y.Action = &PacstrapAction{}
+		action = &PacstrapAction{}
 	case "pack":
-		y.Action = NewPackAction()
+		action = NewPackAction()
 	case "unpack":
-		y.Action = &UnpackAction{}
+		action = &UnpackAction{}
 	case "run":
-		y.Action = &RunAction{}
+		action = &RunAction{}
 	case "apt":
-		y.Action = NewAptAction()
+		action = NewAptAction()
 	case "pacman":
-		y.Action = &PacmanAction{}
+		action = &PacmanAction{}
 	case "ostree-commit":
-		y.Action = &OstreeCommitAction{}
+		action = &OstreeCommitAction{}
 	case "ostree-deploy":
-		y.Action = NewOstreeDeployAction()
+		action = NewOstreeDeployAction()
 	case "overlay":
-		y.Action = &OverlayAction{}
+		action = &OverlayAction{}
 	case "image-partition":
-		y.Action = &ImagePartitionAction{}
+		action = &ImagePartitionAction{}
 	case "filesystem-deploy":
-		y.Action = NewFilesystemDeployAction()
+		action = NewFilesystemDeployAction()
 	case "raw":
-		y.Action = &RawAction{}
+		action = &RawAction{}
 	case "download":
-		y.Action = &DownloadAction{}
+		action = &DownloadAction{}
 	case "recipe":
-		y.Action = &RecipeAction{}
+		action = &RecipeAction{}
+	case "rauc-bundle":
+		action = NewRaucBundleAction()
+	case "mender-artifact":
+		action = &MenderArtifactAction{}
+	case "swupdate":
+		action = &SwupdateAction{}
+	case "alternatives":
+		action = &AlternativesAction{}
+	case "ostree-pull":
+		action = NewOstreePullAction()
+	case "sysusers-tmpfiles":
+		action = NewSysusersTmpfilesAction()
+	case "boot-entries":
+		action = NewBootEntriesAction()
+	case "flash-kernel":
+		action = NewFlashKernelAction()
+	case "first-boot":
+		action = &FirstBootAction{}
+	case "grub-install":
+		action = NewGrubInstallAction()
+	case "uboot-env":
+		action = NewUbootEnvAction()
+	case "systemd-boot":
+		action = NewSystemdBootAction()
+	case "arm-firmware":
+		action = &ArmFirmwareAction{}
+	case "uboot-write":
+		action = NewUbootWriteAction()
+	case "firmware":
+		action = NewFirmwareAction()
+	case "apt-sources":
+		action = NewAptSourcesAction()
+	case "local-repository":
+		action = NewLocalRepositoryAction()
+	case "import-rootfs":
+		action = &ImportRootfsAction{}
+	case "import-image":
+		action = &ImportImageAction{}
+	case "apt-keyring":
+		action = NewAptKeyringAction()
+	case "debconf":
+		action = &DebconfAction{}
+	case "users":
+		action = &UsersAction{}
+	case "system-config":
+		action = &SystemConfigAction{}
+	case "ssh":
+		action = &SSHAction{}
+	case "git":
+		action = NewGitAction()
+	case "ostree-checkout":
+		action = &OstreeCheckoutAction{}
+	case "convert-partition-table":
+		action = &ConvertPartitionTableAction{}
+	case "systemd-firstboot":
+		action = NewSystemdFirstbootAction()
+	case "slim":
+		action = NewSlimAction()
+	case "check-binaries":
+		action = &CheckBinariesAction{}
+	case "erofs":
+		action = NewErofsAction()
+	case "squashfs-root":
+		action = NewSquashfsRootAction()
+	case "usr-merge":
+		action = NewUsrMergeAction()
+	case "iso":
+		action = NewIsoAction()
+	case "netboot":
+		action = NewNetbootAction()
 	default:
-		return fmt.Errorf("Unknown action: %v", aux.Action)
+		return nil, fmt.Errorf("Unknown action: %v", name)
+	}
+
+	return action, nil
+}
+
+func (y *YamlAction) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var aux debos.BaseAction
+
+	err := unmarshal(&aux)
+	if err != nil {
+		return err
+	}
+
+	y.Action, err = newAction(aux.Action)
+	if err != nil {
+		return err
 	}
 
 	err = unmarshal(y.Action)
 	if err != nil {
 		return err
 	}
+	y.when = aux.When
+	y.sandboxName = aux.Sandbox
+
+	if len(aux.WithItems) > 0 {
+		if err := unmarshal(&y.raw); err != nil {
+			return err
+		}
+		delete(y.raw, "with-items")
+		y.items = aux.WithItems
+	}
 
 	return nil
 }
 
+// The sources of the bind mounts of the sandbox have to be in fakemachine
+func (y YamlAction) PreMachine(context *debos.DebosContext, m *fakemachine.Machine, args *[]string) error {
+	if y.sandbox != nil {
+		for _, source := range y.sandbox.BindMountSources() {
+			m.AddVolume(source)
+		}
+	}
+
+	return y.Action.PreMachine(context, m, args)
+}
+
+// Actions check their commands against their sandbox
+func (y YamlAction) Verify(context *debos.DebosContext) error {
+	if y.sandbox != nil {
+		previous := context.Sandbox
+		context.Sandbox = y.sandbox
+		defer func() { context.Sandbox = previous }()
+	}
+
+	return y.Action.Verify(context)
+}
+
+func (y YamlAction) Run(context *debos.DebosContext) error {
+	expandRegistered(reflect.ValueOf(y.Action), context.Registered)
+
+	// Commands run in the chroot by the action get its sandbox
+	if y.sandbox != nil {
+		previous := context.Sandbox
+		context.Sandbox = y.sandbox
+		defer func() { context.Sandbox = previous }()
+	}
+
+	return y.Action.Run(context)
+}
+
+func (y YamlAction) PostMachine(context *debos.DebosContext) error {
+	expandRegistered(reflect.ValueOf(y.Action), context.Registered)
+	return y.Action.PostMachine(context)
+}
+
 // Deprecated we don't know the sector size when processing the template,
 // the sector size can be defined using yaml
 // definition. Append a 's' suffix and let the raw
@@ -184,6 +656,331 @@ func uuid5(namespace string, data string) string {
 	return id.String()
 }
 
+var registeredRegex = regexp.MustCompile(`\$\{registered:([a-zA-Z_][a-zA-Z0-9_]*)\}`)
+
+// The values are only known while running, so leave a placeholder to expand then
+func registered(name string) (string, error) {
+	if !registerNameRegex.MatchString(name) {
+		return "", fmt.Errorf("Invalid registered variable name '%s'", name)
+	}
+	return "${registered:" + name + "}", nil
+}
+
+/*
+Substitute the registered values to their placeholders in the strings of the
+action. Placeholders of values not registered yet are kept, they may be used
+later, e.g. by a postprocessing step or an action of a sub-recipe.
+*/
+func expandRegistered(v reflect.Value, vars map[string]string) {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if !v.IsNil() {
+			expandRegistered(v.Elem(), vars)
+		}
+	case reflect.Struct:
+		// Recipes declaring parameters have their own registered variables
+		if r, ok := v.Interface().(Recipe); ok && len(r.Parameters) > 0 {
+			return
+		}
+		for i := 0; i < v.NumField(); i++ {
+			if v.Field(i).CanSet() {
+				expandRegistered(v.Field(i), vars)
+			}
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			expandRegistered(v.Index(i), vars)
+		}
+	case reflect.Map:
+		for _, k := range v.MapKeys() {
+			e := reflect.New(v.Type().Elem()).Elem()
+			e.Set(v.MapIndex(k))
+			expandRegistered(e, vars)
+			v.SetMapIndex(k, e)
+		}
+	case reflect.String:
+		if v.CanSet() && strings.Contains(v.String(), "${registered:") {
+			v.SetString(registeredRegex.ReplaceAllStringFunc(v.String(), func(p string) string {
+				if value, found := vars[registeredRegex.FindStringSubmatch(p)[1]]; found {
+					return value
+				}
+				return p
+			}))
+		}
+	}
+}
+
+/*
+Placeholders the 'item' template function expands to, substituted for each
+item once the recipe is templated. The random token keeps them apart from the
+shell variables named item the properties may use.
+*/
+var itemToken = strings.ReplaceAll(uuid.New().String(), "-", "")
+var itemRegex = regexp.MustCompile(`\$\{item-` + itemToken + `(?::([a-zA-Z0-9_-]+))?\}`)
+
+// Placeholder of the current item of 'with-items', or of one of its keys
+func item(key ...string) (string, error) {
+	placeholder := "${item-" + itemToken + "}"
+	switch {
+	case len(key) == 0:
+		return placeholder, nil
+	case len(key) == 1:
+		placeholder = "${item-" + itemToken + ":" + key[0] + "}"
+		if itemRegex.FindString(placeholder) == placeholder {
+			return placeholder, nil
+		}
+	}
+
+	return "", fmt.Errorf("Invalid item key %v", key)
+}
+
+// Substitute the item to its placeholders in the properties of an action
+func substituteItem(v interface{}, item interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case string:
+		var err error
+		s := itemRegex.ReplaceAllStringFunc(v, func(p string) string {
+			key := itemRegex.FindStringSubmatch(p)[1]
+			values, isMap := item.(map[interface{}]interface{})
+			switch {
+			case key == "" && !isMap:
+				return fmt.Sprint(item)
+			case key != "" && isMap:
+				if value, found := values[key]; found {
+					return fmt.Sprint(value)
+				}
+			}
+			name := "item"
+			if key != "" {
+				name += ":" + key
+			}
+			err = fmt.Errorf("No '%s' in item %v", name, item)
+			return p
+		})
+		return s, err
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i, e := range v {
+			var err error
+			if l[i], err = substituteItem(e, item); err != nil {
+				return nil, err
+			}
+		}
+		return l, nil
+	case map[interface{}]interface{}:
+		m := make(map[interface{}]interface{}, len(v))
+		for k, e := range v {
+			var err error
+			if m[k], err = substituteItem(e, item); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	}
+
+	return v, nil
+}
+
+// Action of 'with-items' for one item
+func expandItem(raw map[interface{}]interface{}, item interface{}) (YamlAction, error) {
+	var y YamlAction
+
+	properties, err := substituteItem(raw, item)
+	if err != nil {
+		return y, err
+	}
+
+	data, err := yaml.Marshal(properties)
+	if err != nil {
+		return y, err
+	}
+
+	err = yaml.Unmarshal(data, &y)
+	return y, err
+}
+
+// Declarations of the header of a recipe applied before templating it
+type recipeDeclarations struct {
+	Parameters []RecipeParameter
+	Variables  []RecipeVariable
+}
+
+/*
+Parameters and variables declared by the recipe, read from the recipe
+templated with the given variables, missing ones being empty. Errors are left
+to the parsing of the recipe.
+*/
+func declarations(t *template.Template, templateVars map[string]string) recipeDeclarations {
+	var header recipeDeclarations
+
+	t, err := t.Clone()
+	if err != nil {
+		return header
+	}
+	t.Option("missingkey=zero")
+
+	data := new(bytes.Buffer)
+	if err := t.Execute(data, templateVars); err != nil {
+		return header
+	}
+
+	yaml.Unmarshal(data.Bytes(), &header)
+	return header
+}
+
+// Template variables with the defaults of the parameters not given
+func applyParameters(parameters []RecipeParameter, templateVars map[string]string) (map[string]string, error) {
+	vars := make(map[string]string)
+	for k, v := range templateVars {
+		vars[k] = v
+	}
+
+	for _, p := range parameters {
+		if p.Name == "" {
+			return nil, errors.New("Parameter without a name")
+		}
+		if _, found := vars[p.Name]; found {
+			continue
+		}
+		if p.Default == nil {
+			return nil, fmt.Errorf("Missing parameter '%s'", p.Name)
+		}
+		vars[p.Name] = *p.Default
+	}
+
+	return vars, nil
+}
+
+// Check a value of a variable against its declared type
+func checkVariableType(v RecipeVariable, value string) error {
+	var err error
+	switch v.Type {
+	case "", "string":
+	case "bool":
+		_, err = strconv.ParseBool(value)
+	case "int":
+		_, err = strconv.Atoi(value)
+	case "size":
+		_, err = units.FromHumanSize(value)
+	default:
+		return fmt.Errorf("Variable '%s' has unknown type '%s'", v.Name, v.Type)
+	}
+
+	if err != nil {
+		return fmt.Errorf("Invalid value '%s' for variable '%s' of type %s", value, v.Name, v.Type)
+	}
+
+	return nil
+}
+
+/*
+Template variables checked against the declared variables, with the defaults
+of the ones not given. Variables neither given nor with a default are empty.
+*/
+func applyVariables(variables []RecipeVariable, templateVars map[string]string) (map[string]string, error) {
+	vars := make(map[string]string)
+	for k, v := range templateVars {
+		vars[k] = v
+	}
+
+	for _, v := range variables {
+		if v.Name == "" {
+			return nil, errors.New("Variable without a name")
+		}
+		if v.Required && v.Default != nil {
+			return nil, fmt.Errorf("Variable '%s' is required and can't have a default", v.Name)
+		}
+
+		value, found := vars[v.Name]
+		if !found {
+			if v.Required {
+				message := fmt.Sprintf("Missing required variable '%s'", v.Name)
+				if v.Description != "" {
+					message += fmt.Sprintf(" (%s)", v.Description)
+				}
+				return nil, fmt.Errorf("%s, set it with '-t %s:value'", message, v.Name)
+			}
+			if v.Default != nil {
+				value = *v.Default
+			}
+			vars[v.Name] = value
+		}
+
+		// Empty values of optional variables mean unset
+		if value == "" && !v.Required {
+			continue
+		}
+
+		if err := checkVariableType(v, value); err != nil {
+			return nil, err
+		}
+
+		if len(v.Allowed) > 0 {
+			allowed := false
+			for _, a := range v.Allowed {
+				allowed = allowed || a == value
+			}
+			if !allowed {
+				return nil, fmt.Errorf("Invalid value '%s' for variable '%s', allowed values: %s",
+					value, v.Name, strings.Join(v.Allowed, ", "))
+			}
+		}
+	}
+
+	return vars, nil
+}
+
+func newTemplate(name string) *template.Template {
+	t := template.New(name)
+	funcs := template.FuncMap{
+		"sector": sector,
+		"escape": escape,
+		"uuid5": uuid5,
+		"registered": registered,
+		"item": item,
+		"semverCompare": semverCompare,
+	}
+	t.Funcs(funcs)
+
+	/* Add slim-sprig functions to template language */
+	t.Funcs(sprig.FuncMap())
+
+	return t
+}
+
+/*
+Whether the 'when' condition of an action holds. The condition is either a
+boolean, e.g. templated in the recipe, or a template expression evaluated with
+the template variables, e.g. 'eq .flavour "debug"'.
+*/
+func condition(when string, templateVars map[string]string) (bool, error) {
+	when = strings.TrimSpace(when)
+	if when == "" {
+		return true, nil
+	}
+
+	if b, err := strconv.ParseBool(when); err == nil {
+		return b, nil
+	}
+
+	t, err := newTemplate("when").Parse("{{ " + when + " }}")
+	if err != nil {
+		return false, fmt.Errorf("Invalid condition '%s': %v", when, err)
+	}
+
+	data := new(bytes.Buffer)
+	if err := t.Execute(data, templateVars); err != nil {
+		return false, fmt.Errorf("Invalid condition '%s': %v", when, err)
+	}
+
+	b, err := strconv.ParseBool(data.String())
+	if err != nil {
+		return false, fmt.Errorf("Condition '%s' is '%s', not a boolean", when, data)
+	}
+
+	return b, nil
+}
+
 func DumpActionStruct(iface interface{}) string {
 	var a []string
 
@@ -267,16 +1064,8 @@ Parse method reads YAML recipe file and map all steps to appropriate actions.
 engine. Multiple template maps have no effect; only first map will be used.
 */
 func (r *Recipe) Parse(file string, printRecipe bool, dump bool, templateVars ...map[string]string) error {
-	t := template.New(path.Base(file))
-	funcs := template.FuncMap{
-		"sector": sector,
-		"escape": escape,
-		"uuid5": uuid5,
-	}
-	t.Funcs(funcs)
-
-	/* Add slim-sprig functions to template language */
-	t.Funcs(sprig.FuncMap())
+	t := newTemplate(path.Base(file))
+	t.Funcs(fileFuncs(path.Dir(file)))
 
 	if _, err := t.ParseFiles(file); err != nil {
 		return err
@@ -286,6 +1075,23 @@ func (r *Recipe) Parse(file string, printRecipe bool, dump bool, templateVars ..
 		templateVars = append(templateVars, make(map[string]string))
 	}
 
+	header := declarations(t, templateVars[0])
+	if len(header.Parameters) > 0 {
+		vars, err := applyParameters(header.Parameters, templateVars[0])
+		if err != nil {
+			return fmt.Errorf("Recipe %s: %v", path.Base(file), err)
+		}
+		templateVars[0] = vars
+	}
+
+	if len(header.Variables) > 0 {
+		vars, err := applyVariables(header.Variables, templateVars[0])
+		if err != nil {
+			return fmt.Errorf("Recipe %s: %v", path.Base(file), err)
+		}
+		templateVars[0] = vars
+	}
+
 	data := new(bytes.Buffer)
 	if err := t.Execute(data, templateVars[0]); err != nil {
 		return err
@@ -307,6 +1113,18 @@ func (r *Recipe) Parse(file string, printRecipe bool, dump bool, templateVars ..
 		DumpActions(reflect.ValueOf(*r).Interface(), 0)
 	}
 
+	if r.Target != nil {
+		if err := r.Target.Verify(); err != nil {
+			return err
+		}
+
+		if len(r.Architecture) == 0 {
+			r.Architecture = r.Target.DpkgArch()
+		} else if r.Architecture != r.Target.DpkgArch() {
+			return fmt.Errorf("Architecture '%s' doesn't match target '%s'", r.Architecture, r.Target.Triplet())
+		}
+	}
+
 	if len(r.Architecture) == 0 {
 		return fmt.Errorf("Recipe file must have 'architecture' property")
 	}
@@ -315,9 +1133,120 @@ func (r *Recipe) Parse(file string, printRecipe bool, dump bool, templateVars ..
 		return fmt.Errorf("Recipe file must have at least one action")
 	}
 
+	for _, e := range r.Exports {
+		if !registerNameRegex.MatchString(e) {
+			return fmt.Errorf("Invalid exported variable name '%s'", e)
+		}
+	}
+
+	var expanded []YamlAction
+	for _, a := range r.Actions {
+		if len(a.items) == 0 {
+			expanded = append(expanded, a)
+			continue
+		}
+
+		for _, item := range a.items {
+			e, err := expandItem(a.raw, item)
+			if err != nil {
+				return fmt.Errorf("Action %s: %v", a, err)
+			}
+			expanded = append(expanded, e)
+		}
+	}
+	r.Actions = expanded
+
+	var actions []YamlAction
+	for _, a := range r.Actions {
+		run, err := condition(a.when, templateVars[0])
+		if err != nil {
+			return fmt.Errorf("Action %s: %v", a, err)
+		}
+		if run {
+			actions = append(actions, a)
+		} else if printRecipe || dump {
+			log.Printf("Skipping action %s, its condition '%s' is false", a, a.when)
+		}
+	}
+	r.Actions = actions
+
+	for name, sandbox := range r.Sandboxes {
+		if sandbox == nil {
+			r.Sandboxes[name] = &debos.Sandbox{}
+		} else if err := sandbox.Verify(); err != nil {
+			return fmt.Errorf("Sandbox %s: %v", name, err)
+		}
+	}
+
+	for _, a := range r.Artifacts {
+		if err := a.verify(); err != nil {
+			return err
+		}
+	}
+
+	for idx := range r.Actions {
+		a := &r.Actions[idx]
+		if a.sandboxName == "" {
+			continue
+		}
+		if a.sandbox = r.Sandboxes[a.sandboxName]; a.sandbox == nil {
+			return fmt.Errorf("Action %s: Unknown sandbox '%s'", a, a.sandboxName)
+		}
+	}
+
+	// The sector size of an image is the one of the fakemachine disks
+	for _, a := range r.Actions {
+		i, ok := a.Action.(*ImagePartitionAction)
+		if !ok || i.SectorSize == 0 {
+			continue
+		}
+		switch i.SectorSize {
+		case 512, 1024, 2048, 4096:
+		default:
+			return fmt.Errorf("Action %s: Unsupported sector size %d", a, i.SectorSize)
+		}
+		if r.SectorSize != 0 && r.SectorSize != i.SectorSize {
+			return fmt.Errorf("Action %s: Sector size %d differs from the %d of the recipe", a, i.SectorSize, r.SectorSize)
+		}
+		r.SectorSize = i.SectorSize
+	}
+
 	if r.SectorSize == 0 {
 		r.SectorSize = 512
 	}
 
+	if r.Resources != nil {
+		if r.Resources.Memory != "" {
+			if _, err := units.RAMInBytes(r.Resources.Memory); err != nil {
+				return fmt.Errorf("Invalid memory resource '%s': %v", r.Resources.Memory, err)
+			}
+		}
+		if r.Resources.CPUs < 0 {
+			return fmt.Errorf("Invalid cpus resource %d", r.Resources.CPUs)
+		}
+	}
+
+	if r.Fakemachine != nil {
+		for idx, backend := range r.Fakemachine.Backends {
+			if backend == "qemu-tcg" {
+				backend = "qemu"
+				r.Fakemachine.Backends[idx] = backend
+			}
+			known := false
+			for _, name := range fakemachine.BackendNames() {
+				known = known || (name == backend && name != "auto")
+			}
+			if !known {
+				return fmt.Errorf("Unknown fakemachine backend '%s'", backend)
+			}
+		}
+	}
+
+	if r.Umask != "" {
+		if umask, err := strconv.ParseUint(r.Umask, 8, 32); err != nil || umask > 0777 {
+			return fmt.Errorf("Invalid umask '%s', an octal value like \"0022\" is expected", r.Umask)
+		}
+	}
+
 	return nil
 }
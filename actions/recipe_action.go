@@ -6,7 +6,9 @@ override or set template variables.
 
 To ensure compatibility, both the parent recipe and all included recipes have
 to be for the same architecture. For convenience the parent architecture is
-passed in the "architecture" template variable.
+passed in the "architecture" template variable, and if the parent recipe
+declares a target, its description is passed in the "target_*" template
+variables.
 
 Limitations of combined recipes are equivalent to limitations within a
 single recipe (e.g. there can only be one image partition action).
@@ -16,24 +18,90 @@ single recipe (e.g. there can only be one image partition action).
    recipe: path to recipe
    variables:
      key: value
+   bundle: path or URL
+   keyring: path to keyring
+   sha256: checksum
 
 Mandatory properties:
 
-- recipe -- includes the recipe actions at the given path.
+- recipe -- includes the recipe actions at the given path. Relative to the
+root of the bundle if 'bundle' is set.
 
 Optional properties:
 
 - variables -- overrides or adds new template variables.
 
+- bundle -- path, relative to the recipe directory, or http(s) URL of a signed
+recipe bundle containing the recipe, e.g. a base recipe shared by another
+team. The detached signature is fetched from the same location with the
+'.sig' suffix.
+
+- keyring -- OpenPGP keyring, relative to the recipe directory, holding the
+keys trusted to sign the bundle, e.g. exported with 'gpg --export'. Mandatory
+if 'bundle' is set.
+
+- sha256 -- expected checksum of the bundle, to pin a given release of it.
+
+The bundle is created from the directory of a recipe with the '--bundle'
+option of debos. It's included only if its signature is made by a key of the
+keyring, so it can't be silently tampered with, and the fingerprint of the
+signing key is logged and recorded in the manifest of the build:
+
+ $ debos --bundle=base.tar.gz --bundle-key=builds@example.com base/base.yaml
+
+ - action: recipe
+   bundle: https://example.com/recipes/base.tar.gz
+   keyring: keys/base-team.gpg
+   recipe: base.yaml
+
+An included recipe can declare its parameters, so it's used like a function:
+the variables have to be declared parameters, the ones without a default
+value are mandatory, and it only sees the variables registered by its own
+actions, e.g. with the 'register' property of the run action, and the ones
+passed in 'variables'. The registered variables listed in 'exports' are
+available to the following actions of the parent recipe.
+
+ # add-bootloader.yaml
+ architecture: {{ .architecture }}
+
+ parameters:
+   - name: board
+     description: board to install the bootloader for
+   - name: console
+     default: ttyS0
+
+ exports:
+   - bootloader_version
+
+ actions:
+   - action: run
+     chroot: true
+     command: install-bootloader {{ .board }} {{ .console }}
+   - action: run
+     chroot: true
+     command: dpkg-query -W -f '${Version}' u-boot
+     register: bootloader_version
+
+ # Parent recipe
+ - action: recipe
+   recipe: add-bootloader.yaml
+   variables:
+     board: rpi4
+     console: {{ registered "serial_console" }}
 */
 package actions
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
+
 	"github.com/go-debos/debos"
 	"github.com/go-debos/fakemachine"
 )
@@ -42,9 +110,13 @@ type RecipeAction struct {
 	debos.BaseAction `yaml:",inline"`
 	Recipe           string
 	Variables        map[string]string
+	Bundle           string
+	Keyring          string
+	SHA256           string `yaml:"sha256"`
 	Actions          Recipe `yaml:"-"`
 	templateVars     map[string]string
 	context          debos.DebosContext
+	imports          []string // Registered variables of the parent passed in the variables
 }
 
 func (recipe *RecipeAction) Verify(context *debos.DebosContext) error {
@@ -55,7 +127,17 @@ func (recipe *RecipeAction) Verify(context *debos.DebosContext) error {
 	recipe.context = *context
 
 	file := recipe.Recipe
-	if !filepath.IsAbs(file) {
+	if recipe.Bundle != "" {
+		if filepath.IsAbs(file) || strings.HasPrefix(filepath.Clean(file), "..") {
+			return fmt.Errorf("Recipe %s is not in the bundle", file)
+		}
+
+		dir, err := recipe.openBundle(context)
+		if err != nil {
+			return err
+		}
+		file = filepath.Join(dir, file)
+	} else if !filepath.IsAbs(file) {
 		file = filepath.Clean(context.RecipeDir + "/" + recipe.Recipe)
 	}
 	recipe.context.RecipeDir = filepath.Dir(file)
@@ -67,6 +149,11 @@ func (recipe *RecipeAction) Verify(context *debos.DebosContext) error {
 	// Initialise template vars
 	recipe.templateVars = make(map[string]string)
 	recipe.templateVars["architecture"] = context.Architecture
+	if context.Target != nil {
+		for k, v := range context.Target.TemplateVars() {
+			recipe.templateVars[k] = v
+		}
+	}
 
 	// Add Variables to template vars
 	for k, v := range recipe.Variables {
@@ -81,6 +168,22 @@ func (recipe *RecipeAction) Verify(context *debos.DebosContext) error {
 		return fmt.Errorf("Expect architecture '%s' but got '%s'", context.Architecture, recipe.Actions.Architecture)
 	}
 
+	if len(recipe.Actions.Parameters) > 0 {
+		for k, v := range recipe.Variables {
+			declared := false
+			for _, p := range recipe.Actions.Parameters {
+				declared = declared || p.Name == k
+			}
+			if !declared {
+				return fmt.Errorf("Recipe %s has no parameter '%s'", recipe.Recipe, k)
+			}
+
+			for _, m := range registeredRegex.FindAllStringSubmatch(v, -1) {
+				recipe.imports = append(recipe.imports, m[1])
+			}
+		}
+	}
+
 	for _, a := range recipe.Actions.Actions {
 		if err := a.Verify(&recipe.context); err != nil {
 			return err
@@ -90,11 +193,141 @@ func (recipe *RecipeAction) Verify(context *debos.DebosContext) error {
 	return nil
 }
 
+/*
+Fetch a bundle or its signature to the given file. The artifact directory is
+shared with fakemachine, where the file is only checked against the lock, as
+the lock is written by the debos running in fakemachine.
+*/
+func fetchBundleFile(source, file string, context *debos.DebosContext) error {
+	remote := strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+
+	if fakemachine.InMachine() {
+		if remote && context.Lock != nil {
+			return context.Lock.Download(source, file)
+		}
+		return nil
+	}
+
+	if remote {
+		return context.Lock.Fetch(source, file)
+	}
+
+	return debos.CopyFile(debos.CleanPathAt(source, context.RecipeDir), file, 0644)
+}
+
+// Directory of the bundles of the build, in the artifact directory shared with fakemachine
+func bundlesDir(context *debos.DebosContext) string {
+	return path.Join(context.Artifactdir, ".debos-"+context.BuildID+"-bundles")
+}
+
+/*
+Fetch the bundle to the directory of the bundles of the build, check its
+checksum and signature, and unpack it. Returns the directory of the unpacked
+bundle.
+*/
+func (recipe *RecipeAction) openBundle(context *debos.DebosContext) (string, error) {
+	if recipe.Keyring == "" {
+		return "", errors.New("Property 'keyring' is mandatory with 'bundle'")
+	}
+	recipe.Keyring = debos.CleanPathAt(recipe.Keyring, context.RecipeDir)
+
+	id := sha256.Sum256([]byte(recipe.Bundle))
+	dir := path.Join(bundlesDir(context), hex.EncodeToString(id[:8]))
+	bundle := path.Join(dir, "bundle.tar.gz")
+	content := path.Join(dir, "content")
+
+	// The artifact directory is shared with fakemachine, fetch only once
+	if !fakemachine.InMachine() {
+		os.RemoveAll(dir)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return "", err
+		}
+	}
+
+	if err := fetchBundleFile(recipe.Bundle, bundle, context); err != nil {
+		return "", fmt.Errorf("Failed to fetch recipe bundle %s: %v", recipe.Bundle, err)
+	}
+
+	err := fetchBundleFile(debos.BundleSignature(recipe.Bundle), debos.BundleSignature(bundle), context)
+	if err != nil {
+		return "", fmt.Errorf("Failed to fetch signature of recipe bundle %s: %v", recipe.Bundle, err)
+	}
+
+	sum, err := debos.HashFile(bundle)
+	if err != nil {
+		return "", err
+	}
+	if recipe.SHA256 != "" && !strings.EqualFold(recipe.SHA256, sum) {
+		return "", fmt.Errorf("Checksum of recipe bundle %s is %s, expected %s", recipe.Bundle, sum, recipe.SHA256)
+	}
+
+	signer, err := debos.VerifyBundle(bundle, recipe.Keyring)
+	if err != nil {
+		return "", err
+	}
+	log.Printf("Recipe bundle %s signed by %s", recipe.Bundle, signer)
+
+	if context.Manifest != nil {
+		context.Manifest.AddBundle(debos.BundleManifest{
+			Source: recipe.Bundle,
+			SHA256: sum,
+			Signer: signer,
+		})
+	}
+
+	// Unpack again the verified bundle rather than trusting a previous content
+	os.RemoveAll(content)
+	if err := os.MkdirAll(content, 0755); err != nil {
+		return "", err
+	}
+
+	archive, err := debos.NewArchive(bundle, debos.Tar)
+	if err != nil {
+		return "", err
+	}
+	if err := archive.AddOption("tarcompression", "gz"); err != nil {
+		return "", err
+	}
+	if err := archive.Unpack(content); err != nil {
+		return "", err
+	}
+
+	return content, nil
+}
+
+func (recipe *RecipeAction) WatchPaths(context *debos.DebosContext) []string {
+	file := recipe.Recipe
+	if !filepath.IsAbs(file) {
+		file = filepath.Clean(context.RecipeDir + "/" + recipe.Recipe)
+	}
+
+	paths := []string{file}
+	if recipe.Bundle != "" {
+		// Remote bundles are only fetched at the start of the build
+		paths = []string{}
+		if !strings.Contains(recipe.Bundle, "://") {
+			paths = append(paths, debos.CleanPathAt(recipe.Bundle, context.RecipeDir))
+		}
+	}
+	for _, a := range recipe.Actions.Actions {
+		if w, ok := a.Action.(debos.WatchableAction); ok {
+			paths = append(paths, w.WatchPaths(&recipe.context)...)
+		}
+	}
+
+	return paths
+}
+
 func (recipe *RecipeAction) PreMachine(context *debos.DebosContext, m *fakemachine.Machine, args *[]string) error {
 	// TODO: check args?
 
 	m.AddVolume(recipe.context.RecipeDir)
 
+	// The keyring may be kept outside of the recipe directory
+	if recipe.Keyring != "" {
+		m.AddVolume(path.Dir(recipe.Keyring))
+	}
+
 	for _, a := range recipe.Actions.Actions {
 		if err := a.PreMachine(&recipe.context, m, args); err != nil {
 			return err
@@ -114,17 +347,57 @@ func (recipe *RecipeAction) PreNoMachine(context *debos.DebosContext) error {
 	return nil
 }
 
-func (recipe *RecipeAction) Run(context *debos.DebosContext) error {
-	for _, a := range recipe.Actions.Actions {
-		log.Printf("==== %s ====\n", a)
-		if err := a.Run(&recipe.context); err != nil {
-			return err
+/*
+Run the stage of a recipe declaring parameters with its own registered
+variables, then export the declared ones to the parent.
+*/
+func (recipe *RecipeAction) scoped(run func() error) error {
+	if len(recipe.Actions.Parameters) == 0 {
+		return run()
+	}
+
+	parent := recipe.context.Registered
+	scope := make(map[string]string)
+	for _, name := range recipe.imports {
+		if value, found := parent[name]; found {
+			scope[name] = value
+		}
+	}
+
+	recipe.context.Registered = scope
+	err := run()
+	recipe.context.Registered = parent
+	if err != nil {
+		return err
+	}
+
+	for _, name := range recipe.Actions.Exports {
+		value, found := scope[name]
+		if !found {
+			continue
+		}
+		if recipe.context.Registered == nil {
+			recipe.context.Registered = make(map[string]string)
 		}
+		recipe.context.Registered[name] = value
 	}
 
 	return nil
 }
 
+func (recipe *RecipeAction) Run(context *debos.DebosContext) error {
+	return recipe.scoped(func() error {
+		for _, a := range recipe.Actions.Actions {
+			log.Printf("==== %s ====\n", a)
+			if err := a.Run(&recipe.context); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
 func (recipe *RecipeAction) Cleanup(context *debos.DebosContext) error {
 	for _, a := range recipe.Actions.Actions {
 		if err := a.Cleanup(&recipe.context); err != nil {
@@ -136,13 +409,29 @@ func (recipe *RecipeAction) Cleanup(context *debos.DebosContext) error {
 }
 
 func (recipe *RecipeAction) PostMachine(context *debos.DebosContext) error {
-	for _, a := range recipe.Actions.Actions {
-		if err := a.PostMachine(&recipe.context); err != nil {
-			return err
+	return recipe.scoped(func() error {
+		for _, a := range recipe.Actions.Actions {
+			if err := a.PostMachine(&recipe.context); err != nil {
+				return err
+			}
 		}
-	}
 
-	return nil
+		return nil
+	})
+}
+
+func (recipe *RecipeAction) Finalize(context *debos.DebosContext) error {
+	return recipe.scoped(func() error {
+		for _, a := range recipe.Actions.Actions {
+			if f, ok := a.Action.(debos.FinalizingAction); ok {
+				if err := f.Finalize(&recipe.context); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
 }
 
 func (recipe *RecipeAction) PostMachineCleanup(context *debos.DebosContext) error {
@@ -152,5 +441,9 @@ func (recipe *RecipeAction) PostMachineCleanup(context *debos.DebosContext) erro
 		}
 	}
 
+	if recipe.Bundle != "" {
+		return os.RemoveAll(bundlesDir(context))
+	}
+
 	return nil
 }
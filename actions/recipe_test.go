@@ -62,6 +62,41 @@ actions:
   - action: run
   - action: unpack
   - action: recipe
+  - action: rauc-bundle
+  - action: mender-artifact
+  - action: swupdate
+  - action: alternatives
+  - action: ostree-pull
+  - action: sysusers-tmpfiles
+  - action: boot-entries
+  - action: flash-kernel
+  - action: first-boot
+  - action: grub-install
+  - action: uboot-env
+  - action: systemd-boot
+  - action: arm-firmware
+  - action: uboot-write
+  - action: firmware
+  - action: apt-sources
+  - action: local-repository
+  - action: import-rootfs
+  - action: import-image
+  - action: apt-keyring
+  - action: debconf
+  - action: users
+  - action: system-config
+  - action: ssh
+  - action: git
+  - action: ostree-checkout
+  - action: convert-partition-table
+  - action: systemd-firstboot
+  - action: slim
+  - action: check-binaries
+  - action: erofs
+  - action: squashfs-root
+  - action: usr-merge
+  - action: iso
+  - action: netboot
 `,
 			"", // Do not expect failure
 		},
@@ -87,6 +122,41 @@ architecture: arm64
 `,
 			"Recipe file must have at least one action",
 		},
+		// Test architecture derived from target
+		{`
+target:
+  arch: arm
+  abi: gnueabihf
+
+actions:
+  - action: raw
+    origin: recipe
+    source: test
+`,
+			"", // Do not expect failure
+		},
+		// Test architecture not matching target
+		{`
+architecture: arm64
+target:
+  arch: x86_64
+
+actions:
+  - action: raw
+`,
+			"Architecture 'arm64' doesn't match target 'x86_64-linux-gnu'",
+		},
+		// Test of unknown target
+		{`
+target:
+  arch: aarch64
+  endian: big
+
+actions:
+  - action: raw
+`,
+			"Unsupported target aarch64-linux-gnu (big endian)",
+		},
 		// Test of wrong syntax in Yaml
 		{`wrong`,
 			"yaml: unmarshal errors:\n  line 1: cannot unmarshal !!str `wrong` into actions.Recipe",
@@ -152,6 +222,547 @@ actions:
 	runTest(t, testSector)
 }
 
+func TestParse_sectorSize(t *testing.T) {
+	var testSectorSize = testRecipe{
+		// Fail with differing sector sizes
+		`
+architecture: arm64
+sectorsize: 512
+
+actions:
+  - action: image-partition
+    imagename: test.img
+    imagesize: 1GB
+    partitiontype: gpt
+    sector-size: 4096
+`,
+		"Action image-partition: Sector size 4096 differs from the 512 of the recipe",
+	}
+	runTest(t, testSectorSize)
+}
+
+func TestParse_fakemachine(t *testing.T) {
+	var test = testRecipe{
+		`
+architecture: arm64
+fakemachine:
+  backends: [ kvm, qemu-tcg ]
+  kernel-modules: [ btrfs ]
+
+actions:
+  - action: run
+    command: uname -r
+`,
+		"",
+	}
+	r := runTest(t, test)
+	assert.Equal(t, []string{"kvm", "qemu"}, r.Fakemachine.Backends)
+
+	var testUnknown = testRecipe{
+		`
+architecture: arm64
+fakemachine:
+  backends: [ vbox ]
+
+actions:
+  - action: run
+    command: uname -r
+`,
+		"Unknown fakemachine backend 'vbox'",
+	}
+	runTest(t, testUnknown)
+}
+
+// Test of 'registered' function embedded to recipe package
+func TestParse_registered(t *testing.T) {
+	var test = testRecipe{
+		`
+architecture: arm64
+
+actions:
+  - action: run
+    command: uname -r
+    register: kernel_version
+  - action: run
+    command: echo {{ registered "kernel_version" }}
+`,
+		"",
+	}
+	r := runTest(t, test)
+	assert.Equal(t, "echo ${registered:kernel_version}", r.Actions[1].Action.(*actions.RunAction).Command)
+
+	file, err := ioutil.TempFile(os.TempDir(), "recipe")
+	assert.Empty(t, err)
+	defer os.Remove(file.Name())
+	file.WriteString(`
+architecture: arm64
+
+actions:
+  - action: run
+    command: echo {{ registered "kernel-version" }}
+`)
+	file.Close()
+
+	r = actions.Recipe{}
+	err = r.Parse(file.Name(), false, false)
+	assert.ErrorContains(t, err, "Invalid registered variable name 'kernel-version'")
+}
+
+// Test of the 'when' property of actions
+func TestParse_when(t *testing.T) {
+	var test = testRecipe{
+		`
+architecture: arm64
+
+actions:
+  - action: pack
+    when: eq .flavour "debug"
+  - action: unpack
+    when: {{ ne .flavour "debug" }}
+  - action: run
+    when: true
+    command: ok.sh
+`,
+		"",
+	}
+
+	r := runTest(t, test, map[string]string{"flavour": "debug"})
+	assert.Equal(t, 2, len(r.Actions))
+	assert.Equal(t, "pack", r.Actions[0].String())
+	assert.Equal(t, "run", r.Actions[1].String())
+
+	r = runTest(t, test, map[string]string{"flavour": "release"})
+	assert.Equal(t, 2, len(r.Actions))
+	assert.Equal(t, "unpack", r.Actions[0].String())
+
+	var testInvalid = testRecipe{
+		`
+architecture: arm64
+
+actions:
+  - action: pack
+    when: .flavour
+`,
+		"Action pack: Condition '.flavour' is 'debug', not a boolean",
+	}
+	runTest(t, testInvalid, map[string]string{"flavour": "debug"})
+}
+
+// Test of the template functions
+func TestParse_functions(t *testing.T) {
+	var test = testRecipe{
+		`
+architecture: arm64
+
+actions:
+  - action: run
+    command: {{ semverCompare ">= 6.1, < 7" "6.1.0-rc2" }} {{ semverCompare ">= 6.1, < 7" "v6.12" }} {{ semverCompare "!= 2" "2.0.0" }}
+  - action: run
+    command: {{ fileExists "missing.txt" }} {{ "linux-image-6" | trimPrefix "linux-image-" | add 1 }}
+`,
+		"",
+	}
+
+	r := runTest(t, test)
+	assert.Equal(t, "false true false", r.Actions[0].Action.(*actions.RunAction).Command)
+	assert.Equal(t, "false 7", r.Actions[1].Action.(*actions.RunAction).Command)
+}
+
+// Test of the variables declared in the recipe header
+func TestParse_variables(t *testing.T) {
+	var test = testRecipe{
+		`
+variables:
+  - name: suite
+    default: bookworm
+    allowed: [ bookworm, trixie ]
+  - name: board
+    required: true
+  - name: imagesize
+    type: size
+    default: 4GB
+  - name: debug
+    type: bool
+
+architecture: arm64
+
+actions:
+  - action: run
+    command: build {{ .suite }} {{ .board }} {{ .imagesize }} "{{ .debug }}"
+`,
+		"",
+	}
+
+	r := runTest(t, test, map[string]string{"board": "rpi4"})
+	assert.Equal(t, 1, len(r.Actions))
+	assert.Equal(t, `build bookworm rpi4 4GB ""`, r.Actions[0].Action.(*actions.RunAction).Command)
+
+	var tests = []struct {
+		vars map[string]string
+		err  string
+	}{
+		{map[string]string{}, "Missing required variable 'board', set it with '-t board:value'"},
+		{map[string]string{"board": "rpi4", "suite": "sid"}, "Invalid value 'sid' for variable 'suite', allowed values: bookworm, trixie"},
+		{map[string]string{"board": "rpi4", "debug": "maybe"}, "Invalid value 'maybe' for variable 'debug' of type bool"},
+	}
+
+	for _, tc := range tests {
+		file, err := ioutil.TempFile(os.TempDir(), "recipe")
+		assert.Empty(t, err)
+		file.WriteString(test.recipe)
+		file.Close()
+
+		err = (&actions.Recipe{}).Parse(file.Name(), false, false, tc.vars)
+		os.Remove(file.Name())
+		if assert.Error(t, err) {
+			assert.True(t, strings.HasSuffix(err.Error(), tc.err), err.Error())
+		}
+	}
+}
+
+// Test of the sandboxes referenced by actions
+func TestParse_sandbox(t *testing.T) {
+	var test = testRecipe{
+		`
+architecture: arm64
+
+sandboxes:
+  offline:
+    network: false
+  builder:
+    bind-mounts:
+      - /srv/sources:/src:ro
+
+actions:
+  - action: run
+    sandbox: builder
+    command: make
+  - action: run
+    sandbox: offline
+    command: make check
+`,
+		"",
+	}
+	r := runTest(t, test)
+	assert.Equal(t, 2, len(r.Sandboxes))
+
+	var tests = []testRecipe{
+		{
+			`
+architecture: arm64
+
+actions:
+  - action: run
+    sandbox: offline
+    command: make
+`,
+			"Action run: Unknown sandbox 'offline'",
+		},
+		{
+			`
+architecture: arm64
+
+sandboxes:
+  builder:
+    bind-mounts:
+      - sources
+    chroot: nspawn
+
+actions:
+  - action: run
+    command: make
+`,
+			"Sandbox builder: Invalid bind mount 'sources', expected 'source[:target][:ro]' with absolute paths",
+		},
+		{
+			`
+architecture: arm64
+
+sandboxes:
+  builder:
+    user: builder:staff
+
+actions:
+  - action: run
+    command: make
+`,
+			"Sandbox builder: User 'builder:staff' with a group needs the 'chroot' chroot method",
+		},
+	}
+
+	for _, test := range tests {
+		runTest(t, test)
+	}
+
+	// The binds of run actions need the nspawn chroot method of their sandbox
+	var testBinds = testRecipe{
+		`
+architecture: arm64
+
+sandboxes:
+  legacy:
+    chroot: chroot
+
+actions:
+  - action: run
+    sandbox: legacy
+    chroot: true
+    command: make
+    binds:
+      - source: sources
+`,
+		"",
+	}
+	r = runTest(t, testBinds)
+	context := debos.DebosContext{CommonContext: &debos.CommonContext{}}
+	assert.EqualError(t, r.Actions[0].Verify(&context), "Property 'binds' needs the 'nspawn' chroot method")
+	assert.Nil(t, context.Sandbox)
+}
+
+// Test of the problems reported by the linter
+func TestLint(t *testing.T) {
+	recipe := `
+architecture: arm64
+
+actions:
+  - action: run
+    chroot: true
+    comand: make
+  - action: overlay
+    origin: sources
+    source: overlay
+  - action: image-partition
+    imagename: test-{{ .suite }}.img
+    imagesize: 1GB
+    partitiontype: gpt
+    partitions:
+      - name: boot
+        fs: vfat
+        start: 1MB
+        end: 256MB
+      - name: root
+        fs: ext4
+        start: 128MB
+        end: 100%
+  - action: raw
+    source: filesystem
+    path: u-boot.bin
+    offset: {{ sector 64 }}
+`
+	file, err := ioutil.TempFile(os.TempDir(), "recipe")
+	assert.Empty(t, err)
+	file.WriteString(recipe)
+	file.Close()
+	defer os.Remove(file.Name())
+
+	var checks []string
+	for _, d := range actions.Lint(file.Name(), map[string]string{}) {
+		checks = append(checks, d.Severity+" "+d.Check)
+	}
+
+	assert.Equal(t, []string{
+		"warning undefined-variable",
+		"error unknown-property",
+		"error unknown-origin",
+		"error partitions",
+		"warning deprecated",
+		"warning deprecated",
+	}, checks)
+}
+
+func TestMigrate(t *testing.T) {
+	recipe := `
+actions:
+  # Write the bootloader
+  - action: raw
+    source: filesystem
+    path: u-boot.bin
+    offset: {{ sector 64 }}
+  - action: raw
+    origin: filesystem
+    source: spl.bin
+    offset: {{- sector 16 -}}
+  - action: overlay
+    source: overlay
+`
+	expected := `
+actions:
+  # Write the bootloader
+  - action: raw
+    origin: filesystem
+    source: u-boot.bin
+    offset: 64s
+  - action: raw
+    origin: filesystem
+    source: spl.bin
+    offset: 16s
+  - action: overlay
+    source: overlay
+`
+
+	migrated, done := actions.Migrate([]byte(recipe))
+	assert.Equal(t, expected, string(migrated))
+	assert.Equal(t, 2, len(done))
+
+	_, done = actions.Migrate(migrated)
+	assert.Empty(t, done)
+}
+
+// Test of the artifacts declared in the header
+func TestParse_artifacts(t *testing.T) {
+	var test = testRecipe{
+		`
+architecture: arm64
+
+artifacts:
+  - file: rootfs.tar.gz
+    keep: false
+  - file: debian.img
+    name: debian-${date}-${arch}.img
+  - file: debian.iso
+    post-process:
+      - compress: xz
+      - checksum: sha256
+      - rename: debian-${date}.iso.xz
+      - upload: https://images.example.org/
+
+actions:
+  - action: run
+    command: make
+`,
+		"",
+	}
+	r := runTest(t, test)
+	assert.Equal(t, 3, len(r.Artifacts))
+	assert.Equal(t, 4, len(r.Artifacts[2].PostProcess))
+
+	var tests = []testRecipe{
+		{
+			`
+architecture: arm64
+
+artifacts:
+  - file: debian.img
+    name: debian-${date}.img
+    keep: false
+
+actions:
+  - action: run
+    command: make
+`,
+			"Artifact debian.img can't be both renamed and removed",
+		},
+		{
+			`
+architecture: arm64
+
+artifacts:
+  - file: ../debian.img
+
+actions:
+  - action: run
+    command: make
+`,
+			"Artifact '../debian.img' has to be relative to the artifact directory",
+		},
+		{
+			`
+architecture: arm64
+
+artifacts:
+  - file: debian.img
+    post-process:
+      - checksum: sha256
+      - compress: zstd
+
+actions:
+  - action: run
+    command: make
+`,
+			"Artifact debian.img can't be compressed once checksummed or signed",
+		},
+		{
+			`
+architecture: arm64
+
+artifacts:
+  - file: debian.img
+    post-process:
+      - checksum: md5
+
+actions:
+  - action: run
+    command: make
+`,
+			"Artifact debian.img: Unsupported checksum 'md5'",
+		},
+		{
+			`
+architecture: arm64
+
+artifacts:
+  - file: debian.img
+    post-process:
+      - compress: zstd
+        checksum: sha256
+
+actions:
+  - action: run
+    command: make
+`,
+			"Artifact debian.img: Post-process stages need exactly one of compress, checksum, sign, rename, upload or command",
+		},
+	}
+
+	for _, test := range tests {
+		runTest(t, test)
+	}
+}
+
+// Test of the 'with-items' property of actions
+func TestParse_withItems(t *testing.T) {
+	var test = testRecipe{
+		`
+architecture: arm64
+
+actions:
+  - action: run
+    with-items: [ one, two ]
+    command: echo {{ item }}
+  - action: run
+    with-items:
+      - { name: ssh, unit: ssh.service }
+    description: enable {{ item "name" }}
+    command: systemctl enable {{ item "unit" }}
+  - action: run
+    with-items: [ three ]
+    command: for item in a b; do echo {{ item }} ${item}; done
+`,
+		"",
+	}
+
+	r := runTest(t, test)
+	assert.Equal(t, 4, len(r.Actions))
+	assert.Equal(t, "echo one", r.Actions[0].Action.(*actions.RunAction).Command)
+	assert.Equal(t, "echo two", r.Actions[1].Action.(*actions.RunAction).Command)
+	assert.Equal(t, "enable ssh", r.Actions[2].String())
+	assert.Equal(t, "systemctl enable ssh.service", r.Actions[2].Action.(*actions.RunAction).Command)
+	assert.Equal(t, "for item in a b; do echo three ${item}; done", r.Actions[3].Action.(*actions.RunAction).Command)
+
+	var testMissing = testRecipe{
+		`
+architecture: arm64
+
+actions:
+  - action: run
+    with-items: [ one ]
+    command: echo {{ item "name" }}
+`,
+		"Action run: No 'item:name' in item one",
+	}
+	runTest(t, testMissing)
+}
+
 func runTest(t *testing.T, test testRecipe, templateVars ...map[string]string) actions.Recipe {
 	file, err := ioutil.TempFile(os.TempDir(), "recipe")
 	assert.Empty(t, err)
@@ -230,6 +841,25 @@ actions:
 `,
 	}
 
+	var recipeParameters = subRecipe {
+		"parameters.yaml",
+		`
+architecture: amd64
+
+parameters:
+  - name: board
+  - name: console
+    default: ttyS0
+
+exports:
+  - version
+
+actions:
+  - action: run
+    command: install {{ .board }} {{ .console }}
+`,
+	}
+
 	// test recipes
 	var tests = []testSubRecipe {
 		{
@@ -299,6 +929,50 @@ actions:
 		"",
 		"yaml: unmarshal errors:\n  line 8: cannot unmarshal !!seq into map[string]string",
 		},
+		{
+		// Test recipe with parameters OK
+		`
+architecture: amd64
+
+actions:
+  - action: recipe
+    recipe: parameters.yaml
+    variables:
+      board: rpi4
+`,
+		recipeParameters,
+		"", // Do not expect failure
+		"", // Do not expect parse failure
+		},
+		{
+		// Fail with missing parameter
+		`
+architecture: amd64
+
+actions:
+  - action: recipe
+    recipe: parameters.yaml
+`,
+		recipeParameters,
+		"Recipe parameters.yaml: Missing parameter 'board'",
+		"", // Do not expect parse failure
+		},
+		{
+		// Fail with undeclared parameter
+		`
+architecture: amd64
+
+actions:
+  - action: recipe
+    recipe: parameters.yaml
+    variables:
+      board: rpi4
+      serial: ttyAMA0
+`,
+		recipeParameters,
+		"Recipe parameters.yaml has no parameter 'serial'",
+		"", // Do not expect parse failure
+		},
 	}
 
 	for _, test := range tests {
@@ -307,7 +981,7 @@ actions:
 }
 
 func runTestWithSubRecipes(t *testing.T, test testSubRecipe, templateVars ...map[string]string) actions.Recipe {
-	context := debos.DebosContext { &debos.CommonContext{}, "", "", 512 }
+	context := debos.DebosContext { &debos.CommonContext{}, "", "", 512, nil }
 	dir, err := ioutil.TempDir("", "go-debos")
 	assert.Empty(t, err)
 	defer os.RemoveAll(dir)
@@ -369,3 +1043,46 @@ func runTestWithSubRecipes(t *testing.T, test testSubRecipe, templateVars ...map
 
 	return r
 }
+
+func TestImportLayout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "debos-layout")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	wks := `# Yocto layout
+part /boot --source bootimg-partition --fstype=vfat --label boot --active --align 4096 --size 64M
+part / --source rootfs --fstype=ext4 --label root --fsoptions=noatime
+bootloader --ptable msdos
+`
+	assert.Empty(t, ioutil.WriteFile(dir+"/image.wks", []byte(wks), 0644))
+
+	context := debos.DebosContext{CommonContext: &debos.CommonContext{}, RecipeDir: dir, Architecture: "amd64", SectorSize: 512}
+	i := actions.ImagePartitionAction{ImageName: "test.img", ImageSize: "1GB", LayoutFile: "image.wks"}
+	assert.Empty(t, i.Verify(&context))
+	assert.Equal(t, "msdos", i.PartitionType)
+	assert.Equal(t, 2, len(i.Partitions))
+	assert.Equal(t, []string{"4096KiB", "69632KiB", "vfat"},
+		[]string{i.Partitions[0].Start, i.Partitions[0].End, i.Partitions[0].FS})
+	assert.Equal(t, []string{"69632KiB", "100%", "ext4"},
+		[]string{i.Partitions[1].Start, i.Partitions[1].End, i.Partitions[1].FS})
+	assert.Equal(t, 2, len(i.Mountpoints))
+	assert.Equal(t, []string{"noatime"}, i.Mountpoints[1].Options)
+
+	repart := dir + "/repart.d"
+	assert.Empty(t, os.Mkdir(repart, 0755))
+	assert.Empty(t, ioutil.WriteFile(repart+"/10-esp.conf",
+		[]byte("[Partition]\nType=esp\nFormat=vfat\nSizeMinBytes=512M\n"), 0644))
+	assert.Empty(t, ioutil.WriteFile(repart+"/20-root.conf",
+		[]byte("[Partition]\nType=root-x86-64\nFormat=ext4\nMountPoint=/\n"), 0644))
+
+	i = actions.ImagePartitionAction{ImageName: "test.img", ImageSize: "2GB", LayoutFile: "repart.d"}
+	assert.Empty(t, i.Verify(&context))
+	assert.Equal(t, "gpt", i.PartitionType)
+	assert.Equal(t, []string{"esp", "root"}, []string{i.Partitions[0].Name, i.Partitions[1].Name})
+	assert.Equal(t, "4F68BCE3-E8CD-4DB1-96E7-FBCAF984B709", i.Partitions[1].PartType)
+	assert.Equal(t, "525312KiB", i.Partitions[0].End)
+
+	i = actions.ImagePartitionAction{ImageName: "test.img", ImageSize: "1GB", LayoutFile: "image.wks",
+		Partitions: []actions.Partition{{Name: "root"}}}
+	assert.EqualError(t, i.Verify(&context), "'layout-file' and 'partitions' can't be used together")
+}
@@ -12,6 +12,15 @@ by Debos.
    script: script name
    command: command line
    label: string
+   retries: 3
+   retry-delay: 10s
+   ignore-failure: bool
+   register: name
+   binds:
+     - origin: name
+       source: path
+       target: path
+       read-only: bool
 
 Properties 'command' and 'script' are mutually exclusive.
 
@@ -37,6 +46,27 @@ a label is derived from the command or script.
 has access to the recipe directory ($RECIPEDIR) and the artifact directory ($ARTIFACTDIR).
 The working directory will be set to the artifact directory.
 
+- retries -- number of times the command or script is run again when it fails,
+e.g. for steps fetching from the network. Default 0.
+
+- retry-delay -- time to wait before running the command or script again, as a
+duration like '30s' or '1m'. Default '5s'.
+
+- ignore-failure -- if set, a failure of the command or script, once the
+retries are exhausted, is logged instead of failing the build.
+
+- register -- name of a variable holding the standard output of the command or
+script, without the trailing newlines. The following actions use it with the
+'registered' template function, e.g. '{{ registered "name" }}', which is
+substituted when they run. Values registered in the fakemachine aren't
+available to the postprocessing steps.
+
+- binds -- list of directories or files bind mounted in the chroot for this
+action only, requires 'chroot'. The 'source' is relative to the optional
+'origin' (the recipe directory by default) and is mounted at the absolute
+'target' path, by default the same path as the source. With 'read-only', the
+command can't modify the source. Once the command is done, the build fails if
+any of the binds is still mounted. Binds need the 'nspawn' chroot method.
 
 Properties 'chroot' and 'postprocess' are mutually exclusive.
 */
@@ -44,9 +74,13 @@ package actions
 
 import (
 	"errors"
+	"fmt"
 	"github.com/go-debos/fakemachine"
+	"log"
 	"path"
+	"regexp"
 	"strings"
+	"time"
 
 	"github.com/go-debos/debos"
 )
@@ -55,6 +89,15 @@ const (
 	maxLabelLength = 40
 )
 
+var registerNameRegex = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+type RunBind struct {
+	Origin   string
+	Source   string
+	Target   string
+	ReadOnly bool `yaml:"read-only"`
+}
+
 type RunAction struct {
 	debos.BaseAction `yaml:",inline"`
 	Chroot           bool
@@ -62,6 +105,12 @@ type RunAction struct {
 	Script           string
 	Command          string
 	Label            string
+	Binds            []RunBind
+	Retries          int
+	RetryDelay       string `yaml:"retry-delay"`
+	IgnoreFailure    bool   `yaml:"ignore-failure"`
+	Register         string
+	retryDelay       time.Duration
 }
 
 func (run *RunAction) Verify(context *debos.DebosContext) error {
@@ -72,12 +121,52 @@ func (run *RunAction) Verify(context *debos.DebosContext) error {
 	if run.Script == "" && run.Command == "" {
 		return errors.New("Script and Command both cannot be empty")
 	}
+
+	if len(run.Binds) > 0 && !run.Chroot {
+		return errors.New("Property 'binds' can only be used with 'chroot'")
+	}
+	// chroot(8) can't bind mount
+	if len(run.Binds) > 0 && context.Sandbox != nil && context.Sandbox.Chroot == "chroot" {
+		return errors.New("Property 'binds' needs the 'nspawn' chroot method")
+	}
+	for _, b := range run.Binds {
+		if b.Origin == "" && b.Source == "" {
+			return errors.New("Binds need at least one of 'origin' or 'source'")
+		}
+		if b.Target != "" && !path.IsAbs(b.Target) {
+			return fmt.Errorf("Bind target '%s' must be an absolute path", b.Target)
+		}
+	}
+
+	if run.Register != "" && !registerNameRegex.MatchString(run.Register) {
+		return fmt.Errorf("Invalid 'register' name '%s', letters, digits and '_' are allowed", run.Register)
+	}
+
+	if run.Retries < 0 {
+		return errors.New("Property 'retries' can't be negative")
+	}
+
+	run.retryDelay = 5 * time.Second
+	if run.RetryDelay != "" {
+		delay, err := time.ParseDuration(run.RetryDelay)
+		if err != nil || delay < 0 {
+			return fmt.Errorf("Invalid retry delay '%s'", run.RetryDelay)
+		}
+		run.retryDelay = delay
+	}
+
 	return nil
 }
 
 func (run *RunAction) PreMachine(context *debos.DebosContext, m *fakemachine.Machine,
 	args *[]string) error {
 
+	for _, b := range run.Binds {
+		if b.Origin == "" {
+			m.AddVolume(path.Dir(debos.CleanPathAt(b.Source, context.RecipeDir)))
+		}
+	}
+
 	if run.Script == "" {
 		return nil
 	}
@@ -93,6 +182,15 @@ func (run *RunAction) PreMachine(context *debos.DebosContext, m *fakemachine.Mac
 	return nil
 }
 
+func (run *RunAction) WatchPaths(context *debos.DebosContext) []string {
+	if run.Script == "" {
+		return nil
+	}
+
+	script := strings.SplitN(run.Script, " ", 2)
+	return []string{debos.CleanPathAt(script[0], context.RecipeDir)}
+}
+
 func (run *RunAction) doRun(context debos.DebosContext) error {
 	var cmdline []string
 	var label string
@@ -104,6 +202,23 @@ func (run *RunAction) doRun(context debos.DebosContext) error {
 		cmd = debos.Command{}
 	}
 
+	for _, b := range run.Binds {
+		origin := context.RecipeDir
+		if b.Origin != "" {
+			var found bool
+			if origin, found = context.Origin(b.Origin); !found {
+				return fmt.Errorf("Origin not found '%s'", b.Origin)
+			}
+		}
+
+		source := debos.CleanPathAt(b.Source, origin)
+		if b.ReadOnly {
+			cmd.AddBindMountReadOnly(source, b.Target)
+		} else {
+			cmd.AddBindMount(source, b.Target)
+		}
+	}
+
 	if run.Script != "" {
 		script := strings.SplitN(run.Script, " ", 2)
 		script[0] = debos.CleanPathAt(script[0], context.RecipeDir)
@@ -159,7 +274,53 @@ func (run *RunAction) doRun(context debos.DebosContext) error {
 		}
 	}
 
-	return cmd.Run(label, cmdline...)
+	if m := registeredRegex.FindStringSubmatch(strings.Join(cmdline, " ")); m != nil {
+		return fmt.Errorf("Variable '%s' isn't registered by a previous action", m[1])
+	}
+
+	var err error
+	for attempt := 0; attempt <= run.Retries; attempt++ {
+		if attempt > 0 {
+			log.Printf("%s failed: %v, retrying in %s (%d/%d)", label, err, run.retryDelay, attempt, run.Retries)
+			time.Sleep(run.retryDelay)
+		}
+
+		if run.Register == "" {
+			err = cmd.Run(label, cmdline...)
+		} else {
+			err = run.register(context, cmd, label, cmdline)
+		}
+		if err == nil {
+			return nil
+		}
+	}
+
+	if run.IgnoreFailure {
+		log.Printf("%s failed: %v, ignoring the failure", label, err)
+		return nil
+	}
+
+	return err
+}
+
+func (run *RunAction) register(context debos.DebosContext, cmd debos.Command, label string, cmdline []string) error {
+	out, err := cmd.Output(label, cmdline...)
+	value := strings.TrimRight(string(out), "\n")
+	if value != "" {
+		for _, line := range strings.Split(value, "\n") {
+			log.Printf("%s | %s", label, line)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if context.Registered == nil {
+		context.Registered = make(map[string]string)
+	}
+	context.Registered[run.Register] = value
+
+	return nil
 }
 
 func (run *RunAction) Run(context *debos.DebosContext) error {
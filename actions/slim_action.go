@@ -0,0 +1,306 @@
+/*
+Slim Action
+
+Remove the files an image doesn't need at runtime from the rootfs, i.e.
+documentation, man pages, unused translations, APT caches and Python bytecode
+caches, and report the size saved.
+
+ # Yaml syntax:
+ - action: slim
+   docs: bool
+   keep-copyright: bool
+   man: bool
+   locales: bool
+   keep-locales:
+     - en
+   apt-cache: bool
+   pycache: bool
+   dpkg-exclude: bool
+
+Optional properties:
+
+- docs -- remove '/usr/share/doc'. Default 'true'.
+
+- keep-copyright -- keep the 'copyright' files of '/usr/share/doc', which
+Debian packages have to ship for license compliance. Default 'true'.
+
+- man -- remove the man pages and info pages. Default 'true'.
+
+- locales -- remove the translations of '/usr/share/locale' not listed in
+'keep-locales'. Default 'false'.
+
+- keep-locales -- translations kept when 'locales' is set, either a language,
+e.g. 'fr' keeping 'fr', 'fr_FR' and 'fr_CA', or a full locale name. Default
+'en'.
+
+- apt-cache -- remove the downloaded packages, the package lists and the
+caches of APT, 'apt-get update' has to be run again before installing
+packages. Default 'true'.
+
+- pycache -- remove the '__pycache__' directories, they are recreated when
+needed if the directories are writable. Default 'true'.
+
+- dpkg-exclude -- configure dpkg to not install the removed files of the
+packages installed afterwards, with 'path-exclude' in
+'/etc/dpkg/dpkg.cfg.d/debos-slim'. Default 'false'.
+
+ # Example replacing a cleanup script:
+ - action: slim
+   locales: true
+   keep-locales: [ en, de ]
+*/
+package actions
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/go-units"
+	"github.com/go-debos/debos"
+)
+
+type SlimAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Docs             bool
+	KeepCopyright    bool `yaml:"keep-copyright"`
+	Man              bool
+	Locales          bool
+	KeepLocales      []string `yaml:"keep-locales"`
+	AptCache         bool     `yaml:"apt-cache"`
+	Pycache          bool
+	DpkgExclude      bool `yaml:"dpkg-exclude"`
+}
+
+func NewSlimAction() *SlimAction {
+	return &SlimAction{
+		Docs:          true,
+		KeepCopyright: true,
+		Man:           true,
+		KeepLocales:   []string{"en"},
+		AptCache:      true,
+		Pycache:       true,
+	}
+}
+
+func (s *SlimAction) Verify(context *debos.DebosContext) error {
+	for _, l := range s.KeepLocales {
+		if l == "" || strings.ContainsAny(l, "/*") {
+			return fmt.Errorf("Invalid locale '%s' in 'keep-locales'", l)
+		}
+	}
+
+	return nil
+}
+
+// Whether the translations directory is kept, e.g. 'fr_FR' for 'fr'
+func (s *SlimAction) keepLocale(name string) bool {
+	for _, l := range s.KeepLocales {
+		if name == l || strings.HasPrefix(name, l+"_") ||
+			strings.HasPrefix(name, l+"@") || strings.HasPrefix(name, l+".") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Size of the files of the directory, the symlinks not being followed
+func treeSize(dir string) int64 {
+	var size int64
+	filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+
+	return size
+}
+
+/*
+Remove the entries of a directory of the rootfs for which remove returns true,
+returning the size freed. A missing directory isn't an error.
+*/
+func removeEntries(dir string, remove func(name string, info os.FileInfo) bool) (int64, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	var size int64
+	for _, e := range entries {
+		if !remove(e.Name(), e) {
+			continue
+		}
+		p := path.Join(dir, e.Name())
+		size += treeSize(p)
+		if err := os.RemoveAll(p); err != nil {
+			return size, err
+		}
+	}
+
+	return size, nil
+}
+
+func anyEntry(name string, info os.FileInfo) bool {
+	return true
+}
+
+func (s *SlimAction) removeDocs(rootdir string) (int64, error) {
+	doc := path.Join(rootdir, "usr/share/doc")
+	if !s.KeepCopyright {
+		return removeEntries(doc, anyEntry)
+	}
+
+	var size int64
+	err := filepath.Walk(doc, func(p string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if info.IsDir() || info.Name() == "copyright" {
+			return nil
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return os.Remove(p)
+	})
+
+	return size, err
+}
+
+func (s *SlimAction) removeMan(rootdir string) (int64, error) {
+	var size int64
+	for _, dir := range []string{"usr/share/man", "usr/share/info"} {
+		freed, err := removeEntries(path.Join(rootdir, dir), anyEntry)
+		size += freed
+		if err != nil {
+			return size, err
+		}
+	}
+
+	return size, nil
+}
+
+func (s *SlimAction) removeLocales(rootdir string) (int64, error) {
+	return removeEntries(path.Join(rootdir, "usr/share/locale"), func(name string, info os.FileInfo) bool {
+		return info.IsDir() && !s.keepLocale(name)
+	})
+}
+
+func (s *SlimAction) removeAptCache(rootdir string) (int64, error) {
+	var size int64
+	for _, dir := range []string{"var/cache/apt/archives", "var/cache/apt/archives/partial", "var/lib/apt/lists", "var/lib/apt/lists/partial"} {
+		freed, err := removeEntries(path.Join(rootdir, dir), func(name string, info os.FileInfo) bool {
+			return !info.IsDir() && name != "lock"
+		})
+		size += freed
+		if err != nil {
+			return size, err
+		}
+	}
+
+	freed, err := removeEntries(path.Join(rootdir, "var/cache/apt"), func(name string, info os.FileInfo) bool {
+		return strings.HasSuffix(name, ".bin")
+	})
+
+	return size + freed, err
+}
+
+func (s *SlimAction) removePycache(rootdir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(rootdir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if !info.IsDir() {
+			return nil
+		}
+
+		switch strings.TrimPrefix(p, rootdir) {
+		case "/proc", "/sys", "/dev", "/run", "/tmp":
+			return filepath.SkipDir
+		}
+
+		if info.Name() == "__pycache__" {
+			size += treeSize(p)
+			if err := os.RemoveAll(p); err != nil {
+				return err
+			}
+			return filepath.SkipDir
+		}
+
+		return nil
+	})
+
+	return size, err
+}
+
+// dpkg configuration excluding the removed files from the packages
+func (s *SlimAction) dpkgConfig() []byte {
+	lines := []string{"# Generated by debos"}
+
+	if s.Docs {
+		lines = append(lines, "path-exclude=/usr/share/doc/*")
+		if s.KeepCopyright {
+			lines = append(lines, "path-include=/usr/share/doc/*/copyright")
+		}
+	}
+	if s.Man {
+		lines = append(lines, "path-exclude=/usr/share/man/*", "path-exclude=/usr/share/info/*")
+	}
+	if s.Locales {
+		lines = append(lines, "path-exclude=/usr/share/locale/*", "path-include=/usr/share/locale/locale.alias")
+		for _, l := range s.KeepLocales {
+			for _, suffix := range []string{"", "_*", "@*", ".*"} {
+				lines = append(lines, fmt.Sprintf("path-include=/usr/share/locale/%s%s/*", l, suffix))
+			}
+		}
+	}
+
+	return []byte(strings.Join(lines, "\n") + "\n")
+}
+
+func (s *SlimAction) Run(context *debos.DebosContext) error {
+	steps := []struct {
+		enabled bool
+		name    string
+		remove  func(string) (int64, error)
+	}{
+		{s.Docs, "documentation", s.removeDocs},
+		{s.Man, "man pages", s.removeMan},
+		{s.Locales, "translations", s.removeLocales},
+		{s.AptCache, "APT caches", s.removeAptCache},
+		{s.Pycache, "Python caches", s.removePycache},
+	}
+
+	var total int64
+	for _, step := range steps {
+		if !step.enabled {
+			continue
+		}
+
+		size, err := step.remove(context.Rootdir)
+		if err != nil {
+			return fmt.Errorf("Failed to remove the %s: %v", step.name, err)
+		}
+		log.Printf("Removed %s of %s", units.BytesSize(float64(size)), step.name)
+		total += size
+	}
+	log.Printf("Saved %s in total", units.BytesSize(float64(total)))
+
+	if s.DpkgExclude {
+		return writeRootfsFile(context, "/etc/dpkg/dpkg.cfg.d/debos-slim", s.dpkgConfig(), 0644)
+	}
+
+	return nil
+}
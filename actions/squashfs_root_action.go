@@ -0,0 +1,351 @@
+/*
+SquashfsRoot Action
+
+Deploy the filesystem as a read-only squashfs root partition, with a writable
+partition mounted over it with overlayfs at boot. This action replaces the
+'filesystem-deploy' action and requires the 'image-partition' action to be
+executed before it, with a partition for the squashfs image, which doesn't need
+to be formatted, and a formatted partition for the writable layer.
+
+The initramfs mounts the writable partition and the overlay, the read-only and
+writable layers are then available in '/media/root-ro' and '/media/root-rw'
+of the running system. The writes land in the 'upper' directory of the
+writable partition, so resetting the system is a matter of removing it.
+
+ # Yaml syntax:
+ - action: squashfs-root
+   partition: name
+   overlay-partition: name
+   compression: zstd
+   setup-fstab: bool
+   setup-initramfs: bool
+   setup-kernel-cmdline: bool
+   append-kernel-cmdline: arguments
+
+Mandatory properties:
+
+- partition -- name of the partition the squashfs image is written to, e.g.
+with 'fs: none'. The image has to fit in it.
+
+- overlay-partition -- name of the formatted partition holding the writes.
+
+Optional properties:
+
+- compression -- compression of the squashfs image, one of 'gzip', 'lzo',
+'lz4', 'xz' or 'zstd'. Default 'zstd'.
+
+- setup-fstab -- generate '/etc/fstab' with the mount points of the
+'image-partition' action other than '/', the content of these mount points
+being copied to their partitions instead of the squashfs image. Default 'true'.
+
+- setup-initramfs -- install the initramfs-tools script mounting the overlay
+and update the initramfs of the installed kernels. initramfs-tools has to be
+installed in the filesystem. Default 'true'.
+
+- setup-kernel-cmdline -- add the squashfs root partition, by PARTUUID, to
+'/etc/kernel/cmdline'. Default 'true'.
+
+- append-kernel-cmdline -- additional kernel command line arguments.
+
+ # Example:
+ - action: image-partition
+   imagename: image.img
+   imagesize: 4GB
+   partitiontype: gpt
+   mountpoints:
+     - mountpoint: /boot/efi
+       partition: efi
+   partitions:
+     - name: efi
+       fs: vfat
+       start: 0%
+       end: 256MB
+     - name: root
+       fs: none
+       start: 256MB
+       end: 2GB
+     - name: data
+       fs: ext4
+       start: 2GB
+       end: 100%
+
+ - action: squashfs-root
+   partition: root
+   overlay-partition: data
+*/
+package actions
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/go-debos/debos"
+)
+
+var squashfsCompressions = []string{"gzip", "lzo", "lz4", "xz", "zstd"}
+
+const squashfsOverlayScript = `#!/bin/sh
+# Generated by debos: mount the writable overlay over the squashfs root
+PREREQ=""
+prereqs()
+{
+	echo "$PREREQ"
+}
+
+case "$1" in
+prereqs)
+	prereqs
+	exit 0
+	;;
+esac
+
+. /scripts/functions
+
+lower=/run/debos-root-ro
+upper=/run/debos-root-rw
+
+mkdir -p "$lower" "$upper"
+mount -n -o move "$rootmnt" "$lower" || panic "debos: failed to move the read-only root"
+
+device=$(resolve_device "$DEBOS_OVERLAY")
+mount -n -t "$DEBOS_OVERLAY_FSTYPE" "$device" "$upper" || panic "debos: failed to mount $DEBOS_OVERLAY"
+mkdir -p "$upper/upper" "$upper/work"
+
+mount -n -t overlay -o "lowerdir=$lower,upperdir=$upper/upper,workdir=$upper/work" overlay "$rootmnt" ||
+	panic "debos: failed to mount the overlay root"
+
+mount -n -o move "$lower" "$rootmnt/media/root-ro"
+mount -n -o move "$upper" "$rootmnt/media/root-rw"
+`
+
+type SquashfsRootAction struct {
+	debos.BaseAction    `yaml:",inline"`
+	Partition           string
+	OverlayPartition    string `yaml:"overlay-partition"`
+	Compression         string
+	SetupFSTab          bool   `yaml:"setup-fstab"`
+	SetupInitramfs      bool   `yaml:"setup-initramfs"`
+	SetupKernelCmdline  bool   `yaml:"setup-kernel-cmdline"`
+	AppendKernelCmdline string `yaml:"append-kernel-cmdline"`
+}
+
+func NewSquashfsRootAction() *SquashfsRootAction {
+	return &SquashfsRootAction{
+		Compression:        "zstd",
+		SetupFSTab:         true,
+		SetupInitramfs:     true,
+		SetupKernelCmdline: true,
+	}
+}
+
+func (s *SquashfsRootAction) Verify(context *debos.DebosContext) error {
+	if s.Partition == "" || s.OverlayPartition == "" {
+		return fmt.Errorf("'partition' and 'overlay-partition' properties are mandatory")
+	}
+	if s.Partition == s.OverlayPartition {
+		return fmt.Errorf("The squashfs and overlay partitions have to differ")
+	}
+
+	for _, c := range squashfsCompressions {
+		if c == s.Compression {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Unsupported compression '%s', possible ones are %s",
+		s.Compression, strings.Join(squashfsCompressions, ", "))
+}
+
+func partitionDevice(context *debos.DebosContext, name string) (string, error) {
+	for _, p := range context.ImagePartitions {
+		if p.Name == name {
+			return p.DevicePath, nil
+		}
+	}
+
+	return "", fmt.Errorf("Failed to find partition named %s, missing image-partition action?", name)
+}
+
+// Mount points of the image other than the root, from the generated fstab
+func (s *SquashfsRootAction) mountpoints(context *debos.DebosContext) ([]string, []string, error) {
+	var mountpoints, entries []string
+
+	scanner := bufio.NewScanner(bytes.NewReader(context.ImageFSTab.Bytes()))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		if fields[1] == "/" {
+			return nil, nil, fmt.Errorf("The root is the squashfs partition, it can't be a mount point of image-partition")
+		}
+		mountpoints = append(mountpoints, fields[1])
+		entries = append(entries, scanner.Text())
+	}
+
+	return mountpoints, entries, nil
+}
+
+func (s *SquashfsRootAction) setupInitramfs(context *debos.DebosContext, overlay string) error {
+	if _, err := os.Stat(path.Join(context.Rootdir, "usr/sbin/update-initramfs")); err != nil {
+		return fmt.Errorf("initramfs-tools isn't installed in the filesystem")
+	}
+
+	uuid, fstype := blkidValue(overlay, "UUID"), blkidValue(overlay, "TYPE")
+	if uuid == "" || fstype == "" {
+		return fmt.Errorf("No filesystem found on the overlay partition %s", s.OverlayPartition)
+	}
+
+	conf := fmt.Sprintf("# Generated by debos\nDEBOS_OVERLAY=UUID=%s\nDEBOS_OVERLAY_FSTYPE=%s\n", uuid, fstype)
+	if err := writeRootfsFile(context, "/etc/initramfs-tools/conf.d/debos-overlay", []byte(conf), 0644); err != nil {
+		return err
+	}
+	err := writeRootfsFile(context, "/etc/initramfs-tools/scripts/local-bottom/debos-overlay", []byte(squashfsOverlayScript), 0755)
+	if err != nil {
+		return err
+	}
+
+	modules := path.Join(context.Rootdir, "etc/initramfs-tools/modules")
+	current, _ := ioutil.ReadFile(modules)
+	listed := map[string]bool{}
+	for _, line := range strings.Split(string(current), "\n") {
+		listed[strings.TrimSpace(line)] = true
+	}
+
+	f, err := os.OpenFile(modules, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for _, m := range []string{"squashfs", "overlay", fstype} {
+		if !listed[m] {
+			fmt.Fprintln(f, m)
+		}
+	}
+
+	cmd := debos.NewChrootCommandForContext(*context)
+	return cmd.Run("update-initramfs", "update-initramfs", "-u", "-k", "all")
+}
+
+// Write the squashfs image to the partition, failing if it doesn't fit
+func writeSquashfs(image, device string) error {
+	in, err := os.Open(image)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(device, os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("Failed to open %s: %v", device, err)
+	}
+	defer out.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	size, err := out.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if info.Size() > size {
+		return fmt.Errorf("The squashfs image of %d bytes doesn't fit in the partition of %d bytes", info.Size(), size)
+	}
+	if _, err := out.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	log.Printf("Writing the squashfs image of %d bytes to %s", info.Size(), device)
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+
+	return out.Sync()
+}
+
+func (s *SquashfsRootAction) Run(context *debos.DebosContext) error {
+	root, err := partitionDevice(context, s.Partition)
+	if err != nil {
+		return err
+	}
+	overlay, err := partitionDevice(context, s.OverlayPartition)
+	if err != nil {
+		return err
+	}
+
+	mountpoints, entries, err := s.mountpoints(context)
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range []string{"media/root-ro", "media/root-rw"} {
+		if err := os.MkdirAll(path.Join(context.Rootdir, dir), 0755); err != nil {
+			return err
+		}
+	}
+
+	if s.SetupFSTab {
+		fstab := "# Generated by debos, the root is an overlay mounted by the initramfs\n"
+		if len(entries) > 0 {
+			fstab += strings.Join(entries, "\n") + "\n"
+		}
+		if err := writeRootfsFile(context, "/etc/fstab", []byte(fstab), 0644); err != nil {
+			return err
+		}
+	}
+
+	partuuid := blkidValue(root, "PARTUUID")
+	if partuuid == "" {
+		return fmt.Errorf("Failed to get the PARTUUID of partition %s", s.Partition)
+	}
+	context.ImageKernelRoot = fmt.Sprintf("root=PARTUUID=%s rootfstype=squashfs ro", partuuid)
+
+	if s.SetupKernelCmdline {
+		fd := FilesystemDeployAction{AppendKernelCmdline: s.AppendKernelCmdline}
+		if err := fd.setupKernelCmdline(context); err != nil {
+			return err
+		}
+	}
+
+	if s.SetupInitramfs {
+		if err := s.setupInitramfs(context, overlay); err != nil {
+			return err
+		}
+	}
+
+	// The content of the other mount points goes to their partitions
+	var excludes []string
+	for _, m := range mountpoints {
+		source := path.Join(context.Rootdir, m)
+		if _, err := os.Stat(source); os.IsNotExist(err) {
+			continue
+		}
+		err := debos.Command{}.Run("Deploy "+m, "cp", "-a", source+"/.", path.Join(context.ImageMntDir, m))
+		if err != nil {
+			return fmt.Errorf("Deploying %s failed: %v", m, err)
+		}
+		excludes = append(excludes, strings.TrimPrefix(m, "/")+"/*")
+	}
+
+	image := path.Join(context.Scratchdir, "root.squashfs")
+	defer os.Remove(image)
+
+	command := []string{"mksquashfs", context.Rootdir, image, "-noappend", "-comp", s.Compression}
+	if len(excludes) > 0 {
+		command = append(command, "-wildcards", "-e")
+		command = append(command, excludes...)
+	}
+	if err := (debos.Command{}).Run("mksquashfs", command...); err != nil {
+		return err
+	}
+
+	return writeSquashfs(image, root)
+}
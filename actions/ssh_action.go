@@ -0,0 +1,317 @@
+/*
+SSH Action
+
+Provision SSH access to the target rootfs: install the authorized keys of
+users, generate or install the host keys, and optionally harden the sshd
+configuration.
+
+ # Yaml syntax:
+ - action: ssh
+   origin: name
+   authorized-keys:
+     - user: user
+       keys:
+         - ssh-ed25519 AAAA... admin@example.com
+       file: keys/user.pub
+       url: https://example.com/user.keys
+   host-keys: generate
+   harden: bool
+
+Optional properties:
+
+- origin -- reference to a named file or directory containing the 'file' of
+the authorized keys and the 'host-keys' directory. Defaults to the recipe
+directory.
+
+- authorized-keys -- list of users and their keys, from any combination of
+inline 'keys', a 'file' relative to 'origin' and an 'url'. The
+'~/.ssh/authorized_keys' file of each user is replaced by the keys, the users
+have to exist in the target rootfs.
+
+- host-keys -- 'generate' to generate new host keys, so images don't share the
+host keys of a cached rootfs, or a directory relative to 'origin' holding the
+'ssh_host_*_key' files to install, e.g. for images of a known machine.
+
+- harden -- write '/etc/ssh/sshd_config.d/50-debos-hardening.conf' disabling
+the password authentication, the root login with a password, empty passwords
+and X11 forwarding. The sshd configuration has to include the
+'/etc/ssh/sshd_config.d' directory, as done by Debian since bullseye.
+
+At least one of 'authorized-keys', 'host-keys' or 'harden' has to be given.
+Host keys are generated with 'ssh-keygen' from the target rootfs.
+*/
+package actions
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/go-debos/debos"
+	"github.com/go-debos/fakemachine"
+)
+
+type SSHAuthorizedKeys struct {
+	User string
+	Keys []string
+	File string
+	Url  string
+}
+
+type SSHAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Origin           string
+	AuthorizedKeys   []SSHAuthorizedKeys `yaml:"authorized-keys"`
+	HostKeys         string              `yaml:"host-keys"`
+	Harden           bool
+}
+
+const sshHardening = `# Generated by debos
+PasswordAuthentication no
+KbdInteractiveAuthentication no
+PermitRootLogin prohibit-password
+PermitEmptyPasswords no
+X11Forwarding no
+`
+
+func (s *SSHAction) Verify(context *debos.DebosContext) error {
+	if len(s.AuthorizedKeys) == 0 && s.HostKeys == "" && !s.Harden {
+		return errors.New("At least one of 'authorized-keys', 'host-keys' or 'harden' properties is needed")
+	}
+
+	for _, a := range s.AuthorizedKeys {
+		if a.User == "" {
+			return errors.New("Authorized keys need a 'user'")
+		}
+		if len(a.Keys) == 0 && a.File == "" && a.Url == "" {
+			return fmt.Errorf("Authorized keys of %s need 'keys', 'file' or 'url'", a.User)
+		}
+		for _, k := range a.Keys {
+			if len(strings.Fields(k)) < 2 || strings.Contains(k, "\n") {
+				return fmt.Errorf("Invalid SSH public key for %s: %s", a.User, k)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *SSHAction) PreMachine(context *debos.DebosContext, m *fakemachine.Machine, args *[]string) error {
+	if s.Origin != "" {
+		return nil
+	}
+
+	for _, a := range s.AuthorizedKeys {
+		if path.IsAbs(a.File) {
+			m.AddVolume(path.Dir(a.File))
+		}
+	}
+	if s.HostKeys != "generate" && path.IsAbs(s.HostKeys) {
+		m.AddVolume(s.HostKeys)
+	}
+
+	return nil
+}
+
+func (s *SSHAction) origin(context *debos.DebosContext) (string, error) {
+	if s.Origin == "" {
+		return context.RecipeDir, nil
+	}
+
+	origin, found := context.Origin(s.Origin)
+	if !found {
+		return "", fmt.Errorf("Origin not found '%s'", s.Origin)
+	}
+
+	return origin, nil
+}
+
+// Keys of a file, without the empty lines and comments
+func sshKeys(data []byte) []string {
+	var keys []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			keys = append(keys, line)
+		}
+	}
+
+	return keys
+}
+
+func (s *SSHAction) keys(context *debos.DebosContext, a SSHAuthorizedKeys) ([]string, error) {
+	keys := append([]string{}, a.Keys...)
+
+	if a.File != "" {
+		origin, err := s.origin(context)
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadFile(debos.CleanPathAt(a.File, origin))
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, sshKeys(data)...)
+	}
+
+	if a.Url != "" {
+		file, err := ioutil.TempFile(context.Scratchdir, "ssh-keys-")
+		if err != nil {
+			return nil, err
+		}
+		file.Close()
+		defer os.Remove(file.Name())
+
+		if err := context.Lock.Fetch(a.Url, file.Name()); err != nil {
+			return nil, err
+		}
+
+		data, err := ioutil.ReadFile(file.Name())
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, sshKeys(data)...)
+	}
+
+	return keys, nil
+}
+
+func (s *SSHAction) authorizedKeys(context *debos.DebosContext) error {
+	users, err := rootfsEntries(context, "/etc/passwd")
+	if err != nil {
+		return err
+	}
+
+	// Keys of the same user from several entries are merged
+	var order []string
+	keys := make(map[string][]string)
+	for _, a := range s.AuthorizedKeys {
+		if _, found := users[a.User]; !found || len(users[a.User]) < 6 {
+			return fmt.Errorf("User %s doesn't exist in the rootfs", a.User)
+		}
+
+		k, err := s.keys(context, a)
+		if err != nil {
+			return err
+		}
+		if _, found := keys[a.User]; !found {
+			order = append(order, a.User)
+		}
+		keys[a.User] = append(keys[a.User], k...)
+	}
+
+	for _, user := range order {
+		uid, _ := strconv.Atoi(users[user][2])
+		gid, _ := strconv.Atoi(users[user][3])
+
+		dir, err := debos.RestrictedPath(context.Rootdir, path.Join(users[user][5], ".ssh"))
+		if err != nil {
+			return err
+		}
+
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+		if err := os.Chown(dir, uid, gid); err != nil {
+			return err
+		}
+
+		file := path.Join(dir, "authorized_keys")
+		data := strings.Join(keys[user], "\n") + "\n"
+		if err := ioutil.WriteFile(file, []byte(data), 0600); err != nil {
+			return err
+		}
+		if err := os.Chown(file, uid, gid); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *SSHAction) hostKeys(context *debos.DebosContext) error {
+	existing, err := filepath.Glob(path.Join(context.Rootdir, "etc/ssh/ssh_host_*"))
+	if err != nil {
+		return err
+	}
+	for _, f := range existing {
+		if err := os.Remove(f); err != nil {
+			return err
+		}
+	}
+
+	if s.HostKeys == "generate" {
+		c := debos.NewChrootCommandForContext(*context)
+		return c.Run("ssh", "ssh-keygen", "-A")
+	}
+
+	origin, err := s.origin(context)
+	if err != nil {
+		return err
+	}
+
+	keys, err := filepath.Glob(path.Join(debos.CleanPathAt(s.HostKeys, origin), "ssh_host_*"))
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("No host keys found in %s", s.HostKeys)
+	}
+
+	for _, key := range keys {
+		data, err := ioutil.ReadFile(key)
+		if err != nil {
+			return err
+		}
+
+		perm := os.FileMode(0600)
+		if strings.HasSuffix(key, ".pub") {
+			perm = 0644
+		}
+		if err := writeRootfsFile(context, path.Join("/etc/ssh", path.Base(key)), data, perm); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *SSHAction) harden(context *debos.DebosContext) error {
+	config, err := ioutil.ReadFile(path.Join(context.Rootdir, "etc/ssh/sshd_config"))
+	if err != nil {
+		return fmt.Errorf("Failed to read the sshd configuration, is openssh-server installed? %v", err)
+	}
+
+	if !strings.Contains(string(config), "/etc/ssh/sshd_config.d/") {
+		return errors.New("The sshd configuration doesn't include /etc/ssh/sshd_config.d, hardening can't be applied")
+	}
+
+	return writeRootfsFile(context, "/etc/ssh/sshd_config.d/50-debos-hardening.conf", []byte(sshHardening), 0644)
+}
+
+func (s *SSHAction) Run(context *debos.DebosContext) error {
+	if len(s.AuthorizedKeys) > 0 {
+		if err := s.authorizedKeys(context); err != nil {
+			return err
+		}
+	}
+
+	if s.HostKeys != "" {
+		if err := s.hostKeys(context); err != nil {
+			return err
+		}
+	}
+
+	if s.Harden {
+		if err := s.harden(context); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
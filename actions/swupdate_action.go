@@ -0,0 +1,312 @@
+/*
+Swupdate Action
+
+Create a SWUpdate '.swu' update archive from previously built artifacts.
+The 'sw-description' is generated from a template and optionally signed.
+
+ # Yaml syntax:
+ - action: swupdate
+   file: filename.swu
+   sw-description: sw-description.tmpl
+   artifacts:
+     - origin: name
+       file: filename
+   variables:
+     key: value
+   signing: cms
+   signing-key: filename
+   signing-certificate: filename
+
+Mandatory properties:
+
+- file -- name of the output archive, relative to the artifact directory.
+
+- sw-description -- template of the 'sw-description' file, relative to the
+recipe directory. The template is processed like recipes, the 'variables' are
+available as template variables and the 'sha256' and 'size' functions return
+the checksum and size of an artifact given its file name, e.g.:
+
+ sha256 = "{{ sha256 "rootfs.ext4.gz" }}";
+
+- artifacts -- list of artifacts to include in the archive after the
+'sw-description'.
+
+Optional properties:
+
+- variables -- template variables for the 'sw-description' template.
+
+- signing -- signing method of the 'sw-description', either 'rsa' or 'cms'.
+No signature is created by default.
+
+- signing-key -- private key file, relative to the recipe directory.
+Mandatory if 'signing' is set.
+
+- signing-certificate -- certificate file, relative to the recipe directory.
+Mandatory for 'cms' signing.
+
+   # Yaml syntax for artifacts:
+   artifacts:
+     - origin: name
+       file: filename
+
+Mandatory properties:
+
+- file -- the file name located in 'origin'.
+
+Optional properties:
+
+- origin -- reference to a named file or directory. The default value is
+'artifacts'.
+*/
+package actions
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"text/template"
+
+	"github.com/go-debos/debos"
+	"github.com/go-debos/fakemachine"
+	"github.com/go-task/slim-sprig/v3"
+)
+
+type SwupdateArtifact struct {
+	Origin string
+	File   string
+}
+
+type SwupdateAction struct {
+	debos.BaseAction   `yaml:",inline"`
+	File               string
+	SwDescription      string `yaml:"sw-description"`
+	Artifacts          []SwupdateArtifact
+	Variables          map[string]string
+	Signing            string
+	SigningKey         string `yaml:"signing-key"`
+	SigningCertificate string `yaml:"signing-certificate"`
+}
+
+func (sw *SwupdateAction) listOptionFiles(context *debos.DebosContext) []string {
+	files := []string{}
+
+	sw.SwDescription = debos.CleanPathAt(sw.SwDescription, context.RecipeDir)
+	files = append(files, sw.SwDescription)
+
+	if sw.SigningKey != "" {
+		sw.SigningKey = debos.CleanPathAt(sw.SigningKey, context.RecipeDir)
+		files = append(files, sw.SigningKey)
+	}
+
+	if sw.SigningCertificate != "" {
+		sw.SigningCertificate = debos.CleanPathAt(sw.SigningCertificate, context.RecipeDir)
+		files = append(files, sw.SigningCertificate)
+	}
+
+	return files
+}
+
+func (sw *SwupdateAction) Verify(context *debos.DebosContext) error {
+	if len(sw.File) == 0 {
+		return errors.New("Property 'file' is mandatory for swupdate action")
+	}
+
+	if len(sw.SwDescription) == 0 {
+		return errors.New("Property 'sw-description' is mandatory for swupdate action")
+	}
+
+	if len(sw.Artifacts) == 0 {
+		return errors.New("At least one artifact is needed for swupdate action")
+	}
+
+	for idx := range sw.Artifacts {
+		a := &sw.Artifacts[idx]
+		if len(a.File) == 0 {
+			return errors.New("Property 'file' is mandatory for swupdate artifacts")
+		}
+		if len(a.Origin) == 0 {
+			a.Origin = "artifacts"
+		}
+	}
+
+	switch sw.Signing {
+	case "":
+	case "rsa":
+		if sw.SigningKey == "" {
+			return errors.New("'rsa' signing requires the 'signing-key' property")
+		}
+	case "cms":
+		if sw.SigningKey == "" || sw.SigningCertificate == "" {
+			return errors.New("'cms' signing requires the 'signing-key' and 'signing-certificate' properties")
+		}
+	default:
+		return fmt.Errorf("Unsupported signing method '%s'", sw.Signing)
+	}
+
+	for _, f := range sw.listOptionFiles(context) {
+		if _, err := os.Stat(f); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (sw *SwupdateAction) PreMachine(context *debos.DebosContext, m *fakemachine.Machine, args *[]string) error {
+	// Mount configuration files outside of recipes directory
+	for _, f := range sw.listOptionFiles(context) {
+		m.AddVolume(path.Dir(f))
+	}
+
+	return nil
+}
+
+func fileSha256(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+func (sw *SwupdateAction) renderDescription(files map[string]string) ([]byte, error) {
+	t := template.New(path.Base(sw.SwDescription))
+	t.Funcs(sprig.FuncMap())
+	t.Funcs(template.FuncMap{
+		"sha256": func(name string) (string, error) {
+			f, found := files[name]
+			if !found {
+				return "", fmt.Errorf("Unknown artifact '%s'", name)
+			}
+			return fileSha256(f)
+		},
+		"size": func(name string) (int64, error) {
+			f, found := files[name]
+			if !found {
+				return 0, fmt.Errorf("Unknown artifact '%s'", name)
+			}
+			fi, err := os.Stat(f)
+			if err != nil {
+				return 0, err
+			}
+			return fi.Size(), nil
+		},
+	})
+
+	if _, err := t.ParseFiles(sw.SwDescription); err != nil {
+		return nil, err
+	}
+
+	data := new(bytes.Buffer)
+	if err := t.Execute(data, sw.Variables); err != nil {
+		return nil, err
+	}
+
+	return data.Bytes(), nil
+}
+
+func (sw *SwupdateAction) sign(dir string) error {
+	description := path.Join(dir, "sw-description")
+	signature := path.Join(dir, "sw-description.sig")
+
+	var cmdline []string
+	switch sw.Signing {
+	case "rsa":
+		cmdline = []string{"openssl", "dgst", "-sha256",
+			"-sign", sw.SigningKey,
+			"-out", signature, description}
+	case "cms":
+		cmdline = []string{"openssl", "cms", "-sign",
+			"-in", description, "-out", signature,
+			"-signer", sw.SigningCertificate, "-inkey", sw.SigningKey,
+			"-outform", "DER", "-nosmimecap", "-binary"}
+	}
+
+	return debos.Command{}.Run("Signing sw-description", cmdline...)
+}
+
+func (sw *SwupdateAction) Run(context *debos.DebosContext) error {
+	dir, err := ioutil.TempDir(context.Scratchdir, "swupdate-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	// The sw-description has to come first, followed by its signature
+	order := []string{"sw-description"}
+	if sw.Signing != "" {
+		order = append(order, "sw-description.sig")
+	}
+
+	files := make(map[string]string)
+	for _, a := range sw.Artifacts {
+		origin, found := context.Origin(a.Origin)
+		if !found {
+			return fmt.Errorf("Origin not found '%s'", a.Origin)
+		}
+
+		src, err := debos.RestrictedPath(origin, a.File)
+		if err != nil {
+			return err
+		}
+
+		name := path.Base(a.File)
+		if _, found := files[name]; found {
+			return fmt.Errorf("Artifact %s included multiple times", name)
+		}
+		files[name] = src
+		order = append(order, name)
+
+		dst := path.Join(dir, name)
+		if err := os.Link(src, dst); err != nil {
+			if err := debos.CopyFile(src, dst, 0644); err != nil {
+				return fmt.Errorf("Failed to add artifact %s: %v", a.File, err)
+			}
+		}
+	}
+
+	description, err := sw.renderDescription(files)
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(path.Join(dir, "sw-description"), description, 0644)
+	if err != nil {
+		return err
+	}
+
+	if sw.Signing != "" {
+		if err := sw.sign(dir); err != nil {
+			return err
+		}
+	}
+
+	output := path.Join(context.Artifactdir, sw.File)
+	script := fmt.Sprintf("cd %s && printf '%%s\\n' %s | cpio -o -H crc > %s",
+		escape(dir), escapeList(order), escape(output))
+
+	log.Printf("Creating SWUpdate archive %s\n", output)
+	return debos.Command{}.Run("swupdate", "sh", "-c", script)
+}
+
+func escapeList(list []string) string {
+	escaped := make([]string, len(list))
+	for idx, s := range list {
+		escaped[idx] = escape(s)
+	}
+	return strings.Join(escaped, " ")
+}
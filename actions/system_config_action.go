@@ -0,0 +1,191 @@
+/*
+SystemConfig Action
+
+Configure the hostname, the locales and the timezone of the target rootfs in a
+single step.
+
+ # Yaml syntax:
+ - action: system-config
+   hostname: name
+   locales:
+     - en_US.UTF-8
+     - fr_FR.UTF-8
+   locale: en_US.UTF-8
+   timezone: Europe/Paris
+
+Optional properties:
+
+- hostname -- hostname written to '/etc/hostname'. '/etc/hosts' is written
+with the usual localhost entries and the hostname resolving to 127.0.1.1. A
+fully qualified name is listed along with its short name.
+
+- locales -- list of locales to generate, e.g. 'en_US.UTF-8', or 'en_US
+ISO-8859-1' to give the charset. They are enabled in '/etc/locale.gen' and
+generated with 'locale-gen', which needs the 'locales' package in the rootfs.
+
+- locale -- default locale, written as LANG to '/etc/default/locale'. Defaults
+to the first of 'locales'.
+
+- timezone -- timezone, e.g. 'Europe/Paris' or 'Etc/UTC'. '/etc/localtime' is
+linked to its zoneinfo file, which needs the 'tzdata' package in the rootfs,
+and '/etc/timezone' is written.
+
+At least one property has to be given.
+*/
+package actions
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/go-debos/debos"
+)
+
+type SystemConfigAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Hostname         string
+	Locales          []string
+	Locale           string
+	Timezone         string
+}
+
+// Labels of RFC 1123 host names
+var hostnameRegex = regexp.MustCompile(`^[a-zA-Z0-9]([-a-zA-Z0-9]{0,61}[a-zA-Z0-9])?(\.[a-zA-Z0-9]([-a-zA-Z0-9]{0,61}[a-zA-Z0-9])?)*$`)
+
+func (s *SystemConfigAction) Verify(context *debos.DebosContext) error {
+	if s.Hostname == "" && len(s.Locales) == 0 && s.Locale == "" && s.Timezone == "" {
+		return errors.New("At least one of 'hostname', 'locales', 'locale' or 'timezone' properties is needed")
+	}
+
+	if s.Hostname != "" && (len(s.Hostname) > 253 || !hostnameRegex.MatchString(s.Hostname)) {
+		return fmt.Errorf("Invalid hostname '%s'", s.Hostname)
+	}
+
+	for _, l := range s.Locales {
+		if _, err := localeGenEntry(l); err != nil {
+			return err
+		}
+	}
+
+	if s.Timezone != "" && (path.IsAbs(s.Timezone) || strings.Contains(s.Timezone, "..")) {
+		return fmt.Errorf("Invalid timezone '%s'", s.Timezone)
+	}
+
+	return nil
+}
+
+// Entry of /etc/locale.gen for the locale, e.g. "en_US.UTF-8 UTF-8"
+func localeGenEntry(locale string) (string, error) {
+	fields := strings.Fields(locale)
+	switch {
+	case len(fields) == 2:
+		return fields[0] + " " + fields[1], nil
+	case len(fields) == 1 && strings.Contains(fields[0], "."):
+		return fields[0] + " " + strings.SplitN(fields[0], ".", 2)[1], nil
+	}
+
+	return "", fmt.Errorf("Invalid locale '%s', the charset is needed, e.g. 'en_US.UTF-8' or 'en_US ISO-8859-1'", locale)
+}
+
+func (s *SystemConfigAction) hosts() []byte {
+	names := s.Hostname
+	if idx := strings.Index(s.Hostname, "."); idx > 0 {
+		names = s.Hostname + " " + s.Hostname[:idx]
+	}
+
+	return []byte(fmt.Sprintf(`127.0.0.1	localhost
+127.0.1.1	%s
+
+::1	localhost ip6-localhost ip6-loopback
+ff02::1	ip6-allnodes
+ff02::2	ip6-allrouters
+`, names))
+}
+
+// Enable the locales in /etc/locale.gen, keeping the other entries
+func (s *SystemConfigAction) localeGen(context *debos.DebosContext) ([]byte, error) {
+	data, err := ioutil.ReadFile(path.Join(context.Rootdir, "etc/locale.gen"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	for _, l := range s.Locales {
+		entry, _ := localeGenEntry(l)
+
+		enabled := false
+		for idx, line := range lines {
+			if strings.Join(strings.Fields(strings.TrimLeft(line, "# ")), " ") == entry {
+				lines[idx] = entry
+				enabled = true
+			}
+		}
+		if !enabled {
+			lines = append(lines, entry)
+		}
+	}
+
+	return []byte(strings.TrimPrefix(strings.Join(lines, "\n"), "\n") + "\n"), nil
+}
+
+func (s *SystemConfigAction) Run(context *debos.DebosContext) error {
+	if s.Hostname != "" {
+		if err := writeRootfsFile(context, "/etc/hostname", []byte(s.Hostname+"\n"), 0644); err != nil {
+			return err
+		}
+		if err := writeRootfsFile(context, "/etc/hosts", s.hosts(), 0644); err != nil {
+			return err
+		}
+	}
+
+	if len(s.Locales) > 0 {
+		data, err := s.localeGen(context)
+		if err != nil {
+			return err
+		}
+		if err := writeRootfsFile(context, "/etc/locale.gen", data, 0644); err != nil {
+			return err
+		}
+
+		c := debos.NewChrootCommandForContext(*context)
+		if err := c.Run("locale-gen", "locale-gen"); err != nil {
+			return fmt.Errorf("Failed to generate the locales, is the 'locales' package installed? %v", err)
+		}
+	}
+
+	locale := s.Locale
+	if locale == "" && len(s.Locales) > 0 {
+		locale = strings.Fields(s.Locales[0])[0]
+	}
+	if locale != "" {
+		if err := writeRootfsFile(context, "/etc/default/locale", []byte("LANG="+locale+"\n"), 0644); err != nil {
+			return err
+		}
+	}
+
+	if s.Timezone != "" {
+		zoneinfo := path.Join("/usr/share/zoneinfo", s.Timezone)
+		if _, err := os.Stat(path.Join(context.Rootdir, zoneinfo)); err != nil {
+			return fmt.Errorf("Unknown timezone '%s', is the 'tzdata' package installed? %v", s.Timezone, err)
+		}
+
+		localtime := path.Join(context.Rootdir, "etc/localtime")
+		if err := os.Remove(localtime); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.Symlink(zoneinfo, localtime); err != nil {
+			return err
+		}
+
+		if err := writeRootfsFile(context, "/etc/timezone", []byte(s.Timezone+"\n"), 0644); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,144 @@
+/*
+SystemdBoot Action
+
+Install systemd-boot to the EFI system partition of the image and generate
+its loader configuration and boot entries. The EFI system partition has to be
+mounted in the target filesystem, see the 'image-partition' action.
+
+ # Yaml syntax:
+ - action: systemd-boot
+   esp: path
+   min-size: size
+   default: id
+   timeout: seconds
+   entries:
+     - id: id
+       title: title
+       kernel: path
+       initrd:
+         - path
+       devicetree: path
+       cmdline: arguments
+
+Mandatory properties:
+
+- entries -- list of boot entries, see the boot-entries action for the entry
+properties. Paths are relative to the root of the EFI system partition.
+
+Optional properties:
+
+- esp -- mount point of the EFI system partition in the target filesystem.
+Defaults to '/boot/efi'.
+
+- min-size -- minimal size of the EFI system partition, e.g. '256MB'. Defaults
+to '100MB'.
+
+- default -- id of the default entry. Defaults to the first entry.
+
+- timeout -- time in seconds the menu is shown. Defaults to 5.
+
+'bootctl' from the systemd-boot package of the target filesystem is used for
+the installation, no EFI variables are written.
+*/
+package actions
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"syscall"
+
+	"github.com/docker/go-units"
+	"github.com/go-debos/debos"
+)
+
+// Filesystem magic of FAT filesystems as returned by statfs
+const msdosSuperMagic = 0x4d44
+
+type SystemdBootAction struct {
+	debos.BaseAction `yaml:",inline"`
+	ESP              string
+	MinSize          string `yaml:"min-size"`
+	Default          string
+	Timeout          int
+	Entries          []BootEntry
+	minSize          int64
+}
+
+func NewSystemdBootAction() *SystemdBootAction {
+	s := SystemdBootAction{}
+	s.ESP = "/boot/efi"
+	s.MinSize = "100MB"
+	s.Timeout = 5
+
+	return &s
+}
+
+func (s *SystemdBootAction) bootEntries() *BootEntriesAction {
+	return &BootEntriesAction{
+		Bootloader: "systemd-boot",
+		ESP:        s.ESP,
+		Default:    s.Default,
+		Timeout:    s.Timeout,
+		Entries:    s.Entries,
+	}
+}
+
+func (s *SystemdBootAction) Verify(context *debos.DebosContext) error {
+	var err error
+
+	if !path.IsAbs(s.ESP) {
+		return errors.New("Property 'esp' must be an absolute path")
+	}
+
+	if s.minSize, err = units.FromHumanSize(s.MinSize); err != nil {
+		return fmt.Errorf("Failed to parse min-size: %v", err)
+	}
+
+	b := s.bootEntries()
+	if err := b.Verify(context); err != nil {
+		return err
+	}
+	// Keep the defaults filled in by the verification
+	s.Default = b.Default
+
+	return nil
+}
+
+func (s *SystemdBootAction) checkESP(context *debos.DebosContext) error {
+	esp, err := debos.RestrictedPath(context.Rootdir, s.ESP)
+	if err != nil {
+		return err
+	}
+
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(esp, &st); err != nil {
+		return fmt.Errorf("Failed to check EFI system partition %s: %v", s.ESP, err)
+	}
+
+	if st.Type != msdosSuperMagic {
+		return fmt.Errorf("%s is not a FAT filesystem, is the EFI system partition mounted?", s.ESP)
+	}
+
+	size := int64(st.Blocks) * int64(st.Bsize)
+	if size < s.minSize {
+		return fmt.Errorf("EFI system partition is too small: %s, at least %s needed",
+			units.BytesSize(float64(size)), units.BytesSize(float64(s.minSize)))
+	}
+
+	return nil
+}
+
+func (s *SystemdBootAction) Run(context *debos.DebosContext) error {
+	if err := s.checkESP(context); err != nil {
+		return err
+	}
+
+	c := debos.NewChrootCommandForContext(*context)
+	err := c.Run("bootctl", "bootctl", "install", "--esp-path="+s.ESP, "--no-variables")
+	if err != nil {
+		return err
+	}
+
+	return s.bootEntries().Run(context)
+}
@@ -0,0 +1,126 @@
+/*
+SystemdFirstboot Action
+
+Apply the systemd presets and the first boot settings at build time, with
+'systemctl preset-all' and 'systemd-firstboot', so the image doesn't wait for
+them to be entered interactively on its first boot.
+
+ # Yaml syntax:
+ - action: systemd-firstboot
+   preset-all: bool
+   locale: en_US.UTF-8
+   keymap: us
+   timezone: Etc/UTC
+   hostname: name
+   root-password: locked
+   mask: bool
+
+Optional properties:
+
+- preset-all -- enable and disable the units according to the preset files of
+the rootfs with 'systemctl preset-all'. Default 'true'.
+
+- locale -- system locale, e.g. 'en_US.UTF-8'.
+
+- keymap -- console keymap, e.g. 'us'.
+
+- timezone -- timezone, e.g. 'Europe/Paris' or 'Etc/UTC'.
+
+- hostname -- hostname of the system.
+
+- root-password -- either 'locked' to lock the password of root, or a password
+hash as generated by 'mkpasswd', e.g. '$y$j9T$...'. Clear text passwords are
+refused as they would be left in the recipe.
+
+- mask -- mask 'systemd-firstboot.service', so the settings not given aren't
+prompted for on the first boot either. Default 'false'.
+
+The given settings replace the ones already in the rootfs. The tools of the
+rootfs are used, so the 'systemd' package has to be installed.
+*/
+package actions
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/go-debos/debos"
+)
+
+type SystemdFirstbootAction struct {
+	debos.BaseAction `yaml:",inline"`
+	PresetAll        bool `yaml:"preset-all"`
+	Locale           string
+	Keymap           string
+	Timezone         string
+	Hostname         string
+	RootPassword     string `yaml:"root-password"`
+	Mask             bool
+}
+
+func NewSystemdFirstbootAction() *SystemdFirstbootAction {
+	return &SystemdFirstbootAction{PresetAll: true}
+}
+
+func (s *SystemdFirstbootAction) Verify(context *debos.DebosContext) error {
+	if s.RootPassword != "" && s.RootPassword != "locked" && !strings.HasPrefix(s.RootPassword, "$") {
+		return fmt.Errorf("Property 'root-password' has to be 'locked' or a password hash, e.g. from 'mkpasswd'")
+	}
+
+	if s.Hostname != "" && (len(s.Hostname) > 253 || !hostnameRegex.MatchString(s.Hostname)) {
+		return fmt.Errorf("Invalid hostname '%s'", s.Hostname)
+	}
+
+	return nil
+}
+
+// Arguments of systemd-firstboot for the given settings
+func (s *SystemdFirstbootAction) firstbootArgs() []string {
+	var args []string
+
+	if s.Locale != "" {
+		args = append(args, "--locale="+s.Locale)
+	}
+	if s.Keymap != "" {
+		args = append(args, "--keymap="+s.Keymap)
+	}
+	if s.Timezone != "" {
+		args = append(args, "--timezone="+s.Timezone)
+	}
+	if s.Hostname != "" {
+		args = append(args, "--hostname="+s.Hostname)
+	}
+
+	switch s.RootPassword {
+	case "":
+	case "locked":
+		args = append(args, "--root-password-hashed=!*")
+	default:
+		args = append(args, "--root-password-hashed="+s.RootPassword)
+	}
+
+	return args
+}
+
+func (s *SystemdFirstbootAction) Run(context *debos.DebosContext) error {
+	c := debos.NewChrootCommandForContext(*context)
+
+	if args := s.firstbootArgs(); len(args) > 0 {
+		cmdline := append([]string{"systemd-firstboot", "--force"}, args...)
+		if err := c.Run("systemd-firstboot", cmdline...); err != nil {
+			return err
+		}
+	}
+
+	if s.PresetAll {
+		if err := c.Run("systemctl", "systemctl", "preset-all"); err != nil {
+			return err
+		}
+	}
+
+	if s.Mask {
+		return c.Run("systemctl", "systemctl", "mask", "systemd-firstboot.service")
+	}
+
+	return nil
+}
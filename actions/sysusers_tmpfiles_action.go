@@ -0,0 +1,210 @@
+/*
+SysusersTmpfiles Action
+
+Write systemd sysusers.d and tmpfiles.d configuration snippets to the target
+rootfs and apply them at build time with 'systemd-sysusers' and
+'systemd-tmpfiles', so system users and directories exist in the image
+without depending on the first boot.
+
+ # Yaml syntax:
+ - action: sysusers-tmpfiles
+   name: snippet name
+   apply: bool
+   sysusers:
+     - type: u
+       name: user name
+       id: id
+       gecos: description
+       home: path
+       shell: path
+   tmpfiles:
+     - type: d
+       path: path
+       mode: mode
+       user: user name
+       group: group name
+       age: age
+       argument: argument
+
+Mandatory properties:
+
+- name -- name of the snippets, they are written to
+'/usr/lib/sysusers.d/<name>.conf' and '/usr/lib/tmpfiles.d/<name>.conf'.
+
+Optional properties:
+
+- sysusers -- list of sysusers.d entries, see sysusers.d(5). Only 'type' and
+'name' are mandatory, omitted fields are written as '-'.
+
+- tmpfiles -- list of tmpfiles.d entries, see tmpfiles.d(5). Only 'type' and
+'path' are mandatory, omitted fields are written as '-'.
+
+- apply -- run 'systemd-sysusers' and 'systemd-tmpfiles --create' in the
+target rootfs for the written snippets. Default 'true'.
+
+At least one of 'sysusers' or 'tmpfiles' has to be given.
+*/
+package actions
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/go-debos/debos"
+)
+
+type SysusersEntry struct {
+	Type  string
+	Name  string
+	ID    string
+	Gecos string
+	Home  string
+	Shell string
+}
+
+type TmpfilesEntry struct {
+	Type     string
+	Path     string
+	Mode     string
+	User     string
+	Group    string
+	Age      string
+	Argument string
+}
+
+type SysusersTmpfilesAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Name             string
+	Apply            bool
+	Sysusers         []SysusersEntry
+	Tmpfiles         []TmpfilesEntry
+}
+
+func NewSysusersTmpfilesAction() *SysusersTmpfilesAction {
+	return &SysusersTmpfilesAction{Apply: true}
+}
+
+// Format a configuration field, empty ones are replaced by '-'
+func configField(s string) string {
+	if s == "" {
+		return "-"
+	}
+	if strings.ContainsAny(s, " \t\"") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+func (s *SysusersTmpfilesAction) Verify(context *debos.DebosContext) error {
+	if len(s.Name) == 0 || strings.Contains(s.Name, "/") {
+		return errors.New("Property 'name' must be set to a valid file name")
+	}
+
+	if len(s.Sysusers) == 0 && len(s.Tmpfiles) == 0 {
+		return errors.New("At least one of 'sysusers' or 'tmpfiles' properties is needed")
+	}
+
+	for _, u := range s.Sysusers {
+		switch u.Type {
+		case "u", "u!", "g", "m", "r":
+		default:
+			return fmt.Errorf("Unsupported sysusers type '%s'", u.Type)
+		}
+		if u.Name == "" && u.Type != "r" {
+			return fmt.Errorf("sysusers entry of type '%s' needs a name", u.Type)
+		}
+	}
+
+	for _, t := range s.Tmpfiles {
+		if t.Type == "" {
+			return fmt.Errorf("tmpfiles entry for %s needs a type", t.Path)
+		}
+		if !path.IsAbs(t.Path) {
+			return fmt.Errorf("tmpfiles entry path '%s' must be absolute", t.Path)
+		}
+	}
+
+	return nil
+}
+
+func (s *SysusersTmpfilesAction) sysusersConfig() []byte {
+	var b bytes.Buffer
+
+	b.WriteString("# Generated by debos\n")
+	for _, u := range s.Sysusers {
+		b.WriteString(strings.Join([]string{u.Type, configField(u.Name),
+			configField(u.ID), configField(u.Gecos),
+			configField(u.Home), configField(u.Shell)}, " "))
+		b.WriteString("\n")
+	}
+
+	return b.Bytes()
+}
+
+func (s *SysusersTmpfilesAction) tmpfilesConfig() []byte {
+	var b bytes.Buffer
+
+	b.WriteString("# Generated by debos\n")
+	for _, t := range s.Tmpfiles {
+		b.WriteString(strings.Join([]string{t.Type, configField(t.Path),
+			configField(t.Mode), configField(t.User),
+			configField(t.Group), configField(t.Age),
+			configField(t.Argument)}, " "))
+		b.WriteString("\n")
+	}
+
+	return b.Bytes()
+}
+
+func (s *SysusersTmpfilesAction) writeConfig(context *debos.DebosContext, dir string, data []byte) (string, error) {
+	confdir := path.Join(context.Rootdir, dir)
+	if err := os.MkdirAll(confdir, 0755); err != nil {
+		return "", err
+	}
+
+	conf := path.Join(dir, s.Name+".conf")
+	if err := ioutil.WriteFile(path.Join(context.Rootdir, conf), data, 0644); err != nil {
+		return "", err
+	}
+
+	return conf, nil
+}
+
+func (s *SysusersTmpfilesAction) Run(context *debos.DebosContext) error {
+	c := debos.NewChrootCommandForContext(*context)
+
+	/* Users have to exist before creating files owned by them */
+	if len(s.Sysusers) > 0 {
+		conf, err := s.writeConfig(context, "/usr/lib/sysusers.d", s.sysusersConfig())
+		if err != nil {
+			return err
+		}
+
+		if s.Apply {
+			if err := c.Run("sysusers", "systemd-sysusers", conf); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(s.Tmpfiles) > 0 {
+		conf, err := s.writeConfig(context, "/usr/lib/tmpfiles.d", s.tmpfilesConfig())
+		if err != nil {
+			return err
+		}
+
+		if s.Apply {
+			if err := c.Run("tmpfiles", "systemd-tmpfiles", "--create", conf); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
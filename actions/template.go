@@ -0,0 +1,146 @@
+package actions
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/go-debos/debos"
+)
+
+/*
+Template functions reading files, relative to the directory of the recipe
+being templated.
+*/
+func fileFuncs(recipeDir string) template.FuncMap {
+	return template.FuncMap{
+		"readFile": func(file string) (string, error) {
+			data, err := ioutil.ReadFile(debos.CleanPathAt(file, recipeDir))
+			return string(data), err
+		},
+		"fileExists": func(file string) bool {
+			_, err := os.Stat(debos.CleanPathAt(file, recipeDir))
+			return err == nil
+		},
+		"sha256file": func(file string) (string, error) {
+			return debos.HashFile(debos.CleanPathAt(file, recipeDir))
+		},
+	}
+}
+
+// Semantic version, the build metadata being ignored
+type semver struct {
+	numbers    [3]int
+	prerelease []string
+}
+
+func parseSemver(version string) (semver, error) {
+	var v semver
+
+	s := strings.TrimPrefix(strings.TrimSpace(version), "v")
+	if idx := strings.Index(s, "+"); idx >= 0 {
+		s = s[:idx]
+	}
+	if idx := strings.Index(s, "-"); idx >= 0 {
+		v.prerelease = strings.Split(s[idx+1:], ".")
+		s = s[:idx]
+	}
+
+	// Missing minor and patch numbers are 0, e.g. '2' is '2.0.0'
+	parts := strings.Split(s, ".")
+	if len(parts) > 3 {
+		return v, fmt.Errorf("Invalid version '%s'", version)
+	}
+	for idx, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return v, fmt.Errorf("Invalid version '%s'", version)
+		}
+		v.numbers[idx] = n
+	}
+
+	return v, nil
+}
+
+// Compare the prerelease identifiers, a release being greater than its prereleases
+func comparePrerelease(a, b []string) int {
+	if len(a) == 0 || len(b) == 0 {
+		return len(b) - len(a)
+	}
+
+	for idx := 0; idx < len(a) && idx < len(b); idx++ {
+		na, erra := strconv.Atoi(a[idx])
+		nb, errb := strconv.Atoi(b[idx])
+		switch {
+		case erra == nil && errb == nil && na != nb:
+			return na - nb
+		case erra == nil && errb != nil:
+			return -1
+		case erra != nil && errb == nil:
+			return 1
+		case a[idx] != b[idx]:
+			return strings.Compare(a[idx], b[idx])
+		}
+	}
+
+	return len(a) - len(b)
+}
+
+func (v semver) compare(o semver) int {
+	for idx := range v.numbers {
+		if v.numbers[idx] != o.numbers[idx] {
+			return v.numbers[idx] - o.numbers[idx]
+		}
+	}
+
+	return comparePrerelease(v.prerelease, o.prerelease)
+}
+
+/*
+Whether the version matches the constraint, a comma separated list of
+comparisons which all have to hold, e.g. '>= 1.2, < 2'.
+*/
+func semverCompare(constraint, version string) (bool, error) {
+	v, err := parseSemver(version)
+	if err != nil {
+		return false, err
+	}
+
+	for _, c := range strings.Split(constraint, ",") {
+		c = strings.TrimSpace(c)
+		op := c[:len(c)-len(strings.TrimLeft(c, "=!<>"))]
+
+		ref, err := parseSemver(c[len(op):])
+		if err != nil {
+			return false, err
+		}
+
+		cmp := v.compare(ref)
+		var match bool
+		switch op {
+		case "", "=", "==":
+			match = cmp == 0
+		case "!=":
+			match = cmp != 0
+		case "<":
+			match = cmp < 0
+		case "<=":
+			match = cmp <= 0
+		case ">":
+			match = cmp > 0
+		case ">=":
+			match = cmp >= 0
+		default:
+			return false, fmt.Errorf("Invalid version constraint '%s'", c)
+		}
+
+		if !match {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
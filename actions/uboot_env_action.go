@@ -0,0 +1,275 @@
+/*
+UbootEnv Action
+
+Generate the initial U-Boot environment of an A/B image, write it to the
+image and configure the U-Boot userspace tools (fw_printenv/fw_setenv) to
+access it. The slot variables are generated from the partitions created by
+the 'image-partition' action so the bootloader state always matches the disk
+layout. This action requires 'image-partition' action to be executed before
+it.
+
+ # Yaml syntax:
+ - action: uboot-env
+   device: /dev/mmcblk0
+   partition: partition name
+   offset: 0x3f8000
+   redundant-offset: 0x3fc000
+   size: 0x4000
+   bootcount-limit: 3
+   slots:
+     - name: A
+       partition: rootfs-a
+     - name: B
+       partition: rootfs-b
+   variables:
+     key: value
+
+Mandatory properties:
+
+- device -- device holding the environment on the target, as written to
+'/etc/fw_env.config'.
+
+- offset -- offset of the environment in bytes. Hexadecimal values have to be
+prefixed by '0x'.
+
+- size -- size of the environment in bytes.
+
+Optional properties:
+
+- partition -- name of the partition holding the environment. The offsets are
+relative to the partition in that case. By default the environment is written
+to the image itself.
+
+- redundant-offset -- offset of the redundant copy of the environment.
+
+- bootcount-limit -- number of boot attempts of a slot before falling back to
+the other one. Defaults to 3.
+
+- slots -- list of slots of the A/B layout, in boot order. For each slot the
+'BOOT_<name>_LEFT' variable is set to 'bootcount-limit' and 'BOOT_<name>_PART'
+to the number of its partition, 'BOOT_ORDER' lists all the slots.
+
+- variables -- additional variables of the environment, overriding the
+generated ones.
+
+The 'bootcount', 'bootlimit' and 'upgrade_available' variables are always
+generated for use by U-Boot's boot counting. The 'mkenvimage' tool from the
+U-Boot tools has to be available on the build host.
+*/
+package actions
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-debos/debos"
+)
+
+type UbootEnvSlot struct {
+	Name      string
+	Partition string
+}
+
+type UbootEnvAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Device           string
+	Partition        string
+	Offset           string
+	RedundantOffset  string `yaml:"redundant-offset"`
+	Size             string
+	BootcountLimit   int `yaml:"bootcount-limit"`
+	Slots            []UbootEnvSlot
+	Variables        map[string]string
+	offset           int64
+	redundantOffset  int64
+	size             int64
+}
+
+func NewUbootEnvAction() *UbootEnvAction {
+	return &UbootEnvAction{BootcountLimit: 3}
+}
+
+func (u *UbootEnvAction) Verify(context *debos.DebosContext) error {
+	var err error
+
+	if u.Device == "" {
+		return errors.New("Property 'device' is mandatory for uboot-env action")
+	}
+
+	if u.Offset == "" || u.Size == "" {
+		return errors.New("Properties 'offset' and 'size' are mandatory for uboot-env action")
+	}
+
+	if u.offset, err = strconv.ParseInt(u.Offset, 0, 64); err != nil {
+		return fmt.Errorf("Couldn't parse offset %v", err)
+	}
+
+	if u.size, err = strconv.ParseInt(u.Size, 0, 64); err != nil || u.size <= 0 {
+		return fmt.Errorf("Invalid environment size '%s'", u.Size)
+	}
+
+	if u.RedundantOffset != "" {
+		u.redundantOffset, err = strconv.ParseInt(u.RedundantOffset, 0, 64)
+		if err != nil {
+			return fmt.Errorf("Couldn't parse redundant offset %v", err)
+		}
+
+		if u.redundantOffset < u.offset+u.size && u.offset < u.redundantOffset+u.size {
+			return errors.New("Environment and its redundant copy overlap")
+		}
+	}
+
+	if u.BootcountLimit <= 0 {
+		return errors.New("Property 'bootcount-limit' must be positive")
+	}
+
+	names := make(map[string]bool)
+	for _, s := range u.Slots {
+		if s.Name == "" || s.Partition == "" {
+			return errors.New("Slots need a 'name' and a 'partition'")
+		}
+		if strings.ContainsAny(s.Name, " =") {
+			return fmt.Errorf("Invalid slot name '%s'", s.Name)
+		}
+		if names[s.Name] {
+			return fmt.Errorf("Slot %s already exists", s.Name)
+		}
+		names[s.Name] = true
+	}
+
+	return nil
+}
+
+func findPartition(context *debos.DebosContext, name string) (*debos.Partition, error) {
+	for idx, p := range context.ImagePartitions {
+		if p.Name == name {
+			return &context.ImagePartitions[idx], nil
+		}
+	}
+
+	return nil, fmt.Errorf("Failed to find partition named %s", name)
+}
+
+func (u *UbootEnvAction) environment(context *debos.DebosContext) ([]byte, error) {
+	env := map[string]string{
+		"bootcount":         "0",
+		"bootlimit":         strconv.Itoa(u.BootcountLimit),
+		"upgrade_available": "0",
+	}
+
+	if len(u.Slots) > 0 {
+		var order []string
+		for _, s := range u.Slots {
+			p, err := findPartition(context, s.Partition)
+			if err != nil {
+				return nil, err
+			}
+
+			order = append(order, s.Name)
+			env[fmt.Sprintf("BOOT_%s_LEFT", s.Name)] = strconv.Itoa(u.BootcountLimit)
+			env[fmt.Sprintf("BOOT_%s_PART", s.Name)] = strconv.Itoa(p.Number)
+		}
+		env["BOOT_ORDER"] = strings.Join(order, " ")
+	}
+
+	for k, v := range u.Variables {
+		env[k] = v
+	}
+
+	keys := make([]string, 0, len(env))
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var data []byte
+	for _, k := range keys {
+		data = append(data, fmt.Sprintf("%s=%s\n", k, env[k])...)
+	}
+
+	return data, nil
+}
+
+func (u *UbootEnvAction) fwEnvConfig() []byte {
+	config := "# Generated by debos\n"
+	config += fmt.Sprintf("%s 0x%x 0x%x\n", u.Device, u.offset, u.size)
+	if u.RedundantOffset != "" {
+		config += fmt.Sprintf("%s 0x%x 0x%x\n", u.Device, u.redundantOffset, u.size)
+	}
+
+	return []byte(config)
+}
+
+func (u *UbootEnvAction) Run(context *debos.DebosContext) error {
+	devicePath := context.Image
+	if u.Partition != "" {
+		p, err := findPartition(context, u.Partition)
+		if err != nil {
+			return err
+		}
+		devicePath = p.DevicePath
+	}
+
+	if devicePath == "" {
+		return errors.New("uboot-env action requires an image")
+	}
+
+	env, err := u.environment(context)
+	if err != nil {
+		return err
+	}
+
+	dir, err := ioutil.TempDir(context.Scratchdir, "uboot-env-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	envtxt := path.Join(dir, "env.txt")
+	envbin := path.Join(dir, "env.bin")
+	if err := ioutil.WriteFile(envtxt, env, 0644); err != nil {
+		return err
+	}
+
+	cmdline := []string{"mkenvimage", "-s", strconv.FormatInt(u.size, 10)}
+	if u.RedundantOffset != "" {
+		cmdline = append(cmdline, "-r")
+	}
+	cmdline = append(cmdline, "-o", envbin, envtxt)
+
+	if err := (debos.Command{}).Run("mkenvimage", cmdline...); err != nil {
+		return err
+	}
+
+	content, err := ioutil.ReadFile(envbin)
+	if err != nil {
+		return err
+	}
+
+	target, err := os.OpenFile(devicePath, os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("Failed to open %s: %v", devicePath, err)
+	}
+	defer target.Close()
+
+	offsets := []int64{u.offset}
+	if u.RedundantOffset != "" {
+		offsets = append(offsets, u.redundantOffset)
+	}
+
+	for _, offset := range offsets {
+		log.Printf("Writing U-Boot environment to %s at 0x%x", devicePath, offset)
+		if _, err := target.WriteAt(content, offset); err != nil {
+			return fmt.Errorf("Failed to write U-Boot environment: %v", err)
+		}
+	}
+
+	return writeRootfsFile(context, "/etc/fw_env.config", u.fwEnvConfig(), 0644)
+}
@@ -0,0 +1,205 @@
+/*
+UbootWrite Action
+
+Write SPL and U-Boot binaries to the output image at the offsets expected by
+the SoC boot ROM, optionally with redundant copies of the SPL. This action
+requires 'image-partition' action to be executed before it.
+
+ # Yaml syntax:
+ - action: uboot-write
+   origin: name
+   soc: name
+   spl: filename
+   u-boot: filename
+   copies: number
+   spl-offsets:
+     - bytes
+   u-boot-offset: bytes
+
+Mandatory properties:
+
+- origin -- reference to the named directory holding the binaries, e.g.
+'recipe' or the origin of a previous download or unpack action.
+
+- spl -- the SPL binary, or the combined SPL and U-Boot binary for SoCs booting
+from a single image (e.g. 'u-boot-sunxi-with-spl.bin' or 'flash.bin').
+
+Optional properties:
+
+- soc -- SoC preset giving the offsets. Supported presets are:
+ 'sunxi' -- SPL at 8KiB, redundant copy at 128KiB
+ 'imx6', 'imx7' -- SPL at 1KiB, U-Boot at 69KiB
+ 'imx8mq', 'imx8mm' -- SPL at 33KiB, U-Boot at 384KiB
+ 'imx8mn', 'imx8mp' -- SPL at 32KiB, U-Boot at 384KiB
+ 'rockchip' -- SPL ('idbloader.img') at 32KiB, redundant copy at 544KiB,
+U-Boot ('u-boot.itb') at 8MiB
+
+- u-boot -- the U-Boot binary loaded by the SPL.
+
+- copies -- number of copies of the SPL to write, at most the number of
+locations known for the SoC. Defaults to 1.
+
+- spl-offsets -- offsets of the SPL and of its redundant copies in bytes or in
+sectors e.g. '256s', overriding the SoC preset.
+
+- u-boot-offset -- offset of the U-Boot binary in bytes or in sectors,
+overriding the SoC preset.
+
+Either 'soc' or 'spl-offsets' has to be given. Before writing, the binaries
+are checked not to overlap each other, the partition table or any partition.
+*/
+package actions
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+
+	"github.com/go-debos/debos"
+)
+
+type UbootWriteAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Origin           string
+	Soc              string
+	SPL              string `yaml:"spl"`
+	UBoot            string `yaml:"u-boot"`
+	Copies           int
+	SPLOffsets       []string `yaml:"spl-offsets"`
+	UBootOffset      string   `yaml:"u-boot-offset"`
+}
+
+func NewUbootWriteAction() *UbootWriteAction {
+	return &UbootWriteAction{Copies: 1}
+}
+
+func (u *UbootWriteAction) Verify(context *debos.DebosContext) error {
+	if len(u.Origin) == 0 || len(u.SPL) == 0 {
+		return errors.New("'origin' and 'spl' properties can't be empty")
+	}
+
+	if u.Soc != "" {
+		if _, found := socPresets[u.Soc]; !found {
+			return fmt.Errorf("Unsupported SoC preset '%s'", u.Soc)
+		}
+	} else if len(u.SPLOffsets) == 0 {
+		return errors.New("Either 'soc' or 'spl-offsets' property is needed")
+	}
+
+	if u.Copies < 1 {
+		return errors.New("Property 'copies' must be at least 1")
+	}
+
+	return nil
+}
+
+// Offsets of the SPL copies and of U-Boot according to the preset and overrides
+func (u *UbootWriteAction) offsets(context *debos.DebosContext) ([]int64, int64, error) {
+	var preset socPreset
+	if u.Soc != "" {
+		preset = socPresets[u.Soc]
+	}
+
+	spl := preset.SPL
+	if len(u.SPLOffsets) > 0 {
+		spl = nil
+		for _, o := range u.SPLOffsets {
+			offset, err := parseOffset(o, context.SectorSize)
+			if err != nil {
+				return nil, 0, err
+			}
+			spl = append(spl, offset)
+		}
+	}
+
+	if u.Copies > len(spl) {
+		return nil, 0, fmt.Errorf("Only %d locations known for the SPL, can't write %d copies", len(spl), u.Copies)
+	}
+
+	uboot := preset.UBoot
+	if u.UBootOffset != "" {
+		offset, err := parseOffset(u.UBootOffset, context.SectorSize)
+		if err != nil {
+			return nil, 0, err
+		}
+		uboot = offset
+	}
+
+	return spl[:u.Copies], uboot, nil
+}
+
+type bootBinary struct {
+	name    string
+	content []byte
+	offset  int64
+}
+
+func (u *UbootWriteAction) Run(context *debos.DebosContext) error {
+	if context.Image == "" {
+		return errors.New("uboot-write action requires an image")
+	}
+
+	origin, found := context.Origin(u.Origin)
+	if !found {
+		return fmt.Errorf("Origin not found '%s'", u.Origin)
+	}
+
+	splOffsets, ubootOffset, err := u.offsets(context)
+	if err != nil {
+		return err
+	}
+
+	read := func(file string) ([]byte, error) {
+		p, err := debos.RestrictedPath(origin, file)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadFile(p)
+	}
+
+	spl, err := read(u.SPL)
+	if err != nil {
+		return err
+	}
+
+	var binaries []bootBinary
+	for idx, offset := range splOffsets {
+		name := path.Base(u.SPL)
+		if idx > 0 {
+			name = fmt.Sprintf("%s (copy %d)", name, idx)
+		}
+		binaries = append(binaries, bootBinary{name, spl, offset})
+	}
+
+	if u.UBoot != "" {
+		if ubootOffset == 0 {
+			return fmt.Errorf("No U-Boot offset known for SoC '%s', set 'u-boot-offset'", u.Soc)
+		}
+
+		uboot, err := read(u.UBoot)
+		if err != nil {
+			return err
+		}
+		binaries = append(binaries, bootBinary{path.Base(u.UBoot), uboot, ubootOffset})
+	}
+
+	for i, a := range binaries {
+		for _, b := range binaries[i+1:] {
+			aEnd := a.offset + int64(len(a.content))
+			bEnd := b.offset + int64(len(b.content))
+			if a.offset < bEnd && b.offset < aEnd {
+				return fmt.Errorf("%s at 0x%x-0x%x overlaps %s at 0x%x-0x%x",
+					a.name, a.offset, aEnd, b.name, b.offset, bEnd)
+			}
+		}
+	}
+
+	for _, b := range binaries {
+		if err := writeBootFirmware(context.Image, b.content, b.offset); err != nil {
+			return fmt.Errorf("Failed to write %s: %v", b.name, err)
+		}
+	}
+
+	return nil
+}
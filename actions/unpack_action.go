@@ -4,13 +4,17 @@ Unpack Action
 Unpack files from archive to the filesystem.
 Useful for creating target rootfs from saved tarball with prepared file structure.
 
-Only (compressed) tar archives are supported currently.
+The (compressed) tar, zip and (compressed) cpio archives are supported, as
+well as the payload of the Debian and RPM packages, e.g. to consume firmware
+blobs or vendor SDKs. The format is guessed from the file extension, '.zip',
+'.deb', '.rpm', '.cpio' or '.cpio.<compression>', tar otherwise.
 
  # Yaml syntax:
  - action: unpack
    origin: name
    file: file.ext
    compression: gz
+   format: tar
 
 Mandatory properties:
 
@@ -27,8 +31,12 @@ The default value is 'artifacts' directory in case if this property is omitted.
 
 - compression -- optional hint for unpack allowing to use proper compression method.
 
-Currently 'bzip2', 'gz', 'lzip', 'lzma', 'lzop', 'xz' and 'zstd' compression types are supported.
+Currently 'bzip2', 'gz', 'lz4', 'lzip', 'lzma', 'lzop', 'xz' and 'zstd' compression types are supported.
 If not provided an attempt to autodetect the compression type will be done.
+Only supported for tar and cpio archives.
+
+- format -- format of the archive, when its extension doesn't tell it, e.g.
+for a downloaded file: 'tar', 'zip', 'deb', 'rpm' or 'cpio'.
 */
 package actions
 
@@ -42,6 +50,40 @@ type UnpackAction struct {
 	Compression      string
 	Origin           string
 	File             string
+	Format           string
+}
+
+var unpackFormats = map[string]debos.ArchiveType{
+	"tar":  debos.Tar,
+	"zip":  debos.Zip,
+	"deb":  debos.Deb,
+	"rpm":  debos.Rpm,
+	"cpio": debos.Cpio,
+}
+
+func (pf *UnpackAction) archive(file string) (debos.Archive, error) {
+	if pf.Format == "" {
+		return debos.NewArchive(file)
+	}
+
+	format, ok := unpackFormats[pf.Format]
+	if !ok {
+		return debos.Archive{}, fmt.Errorf("Unsupported format '%s'", pf.Format)
+	}
+
+	return debos.NewArchive(file, format)
+}
+
+// Hint the compression of the archive, for the formats supporting it
+func addCompression(archive debos.Archive, compression string) error {
+	switch archive.Type() {
+	case debos.Tar:
+		return archive.AddOption("tarcompression", compression)
+	case debos.Cpio:
+		return archive.AddOption("cpiocompression", compression)
+	}
+
+	return fmt.Errorf("Option 'compression' is supported for tar and cpio archives only.")
 }
 
 func (pf *UnpackAction) Verify(context *debos.DebosContext) error {
@@ -50,15 +92,12 @@ func (pf *UnpackAction) Verify(context *debos.DebosContext) error {
 		return fmt.Errorf("Filename can't be empty. Please add 'file' and/or 'origin' property.")
 	}
 
-	archive, err := debos.NewArchive(pf.File)
+	archive, err := pf.archive(pf.File)
 	if err != nil {
 		return err
 	}
 	if len(pf.Compression) > 0 {
-		if archive.Type() != debos.Tar {
-			return fmt.Errorf("Option 'compression' is supported for Tar archives only.")
-		}
-		if err := archive.AddOption("tarcompression", pf.Compression); err != nil {
+		if err := addCompression(archive, pf.Compression); err != nil {
 			return fmt.Errorf("'%s': %s", pf.File, err)
 		}
 	}
@@ -85,12 +124,12 @@ func (pf *UnpackAction) Run(context *debos.DebosContext) error {
 		return err
 	}
 
-	archive, err := debos.NewArchive(infile)
+	archive, err := pf.archive(infile)
 	if err != nil {
 		return err
 	}
 	if len(pf.Compression) > 0 {
-		if err := archive.AddOption("tarcompression", pf.Compression); err != nil {
+		if err := addCompression(archive, pf.Compression); err != nil {
 			return err
 		}
 	}
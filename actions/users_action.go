@@ -0,0 +1,235 @@
+/*
+Users Action
+
+Create or update groups and users in the target rootfs. The action is
+idempotent: existing groups and users are updated to match the properties, so
+rerunning a recipe, e.g. with --watch, doesn't fail.
+
+ # Yaml syntax:
+ - action: users
+   groups:
+     - name: plugdev
+       gid: 46
+       system: true
+   users:
+     - name: user
+       uid: 1000
+       group: user
+       groups: [sudo, plugdev]
+       home: /home/user
+       shell: /bin/bash
+       password: $y$j9T$...
+
+Optional properties:
+
+- groups -- list of groups, created before the users. Each group has a 'name'
+and optionally a 'gid'. Set 'system' to create a system group.
+
+- users -- list of users. Each user has a 'name' and optionally:
+  - uid -- user ID.
+  - group -- name of the primary group, it has to exist already or be listed
+    in 'groups'. By default a group named after the user is created.
+  - groups -- supplementary groups, replacing the existing ones of the user.
+  - home -- home directory, created for new users and moved for existing
+    ones. Default '/home/<name>'.
+  - shell -- login shell. Default '/bin/sh' for new users.
+  - password -- hashed password as in /etc/shadow, e.g. from 'mkpasswd'.
+    Clear text passwords aren't supported.
+  - locked -- set to 'true' to lock the password of the user. Mutually
+    exclusive with 'password'.
+  - system -- set to 'true' to create a system user.
+
+At least one of 'groups' or 'users' has to be given. The users and groups are
+managed with 'useradd', 'usermod', 'groupadd' and 'groupmod' from the target
+rootfs.
+*/
+package actions
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/go-debos/debos"
+)
+
+type UsersGroup struct {
+	Name   string
+	Gid    *int
+	System bool
+}
+
+type UsersUser struct {
+	Name     string
+	Uid      *int
+	Group    string
+	Groups   []string
+	Home     string
+	Shell    string
+	Password string
+	Locked   bool
+	System   bool
+}
+
+type UsersAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Groups           []UsersGroup
+	Users            []UsersUser
+}
+
+// Names accepted by useradd and groupadd with the default NAME_REGEX of Debian
+var userNameRegex = regexp.MustCompile(`^[a-z_][-a-z0-9_]*\$?$`)
+
+func (u *UsersAction) Verify(context *debos.DebosContext) error {
+	if len(u.Groups) == 0 && len(u.Users) == 0 {
+		return errors.New("At least one of 'groups' or 'users' properties is needed")
+	}
+
+	for _, g := range u.Groups {
+		if !userNameRegex.MatchString(g.Name) {
+			return fmt.Errorf("Invalid group name '%s'", g.Name)
+		}
+	}
+
+	for _, user := range u.Users {
+		if !userNameRegex.MatchString(user.Name) {
+			return fmt.Errorf("Invalid user name '%s'", user.Name)
+		}
+		for _, g := range append([]string{user.Group}, user.Groups...) {
+			if g != "" && !userNameRegex.MatchString(g) {
+				return fmt.Errorf("Invalid group name '%s' for user %s", g, user.Name)
+			}
+		}
+		if user.Home != "" && !path.IsAbs(user.Home) {
+			return fmt.Errorf("Home of user %s must be an absolute path", user.Name)
+		}
+		if user.Password != "" && !strings.HasPrefix(user.Password, "$") {
+			return fmt.Errorf("Password of user %s must be hashed, e.g. with mkpasswd", user.Name)
+		}
+		if user.Password != "" && user.Locked {
+			return fmt.Errorf("Properties 'password' and 'locked' of user %s are mutually exclusive", user.Name)
+		}
+	}
+
+	return nil
+}
+
+// Entries of /etc/passwd or /etc/group of the rootfs, keyed by name
+func rootfsEntries(context *debos.DebosContext, file string) (map[string][]string, error) {
+	entries := make(map[string][]string)
+
+	data, err := ioutil.ReadFile(path.Join(context.Rootdir, file))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) > 2 {
+			entries[fields[0]] = fields
+		}
+	}
+
+	return entries, nil
+}
+
+func (u *UsersAction) group(c debos.Command, groups map[string][]string, g UsersGroup) error {
+	if _, found := groups[g.Name]; found {
+		if g.Gid == nil || groups[g.Name][2] == strconv.Itoa(*g.Gid) {
+			return nil
+		}
+		return c.Run("users", "groupmod", "--gid", strconv.Itoa(*g.Gid), g.Name)
+	}
+
+	cmd := []string{"groupadd"}
+	if g.Gid != nil {
+		cmd = append(cmd, "--gid", strconv.Itoa(*g.Gid))
+	}
+	if g.System {
+		cmd = append(cmd, "--system")
+	}
+
+	return c.Run("users", append(cmd, g.Name)...)
+}
+
+func (u *UsersAction) user(c debos.Command, users map[string][]string, user UsersUser) error {
+	var cmd []string
+	_, found := users[user.Name]
+
+	if found {
+		cmd = []string{"usermod"}
+		if user.Home != "" && len(users[user.Name]) > 5 && users[user.Name][5] != user.Home {
+			cmd = append(cmd, "--home", user.Home, "--move-home")
+		}
+	} else {
+		cmd = []string{"useradd", "--create-home"}
+		if user.Home != "" {
+			cmd = append(cmd, "--home-dir", user.Home)
+		}
+		if user.Group == "" {
+			cmd = append(cmd, "--user-group")
+		}
+		if user.System {
+			cmd = append(cmd, "--system")
+		}
+	}
+
+	if user.Uid != nil {
+		cmd = append(cmd, "--uid", strconv.Itoa(*user.Uid))
+	}
+	if user.Group != "" {
+		cmd = append(cmd, "--gid", user.Group)
+	}
+	if user.Groups != nil {
+		cmd = append(cmd, "--groups", strings.Join(user.Groups, ","))
+	}
+	if user.Shell != "" {
+		cmd = append(cmd, "--shell", user.Shell)
+	}
+	if user.Password != "" {
+		cmd = append(cmd, "--password", user.Password)
+	}
+	// New users without password are locked by useradd
+	if found && user.Locked {
+		cmd = append(cmd, "--lock")
+	}
+
+	// Nothing to update
+	if len(cmd) == 1 {
+		return nil
+	}
+
+	return c.Run("users", append(cmd, user.Name)...)
+}
+
+func (u *UsersAction) Run(context *debos.DebosContext) error {
+	c := debos.NewChrootCommandForContext(*context)
+
+	groups, err := rootfsEntries(context, "/etc/group")
+	if err != nil {
+		return err
+	}
+
+	for _, g := range u.Groups {
+		if err := u.group(c, groups, g); err != nil {
+			return err
+		}
+	}
+
+	users, err := rootfsEntries(context, "/etc/passwd")
+	if err != nil {
+		return err
+	}
+
+	for _, user := range u.Users {
+		if err := u.user(c, users, user); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,235 @@
+/*
+UsrMerge Action
+
+Check the layout of '/usr' of the filesystem is consistent, and optionally
+repair it. Mixing base tarballs, overlays and packages of different releases
+can leave a partially merged '/usr', e.g. an overlay replacing the '/bin'
+symlink by a directory, which breaks dpkg on Debian releases requiring the
+merged '/usr'.
+
+ # Yaml syntax:
+ - action: usr-merge
+   layout: merged
+   repair: bool
+
+Optional properties:
+
+- layout -- expected layout, 'merged' where '/bin', '/sbin', '/lib' and the
+'/lib*' multilib directories are symlinks to their '/usr' counterparts, or
+'split' where they are directories. Default 'merged'.
+
+- repair -- for the 'merged' layout, move the content of the aliased
+directories to '/usr' and replace them by symlinks, as the 'usrmerge' package
+does. Files present in both places are only accepted if they are identical.
+Default 'false', the inconsistencies fail the action.
+*/
+package actions
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/go-debos/debos"
+)
+
+// Directories of the root aliased to '/usr' on a merged '/usr'
+var usrMergeDirs = []string{"bin", "sbin", "lib", "lib32", "lib64", "libo32", "libx32"}
+
+type UsrMergeAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Layout           string
+	Repair           bool
+}
+
+func NewUsrMergeAction() *UsrMergeAction {
+	return &UsrMergeAction{Layout: "merged"}
+}
+
+func (u *UsrMergeAction) Verify(context *debos.DebosContext) error {
+	switch u.Layout {
+	case "merged":
+	case "split":
+		if u.Repair {
+			return fmt.Errorf("Only the merged layout can be repaired")
+		}
+	default:
+		return fmt.Errorf("Unknown layout '%s', has to be 'merged' or 'split'", u.Layout)
+	}
+
+	return nil
+}
+
+// Problems of a merged '/usr' for the aliased directory, nil if consistent
+func (u *UsrMergeAction) checkMerged(rootdir, dir string) []string {
+	info, err := os.Lstat(path.Join(rootdir, dir))
+	if os.IsNotExist(err) {
+		if _, err := os.Stat(path.Join(rootdir, "usr", dir)); err == nil {
+			return []string{fmt.Sprintf("/%s is missing, it should link to usr/%s", dir, dir)}
+		}
+		return nil
+	} else if err != nil {
+		return []string{err.Error()}
+	}
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, _ := os.Readlink(path.Join(rootdir, dir))
+		if target != "usr/"+dir {
+			return []string{fmt.Sprintf("/%s links to %s instead of usr/%s", dir, target, dir)}
+		}
+		return nil
+	}
+
+	if !info.IsDir() {
+		return []string{fmt.Sprintf("/%s isn't a directory nor a symlink", dir)}
+	}
+
+	problems := []string{fmt.Sprintf("/%s is a directory instead of a symlink to usr/%s", dir, dir)}
+	entries, _ := ioutil.ReadDir(path.Join(rootdir, dir))
+	for _, e := range entries {
+		if _, err := os.Lstat(path.Join(rootdir, "usr", dir, e.Name())); err == nil {
+			problems = append(problems, fmt.Sprintf("/%s/%s is also in /usr/%s", dir, e.Name(), dir))
+		}
+	}
+
+	return problems
+}
+
+func (u *UsrMergeAction) checkSplit(rootdir, dir string) []string {
+	info, err := os.Lstat(path.Join(rootdir, dir))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return []string{err.Error()}
+	}
+
+	if !info.IsDir() {
+		return []string{fmt.Sprintf("/%s isn't a directory on a split /usr", dir)}
+	}
+
+	return nil
+}
+
+// Whether both files are the same, symlinks to the same target or identical content
+func sameFile(a, b string) bool {
+	ia, erra := os.Lstat(a)
+	ib, errb := os.Lstat(b)
+	if erra != nil || errb != nil || ia.Mode() != ib.Mode() {
+		return false
+	}
+
+	switch {
+	case ia.Mode()&os.ModeSymlink != 0:
+		ta, _ := os.Readlink(a)
+		tb, _ := os.Readlink(b)
+		return ta == tb
+	case ia.Mode().IsRegular():
+		ca, erra := ioutil.ReadFile(a)
+		cb, errb := ioutil.ReadFile(b)
+		return erra == nil && errb == nil && bytes.Equal(ca, cb)
+	case ia.IsDir():
+		return true
+	}
+
+	return false
+}
+
+// Move the content of the directory into the one of /usr, recursively
+func mergeDir(source, target string) error {
+	entries, err := ioutil.ReadDir(source)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		src := path.Join(source, e.Name())
+		dst := path.Join(target, e.Name())
+
+		if _, err := os.Lstat(dst); os.IsNotExist(err) {
+			if err := os.Rename(src, dst); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !sameFile(src, dst) {
+			return fmt.Errorf("%s and %s differ", src, dst)
+		}
+		if e.IsDir() {
+			if err := mergeDir(src, dst); err != nil {
+				return err
+			}
+		}
+		if err := os.RemoveAll(src); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (u *UsrMergeAction) repair(rootdir, dir string) error {
+	alias := path.Join(rootdir, dir)
+	info, err := os.Lstat(alias)
+
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return err
+	case info.Mode()&os.ModeSymlink != 0:
+		if err := os.Remove(alias); err != nil {
+			return err
+		}
+	case info.IsDir():
+		if err := os.MkdirAll(path.Join(rootdir, "usr", dir), 0755); err != nil {
+			return err
+		}
+		if err := mergeDir(alias, path.Join(rootdir, "usr", dir)); err != nil {
+			return fmt.Errorf("Failed to merge /%s: %v", dir, strings.Replace(err.Error(), rootdir, "", -1))
+		}
+		if err := os.Remove(alias); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("/%s isn't a directory nor a symlink", dir)
+	}
+
+	log.Printf("Linking /%s to usr/%s", dir, dir)
+	return os.Symlink("usr/"+dir, alias)
+}
+
+func (u *UsrMergeAction) Run(context *debos.DebosContext) error {
+	var problems []string
+
+	for _, dir := range usrMergeDirs {
+		if u.Layout == "split" {
+			problems = append(problems, u.checkSplit(context.Rootdir, dir)...)
+			continue
+		}
+
+		found := u.checkMerged(context.Rootdir, dir)
+		if len(found) == 0 {
+			continue
+		}
+		if !u.Repair {
+			problems = append(problems, found...)
+			continue
+		}
+
+		log.Printf("Repairing /%s: %s", dir, strings.Join(found, ", "))
+		if err := u.repair(context.Rootdir, dir); err != nil {
+			return err
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("Inconsistent %s /usr:\n%s", u.Layout, strings.Join(problems, "\n"))
+	}
+
+	log.Printf("The /usr layout is consistently %s", u.Layout)
+	return nil
+}
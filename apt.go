@@ -0,0 +1,241 @@
+package debos
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+AptCommand runs apt-get in the rootfs of a context. Install reports what was
+installed, so actions and the tools around debos don't have to parse the
+output of apt themselves.
+*/
+type AptCommand struct {
+	cmd     Command
+	label   string
+	rootdir string
+	cache   *AptCacheStats
+}
+
+// Packages installed or changed by APT, taken from its cache or downloaded
+type AptCacheStats struct {
+	Hits   int
+	Misses int
+}
+
+// HitRate is the share of the packages taken from the cache, 0 if none were installed
+func (s AptCacheStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// Options of AptCommand.Install
+type AptInstallOptions struct {
+	Recommends      bool // Install the recommended packages too
+	Unauthenticated bool // Allow packages from unauthenticated sources
+	AllowDowngrades bool // Allow installing older versions than the installed ones
+}
+
+// Outcome of an installation for a package, requested or dependency
+type AptPackageResult struct {
+	Package      string // name:arch
+	From         string // Previously installed version, empty if newly installed
+	Version      string // Installed version, empty if removed
+	DownloadSize int64  // Size of the downloaded .deb, 0 if it was cached
+	Error        string // Why the package couldn't be installed
+}
+
+type AptResult struct {
+	Packages     []AptPackageResult
+	DownloadSize int64
+}
+
+// Failed packages of the result, with their errors
+func (r *AptResult) Errors() []AptPackageResult {
+	var failed []AptPackageResult
+	for _, p := range r.Packages {
+		if p.Error != "" {
+			failed = append(failed, p)
+		}
+	}
+
+	return failed
+}
+
+// Don't show progress update percentages
+var aptConfig = []string{"-o=quiet::NoUpdate=1"}
+
+// Errors of apt-get about a given package, the package being the last submatch
+var aptErrors = []*regexp.Regexp{
+	regexp.MustCompile(`^E: Unable to locate package (\S+)$`),
+	regexp.MustCompile(`^E: Package '(\S+)' has no installation candidate$`),
+	regexp.MustCompile(`^E: Version '.+' for '(\S+)' was not found$`),
+	regexp.MustCompile(`^E: Release '.+' for '(\S+)' was not found$`),
+	regexp.MustCompile(`^ (\S+) : ((?:Pre)?Depends|Conflicts|Breaks): .*$`),
+}
+
+func NewAptCommand(context DebosContext, label string) AptCommand {
+	c := NewChrootCommandForContext(context)
+	c.AddEnv("DEBIAN_FRONTEND=noninteractive")
+
+	return AptCommand{cmd: c, label: label, rootdir: context.Rootdir, cache: &context.AptCache}
+}
+
+func (apt AptCommand) apt(args ...string) error {
+	cmdline := append(append([]string{"apt-get"}, aptConfig...), args...)
+	return apt.cmd.Run(apt.label, cmdline...)
+}
+
+// Update the package lists
+func (apt AptCommand) Update() error {
+	return apt.apt("update")
+}
+
+// Clean the cache of downloaded packages
+func (apt AptCommand) Clean() error {
+	return apt.apt("clean")
+}
+
+func (options AptInstallOptions) args() []string {
+	args := []string{"-y"}
+	if !options.Recommends {
+		args = append(args, "--no-install-recommends")
+	}
+	if options.Unauthenticated {
+		args = append(args, "--allow-unauthenticated")
+	}
+	if options.AllowDowngrades {
+		args = append(args, "--allow-downgrades")
+	}
+
+	return args
+}
+
+// Parse the errors of apt-get, keyed by package
+func parseAptErrors(output []byte) map[string]string {
+	errors := make(map[string]string)
+	for _, line := range strings.Split(string(output), "\n") {
+		for _, r := range aptErrors {
+			m := r.FindStringSubmatch(line)
+			if m == nil {
+				continue
+			}
+			reason := strings.TrimSpace(strings.TrimPrefix(line, "E: "))
+			if errors[m[1]] != "" {
+				reason = errors[m[1]] + "; " + reason
+			}
+			errors[m[1]] = reason
+		}
+	}
+
+	return errors
+}
+
+/*
+Parse the download sizes, keyed by name:arch, from lines of 'apt-get
+--print-uris' like "'http://...' name_version_arch.deb size checksum"
+*/
+func parseAptURIs(output []byte) map[string]int64 {
+	sizes := make(map[string]int64)
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || !strings.HasPrefix(fields[0], "'") || !strings.HasSuffix(fields[1], ".deb") {
+			continue
+		}
+
+		parts := strings.Split(strings.TrimSuffix(fields[1], ".deb"), "_")
+		size, err := strconv.ParseInt(fields[2], 10, 64)
+		if len(parts) != 3 || err != nil {
+			continue
+		}
+		name, _ := url.PathUnescape(parts[0])
+		sizes[name+":"+parts[2]] = size
+	}
+
+	return sizes
+}
+
+/*
+Install installs the packages and their dependencies. The result lists the
+packages installed, upgraded, downgraded or removed, and the sizes of their
+downloads. If the packages can't be installed, the result lists the errors
+reported by apt for each package, if any.
+*/
+func (apt AptCommand) Install(packages []string, options AptInstallOptions) (*AptResult, error) {
+	result := &AptResult{}
+	args := append(options.args(), "install")
+	args = append(args, packages...)
+
+	// Resolve the installation first, for the errors and the download sizes
+	cmdline := append(append([]string{"apt-get"}, aptConfig...), "-qq", "--print-uris")
+	output, err := apt.cmd.CombinedOutput(apt.label, append(cmdline, args...)...)
+	if err != nil {
+		for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+			log.Printf("%s | %s", apt.label, line)
+		}
+
+		errors := parseAptErrors(output)
+		var names []string
+		for p := range errors {
+			names = append(names, p)
+		}
+		sort.Strings(names)
+
+		var reasons []string
+		for _, p := range names {
+			result.Packages = append(result.Packages, AptPackageResult{Package: p, Error: errors[p]})
+			reasons = append(reasons, errors[p])
+		}
+		if len(reasons) > 0 {
+			return result, fmt.Errorf("Failed to install packages: %s", strings.Join(reasons, ", "))
+		}
+		return result, fmt.Errorf("Failed to install packages: %v", err)
+	}
+	sizes := parseAptURIs(output)
+
+	before, err := InstalledPackages(apt.rootdir)
+	if err != nil {
+		return result, err
+	}
+
+	if err := apt.apt(args...); err != nil {
+		return result, err
+	}
+
+	after, err := InstalledPackages(apt.rootdir)
+	if err != nil {
+		return result, err
+	}
+
+	for key, p := range after {
+		if before[key].Version == p.Version {
+			continue
+		}
+		r := AptPackageResult{Package: key, From: before[key].Version, Version: p.Version, DownloadSize: sizes[key]}
+		result.Packages = append(result.Packages, r)
+		result.DownloadSize += r.DownloadSize
+		if r.DownloadSize > 0 {
+			apt.cache.Misses++
+		} else {
+			apt.cache.Hits++
+		}
+	}
+	for key, p := range before {
+		if _, found := after[key]; !found {
+			result.Packages = append(result.Packages, AptPackageResult{Package: key, From: p.Version})
+		}
+	}
+
+	sort.Slice(result.Packages, func(i, j int) bool {
+		return result.Packages[i].Package < result.Packages[j].Package
+	})
+
+	return result, nil
+}
@@ -0,0 +1,140 @@
+package debos
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAptErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		errors map[string]string
+	}{
+		{
+			"unknown package",
+			`Reading package lists...
+Building dependency tree...
+Reading state information...
+E: Unable to locate package hello-world
+`,
+			map[string]string{"hello-world": "Unable to locate package hello-world"},
+		},
+		{
+			"no installation candidate",
+			`Reading package lists...
+Building dependency tree...
+Reading state information...
+Package python is not available, but is referred to by another package.
+This may mean that the package is missing, has been obsoleted, or
+is only available from another source
+However the following packages replace it:
+  python-is-python3 2to3
+
+E: Package 'python' has no installation candidate
+`,
+			map[string]string{"python": "Package 'python' has no installation candidate"},
+		},
+		{
+			"version and release not found",
+			`Reading package lists...
+Building dependency tree...
+Reading state information...
+E: Version '9.9-1' for 'bash' was not found
+E: Release 'bookworm-backports' for 'linux-image-amd64' was not found
+`,
+			map[string]string{
+				"bash":              "Version '9.9-1' for 'bash' was not found",
+				"linux-image-amd64": "Release 'bookworm-backports' for 'linux-image-amd64' was not found",
+			},
+		},
+		{
+			"unmet dependencies",
+			`Reading package lists...
+Building dependency tree...
+Reading state information...
+Some packages could not be installed. This may mean that you have
+requested an impossible situation or if you are using the unstable
+distribution that some required packages have not yet been created
+or been moved out of Incoming.
+The following information may help to resolve the situation:
+
+The following packages have unmet dependencies:
+ libssl-dev : Depends: libssl3 (= 3.0.11-1~deb12u2) but 3.0.13-1~deb12u1 is to be installed
+ systemd-sysv : Conflicts: sysvinit-core but 3.06-4 is to be installed
+                Breaks: sysvinit-core
+ sysvinit-core : PreDepends: sysvinit-utils (>= 3.06-4) but it is not going to be installed
+E: Unable to correct problems, you have held broken packages.
+`,
+			map[string]string{
+				"libssl-dev":    "libssl-dev : Depends: libssl3 (= 3.0.11-1~deb12u2) but 3.0.13-1~deb12u1 is to be installed",
+				"systemd-sysv":  "systemd-sysv : Conflicts: sysvinit-core but 3.06-4 is to be installed",
+				"sysvinit-core": "sysvinit-core : PreDepends: sysvinit-utils (>= 3.06-4) but it is not going to be installed",
+			},
+		},
+		{
+			"several errors for a package",
+			`E: Version '2.0' for 'hello' was not found
+E: Release 'sid' for 'hello' was not found
+`,
+			map[string]string{"hello": "Version '2.0' for 'hello' was not found; Release 'sid' for 'hello' was not found"},
+		},
+		{
+			"no package errors",
+			`E: Could not open lock file /var/lib/dpkg/lock-frontend - open (13: Permission denied)
+E: Unable to acquire the dpkg frontend lock (/var/lib/dpkg/lock-frontend), are you root?
+`,
+			map[string]string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.errors, parseAptErrors([]byte(test.output)))
+		})
+	}
+}
+
+func TestParseAptURIs(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		sizes  map[string]int64
+	}{
+		{
+			"packages",
+			`'http://deb.debian.org/debian/pool/main/h/hello/hello_2.10-3_amd64.deb' hello_2.10-3_amd64.deb 53276 SHA256:a4d5d2a2fbc8e1d7f7d7e2c49f3a5d2ec3e3b4b8b7c2c1b0f9e8d7c6b5a49382
+'http://deb.debian.org/debian/pool/main/c/ca-certificates/ca-certificates_20230311_all.deb' ca-certificates_20230311_all.deb 153476 SHA256:5308b9bd88eebe2a48be3168cb3d87677aaec5da9c63ad0cf561a29b8219115c
+`,
+			map[string]int64{
+				"hello:amd64":         53276,
+				"ca-certificates:all": 153476,
+			},
+		},
+		{
+			"epochs and plus signs",
+			`'http://deb.debian.org/debian/pool/main/u/util-linux/bsdutils_1%3a2.38.1-5%2bdeb12u1_amd64.deb' bsdutils_1%3a2.38.1-5+deb12u1_amd64.deb 92104 SHA256:0d0fd3e4d2ae1d2e0c8e1b58a4a82dd4a43b8f8e4b39a8fb1ab9d5f3d5b6f8c1
+'http://deb.debian.org/debian/pool/main/libs/libstdc%2b%2b/libstdc%2b%2b6_12.2.0-14_arm64.deb' libstdc++6_12.2.0-14_arm64.deb 613716 SHA256:2b7ad8bb16e0b2c3d0e1f1e3ab2bf0f7a6f8c4e3d2c1b0a9f8e7d6c5b4a39281
+`,
+			map[string]int64{
+				"bsdutils:amd64":   92104,
+				"libstdc++6:arm64": 613716,
+			},
+		},
+		{
+			"not packages",
+			`Reading package lists...
+'http://deb.debian.org/debian/dists/bookworm/InRelease' deb.debian.org_debian_dists_bookworm_InRelease 0
+'http://deb.debian.org/debian/pool/main/h/hello/hello_2.10-3_amd64.deb' hello_2.10-3_amd64.deb unknown SHA256:a4d5
+`,
+			map[string]int64{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.sizes, parseAptURIs([]byte(test.output)))
+		})
+	}
+}
@@ -16,6 +16,8 @@ const (
 	Tar
 	Zip
 	Deb
+	Cpio
+	Rpm
 )
 
 type ArchiveBase struct {
@@ -32,6 +34,12 @@ type ArchiveZip struct {
 type ArchiveDeb struct {
 	ArchiveBase
 }
+type ArchiveCpio struct {
+	ArchiveBase
+}
+type ArchiveRpm struct {
+	ArchiveBase
+}
 
 type Unpacker interface {
 	Unpack(destination string) error
@@ -85,6 +93,7 @@ func tarOptions(compression string) string {
 	unpackTarOpts := map[string]string{
 		"bzip2": "--bzip2",
 		"gz":    "--gzip",
+		"lz4":   "--use-compress-program=lz4",
 		"lzip":  "--lzip",
 		"lzma":  "--lzma",
 		"lzop":  "--lzop",
@@ -189,6 +198,108 @@ func (deb *ArchiveDeb) RelaxedUnpack(destination string) error {
 	return deb.Unpack(destination)
 }
 
+// Decompressors of the cpio archives, by compression type
+var cpioDecompressors = map[string][]string{
+	"bzip2": {"bzip2", "-dc"},
+	"gz":    {"gzip", "-dc"},
+	"lz4":   {"lz4", "-dc"},
+	"lzip":  {"lzip", "-dc"},
+	"lzma":  {"xz", "--format=lzma", "-dc"},
+	"lzop":  {"lzop", "-dc"},
+	"xz":    {"xz", "-dc"},
+	"zstd":  {"zstd", "-dc"},
+}
+
+// Compression types of the cpio archives, guessed from their extension
+var cpioCompressions = map[string]string{
+	".bz2":  "bzip2",
+	".gz":   "gz",
+	".lz4":  "lz4",
+	".lz":   "lzip",
+	".lzma": "lzma",
+	".lzo":  "lzop",
+	".xz":   "xz",
+	".zst":  "zstd",
+}
+
+/*
+Extract the cpio archive written on its standard output by the stream command
+in the destination. Both commands have to succeed.
+*/
+func unpackCpio(stream []string, destination string) error {
+	if err := os.MkdirAll(destination, 0755); err != nil {
+		return err
+	}
+
+	w := newCommandWrapper(stream[0])
+	defer w.flush()
+
+	producer := exec.Command(stream[0], stream[1:]...)
+	producer.Stderr = w
+	archive, err := producer.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := producer.Start(); err != nil {
+		return err
+	}
+
+	cpio := Command{Stdin: archive}
+	err = cpio.Run("unpack", "cpio", "-idm", "--quiet", "--no-absolute-filenames", "-D", destination)
+
+	// Don't leave the producer blocked on a pipe cpio stopped reading
+	archive.Close()
+	if perr := producer.Wait(); perr != nil && err == nil {
+		err = fmt.Errorf("%s failed: %v", stream[0], perr)
+	}
+
+	return err
+}
+
+func (cpio *ArchiveCpio) Unpack(destination string) error {
+	compression, ok := cpio.options["cpiocompression"].(string)
+	if !ok {
+		compression = cpioCompressions[strings.ToLower(filepath.Ext(cpio.file))]
+	}
+
+	stream := []string{"cat", cpio.file}
+	if decompressor, ok := cpioDecompressors[compression]; ok {
+		stream = append(append([]string{}, decompressor...), cpio.file)
+	}
+
+	return unpackCpio(stream, destination)
+}
+
+func (cpio *ArchiveCpio) RelaxedUnpack(destination string) error {
+	return cpio.Unpack(destination)
+}
+
+func (cpio *ArchiveCpio) AddOption(key, value interface{}) error {
+	switch key {
+	case "cpiocompression":
+		compression, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("Wrong type for value")
+		}
+		if _, ok := cpioDecompressors[compression]; !ok {
+			return fmt.Errorf("Compression '%s' is not supported", compression)
+		}
+		cpio.options["cpiocompression"] = compression
+
+	default:
+		return fmt.Errorf("Option '%v' is not supported for cpio archive type", key)
+	}
+	return nil
+}
+
+func (rpm *ArchiveRpm) Unpack(destination string) error {
+	return unpackCpio([]string{"rpm2cpio", rpm.file}, destination)
+}
+
+func (rpm *ArchiveRpm) RelaxedUnpack(destination string) error {
+	return rpm.Unpack(destination)
+}
+
 /*
 NewArchive associate correct structure and methods according to
 archive type. If ArchiveType is omitted -- trying to guess the type.
@@ -202,11 +313,15 @@ func NewArchive(file string, arcType ...ArchiveType) (Archive, error) {
 		ext := filepath.Ext(file)
 		ext = strings.ToLower(ext)
 
-		switch ext {
-		case ".deb":
+		switch {
+		case ext == ".deb":
 			atype = Deb
-		case ".zip":
+		case ext == ".zip":
 			atype = Zip
+		case ext == ".rpm":
+			atype = Rpm
+		case ext == ".cpio" || strings.HasSuffix(strings.TrimSuffix(strings.ToLower(file), ext), ".cpio"):
+			atype = Cpio
 		default:
 			//FIXME: guess Tar maybe?
 			atype = Tar
@@ -227,6 +342,10 @@ func NewArchive(file string, arcType ...ArchiveType) (Archive, error) {
 		archive = Archive{&ArchiveZip{ArchiveBase: common}}
 	case Deb:
 		archive = Archive{&ArchiveDeb{ArchiveBase: common}}
+	case Cpio:
+		archive = Archive{&ArchiveCpio{ArchiveBase: common}}
+	case Rpm:
+		archive = Archive{&ArchiveRpm{ArchiveBase: common}}
 	default:
 		return archive, fmt.Errorf("Unsupported archive '%s'", file)
 	}
@@ -155,3 +155,41 @@ func TestZip(t *testing.T) {
 	err = archive.RelaxedUnpack("/tmp/test")
 	assert.EqualError(t, err, "exit status 9")
 }
+
+func TestCpio(t *testing.T) {
+	// Guess cpio, compressed or not
+	for _, file := range []string{"test.cpio", "test.cpio.gz", "test.CPIO.zst"} {
+		archive, err := debos.NewArchive(file)
+		assert.NotEmpty(t, archive)
+		assert.Empty(t, err)
+		assert.Equal(t, debos.Cpio, archive.Type())
+	}
+
+	// Force cpio type
+	archive, err := debos.NewArchive("initrd.img", debos.Cpio)
+	assert.NotEmpty(t, archive)
+	assert.Empty(t, err)
+	assert.Equal(t, debos.Cpio, archive.Type())
+
+	// Compression override
+	err = archive.AddOption("cpiocompression", "zstd")
+	assert.Empty(t, err)
+	err = archive.AddOption("cpiocompression", "rar")
+	assert.EqualError(t, err, "Compression 'rar' is not supported")
+	err = archive.AddOption("taroptions", []string{"--overwrite"})
+	assert.EqualError(t, err, "Option 'taroptions' is not supported for cpio archive type")
+
+	err = archive.Unpack("/proc/debostest")
+	assert.EqualError(t, err, "mkdir /proc/debostest: no such file or directory")
+}
+
+func TestRpm(t *testing.T) {
+	// Guess rpm
+	archive, err := debos.NewArchive("test.rpm")
+	assert.NotEmpty(t, archive)
+	assert.Empty(t, err)
+	assert.Equal(t, debos.Rpm, archive.Type())
+
+	err = archive.Unpack("/proc/debostest")
+	assert.EqualError(t, err, "mkdir /proc/debostest: no such file or directory")
+}
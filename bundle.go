@@ -0,0 +1,68 @@
+package debos
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+)
+
+/*
+A recipe bundle is a tarball of a recipe directory, e.g. a shared base recipe
+with its overlays and scripts, with a detached OpenPGP signature next to it
+named after the bundle with the '.sig' suffix.
+*/
+
+// BundleSignature returns the name of the detached signature of a bundle
+func BundleSignature(bundle string) string {
+	return bundle + ".sig"
+}
+
+/*
+CreateBundle packs the content of dir into the bundle and signs it with the
+given key, or the default key of gpg if empty.
+*/
+func CreateBundle(dir, bundle, key string) error {
+	err := Command{}.Run("Packing recipe bundle", "tar", "--sort=name",
+		"--owner=0", "--group=0", "--numeric-owner", "--exclude-vcs",
+		"-czf", bundle, "-C", dir, ".")
+	if err != nil {
+		return err
+	}
+
+	cmdline := []string{"gpg", "--batch", "--yes", "--detach-sign"}
+	if key != "" {
+		cmdline = append(cmdline, "--local-user", key)
+	}
+	cmdline = append(cmdline, "--output", BundleSignature(bundle), bundle)
+
+	return Command{}.Run("Signing recipe bundle", cmdline...)
+}
+
+/*
+VerifyBundle checks the signature of the bundle against the keys of the
+keyring and returns the fingerprint of the signing key.
+*/
+func VerifyBundle(bundle, keyring string) (string, error) {
+	if _, err := os.Stat(keyring); err != nil {
+		return "", err
+	}
+
+	// gpgv fails unless the signature is valid and made by a key of the keyring
+	out, err := Command{}.Output("gpgv", "gpgv", "--keyring", keyring,
+		"--status-fd", "1", BundleSignature(bundle), bundle)
+	if err != nil {
+		return "", fmt.Errorf("Invalid signature of recipe bundle %s: %v", bundle, err)
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 2 && fields[0] == "[GNUPG:]" && fields[1] == "VALIDSIG" {
+			return fields[2], nil
+		}
+	}
+
+	return "", fmt.Errorf("No valid signature of recipe bundle %s", bundle)
+}
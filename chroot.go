@@ -0,0 +1,133 @@
+package debos
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"syscall"
+)
+
+// Device nodes of the host available in /dev when using CHROOT_METHOD_CHROOT
+var ChrootDevices = []string{
+	"null", "zero", "full", "random", "urandom", "tty",
+}
+
+/*
+Mounts of the minimal environment set up in the rootfs for CHROOT_METHOD_CHROOT:
+a private /dev with only the allowed device nodes, /proc and a read-only /sys.
+This doesn't depend on the device nodes the rootfs may contain, which are
+missing when it was created without mknod.
+*/
+type chrootMounts struct {
+	root    string
+	mounted []string // In mount order
+}
+
+func (m *chrootMounts) mount(source, target, fstype string, flags uintptr, data string) error {
+	target = path.Join(m.root, target)
+	if err := syscall.Mount(source, target, fstype, flags, data); err != nil {
+		return fmt.Errorf("Failed to mount %s on %s: %v", source, target, err)
+	}
+
+	m.mounted = append(m.mounted, target)
+	return nil
+}
+
+// Bind mount a device node of the host, creating the mount point
+func (m *chrootMounts) bindDevice(name string) error {
+	source := path.Join("/dev", name)
+	if _, err := os.Stat(source); os.IsNotExist(err) {
+		return nil
+	}
+
+	f, err := os.OpenFile(path.Join(m.root, "dev", name), os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	f.Close()
+
+	return m.mount(source, path.Join("dev", name), "", syscall.MS_BIND, "")
+}
+
+func setupChrootMounts(root string, devices []string) (*chrootMounts, error) {
+	m := &chrootMounts{root: root}
+
+	err := func() error {
+		for _, dir := range []string{"dev", "proc", "sys"} {
+			if err := os.MkdirAll(path.Join(root, dir), 0755); err != nil {
+				return err
+			}
+		}
+
+		if err := m.mount("tmpfs", "dev", "tmpfs", syscall.MS_NOSUID, "mode=0755"); err != nil {
+			return err
+		}
+
+		for _, d := range devices {
+			if err := m.bindDevice(d); err != nil {
+				return err
+			}
+		}
+
+		for _, dir := range []string{"dev/pts", "dev/shm"} {
+			if err := os.Mkdir(path.Join(root, dir), 0755); err != nil {
+				return err
+			}
+		}
+		if err := m.mount("devpts", "dev/pts", "devpts", syscall.MS_NOSUID|syscall.MS_NOEXEC,
+			"newinstance,ptmxmode=0666,mode=0620"); err != nil {
+			return err
+		}
+		if err := m.mount("tmpfs", "dev/shm", "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777"); err != nil {
+			return err
+		}
+
+		links := map[string]string{
+			"fd":     "/proc/self/fd",
+			"stdin":  "/proc/self/fd/0",
+			"stdout": "/proc/self/fd/1",
+			"stderr": "/proc/self/fd/2",
+			"ptmx":   "pts/ptmx",
+		}
+		for name, target := range links {
+			if err := os.Symlink(target, path.Join(root, "dev", name)); err != nil {
+				return err
+			}
+		}
+
+		if err := m.mount("proc", "proc", "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, ""); err != nil {
+			return err
+		}
+
+		return m.mount("sysfs", "sys", "sysfs",
+			syscall.MS_RDONLY|syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "")
+	}()
+
+	if err != nil {
+		m.teardown()
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// Unmount in reverse order and check nothing is left mounted
+func (m *chrootMounts) teardown() error {
+	var failed []string
+
+	for idx := len(m.mounted) - 1; idx >= 0; idx-- {
+		if err := syscall.Unmount(m.mounted[idx], 0); err != nil {
+			// Leave the environment usable even if a process is left behind
+			if err := syscall.Unmount(m.mounted[idx], syscall.MNT_DETACH); err != nil {
+				failed = append(failed, m.mounted[idx])
+			}
+		}
+	}
+	m.mounted = nil
+
+	if len(failed) > 0 {
+		return fmt.Errorf("Failed to unmount %v", failed)
+	}
+
+	return nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/go-debos/debos/actions"
+	"github.com/go-debos/fakemachine"
+)
+
+// Backends tried in order by "auto", qemu being too slow to be picked implicitly
+var autoBackends = []string{"kvm", "uml"}
+
+/*
+Directory of the kernel modules booted by the backend, as found by
+fakemachine: the ones of the user-mode-linux package for uml, otherwise the
+ones of the running kernel or the ones of the latest kernel version in
+/lib/modules.
+*/
+func backendModuleDir(backend string) (string, error) {
+	if backend == "uml" {
+		dirs, err := ioutil.ReadDir("/usr/lib/uml/modules")
+		if err != nil || len(dirs) != 1 {
+			return "", fmt.Errorf("user-mode-linux modules not found")
+		}
+		return path.Join("/usr/lib/uml/modules", dirs[0].Name()), nil
+	}
+
+	release, err := ioutil.ReadFile("/proc/sys/kernel/osrelease")
+	if err == nil {
+		moddir := path.Join("/lib/modules", strings.TrimSpace(string(release)))
+		if _, err := os.Stat(moddir); err == nil {
+			return moddir, nil
+		}
+	}
+
+	dirs, err := ioutil.ReadDir("/lib/modules")
+	if err != nil || len(dirs) == 0 {
+		return "", fmt.Errorf("No kernel modules found in /lib/modules")
+	}
+
+	latest := dirs[0].Name()
+	for _, dir := range dirs[1:] {
+		if kernelVersionLess(latest, dir.Name()) {
+			latest = dir.Name()
+		}
+	}
+
+	return path.Join("/lib/modules", latest), nil
+}
+
+/*
+Compare kernel versions such as '6.1.0-9-amd64' and '6.1.0-18-amd64', the
+runs of digits being compared as numbers and the rest as strings.
+*/
+func kernelVersionLess(a, b string) bool {
+	for a != "" && b != "" {
+		ra, rb := versionRun(a), versionRun(b)
+		a, b = a[len(ra):], b[len(rb):]
+
+		na, erra := strconv.Atoi(ra)
+		nb, errb := strconv.Atoi(rb)
+		switch {
+		case erra == nil && errb == nil && na != nb:
+			return na < nb
+		case (erra != nil || errb != nil) && ra != rb:
+			return ra < rb
+		}
+	}
+
+	return len(a) < len(b)
+}
+
+// Leading run of digits or of other characters of a version
+func versionRun(v string) string {
+	digit := unicode.IsDigit(rune(v[0]))
+	for idx, c := range v {
+		if unicode.IsDigit(c) != digit {
+			return v[:idx]
+		}
+	}
+
+	return v
+}
+
+// Module name as modprobe compares them
+func moduleName(file string) string {
+	name := path.Base(file)
+	if idx := strings.Index(name, ".ko"); idx >= 0 {
+		name = name[:idx]
+	}
+
+	return strings.ReplaceAll(name, "-", "_")
+}
+
+// Required modules neither built in the kernel nor loadable from the directory
+func missingModules(moddir string, modules []string) ([]string, error) {
+	available := map[string]bool{}
+
+	for _, index := range []string{"modules.builtin", "modules.dep"} {
+		f, err := os.Open(path.Join(moddir, index))
+		if err != nil {
+			return nil, err
+		}
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			file := strings.SplitN(scanner.Text(), ":", 2)[0]
+			available[moduleName(file)] = true
+		}
+		f.Close()
+
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	var missing []string
+	for _, module := range modules {
+		if !available[moduleName(module)] {
+			missing = append(missing, module)
+		}
+	}
+
+	return missing, nil
+}
+
+/*
+Create the fakemachine with the backend given on the command line, checked
+against the requirements of the recipe, or with the first of the backends
+acceptable for the recipe which is supported by the host.
+*/
+func newMachine(backend string, requirements *actions.RecipeFakemachine) (*fakemachine.Machine, error) {
+	if requirements == nil {
+		return fakemachine.NewMachineWithBackend(backend)
+	}
+
+	candidates := requirements.Backends
+	if len(candidates) == 0 {
+		candidates = autoBackends
+	}
+
+	if backend != "auto" {
+		acceptable := false
+		for _, candidate := range candidates {
+			acceptable = acceptable || candidate == backend
+		}
+		if !acceptable && len(requirements.Backends) > 0 {
+			return nil, fmt.Errorf("The %s backend isn't acceptable for the recipe, use one of %s",
+				backend, strings.Join(requirements.Backends, ", "))
+		}
+		candidates = []string{backend}
+	}
+
+	var failures []string
+	for _, candidate := range candidates {
+		if len(requirements.KernelModules) > 0 {
+			moddir, err := backendModuleDir(candidate)
+			if err != nil {
+				failures = append(failures, fmt.Sprintf("%s: %v", candidate, err))
+				continue
+			}
+
+			missing, err := missingModules(moddir, requirements.KernelModules)
+			if err != nil {
+				failures = append(failures, fmt.Sprintf("%s: %v", candidate, err))
+				continue
+			}
+			if len(missing) > 0 {
+				failures = append(failures, fmt.Sprintf("%s: kernel modules %s not available in %s",
+					candidate, strings.Join(missing, ", "), moddir))
+				continue
+			}
+		}
+
+		m, err := fakemachine.NewMachineWithBackend(candidate)
+		if err != nil {
+			failures = append(failures, err.Error())
+			continue
+		}
+
+		log.Printf("Using the %s fakemachine backend\n", candidate)
+		return m, nil
+	}
+
+	return nil, fmt.Errorf("No fakemachine backend meets the requirements of the recipe: %s",
+		strings.Join(failures, "; "))
+}
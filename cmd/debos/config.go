@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/go-debos/fakemachine"
+	"github.com/jessevdk/go-flags"
+	"gopkg.in/yaml.v2"
+)
+
+/*
+Config holds default command line options read from the user configuration
+(~/.config/debos/config.yaml) or the project configuration (.debos.yaml in
+the current directory). Options are named after the long command line options:
+
+ options:
+   fakemachine-backend: kvm
+   memory: 4Gb
+   environ-var:
+     http_proxy: http://proxy.example.com:3128
+ profiles:
+   ci:
+     cpus: 8
+     verbose: true
+
+Project options override user options, options from the selected profile
+override both and the command line overrides everything. Boolean options are
+given a value, e.g. '--verbose=false', so they can be disabled again.
+*/
+type Config struct {
+	Options  map[string]interface{}
+	Profiles map[string]map[string]interface{}
+}
+
+const projectConfigFile = ".debos.yaml"
+
+func configFiles() []string {
+	files := []string{}
+
+	if dir, err := os.UserConfigDir(); err == nil {
+		files = append(files, path.Join(dir, "debos", "config.yaml"))
+	}
+
+	if cwd, err := os.Getwd(); err == nil {
+		files = append(files, path.Join(cwd, projectConfigFile))
+	}
+
+	return files
+}
+
+func loadConfig(file string) (*Config, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	config := Config{}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+
+	return &config, nil
+}
+
+// Convert configured options to command line arguments
+func optionArgs(parser *flags.Parser, file string, options map[string]interface{}) ([]string, error) {
+	var args []string
+
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if name == "profile" || parser.FindOptionByLongName(name) == nil {
+			return nil, fmt.Errorf("%s: unknown option '%s'", file, name)
+		}
+
+		switch value := options[name].(type) {
+		case map[interface{}]interface{}:
+			keys := make([]string, 0, len(value))
+			for k := range value {
+				keys = append(keys, fmt.Sprint(k))
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				args = append(args, fmt.Sprintf("--%s=%s:%v", name, k, value[k]))
+			}
+		case []interface{}:
+			for _, v := range value {
+				args = append(args, fmt.Sprintf("--%s=%v", name, v))
+			}
+		default:
+			args = append(args, fmt.Sprintf("--%s=%v", name, value))
+		}
+	}
+
+	return args, nil
+}
+
+/*
+configArgs returns the command line arguments defined by the configuration
+files for the given profile. These should be prepended to the user supplied
+arguments so the latter take precedence.
+*/
+func configArgs(parser *flags.Parser, profile string) ([]string, error) {
+	var args []string
+	var profileArgs []string
+	profileFound := false
+
+	/* The outer debos passes the resulting options to the fakemachine */
+	if fakemachine.InMachine() {
+		return nil, nil
+	}
+
+	for _, file := range configFiles() {
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			continue
+		}
+
+		config, err := loadConfig(file)
+		if err != nil {
+			return nil, err
+		}
+
+		a, err := optionArgs(parser, file, config.Options)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, a...)
+
+		if p, found := config.Profiles[profile]; found && profile != "" {
+			a, err = optionArgs(parser, file, p)
+			if err != nil {
+				return nil, err
+			}
+			profileArgs = append(profileArgs, a...)
+			profileFound = true
+		}
+	}
+
+	if profile != "" && !profileFound {
+		return nil, fmt.Errorf("Profile '%s' not found in configuration", profile)
+	}
+
+	return append(args, profileArgs...), nil
+}
@@ -1,13 +1,19 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"path"
+	"regexp"
 	"runtime/debug"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/docker/go-units"
 	"github.com/go-debos/debos"
@@ -18,6 +24,17 @@ import (
 
 var Version string
 
+// Telemetry of the build, nil unless traces or metrics are exported
+var tel *telemetry
+
+// Exit status of the builds stopped by --max-build-time, as timeout(1)
+const deadlineExitCode = 124
+
+var (
+	buildDeadline         time.Time // Zero unless --max-build-time is given
+	innerDeadlineExceeded bool      // The fakemachine was stopped by the deadline
+)
+
 func GetDeterminedVersion(version string) string {
 	DeterminedVersion := "unknown"
 
@@ -54,20 +71,86 @@ func GetDeterminedVersion(version string) string {
 }
 
 func handleError(context *debos.DebosContext, err error, a debos.Action, stage string) bool {
+	// Stop at the first action done after the deadline, even if it succeeded
+	if err == nil && debos.DeadlineExceeded() {
+		err = debos.ErrDeadlineExceeded
+	}
+
 	if err == nil {
 		return false
 	}
 
 	context.State = debos.Failed
 	log.Printf("Action `%s` failed at stage %s, error: %s", a, stage, err)
-	debos.DebugShell(*context)
+	if buildFailure == "" {
+		buildFailure = fmt.Sprintf("Action `%s` failed at stage %s, error: %s", a, stage, err)
+	}
+
+	// Nobody waits for the shell of a build running out of time
+	if !debos.DeadlineExceeded() {
+		debos.DebugShell(*context)
+	}
+	return true
+}
+
+// Finalize the outputs of the actions, once all their PostMachine succeeded
+func finalizeActions(r actions.Recipe, context *debos.DebosContext) bool {
+	for _, a := range r.Actions {
+		f, ok := a.Action.(debos.FinalizingAction)
+		if !ok {
+			continue
+		}
+
+		done := stage(context, a, "Finalize")
+		err := f.Finalize(context)
+		done(err)
+		if handleError(context, err, a, "Finalize") {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Rename and remove the artifacts declared in the recipe, once the build succeeded
+func finalizeArtifacts(r actions.Recipe, context *debos.DebosContext) bool {
+	if err := r.FinalizeArtifacts(context); err != nil {
+		context.State = debos.Failed
+		log.Printf("Failed to finalize the artifacts: %v", err)
+		if buildFailure == "" {
+			buildFailure = fmt.Sprintf("Failed to finalize the artifacts: %v", err)
+		}
+		return false
+	}
+
 	return true
 }
 
 func do_run(r actions.Recipe, context *debos.DebosContext) bool {
 	for _, a := range r.Actions {
 		log.Printf("==== %s ====\n", a)
+
+		var before map[string]debos.DpkgPackage
+		if context.Manifest != nil {
+			before, _ = debos.InstalledPackages(context.Rootdir)
+		}
+
+		done := stage(context, a, "Run")
 		err := a.Run(context)
+		done(err)
+
+		// Fail as soon as an action installs packages not matching the lock
+		if err == nil && context.Lock != nil {
+			err = context.Lock.InstalledPackages(context.Rootdir)
+		}
+
+		// The rootdir may change during the action, e.g. filesystem-deploy
+		if context.Manifest != nil && before != nil {
+			after, perr := debos.InstalledPackages(context.Rootdir)
+			if perr == nil {
+				context.Manifest.AddTransaction(a.String(), before, after)
+			}
+		}
 
 		// This does not stop the call of stacked Cleanup methods for other Actions
 		// Stack Cleanup methods
@@ -82,6 +165,18 @@ func do_run(r actions.Recipe, context *debos.DebosContext) bool {
 	return true
 }
 
+var buildIDRegex = regexp.MustCompile(`^[a-zA-Z0-9._-]+$`)
+
+// Random identifier of the build, unless given with --build-id
+func newBuildID() string {
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		return strconv.Itoa(os.Getpid())
+	}
+
+	return hex.EncodeToString(id)
+}
+
 func warnLocalhost(variable string, value string) {
 	message := `WARNING: Environment variable %[1]s contains a reference to
 		    localhost. This may not work when running from fakemachine.
@@ -96,23 +191,50 @@ func warnLocalhost(variable string, value string) {
 
 
 func main() {
-	context := debos.DebosContext { &debos.CommonContext{}, "", "", 512 }
+	context := debos.DebosContext { &debos.CommonContext{}, "", "", 512, nil }
 	var options struct {
 		Backend       string            `short:"b" long:"fakemachine-backend" description:"Fakemachine backend to use" default:"auto"`
 		ArtifactDir   string            `long:"artifactdir" description:"Directory for packed archives and ostree repositories (default: current directory)"`
 		InternalImage string            `long:"internal-image" hidden:"true"`
+		InternalTraceParent string      `long:"internal-trace-parent" hidden:"true"`
+		InternalInstance string         `long:"internal-instance" hidden:"true"`
+		InternalFailureFile string      `long:"internal-failure-file" hidden:"true"`
 		TemplateVars  map[string]string `short:"t" long:"template-var" description:"Template variables (use -t VARIABLE:VALUE syntax)"`
 		DebugShell    bool              `long:"debug-shell" description:"Fall into interactive shell on error"`
 		Shell         string            `short:"s" long:"shell" description:"Redefine interactive shell binary (default: bash)" optionsl:"" default:"/bin/bash"`
 		ScratchSize   string            `long:"scratchsize" description:"Size of disk-backed scratch space (parsed with human-readable suffix; assumed bytes if no suffix)"`
-		CPUs          int               `short:"c" long:"cpus" description:"Number of CPUs to use for build VM (default: 2)"`
-		Memory        string            `short:"m" long:"memory" description:"Amount of memory for build VM (parsed with human-readable suffix; assumed bytes if no suffix. default: 2Gb)"`
+		CPUs          int               `short:"c" long:"cpus" description:"Number of CPUs to use for build VM (default: recipe resources or 2)"`
+		Memory        string            `short:"m" long:"memory" description:"Amount of memory for build VM (parsed with human-readable suffix; assumed bytes if no suffix. default: recipe resources or 2Gb)"`
 		ShowBoot      bool              `long:"show-boot" description:"Show boot/console messages from the fake machine"`
 		EnvironVars   map[string]string `short:"e" long:"environ-var" description:"Environment variables (use -e VARIABLE:VALUE syntax)"`
 		Verbose       bool              `short:"v" long:"verbose" description:"Verbose output"`
 		PrintRecipe   bool              `long:"print-recipe" description:"Print final recipe"`
-		DryRun        bool              `long:"dry-run" description:"Compose final recipe to build but without any real work started"`
+		DryRun        bool              `long:"dry-run" description:"Compose final recipe to build and print the plan of the actions, but without any real work started"`
 		DisableFakeMachine bool         `long:"disable-fakemachine" description:"Do not use fakemachine."`
+		Profile       string            `long:"profile" description:"Use the named profile from the configuration files"`
+		NotifyWebhook []string          `long:"notify-webhook" description:"URL to POST a JSON build summary to on completion (may be repeated)"`
+		NotifyDesktop bool              `long:"notify-desktop" description:"Send a desktop notification on completion"`
+		OTLPEndpoint  string            `long:"otlp-endpoint" description:"Export per action traces to this OTLP/HTTP collector endpoint"`
+		Pushgateway   string            `long:"metrics-pushgateway" description:"Push build metrics to this Prometheus pushgateway"`
+		Watch         bool              `long:"watch" description:"Re-run affected actions when the recipe, overlays or scripts change (implies running on the host)"`
+		SnapshotCompression string      `long:"snapshot-compression" description:"Compression of the rootfs snapshots taken by --watch" choice:"zstd" choice:"none" default:"zstd"`
+		SnapshotZstdLevel int           `long:"snapshot-zstd-level" description:"zstd compression level of the snapshots" default:"3"`
+		SnapshotZstdThreads int         `long:"snapshot-zstd-threads" description:"zstd compression threads of the snapshots, 0 for one per core" default:"0"`
+		WatchPackages bool              `long:"watch-packages" description:"Only undo the package changes, instead of restoring the rootfs, when --watch restarts from an apt action (the following actions have to be idempotent)"`
+		DumpContext   string            `long:"dump-context" description:"Append the context to this YAML file after each action stage, for debugging"`
+		Manifest      string            `long:"manifest" description:"Write a JSON manifest of the build, including the partitions hashes and packages changes, to this file"`
+		VerifyManifest string           `long:"verify-manifest" description:"Fail if the partitions hashes differ from the ones of this manifest (requires --manifest)"`
+		Profiling     bool              `long:"profiling" description:"Report the slowest actions and suggest recipe optimizations at the end of the build"`
+		AptProxy      string            `long:"apt-proxy" description:"APT proxy URL used for bootstrapping and in the chroot during the build, 'auto' to detect an apt-cacher-ng"`
+		UpdateLock    bool              `long:"update-lock" description:"Record the checksums of the downloads and the installed packages versions in the lock file"`
+		Locked        bool              `long:"locked" description:"Fail if a download or an installed package doesn't match the lock file"`
+		LockFile      string            `long:"lock-file" description:"Lock file used by --update-lock and --locked (default: debos.lock next to the recipe)"`
+		BuildID       string            `long:"build-id" description:"Identifier of the build shown in the logs, reports and temporary paths, to tell concurrent builds apart (default: random)"`
+		Bundle        string            `long:"bundle" description:"Pack the directory of the recipe into this signed recipe bundle instead of building it"`
+		BundleKey     string            `long:"bundle-key" description:"OpenPGP key signing the recipe bundle (default: the default key of gpg)"`
+		LintFormat    string            `long:"lint-format" description:"Format of the diagnostics of 'debos lint'" choice:"text" choice:"json" default:"text"`
+		MigrateWrite  bool              `long:"migrate-write" description:"Rewrite the recipes given to 'debos migrate' instead of only printing the diff"`
+		MaxBuildTime  string            `long:"max-build-time" description:"Stop the build, cleaning up, once it ran for this duration, e.g. '2h', and exit with status 124"`
 		Version       bool              `long:"version" description:"Print debos version"`
 	}
 
@@ -131,15 +253,32 @@ func main() {
 	// Allow to run all deferred calls prior to os.Exit()
 	defer func(context debos.DebosContext) {
 		if context.State == debos.Failed {
+			if debos.DeadlineExceeded() || innerDeadlineExceeded {
+				os.Exit(deadlineExitCode)
+			}
 			os.Exit(1)
 		}
 	}(context)
 
-	parser := flags.NewParser(&options, flags.Default)
+	parser := flags.NewParser(&options, flags.Default|flags.AllowBoolValues)
 	fakemachineBackends := parser.FindOptionByLongName("fakemachine-backend")
 	fakemachineBackends.Choices = fakemachine.BackendNames()
 
-	args, err := parser.Parse()
+	// Only look for the profile first, the configuration is parsed together
+	// with the command line so the latter can override it
+	var profileOptions struct {
+		Profile string `long:"profile"`
+	}
+	flags.NewParser(&profileOptions, flags.IgnoreUnknown).ParseArgs(os.Args[1:])
+
+	cfgArgs, err := configArgs(parser, profileOptions.Profile)
+	if err != nil {
+		log.Println(err)
+		context.State = debos.Failed
+		return
+	}
+
+	args, err := parser.ParseArgs(append(cfgArgs, os.Args[1:]...))
 	if err != nil {
 		flagsErr, ok := err.(*flags.Error)
 		if ok && flagsErr.Type == flags.ErrHelp {
@@ -155,6 +294,26 @@ func main() {
 		return
 	}
 
+	if len(args) > 0 && args[0] == "lint" {
+		if len(args) == 1 {
+			log.Println("No recipe given!")
+			context.State = debos.Failed
+		} else if !lint(args[1:], options.TemplateVars, options.LintFormat) {
+			context.State = debos.Failed
+		}
+		return
+	}
+
+	if len(args) > 0 && args[0] == "migrate" {
+		if len(args) == 1 {
+			log.Println("No recipe given!")
+			context.State = debos.Failed
+		} else if !migrate(args[1:], options.MigrateWrite) {
+			context.State = debos.Failed
+		}
+		return
+	}
+
 	if len(args) != 1 {
 		log.Println("No recipe given!")
 		context.State = debos.Failed
@@ -167,6 +326,59 @@ func main() {
 		return
 	}
 
+	if args[0] == "selftest" {
+		var selftestOptions []string
+		if options.DisableFakeMachine {
+			selftestOptions = append(selftestOptions, "--disable-fakemachine")
+		} else {
+			selftestOptions = append(selftestOptions, "--fakemachine-backend", options.Backend)
+		}
+		if options.CPUs != 0 {
+			selftestOptions = append(selftestOptions, "--cpus", strconv.Itoa(options.CPUs))
+		}
+		if options.Memory != "" {
+			selftestOptions = append(selftestOptions, "--memory", options.Memory)
+		}
+		if options.ScratchSize != "" {
+			selftestOptions = append(selftestOptions, "--scratchsize", options.ScratchSize)
+		}
+
+		if !selftest(selftestOptions, options.Verbose) {
+			context.State = debos.Failed
+		}
+		return
+	}
+
+	if options.Bundle != "" {
+		err := debos.CreateBundle(path.Dir(debos.CleanPath(args[0])), debos.CleanPath(options.Bundle), options.BundleKey)
+		if err != nil {
+			log.Println(err)
+			context.State = debos.Failed
+		}
+		return
+	}
+
+	context.BuildID = options.BuildID
+	if context.BuildID == "" {
+		context.BuildID = newBuildID()
+	} else if !buildIDRegex.MatchString(context.BuildID) {
+		log.Printf("Invalid build ID '%s', letters, digits, '.', '_' and '-' are allowed", context.BuildID)
+		context.State = debos.Failed
+		return
+	}
+	log.SetPrefix("[" + context.BuildID + "] ")
+
+	if options.MaxBuildTime != "" {
+		maxBuildTime, err := time.ParseDuration(options.MaxBuildTime)
+		if err != nil || maxBuildTime <= 0 {
+			log.Printf("Invalid maximum build time '%s', e.g. '90m' or '2h' is expected", options.MaxBuildTime)
+			context.State = debos.Failed
+			return
+		}
+		buildDeadline = time.Now().Add(maxBuildTime)
+		debos.SetBuildDeadline(maxBuildTime)
+	}
+
 	// Set interactive shell binary only if '--debug-shell' options passed
 	if options.DebugShell {
 		context.DebugShell = options.Shell
@@ -183,6 +395,91 @@ func main() {
 	file := args[0]
 	file = debos.CleanPath(file)
 
+	notifying := len(options.NotifyWebhook) > 0 || options.NotifyDesktop
+	if notifying && !fakemachine.InMachine() {
+		start := time.Now()
+		defer func() {
+			notify(options.NotifyWebhook, options.NotifyDesktop, newBuildSummary(file, &context, start))
+		}()
+	}
+
+	// Hand the failure over to the debos notifying outside of the fakemachine
+	if options.InternalFailureFile != "" {
+		defer func() {
+			if context.State == debos.Failed && buildFailure != "" {
+				ioutil.WriteFile(options.InternalFailureFile, []byte(buildFailure), 0644)
+			}
+		}()
+	}
+
+	if options.OTLPEndpoint != "" || options.Pushgateway != "" {
+		instance := options.InternalInstance
+		if instance == "" {
+			instance, _ = os.Hostname()
+		}
+		tel, err = newTelemetry(options.InternalTraceParent, instance)
+		if err != nil {
+			log.Println(err)
+			context.State = debos.Failed
+			return
+		}
+
+		defer func() {
+			tel.finish(&context)
+			if !fakemachine.InMachine() {
+				tel.recordArtifacts(context.Artifactdir)
+			}
+			if options.OTLPEndpoint != "" {
+				if err := tel.exportOTLP(options.OTLPEndpoint); err != nil {
+					log.Printf("Failed to export traces: %v", err)
+				}
+			}
+			if options.Pushgateway != "" {
+				if err := tel.pushPrometheus(options.Pushgateway); err != nil {
+					log.Printf("Failed to push metrics: %v", err)
+				}
+			}
+		}()
+	}
+
+	if options.DumpContext != "" {
+		dumper = &contextDumper{
+			file:         debos.CleanPath(options.DumpContext),
+			templateVars: options.TemplateVars,
+		}
+
+		// Start from an empty file, the fakemachine appends to it
+		if !fakemachine.InMachine() {
+			if err := ioutil.WriteFile(dumper.file, nil, 0644); err != nil {
+				log.Println(err)
+				context.State = debos.Failed
+				return
+			}
+		}
+	}
+
+	var manifestFile string
+	if options.Manifest != "" {
+		manifestFile = debos.CleanPath(options.Manifest)
+		context.Manifest = &debos.Manifest{BuildID: context.BuildID}
+		defer finishManifest(&context, manifestFile, options.VerifyManifest)
+	} else if options.VerifyManifest != "" {
+		log.Println("--verify-manifest requires --manifest")
+		context.State = debos.Failed
+		return
+	}
+
+	if err := debos.VerifyAptProxy(options.AptProxy); err != nil {
+		log.Println(err)
+		context.State = debos.Failed
+		return
+	}
+	context.AptProxy = options.AptProxy
+
+	if options.Profiling {
+		prof = newProfiler()
+	}
+
 	r := actions.Recipe{}
 	if _, err := os.Stat(file); os.IsNotExist(err) {
 		log.Println(err)
@@ -200,19 +497,32 @@ func main() {
 	 * outer debos creating a temporary directory */
 	context.Scratchdir = "/scratch"
 
+	if options.Watch {
+		if options.Backend != "auto" {
+			log.Println("--watch and --fakemachine-backend are mutually exclusive")
+			context.State = debos.Failed
+			return
+		}
+		if err := checkWatchable(r); err != nil {
+			log.Println(err)
+			context.State = debos.Failed
+			return
+		}
+	}
+
 	var runInFakeMachine = true
 	var m *fakemachine.Machine
-	if options.DisableFakeMachine || fakemachine.InMachine() {
+	if options.DisableFakeMachine || options.Watch || fakemachine.InMachine() {
 		runInFakeMachine = false
 	} else {
 		// attempt to create a fakemachine
-		m, err = fakemachine.NewMachineWithBackend(options.Backend)
+		m, err = newMachine(options.Backend, r.Fakemachine)
 		if err != nil {
 			log.Printf("Couldn't create fakemachine: %v", err)
 
 			/* fallback to running on the host unless the user has chosen
-			 * a specific backend */
-			if options.Backend == "auto" {
+			 * a specific backend or the recipe has requirements */
+			if options.Backend == "auto" && r.Fakemachine == nil {
 				runInFakeMachine = false
 			} else {
 				context.State = debos.Failed
@@ -221,11 +531,16 @@ func main() {
 		}
 	}
 
+	// Only the debos running the actions has a meaningful profile
+	if !runInFakeMachine {
+		defer prof.report(r, &context)
+	}
+
 	// if running on the host create a scratchdir
 	if !runInFakeMachine && !fakemachine.InMachine() {
 		log.Printf("fakemachine not supported, running on the host!")
 		cwd, _ := os.Getwd()
-		context.Scratchdir, err = ioutil.TempDir(cwd, ".debos-")
+		context.Scratchdir, err = ioutil.TempDir(cwd, ".debos-"+context.BuildID+"-")
 		defer os.RemoveAll(context.Scratchdir)
 	}
 
@@ -233,6 +548,30 @@ func main() {
 	context.Image = options.InternalImage
 	context.RecipeDir = path.Dir(file)
 
+	var lockFile string
+	if options.UpdateLock && options.Locked {
+		log.Println("--update-lock and --locked are mutually exclusive")
+		context.State = debos.Failed
+		return
+	} else if options.UpdateLock || options.Locked {
+		lockFile = options.LockFile
+		if lockFile == "" {
+			lockFile = path.Join(context.RecipeDir, "debos.lock")
+		}
+		lockFile = debos.CleanPath(lockFile)
+
+		if options.Locked {
+			context.Lock, err = debos.LoadLock(lockFile, true)
+			if err != nil {
+				log.Println(err)
+				context.State = debos.Failed
+				return
+			}
+		} else {
+			context.Lock = debos.NewLock()
+		}
+	}
+
 	context.Artifactdir = options.ArtifactDir
 	if context.Artifactdir == "" {
 		context.Artifactdir, _ = os.Getwd()
@@ -252,12 +591,29 @@ func main() {
 
 	context.Architecture = r.Architecture
 	context.SectorSize = r.SectorSize
+	context.Target = r.Target
+
+	context.NormalizeOwnership = r.NormalizeOwnership
+	context.Umask = 0022
+	if r.Umask != "" {
+		umask, _ := strconv.ParseUint(r.Umask, 8, 32)
+		context.Umask = os.FileMode(umask)
+		// Inherited by all the commands, in and out of the chroot
+		syscall.Umask(int(umask))
+	}
 
 	context.State = debos.Success
 
 	// Initialize environment variables map
 	context.EnvironVars = make(map[string]string)
 
+	// Toolchain variables of the target, may be overridden below
+	if context.Target != nil {
+		for k, v := range context.Target.Environment() {
+			context.EnvironVars[k] = v
+		}
+	}
+
 	// First add variables from host
 	for _, e := range environ_vars {
 		lowerVar := strings.ToLower(e) // lowercase not really needed
@@ -284,13 +640,16 @@ func main() {
 	}
 
 	for _, a := range r.Actions {
+		done := stage(&context, a, "Verify")
 		err = a.Verify(&context)
+		done(err)
 		if handleError(&context, err, a, "Verify") {
 			return
 		}
 	}
 
 	if options.DryRun {
+		printPlan(r, &context)
 		log.Printf("==== Recipe done (Dry run) ====")
 		return
 	}
@@ -298,13 +657,9 @@ func main() {
 	if runInFakeMachine {
 		var args []string
 
-		if options.Memory == "" {
-			// Set default memory size for fakemachine
-			options.Memory = "2Gb"
-		}
-		memsize, err := units.RAMInBytes(options.Memory)
+		memsize, cpus, err := machineResources(options.Memory, options.CPUs, r.Resources)
 		if err != nil {
-			log.Printf("Couldn't parse memory size: %v\n", err)
+			log.Println(err)
 			context.State = debos.Failed
 			return
 		}
@@ -314,12 +669,7 @@ func main() {
 			log.Printf("WARNING: Memory size of %dMB is less than recommended minimum 256MB\n", memsizeMB)
 		}
 		m.SetMemory(memsizeMB)
-
-		if options.CPUs == 0 {
-			// Set default CPU count for fakemachine
-			options.CPUs = 2
-		}
-		m.SetNumCPUs(options.CPUs)
+		m.SetNumCPUs(cpus)
 		m.SetSectorSize(r.SectorSize)
 
 		if options.ScratchSize != "" {
@@ -360,19 +710,79 @@ func main() {
 			args = append(args, "--environ-var", fmt.Sprintf("%s:%s", k, v))
 		}
 
+		if options.AptProxy != "" {
+			args = append(args, "--apt-proxy", options.AptProxy)
+		}
+
+		if options.Profiling {
+			args = append(args, "--profiling")
+		}
+
+		if lockFile != "" {
+			m.AddVolume(path.Dir(lockFile))
+			args = append(args, "--lock-file", lockFile)
+			if options.Locked {
+				args = append(args, "--locked")
+			} else {
+				args = append(args, "--update-lock")
+			}
+		}
+
+		if dumper != nil {
+			m.AddVolume(path.Dir(dumper.file))
+			args = append(args, "--dump-context", dumper.file)
+		}
+
+		if manifestFile != "" {
+			// Don't pick up a stale manifest if the build fails early
+			os.Remove(manifestFile)
+			m.AddVolume(path.Dir(manifestFile))
+			args = append(args, "--manifest", manifestFile)
+		}
+
+		var failureFile string
+		if notifying {
+			failureFile = path.Join(context.Artifactdir, ".debos-"+context.BuildID+"-failure")
+			defer os.Remove(failureFile)
+			args = append(args, "--internal-failure-file", failureFile)
+		}
+
 		m.AddVolume(context.RecipeDir)
+		args = append(args, "--build-id", context.BuildID)
 		args = append(args, file)
 
+		if tel != nil {
+			args = append(args, "--internal-trace-parent", tel.traceParent())
+			args = append(args, "--internal-instance", tel.instance+"-fakemachine")
+			if options.OTLPEndpoint != "" {
+				args = append(args, "--otlp-endpoint", options.OTLPEndpoint)
+			}
+			if options.Pushgateway != "" {
+				args = append(args, "--metrics-pushgateway", options.Pushgateway)
+			}
+		}
+
 		if options.DebugShell {
 			args = append(args, "--debug-shell")
 			args = append(args, "--shell", fmt.Sprintf("%s", options.Shell))
 		}
 
+		if !buildDeadline.IsZero() {
+			// The fakemachine gets the remaining time, to stop before the outer debos
+			remaining := time.Until(buildDeadline).Round(time.Second)
+			if remaining < time.Second {
+				remaining = time.Second
+			}
+			args = append(args, "--max-build-time", remaining.String())
+		}
+
 		for _, a := range r.Actions {
 			// Stack PostMachineCleanup methods
 			defer a.PostMachineCleanup(&context)
 
+			done := stage(&context, a, "PreMachine")
 			err = a.PreMachine(&context, m, &args)
+			done(err)
 			if handleError(&context, err, a, "PreMachine") {
 				return
 			}
@@ -381,26 +791,56 @@ func main() {
 		// Silence extra output from fakemachine unless the --verbose flag was passed.
 		m.SetQuiet(!options.Verbose)
 
-		exitcode, err := m.RunInMachineWithArgs(args)
+		var exitcode int
+		err = debos.RunUntilDeadline(func() error {
+			var err error
+			exitcode, err = m.RunInMachineWithArgs(args)
+			return err
+		})
 		if err != nil {
 			log.Printf("Couldn't start fakemachine: %v\n", err)
+			buildFailure = fmt.Sprintf("Couldn't start fakemachine: %v", err)
 			context.State = debos.Failed
 			return
 		}
 
 		if exitcode != 0 {
 			log.Printf("fakemachine failed with non-zero exitcode: %d\n", exitcode)
+			innerDeadlineExceeded = exitcode == deadlineExitCode && !buildDeadline.IsZero()
 			context.State = debos.Failed
+			buildFailure = fmt.Sprintf("fakemachine failed with non-zero exitcode: %d", exitcode)
+			if failureFile != "" {
+				if failure, err := ioutil.ReadFile(failureFile); err == nil {
+					buildFailure = string(failure)
+				}
+			}
 			return
 		}
 
+		if manifestFile != "" {
+			// Complete the manifest written in the fakemachine
+			context.Manifest, err = debos.LoadManifest(manifestFile)
+			if err != nil {
+				log.Println(err)
+				context.Manifest = &debos.Manifest{}
+				context.State = debos.Failed
+				return
+			}
+		}
+
 		for _, a := range r.Actions {
+			done := stage(&context, a, "PostMachine")
 			err = a.PostMachine(&context)
+			done(err)
 			if handleError(&context, err, a, "PostMachine") {
 				return
 			}
 		}
 
+		if !finalizeActions(r, &context) || !finalizeArtifacts(r, &context) {
+			return
+		}
+
 		log.Printf("==== Recipe done ====")
 		return
 	}
@@ -410,7 +850,9 @@ func main() {
 			// Stack PostMachineCleanup methods
 			defer a.PostMachineCleanup(&context)
 
+			done := stage(&context, a, "PreNoMachine")
 			err = a.PreNoMachine(&context)
+			done(err)
 			if handleError(&context, err, a, "PreNoMachine") {
 				return
 			}
@@ -427,17 +869,44 @@ func main() {
 		}
 	}
 
+	if options.Watch {
+		compression := snapshotCompression{
+			method:  options.SnapshotCompression,
+			level:   options.SnapshotZstdLevel,
+			threads: options.SnapshotZstdThreads,
+		}
+		do_watch(r, &context, file, options.TemplateVars, compression, options.WatchPackages)
+		return
+	}
+
 	if !do_run(r, &context) {
 		return
 	}
 
+	// When running in fakemachine the inner debos writes the lock
+	if context.Lock != nil && !context.Lock.Enforced() {
+		if err := context.Lock.Save(lockFile); err != nil {
+			log.Printf("Failed to save lock file: %v", err)
+			context.State = debos.Failed
+			return
+		}
+		log.Printf("Lock file written to %s", lockFile)
+	}
+
 	if !fakemachine.InMachine() {
 		for _, a := range r.Actions {
+			done := stage(&context, a, "PostMachine")
 			err = a.PostMachine(&context)
+			done(err)
 			if handleError(&context, err, a, "PostMachine") {
 				return
 			}
 		}
+
+		if !finalizeActions(r, &context) || !finalizeArtifacts(r, &context) {
+			return
+		}
+
 		log.Printf("==== Recipe done ====")
 	}
 }
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/go-debos/debos"
+	"gopkg.in/yaml.v2"
+)
+
+// Snapshot of the context after a stage of an action
+type contextSnapshot struct {
+	Time            string            `yaml:"time"`
+	Action          string            `yaml:"action"`
+	Stage           string            `yaml:"stage"`
+	Error           string            `yaml:"error,omitempty"`
+	State           string            `yaml:"state"`
+	BuildID         string            `yaml:"buildid"`
+	RecipeDir       string            `yaml:"recipedir"`
+	Architecture    string            `yaml:"architecture"`
+	SectorSize      int               `yaml:"sectorsize"`
+	Target          *debos.Target     `yaml:"target,omitempty"`
+	Scratchdir      string            `yaml:"scratchdir"`
+	Rootdir         string            `yaml:"rootdir"`
+	Artifactdir     string            `yaml:"artifactdir"`
+	Downloaddir     string            `yaml:"downloaddir,omitempty"`
+	Image           string            `yaml:"image,omitempty"`
+	ImageMntDir     string            `yaml:"imagemntdir,omitempty"`
+	ImagePartitions []debos.Partition `yaml:"imagepartitions,omitempty"`
+	ImageFSTab      string            `yaml:"imagefstab,omitempty"`
+	ImageKernelRoot string            `yaml:"imagekernelroot,omitempty"`
+	Origins         map[string]string `yaml:"origins"`
+	EnvironVars     map[string]string `yaml:"environvars"`
+	TemplateVars    map[string]string `yaml:"templatevars,omitempty"`
+}
+
+/*
+The context dumper appends a YAML document describing the context to a file
+after each stage of each action, for post-mortem debugging. When running in
+fakemachine, the inner debos appends to the same file.
+*/
+type contextDumper struct {
+	file         string
+	templateVars map[string]string
+}
+
+// Context dumper of the build, nil unless --dump-context is used
+var dumper *contextDumper
+
+func (d *contextDumper) dump(context *debos.DebosContext, a debos.Action, stage string, err error) {
+	if d == nil {
+		return
+	}
+
+	s := contextSnapshot{
+		Time:            time.Now().Format(time.RFC3339),
+		Action:          a.String(),
+		Stage:           stage,
+		State:           "success",
+		BuildID:         context.BuildID,
+		RecipeDir:       context.RecipeDir,
+		Architecture:    context.Architecture,
+		SectorSize:      context.SectorSize,
+		Target:          context.Target,
+		Scratchdir:      context.Scratchdir,
+		Rootdir:         context.Rootdir,
+		Artifactdir:     context.Artifactdir,
+		Downloaddir:     context.Downloaddir,
+		Image:           context.Image,
+		ImageMntDir:     context.ImageMntDir,
+		ImagePartitions: context.ImagePartitions,
+		ImageFSTab:      context.ImageFSTab.String(),
+		ImageKernelRoot: context.ImageKernelRoot,
+		Origins:         context.Origins,
+		EnvironVars:     context.EnvironVars,
+		TemplateVars:    d.templateVars,
+	}
+
+	if context.State != debos.Success {
+		s.State = "failed"
+	}
+	if err != nil {
+		s.Error = err.Error()
+	}
+
+	data, merr := yaml.Marshal(s)
+	if merr != nil {
+		fmt.Fprintf(os.Stderr, "Failed to dump context: %v\n", merr)
+		return
+	}
+
+	f, ferr := os.OpenFile(d.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if ferr != nil {
+		fmt.Fprintf(os.Stderr, "Failed to dump context: %v\n", ferr)
+		return
+	}
+	defer f.Close()
+
+	f.WriteString("---\n")
+	f.Write(data)
+}
+
+/*
+stage tracks a stage of an action for the telemetry, the context dump and the
+profiler, the returned function has to be called with the result of the stage.
+*/
+func stage(context *debos.DebosContext, a debos.Action, name string) func(err error) {
+	done := tel.stage(a, name)
+	start := time.Now()
+
+	return func(err error) {
+		done(err)
+		dumper.dump(context, a, name, err)
+		prof.record(a, time.Since(start))
+	}
+}
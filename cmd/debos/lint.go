@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/go-debos/debos"
+	"github.com/go-debos/debos/actions"
+)
+
+/*
+Lint the recipes and print the diagnostics, either as text or as a JSON list
+for CI. Returns false if an error was found, warnings being only reported.
+*/
+func lint(files []string, templateVars map[string]string, format string) bool {
+	diagnostics := []actions.Diagnostic{}
+	for _, file := range files {
+		diagnostics = append(diagnostics, actions.Lint(debos.CleanPath(file), templateVars)...)
+	}
+
+	if format == "json" {
+		data, _ := json.MarshalIndent(diagnostics, "", "  ")
+		fmt.Println(string(data))
+	} else {
+		for _, d := range diagnostics {
+			fmt.Println(d)
+		}
+	}
+
+	for _, d := range diagnostics {
+		if d.Severity == "error" {
+			return false
+		}
+	}
+
+	return true
+}
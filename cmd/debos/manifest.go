@@ -0,0 +1,64 @@
+package main
+
+import (
+	"log"
+
+	"github.com/go-debos/debos"
+	"github.com/go-debos/fakemachine"
+)
+
+/*
+Compare the partitions hashes of the build with the ones of a reference
+manifest, e.g. from a previous build of the same recipe, and report the
+partitions which aren't reproducible.
+*/
+func verifyManifest(m *debos.Manifest, file string) bool {
+	reference, err := debos.LoadManifest(file)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+
+	reproducible := true
+	for _, ref := range reference.Partitions {
+		p := m.Partition(ref.Name)
+
+		if p.SHA256 == "" {
+			log.Printf("Partition %s: not built", ref.Name)
+			reproducible = false
+			continue
+		}
+
+		if p.SHA256 == ref.SHA256 {
+			log.Printf("Partition %s: reproducible", ref.Name)
+			continue
+		}
+
+		reproducible = false
+		if ref.ContentSHA256 != "" && p.ContentSHA256 == ref.ContentSHA256 {
+			log.Printf("Partition %s: differs, but the filesystem content is identical", ref.Name)
+		} else {
+			log.Printf("Partition %s: differs", ref.Name)
+		}
+	}
+
+	return reproducible
+}
+
+// Save the manifest at the end of the build and verify it against the reference
+func finishManifest(context *debos.DebosContext, file string, reference string) {
+	if err := context.Manifest.Save(file); err != nil {
+		log.Printf("Failed to save manifest: %v", err)
+		context.State = debos.Failed
+		return
+	}
+
+	if fakemachine.InMachine() || reference == "" || context.State != debos.Success {
+		return
+	}
+
+	if !verifyManifest(context.Manifest, reference) {
+		log.Printf("Build is not reproducible compared to %s", reference)
+		context.State = debos.Failed
+	}
+}
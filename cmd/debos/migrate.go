@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+
+	"github.com/go-debos/debos"
+	"github.com/go-debos/debos/actions"
+)
+
+/*
+Migrate the deprecated syntaxes of the recipes, printing the diff of the
+changes as a preview, and rewriting the recipes if write is set. Returns false
+if a recipe couldn't be read or written.
+*/
+func migrate(files []string, write bool) bool {
+	ok := true
+
+	for _, file := range files {
+		file = debos.CleanPath(file)
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			log.Println(err)
+			ok = false
+			continue
+		}
+
+		migrated, done := actions.Migrate(data)
+		if len(done) == 0 {
+			log.Printf("%s: nothing to migrate", file)
+			continue
+		}
+		for _, d := range done {
+			log.Printf("%s: %s", file, d)
+		}
+
+		// diff exits with 1 as the files differ
+		diff := exec.Command("diff", "-u", "--label", file, "--label", file+" (migrated)", file, "-")
+		diff.Stdin = bytes.NewReader(migrated)
+		diff.Stdout = os.Stdout
+		diff.Stderr = os.Stderr
+		diff.Run()
+
+		if !write {
+			continue
+		}
+
+		info, err := os.Stat(file)
+		if err == nil {
+			err = ioutil.WriteFile(file, migrated, info.Mode())
+		}
+		if err != nil {
+			log.Printf("Failed to write %s: %v", file, err)
+			ok = false
+			continue
+		}
+		log.Printf("%s migrated", file)
+	}
+
+	return ok
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os/exec"
+	"time"
+
+	"github.com/go-debos/debos"
+)
+
+// Summary of a build as sent to the notification targets
+type buildSummary struct {
+	Recipe      string `json:"recipe"`
+	Status      string `json:"status"`
+	Duration    string `json:"duration"`
+	Error       string `json:"error,omitempty"`
+	Artifactdir string `json:"artifactdir"`
+	BuildID     string `json:"build-id"`
+}
+
+// Description of the first failure, reported in the build summary
+var buildFailure string
+
+func newBuildSummary(recipe string, context *debos.DebosContext, start time.Time) buildSummary {
+	s := buildSummary{
+		Recipe:      recipe,
+		Status:      "success",
+		Duration:    time.Since(start).Round(time.Second).String(),
+		Artifactdir: context.Artifactdir,
+		BuildID:     context.BuildID,
+	}
+
+	if context.State != debos.Success {
+		s.Status = "failed"
+		s.Error = buildFailure
+	}
+
+	return s
+}
+
+func (s buildSummary) String() string {
+	str := fmt.Sprintf("Build %s of %s %s after %s", s.BuildID, s.Recipe, s.Status, s.Duration)
+	if s.Error != "" {
+		str += ": " + s.Error
+	}
+	return str
+}
+
+func notifyWebhook(url string, s buildSummary) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	return postData(url, "application/json", data)
+}
+
+// Post data to url, failing unless it answers with a success status code
+func postData(url string, contentType string, data []byte) error {
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(url, contentType, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("'%s' returned status code %d (%s)", url, resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+
+	return nil
+}
+
+func notifyDesktop(s buildSummary) error {
+	urgency := "normal"
+	if s.Status != "success" {
+		urgency = "critical"
+	}
+
+	return exec.Command("notify-send", "--urgency", urgency, "--app-name", "debos",
+		fmt.Sprintf("debos: build %s", s.Status), s.String()).Run()
+}
+
+/*
+notify sends the build summary to the configured targets. Failing to notify
+does not change the outcome of the build.
+*/
+func notify(webhooks []string, desktop bool, s buildSummary) {
+	for _, url := range webhooks {
+		if err := notifyWebhook(url, s); err != nil {
+			log.Printf("Failed to notify webhook: %v", err)
+		}
+	}
+
+	if desktop {
+		if err := notifyDesktop(s); err != nil {
+			log.Printf("Failed to send desktop notification: %v", err)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/go-debos/debos"
+	"github.com/go-debos/debos/actions"
+	"gopkg.in/yaml.v2"
+)
+
+// Properties of a verified action as YAML, leaving out the unset ones
+func planProperties(a debos.Action) []string {
+	data, err := yaml.Marshal(a)
+	if err != nil {
+		return nil
+	}
+
+	var properties yaml.MapSlice
+	if err := yaml.Unmarshal(data, &properties); err != nil {
+		return nil
+	}
+
+	var set yaml.MapSlice
+	for _, p := range properties {
+		if p.Key == "action" || p.Value == nil || reflect.ValueOf(p.Value).IsZero() {
+			continue
+		}
+		if v := reflect.ValueOf(p.Value); (v.Kind() == reflect.Slice || v.Kind() == reflect.Map) && v.Len() == 0 {
+			continue
+		}
+		set = append(set, p)
+	}
+
+	if len(set) == 0 {
+		return nil
+	}
+
+	data, _ = yaml.Marshal(set)
+	return strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+}
+
+func printPlanActions(r actions.Recipe, context *debos.DebosContext, prefix string) {
+	for idx, a := range r.Actions {
+		number := fmt.Sprintf("%s%d.", prefix, idx+1)
+		indent := strings.Repeat(" ", len(number)+1)
+
+		log.Printf("%s %s", number, a)
+		for _, line := range planProperties(a.Action) {
+			log.Printf("%s%s", indent, line)
+		}
+
+		switch action := a.Action.(type) {
+		case *actions.ImagePartitionAction:
+			log.Printf("%sLayout:", indent)
+			for _, line := range action.Layout(context) {
+				log.Printf("%s  %s", indent, line)
+			}
+		case *actions.RecipeAction:
+			printPlanActions(action.Actions, context, number)
+		}
+	}
+}
+
+/*
+Print the ordered actions of the verified recipe, with their resolved
+properties and the estimated layout of the images, for --dry-run.
+*/
+func printPlan(r actions.Recipe, context *debos.DebosContext) {
+	log.Printf("==== Plan ====")
+	log.Printf("Architecture: %s", context.Architecture)
+
+	var origins []string
+	for name, dir := range context.Origins {
+		origins = append(origins, fmt.Sprintf("%s=%s", name, dir))
+	}
+	sort.Strings(origins)
+	log.Printf("Origins: %s", strings.Join(origins, ", "))
+
+	printPlanActions(r, context, "")
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/go-debos/debos"
+	"github.com/go-debos/debos/actions"
+)
+
+/*
+The profiler records the duration of the stages of the actions and, once the
+build is done, suggests changes to the recipe to build faster. When running
+in fakemachine the inner debos, running the actions, does the analysis.
+*/
+type profiler struct {
+	durations map[debos.Action]time.Duration
+	total     time.Duration
+}
+
+// Profiler of the build, nil unless --profiling is used
+var prof *profiler
+
+func newProfiler() *profiler {
+	return &profiler{durations: make(map[debos.Action]time.Duration)}
+}
+
+func (p *profiler) record(a debos.Action, d time.Duration) {
+	if p == nil {
+		return
+	}
+
+	// Recipes hold their actions wrapped for parsing
+	if y, ok := a.(actions.YamlAction); ok {
+		a = y.Action
+	}
+
+	p.durations[a] += d
+	p.total += d
+}
+
+// Share of the build spent in the actions, in percent
+func (p *profiler) share(as ...debos.Action) int {
+	var d time.Duration
+	for _, a := range as {
+		d += p.durations[a]
+	}
+
+	if p.total == 0 {
+		return 0
+	}
+	return int(100 * d / p.total)
+}
+
+func (p *profiler) suggestions(r actions.Recipe, context *debos.DebosContext) []string {
+	var suggestions []string
+	var bootstrap, aptActions []debos.Action
+	packed := make(map[string]bool)
+
+	for idx, y := range r.Actions {
+		a := y.Action
+
+		switch action := a.(type) {
+		case *actions.DebootstrapAction, *actions.MmdebstrapAction:
+			bootstrap = append(bootstrap, a)
+		case *actions.AptAction:
+			bootstrap = append(bootstrap, a)
+			aptActions = append(aptActions, a)
+			if idx > 0 {
+				if previous, ok := r.Actions[idx-1].Action.(*actions.AptAction); ok &&
+					previous.Recommends == action.Recommends &&
+					previous.Unauthenticated == action.Unauthenticated {
+					suggestions = append(suggestions, fmt.Sprintf(
+						"'%s' and '%s' could be merged into a single apt action, saving an update and a dependency resolution",
+						previous, action))
+				}
+			}
+		case *actions.PackAction:
+			packed[action.File] = true
+			if (action.Compression == "xz" || action.Compression == "bzip2") && p.share(a) >= 20 {
+				suggestions = append(suggestions, fmt.Sprintf(
+					"'%s' takes %d%% of the build with %s compression, 'zstd' is much faster at a similar ratio",
+					action, p.share(a), action.Compression))
+			}
+		case *actions.UnpackAction:
+			if packed[action.File] && (action.Origin == "" || action.Origin == "artifacts") {
+				suggestions = append(suggestions, fmt.Sprintf(
+					"'%s' unpacks a tarball packed earlier in the same build, the pack/unpack round trip could be dropped",
+					action))
+			}
+		}
+	}
+
+	if len(bootstrap) > 0 && p.share(bootstrap...) >= 50 && len(packed) == 0 {
+		suggestions = append(suggestions, fmt.Sprintf(
+			"bootstrapping and installing packages takes %d%% of the build, these actions could be cached: pack the rootfs once with a separate recipe and start from it with 'unpack'",
+			p.share(bootstrap...)))
+	}
+
+	if len(aptActions) > 0 && context.AptProxy == "" && p.share(aptActions...) >= 20 {
+		suggestions = append(suggestions, fmt.Sprintf(
+			"apt actions take %d%% of the build, a caching proxy could speed up repeated builds, see --apt-proxy",
+			p.share(aptActions...)))
+	}
+
+	return suggestions
+}
+
+func (p *profiler) report(r actions.Recipe, context *debos.DebosContext) {
+	if p == nil || p.total == 0 {
+		return
+	}
+
+	var sorted []debos.Action
+	for a := range p.durations {
+		sorted = append(sorted, a)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return p.durations[sorted[i]] > p.durations[sorted[j]]
+	})
+	if len(sorted) > 5 {
+		sorted = sorted[:5]
+	}
+
+	log.Printf("==== Profile ====")
+	log.Printf("Slowest actions of %s:", p.total.Round(time.Second))
+	for _, a := range sorted {
+		log.Printf("  %3d%% %8s  %s", p.share(a), p.durations[a].Round(time.Second), a)
+	}
+
+	suggestions := p.suggestions(r, context)
+	if len(suggestions) == 0 {
+		log.Printf("No suggestions")
+		return
+	}
+
+	log.Printf("Suggestions:")
+	for _, s := range suggestions {
+		log.Printf("  - %s", s)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/docker/go-units"
+	"github.com/go-debos/debos/actions"
+)
+
+const (
+	defaultMachineMemory = "2Gb"
+	defaultMachineCPUs   = 2
+
+	// Memory left to the host and to fakemachine itself
+	hostMemoryHeadroom = 512 * 1024 * 1024
+)
+
+// Memory available on the host in bytes, 0 if unknown
+func hostAvailableMemory() int64 {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "MemAvailable:" {
+			continue
+		}
+		kb, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return 0
+		}
+		return kb * 1024
+	}
+
+	return 0
+}
+
+/*
+Memory in bytes and CPUs of the fakemachine: the command line options as
+given, otherwise the resources of the recipe or the defaults, sized down to
+what the host has available.
+*/
+func machineResources(memory string, cpus int, resources *actions.RecipeResources) (int64, int, error) {
+	if memory != "" {
+		memsize, err := units.RAMInBytes(memory)
+		if err != nil {
+			return 0, 0, fmt.Errorf("Couldn't parse memory size: %v", err)
+		}
+		return memsize, machineCPUs(cpus, resources), nil
+	}
+
+	memory = defaultMachineMemory
+	if resources != nil && resources.Memory != "" {
+		memory = resources.Memory
+	}
+	memsize, err := units.RAMInBytes(memory)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Couldn't parse memory size: %v", err)
+	}
+
+	if available := hostAvailableMemory() - hostMemoryHeadroom; available > 0 && memsize > available {
+		log.Printf("WARNING: Only %s of the %s of memory requested are available on the host\n",
+			units.BytesSize(float64(available)), units.BytesSize(float64(memsize)))
+		memsize = available
+	}
+
+	return memsize, machineCPUs(cpus, resources), nil
+}
+
+func machineCPUs(cpus int, resources *actions.RecipeResources) int {
+	if cpus != 0 {
+		return cpus
+	}
+
+	cpus = defaultMachineCPUs
+	if resources != nil && resources.CPUs != 0 {
+		cpus = resources.CPUs
+	}
+
+	if host := runtime.NumCPU(); cpus > host {
+		log.Printf("WARNING: Only %d of the %d CPUs requested are available on the host\n", host, cpus)
+		cpus = host
+	}
+
+	return cpus
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// Reference recipes built by 'debos selftest', they don't need network access
+//
+//go:embed selftest/*.yaml
+var selftestRecipes embed.FS
+
+/*
+Build the reference recipes with the given options, e.g. the fakemachine
+backend, to check the host is able to build images. Returns true if all
+recipes were built successfully.
+*/
+func selftest(options []string, verbose bool) bool {
+	exe, err := os.Executable()
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+
+	dir, err := ioutil.TempDir("", "debos-selftest-")
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	defer os.RemoveAll(dir)
+
+	recipes, err := fs.Glob(selftestRecipes, "selftest/*.yaml")
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+
+	passed := 0
+	for _, r := range recipes {
+		name := strings.TrimSuffix(path.Base(r), ".yaml")
+		data, _ := selftestRecipes.ReadFile(r)
+
+		recipe := path.Join(dir, path.Base(r))
+		artifactdir := path.Join(dir, name)
+		if err := ioutil.WriteFile(recipe, data, 0644); err != nil {
+			log.Println(err)
+			return false
+		}
+		if err := os.Mkdir(artifactdir, 0755); err != nil {
+			log.Println(err)
+			return false
+		}
+
+		args := append(append([]string{}, options...), "--artifactdir", artifactdir, recipe)
+		cmd := exec.Command(exe, args...)
+		var out []byte
+		if verbose {
+			cmd.Stdout = os.Stdout
+			cmd.Stderr = os.Stderr
+			err = cmd.Run()
+		} else {
+			out, err = cmd.CombinedOutput()
+		}
+
+		if err != nil {
+			log.Printf("Selftest %s: FAIL (%v)", name, err)
+			os.Stderr.Write(out)
+			continue
+		}
+
+		log.Printf("Selftest %s: PASS", name)
+		passed++
+	}
+
+	log.Printf("Selftest: %d/%d recipes built", passed, len(recipes))
+	return passed == len(recipes)
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-debos/debos"
+)
+
+/*
+The telemetry records a span for each stage run for each action. Spans are
+exported as OpenTelemetry traces (OTLP/HTTP with JSON encoding) and their
+durations, along with the artifact sizes and the hit rate of the APT cache, are
+pushed to a Prometheus pushgateway.
+
+When running in fakemachine both the outer and the inner debos export their
+own spans; the inner spans are linked to the outer build span through the
+internal trace parent passed on the command line.
+*/
+type span struct {
+	name     string
+	id       string
+	parentID string
+	action   string
+	stage    string
+	start    time.Time
+	end      time.Time
+	failed   bool
+}
+
+type telemetry struct {
+	traceID  string
+	root     span
+	instance string
+	spans    []span
+	sizes    map[string]int64
+	aptCache debos.AptCacheStats
+}
+
+func randomID(size int) string {
+	id := make([]byte, size)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+/* parent is either empty or "<trace id>-<span id>" as passed to the
+ * fakemachine by the outer debos */
+func newTelemetry(parent string, instance string) (*telemetry, error) {
+	t := telemetry{instance: instance, sizes: make(map[string]int64)}
+
+	t.traceID = randomID(16)
+	t.root = span{name: "build", id: randomID(8), start: time.Now()}
+
+	if parent != "" {
+		ids := strings.Split(parent, "-")
+		if len(ids) != 2 || len(ids[0]) != 32 || len(ids[1]) != 16 {
+			return nil, fmt.Errorf("Invalid trace parent '%s'", parent)
+		}
+		t.traceID = ids[0]
+		t.root.parentID = ids[1]
+		t.root.name = "build (" + instance + ")"
+	}
+
+	return &t, nil
+}
+
+func (t *telemetry) traceParent() string {
+	return t.traceID + "-" + t.root.id
+}
+
+// Start a span for the stage of action, the returned function ends it
+func (t *telemetry) stage(a debos.Action, stage string) func(err error) {
+	if t == nil {
+		return func(error) {}
+	}
+
+	s := span{
+		name:     fmt.Sprintf("%s %s", a, stage),
+		id:       randomID(8),
+		parentID: t.root.id,
+		action:   a.String(),
+		stage:    stage,
+		start:    time.Now(),
+	}
+
+	return func(err error) {
+		s.end = time.Now()
+		s.failed = err != nil
+		t.spans = append(t.spans, s)
+	}
+}
+
+// Record the size of the artifacts written since the build started
+func (t *telemetry) recordArtifacts(artifactdir string) {
+	files, err := ioutil.ReadDir(artifactdir)
+	if err != nil {
+		return
+	}
+
+	for _, f := range files {
+		if f.Mode().IsRegular() && !f.ModTime().Before(t.root.start) {
+			t.sizes[f.Name()] = f.Size()
+		}
+	}
+}
+
+func (t *telemetry) finish(context *debos.DebosContext) {
+	t.root.end = time.Now()
+	t.root.failed = context.State != debos.Success
+	t.aptCache = context.AptCache
+}
+
+type otlpAttribute struct {
+	Key   string            `json:"key"`
+	Value map[string]string `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            map[string]int  `json:"status"`
+}
+
+func stringAttribute(key, value string) otlpAttribute {
+	return otlpAttribute{key, map[string]string{"stringValue": value}}
+}
+
+func (t *telemetry) otlpSpan(s span) otlpSpan {
+	o := otlpSpan{
+		TraceID:           t.traceID,
+		SpanID:            s.id,
+		ParentSpanID:      s.parentID,
+		Name:              s.name,
+		Kind:              1, // SPAN_KIND_INTERNAL
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		Status:            map[string]int{"code": 1}, // STATUS_CODE_OK
+	}
+
+	if s.failed {
+		o.Status["code"] = 2 // STATUS_CODE_ERROR
+	}
+
+	if s.action != "" {
+		o.Attributes = append(o.Attributes,
+			stringAttribute("debos.action", s.action),
+			stringAttribute("debos.stage", s.stage))
+	}
+
+	return o
+}
+
+// Export the spans to an OTLP/HTTP collector
+func (t *telemetry) exportOTLP(endpoint string) error {
+	spans := []otlpSpan{t.otlpSpan(t.root)}
+	for _, s := range t.spans {
+		spans = append(spans, t.otlpSpan(s))
+	}
+
+	hostname, _ := os.Hostname()
+	request := map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []otlpAttribute{
+						stringAttribute("service.name", "debos"),
+						stringAttribute("service.version", GetDeterminedVersion(Version)),
+						stringAttribute("host.name", hostname),
+					},
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": "debos"},
+						"spans": spans,
+					},
+				},
+			},
+		},
+	}
+
+	data, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	return postData(strings.TrimSuffix(endpoint, "/")+"/v1/traces", "application/json", data)
+}
+
+// Escaping of the label values of the Prometheus text format
+var promLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func promLabel(value string) string {
+	return `"` + promLabelEscaper.Replace(value) + `"`
+}
+
+// Push the durations and sizes to a Prometheus pushgateway
+func (t *telemetry) pushPrometheus(gateway string) error {
+	var m bytes.Buffer
+
+	success := 1
+	if t.root.failed {
+		success = 0
+	}
+
+	m.WriteString("# TYPE debos_build_duration_seconds gauge\n")
+	m.WriteString(fmt.Sprintf("debos_build_duration_seconds %f\n", t.root.end.Sub(t.root.start).Seconds()))
+	m.WriteString("# TYPE debos_build_success gauge\n")
+	m.WriteString(fmt.Sprintf("debos_build_success %d\n", success))
+
+	m.WriteString("# TYPE debos_action_duration_seconds gauge\n")
+	for idx, s := range t.spans {
+		m.WriteString(fmt.Sprintf("debos_action_duration_seconds{index=\"%d\",action=%s,stage=%s} %f\n",
+			idx, promLabel(s.action), promLabel(s.stage), s.end.Sub(s.start).Seconds()))
+	}
+
+	if len(t.sizes) > 0 {
+		m.WriteString("# TYPE debos_artifact_size_bytes gauge\n")
+		for name, size := range t.sizes {
+			m.WriteString(fmt.Sprintf("debos_artifact_size_bytes{artifact=%s} %d\n", promLabel(name), size))
+		}
+	}
+
+	if t.aptCache.Hits+t.aptCache.Misses > 0 {
+		m.WriteString("# TYPE debos_apt_cache_hits gauge\n")
+		m.WriteString(fmt.Sprintf("debos_apt_cache_hits %d\n", t.aptCache.Hits))
+		m.WriteString("# TYPE debos_apt_cache_misses gauge\n")
+		m.WriteString(fmt.Sprintf("debos_apt_cache_misses %d\n", t.aptCache.Misses))
+		m.WriteString("# TYPE debos_apt_cache_hit_rate gauge\n")
+		m.WriteString(fmt.Sprintf("debos_apt_cache_hit_rate %f\n", t.aptCache.HitRate()))
+	}
+
+	target := fmt.Sprintf("%s/metrics/job/debos/instance/%s",
+		strings.TrimSuffix(gateway, "/"), url.PathEscape(t.instance))
+	return postData(target, "text/plain; version=0.0.4", m.Bytes())
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/go-debos/debos"
+	"github.com/go-debos/debos/actions"
+)
+
+const watchInterval = time.Second
+
+/* State saved before running an action so the recipe can be restarted
+ * from that action without running the preceding ones again */
+type watchSnapshot struct {
+	rootfs  string           // Tarball, or directory when not compressed
+	dpkg    *debos.DpkgState // Package state only, before apt actions
+	origins map[string]string
+}
+
+/* Compression of the snapshots, zstd by default as full copies of large
+ * rootfs are expensive unless the filesystem supports reflinks */
+type snapshotCompression struct {
+	method  string // "zstd" or "none"
+	level   int
+	threads int // 0 to use all the cores
+}
+
+// Archive options preserving the rootfs as 'cp -a' does
+var snapshotTarOptions = []string{"--numeric-owner", "--xattrs", "--xattrs-include=*", "--acls"}
+
+func (c snapshotCompression) command() debos.Command {
+	cmd := debos.Command{}
+	cmd.AddEnvKey("ZSTD_CLEVEL", strconv.Itoa(c.level))
+	cmd.AddEnvKey("ZSTD_NBTHREADS", strconv.Itoa(c.threads))
+
+	return cmd
+}
+
+type recipeWatcher struct {
+	file         string
+	templateVars map[string]string
+	context      *debos.DebosContext
+	recipe       actions.Recipe
+	pristine     actions.Recipe // As parsed, before any action modified itself
+	snapshots    map[int]watchSnapshot
+	compression  snapshotCompression
+	packages     bool // Undo the package changes only when restarting from apt actions
+}
+
+func checkWatchable(r actions.Recipe) error {
+	for _, a := range r.Actions {
+		switch a.Action.(type) {
+		case *actions.ImagePartitionAction, *actions.FilesystemDeployAction, *actions.OstreeDeployAction:
+			return fmt.Errorf("Action `%s` is not supported in watch mode", a)
+		}
+	}
+
+	return nil
+}
+
+func (w *recipeWatcher) parse() error {
+	var r, pristine actions.Recipe
+
+	if err := r.Parse(w.file, false, false, w.templateVars); err != nil {
+		return err
+	}
+	if err := pristine.Parse(w.file, false, false, w.templateVars); err != nil {
+		return err
+	}
+
+	if r.Architecture != w.context.Architecture {
+		return fmt.Errorf("Changing the architecture is not supported in watch mode")
+	}
+
+	if err := checkWatchable(r); err != nil {
+		return err
+	}
+
+	for _, a := range r.Actions {
+		if err := a.Verify(w.context); err != nil {
+			return fmt.Errorf("Action `%s` failed at stage Verify, error: %s", a, err)
+		}
+		if err := a.PreNoMachine(w.context); err != nil {
+			return fmt.Errorf("Action `%s` failed at stage PreNoMachine, error: %s", a, err)
+		}
+	}
+
+	w.recipe = r
+	w.pristine = pristine
+	return nil
+}
+
+/* Snapshots are only taken before actions depending on watched files, any
+ * other action is restarted from the nearest preceding snapshot */
+func (w *recipeWatcher) needsSnapshot(idx int) bool {
+	if idx == 0 {
+		return true
+	}
+	if w.dpkgSnapshot(idx) {
+		return true
+	}
+	_, ok := w.recipe.Actions[idx].Action.(debos.WatchableAction)
+	return ok
+}
+
+/* Package state snapshots are taken before the apt actions, so trying other
+ * packages only undoes the package changes of the previous run */
+func (w *recipeWatcher) dpkgSnapshot(idx int) bool {
+	if !w.packages || idx == 0 {
+		return false
+	}
+	_, ok := w.recipe.Actions[idx].Action.(*actions.AptAction)
+	return ok
+}
+
+func (w *recipeWatcher) snapshot(idx int) error {
+	s := watchSnapshot{
+		rootfs:  path.Join(w.context.Scratchdir, "watch", strconv.Itoa(idx)),
+		origins: make(map[string]string),
+	}
+	for k, v := range w.context.Origins {
+		s.origins[k] = v
+	}
+
+	var err error
+	if w.dpkgSnapshot(idx) {
+		s.dpkg, err = debos.SaveDpkgState(*w.context, s.rootfs+".dpkg")
+		s.rootfs = ""
+	} else if w.compression.method == "zstd" {
+		s.rootfs += ".tar.zst"
+		os.Remove(s.rootfs)
+		if err := os.MkdirAll(path.Dir(s.rootfs), 0755); err != nil {
+			return err
+		}
+
+		cmd := append([]string{"tar", "--zstd"}, snapshotTarOptions...)
+		cmd = append(cmd, "-C", w.context.Rootdir, "-cf", s.rootfs, ".")
+		err = w.compression.command().Run("Snapshot", cmd...)
+	} else {
+		os.RemoveAll(s.rootfs)
+		if err := os.MkdirAll(s.rootfs, 0755); err != nil {
+			return err
+		}
+		err = debos.Command{}.Run("Snapshot", "cp", "-a", "--reflink=auto", w.context.Rootdir+"/.", s.rootfs)
+	}
+	if err != nil {
+		return err
+	}
+
+	w.snapshots[idx] = s
+	return nil
+}
+
+func (w *recipeWatcher) restore(idx int) error {
+	s := w.snapshots[idx]
+
+	var err error
+	if s.dpkg != nil {
+		err = s.dpkg.Restore(*w.context)
+	} else if err = w.clearRootfs(); err != nil {
+		return err
+	} else if w.compression.method == "zstd" {
+		cmd := append([]string{"tar", "--zstd"}, snapshotTarOptions...)
+		cmd = append(cmd, "-C", w.context.Rootdir, "-xf", s.rootfs)
+		err = w.compression.command().Run("Restore", cmd...)
+	} else {
+		err = debos.Command{}.Run("Restore", "cp", "-a", "--reflink=auto", s.rootfs+"/.", w.context.Rootdir)
+	}
+	if err != nil {
+		return err
+	}
+
+	w.context.Origins = make(map[string]string)
+	for k, v := range s.origins {
+		w.context.Origins[k] = v
+	}
+
+	/* Snapshots of later actions are outdated now */
+	for i := range w.snapshots {
+		if i > idx {
+			if w.snapshots[i].dpkg != nil {
+				w.snapshots[i].dpkg.Remove()
+			} else {
+				os.RemoveAll(w.snapshots[i].rootfs)
+			}
+			delete(w.snapshots, i)
+		}
+	}
+
+	return nil
+}
+
+func (w *recipeWatcher) clearRootfs() error {
+	if err := os.RemoveAll(w.context.Rootdir); err != nil {
+		return err
+	}
+
+	return os.Mkdir(w.context.Rootdir, 0755)
+}
+
+func (w *recipeWatcher) run(start int) bool {
+	for idx := start; idx < len(w.recipe.Actions); idx++ {
+		a := w.recipe.Actions[idx]
+
+		if w.needsSnapshot(idx) {
+			if err := w.snapshot(idx); err != nil {
+				log.Printf("Couldn't snapshot the filesystem: %v", err)
+				w.context.State = debos.Failed
+				return false
+			}
+		}
+
+		log.Printf("==== %s ====\n", a)
+		done := stage(w.context, a, "Run")
+		err := a.Run(w.context)
+		done(err)
+
+		defer a.Cleanup(w.context)
+
+		if handleError(w.context, err, a, "Run") {
+			return false
+		}
+	}
+
+	for _, a := range w.recipe.Actions {
+		done := stage(w.context, a, "PostMachine")
+		err := a.PostMachine(w.context)
+		done(err)
+		if handleError(w.context, err, a, "PostMachine") {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (w *recipeWatcher) watchPaths() []string {
+	paths := []string{w.file}
+	for _, a := range w.recipe.Actions {
+		if wa, ok := a.Action.(debos.WatchableAction); ok {
+			paths = append(paths, wa.WatchPaths(w.context)...)
+		}
+	}
+	return paths
+}
+
+// Index of the first action affected by the changed paths
+func (w *recipeWatcher) firstAffected(changed []string, previous actions.Recipe) int {
+	first := len(w.recipe.Actions)
+
+	/* Compare freshly parsed actions, Verify may have modified the others */
+	for idx, a := range w.pristine.Actions {
+		if idx >= len(previous.Actions) || !reflect.DeepEqual(a, previous.Actions[idx]) {
+			first = idx
+			break
+		}
+	}
+
+	for idx, a := range w.recipe.Actions[:first] {
+		wa, ok := a.Action.(debos.WatchableAction)
+		if !ok {
+			continue
+		}
+		for _, p := range wa.WatchPaths(w.context) {
+			for _, c := range changed {
+				if p == c {
+					return idx
+				}
+			}
+		}
+	}
+
+	return first
+}
+
+/*
+do_watch runs the recipe and then monitors the recipe, overlays and scripts
+for changes, re-running the affected actions until interrupted.
+*/
+func do_watch(r actions.Recipe, context *debos.DebosContext, file string, templateVars map[string]string, compression snapshotCompression, packages bool) {
+	w := recipeWatcher{
+		file:         file,
+		templateVars: templateVars,
+		context:      context,
+		recipe:       r,
+		snapshots:    make(map[int]watchSnapshot),
+		compression:  compression,
+		packages:     packages,
+	}
+	if err := w.pristine.Parse(file, false, false, templateVars); err != nil {
+		log.Println(err)
+		context.State = debos.Failed
+		return
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+
+	start := 0
+	for {
+		context.State = debos.Success
+		if w.run(start) {
+			log.Printf("==== Recipe done ====")
+		}
+
+		watcher := debos.NewWatcher(w.watchPaths()...)
+		log.Printf("==== Watching for changes (interrupt to stop) ====")
+
+		for {
+			select {
+			case <-interrupt:
+				return
+			case <-time.After(watchInterval):
+			}
+
+			changed := watcher.Changed()
+			if len(changed) == 0 {
+				continue
+			}
+
+			previous := w.pristine
+			if err := w.parse(); err != nil {
+				log.Printf("Failed to reload recipe: %v", err)
+				continue
+			}
+
+			affected := w.firstAffected(changed, previous)
+			if affected == len(w.recipe.Actions) {
+				continue
+			}
+
+			/* Restart from the nearest snapshot before the affected action */
+			for start = affected; start > 0; start-- {
+				if _, ok := w.snapshots[start]; ok && w.needsSnapshot(start) {
+					break
+				}
+			}
+
+			if err := w.restore(start); err != nil {
+				log.Printf("Couldn't restore the filesystem: %v", err)
+				context.State = debos.Failed
+				return
+			}
+			log.Printf("==== Changes detected, restarting from `%s` ====", w.recipe.Actions[start])
+			break
+		}
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"os/exec"
 	"path"
 	"runtime"
+	"strings"
 )
 
 type ChrootEnterMethod int
@@ -22,33 +23,84 @@ const (
 )
 
 type Command struct {
-	Architecture string            // Architecture of the chroot, nil if same as host
-	Dir          string            // Working dir to run command in
-	Chroot       string            // Run in the chroot at path
-	ChrootMethod ChrootEnterMethod // Method to enter the chroot
+	Architecture   string            // Architecture of the chroot, nil if same as host
+	Dir            string            // Working dir to run command in
+	Chroot         string            // Run in the chroot at path
+	ChrootMethod   ChrootEnterMethod // Method to enter the chroot
+	Devices        []string          // Device nodes in the chroot for CHROOT_METHOD_CHROOT, ChrootDevices if nil
+	RootfsDev      bool              // Keep the /dev, /proc and /sys of the rootfs for CHROOT_METHOD_CHROOT
+	User           string            // User[:group] running the command in the chroot, root if empty
+	PrivateNetwork bool              // No network access in the chroot
+	Stdin          io.Reader         // Standard input of the command, none if nil
+
+	bindMounts []bindMount /// Items to bind mount
+	extraEnv   []string    // Extra environment variables to set
+	buildID    string      // Build running the command, for the policy helper
+}
+
+type bindMount struct {
+	source   string
+	target   string // Same as source if empty
+	readOnly bool
+}
 
-	bindMounts []string /// Items to bind mount
-	extraEnv   []string // Extra environment variables to set
+func (b bindMount) String() string {
+	if b.target == "" {
+		return b.source
+	}
+	return fmt.Sprintf("%s:%s", b.source, b.target)
 }
 
 type commandWrapper struct {
 	label  string
 	buffer *bytes.Buffer
+	hints  *[]string // Diagnostics of the qemu failures seen in the output
 }
 
 func newCommandWrapper(label string) *commandWrapper {
 	b := bytes.Buffer{}
-	return &commandWrapper{label, &b}
+	return &commandWrapper{label, &b, &[]string{}}
+}
+
+// Output of qemu user emulation failures and their likely cause
+var qemuFailures = []struct {
+	signature string
+	hint      string
+}{
+	{"Exec format error",
+		"binaries of the target architecture can't be executed, check qemu-user-static is installed and its binfmt_misc handlers are enabled (e.g. 'update-binfmts --enable'), or use a fakemachine backend"},
+	{"qemu: uncaught target signal",
+		"a program crashed under qemu user emulation, this is often a qemu bug: try a newer qemu-user-static, or build on a native host"},
+	{"qemu: Unsupported syscall",
+		"a program uses a syscall unsupported by qemu user emulation: try a newer qemu-user-static, or build on a native host"},
+	{"Could not open '/lib",
+		"qemu can't find the dynamic loader of the target, the binfmt_misc handler probably doesn't use the static qemu binary (missing 'F' flag)"},
+}
+
+func (w commandWrapper) diagnose(line string) {
+	for _, f := range qemuFailures {
+		if !strings.Contains(line, f.signature) {
+			continue
+		}
+		for _, h := range *w.hints {
+			if h == f.hint {
+				return
+			}
+		}
+		*w.hints = append(*w.hints, f.hint)
+	}
 }
 
 func (w commandWrapper) out(atEOF bool) {
 	for {
 		s, err := w.buffer.ReadString('\n')
 		if err == nil {
+			w.diagnose(s)
 			log.Printf("%s | %v", w.label, s)
 		} else {
 			if len(s) > 0 {
 				if atEOF && err == io.EOF {
+					w.diagnose(s)
 					log.Printf("%s | %v\n", w.label, s)
 				} else {
 					w.buffer.WriteString(s)
@@ -71,6 +123,7 @@ func (w *commandWrapper) flush() {
 
 func NewChrootCommandForContext(context DebosContext) Command {
 	c := Command{Architecture: context.Architecture, Chroot: context.Rootdir, ChrootMethod: CHROOT_METHOD_NSPAWN}
+	c.buildID = context.BuildID
 
 	if context.EnvironVars != nil {
 		for k, v := range context.EnvironVars {
@@ -96,6 +149,11 @@ func NewChrootCommandForContext(context DebosContext) Command {
 		c.AddBindMount("/dev/disk", "")
 	}
 
+	// Environment variables of the sandbox override the ones of the build
+	if context.Sandbox != nil {
+		context.Sandbox.apply(&c)
+	}
+
 	return c
 }
 
@@ -108,14 +166,55 @@ func (cmd *Command) AddEnvKey(key, value string) {
 }
 
 func (cmd *Command) AddBindMount(source, target string) {
-	var mount string
-	if target != "" {
-		mount = fmt.Sprintf("%s:%s", source, target)
-	} else {
-		mount = source
+	cmd.bindMounts = append(cmd.bindMounts, bindMount{source, target, false})
+}
+
+// AddBindMountReadOnly bind mounts source so the command can't modify it
+func (cmd *Command) AddBindMountReadOnly(source, target string) {
+	cmd.bindMounts = append(cmd.bindMounts, bindMount{source, target, true})
+}
+
+/*
+Check that none of the bind mounts of the command, nor the /dev, /proc and
+/sys mounted for CHROOT_METHOD_CHROOT, is left mounted in the host namespace
+once the command is done, so later actions can't modify their sources by
+accident.
+*/
+func (cmd *Command) verifyUnmounted(chrootMounts []string) error {
+	if len(cmd.bindMounts) == 0 && len(chrootMounts) == 0 {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile("/proc/self/mounts")
+	if err != nil {
+		return err
+	}
+
+	mounted := make(map[string]bool)
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 1 {
+			mounted[fields[1]] = true
+		}
+	}
+
+	for _, b := range cmd.bindMounts {
+		target := b.target
+		if target == "" {
+			target = b.source
+		}
+		if mounted[path.Join(cmd.Chroot, target)] {
+			return fmt.Errorf("Bind mount of %s is still mounted on %s", b.source, target)
+		}
 	}
 
-	cmd.bindMounts = append(cmd.bindMounts, mount)
+	for _, m := range chrootMounts {
+		if mounted[m] {
+			return fmt.Errorf("%s is still mounted", m)
+		}
+	}
+
+	return nil
 }
 
 func (cmd *Command) saveResolvConf() (*[sha256.Size]byte, error) {
@@ -210,12 +309,49 @@ func (cmd *Command) restoreResolvConf(sum *[sha256.Size]byte) error {
 }
 
 func (cmd Command) Run(label string, cmdline ...string) error {
+	return cmd.run(label, nil, nil, cmdline...)
+}
+
+/*
+Output runs the command like Run, but returns its standard output instead of
+logging it. The standard error is logged.
+*/
+func (cmd Command) Output(label string, cmdline ...string) ([]byte, error) {
+	var out bytes.Buffer
+	err := cmd.run(label, &out, nil, cmdline...)
+
+	return out.Bytes(), err
+}
+
+/*
+Stream runs the command like Run, but writes its standard output to the
+writer, e.g. to pipe it to another process. The standard error is logged.
+*/
+func (cmd Command) Stream(label string, stdout io.Writer, cmdline ...string) error {
+	return cmd.run(label, stdout, nil, cmdline...)
+}
+
+/*
+CombinedOutput runs the command like Run, but returns its standard output and
+error instead of logging them, e.g. to parse them.
+*/
+func (cmd Command) CombinedOutput(label string, cmdline ...string) ([]byte, error) {
+	var out bytes.Buffer
+	err := cmd.run(label, &out, &out, cmdline...)
+
+	return out.Bytes(), err
+}
+
+func (cmd Command) run(label string, stdout, stderr io.Writer, cmdline ...string) error {
 	q, err := newQemuHelper(cmd)
 	if err != nil {
 		return err
 	}
 
-	q.Setup()
+	// The binfmt_misc handler may not need the copy, so carry on
+	if err := q.Setup(); err != nil {
+		log.Printf("Warning: failed to set up qemu user emulation, check qemu-user-static is installed: %v", err)
+	}
 	defer q.Cleanup()
 
 	var options []string
@@ -223,7 +359,13 @@ func (cmd Command) Run(label string, cmdline ...string) error {
 	case CHROOT_METHOD_NONE:
 		options = cmdline
 	case CHROOT_METHOD_CHROOT:
+		if cmd.PrivateNetwork {
+			options = append(options, "unshare", "--net")
+		}
 		options = append(options, "chroot")
+		if cmd.User != "" {
+			options = append(options, "--userspec", cmd.User)
+		}
 		options = append(options, cmd.Chroot)
 		options = append(options, cmdline...)
 	case CHROOT_METHOD_NSPAWN:
@@ -234,13 +376,26 @@ func (cmd Command) Run(label string, cmdline ...string) error {
 		options = append(options, "--register=no")
 		options = append(options, "--keep-unit")
 		options = append(options, "--console=pipe")
+		// Report a 32 bits machine to the target, e.g. for uname
+		if cmd.Architecture == "i386" && runtime.GOARCH == "amd64" {
+			options = append(options, "--personality=x86")
+		}
 		for _, e := range cmd.extraEnv {
 			options = append(options, "--setenv", e)
 
 		}
 		for _, b := range cmd.bindMounts {
-			options = append(options, "--bind", b)
-
+			if b.readOnly {
+				options = append(options, "--bind-ro", b.String())
+			} else {
+				options = append(options, "--bind", b.String())
+			}
+		}
+		if cmd.PrivateNetwork {
+			options = append(options, "--private-network")
+		}
+		if cmd.User != "" {
+			options = append(options, "--user", cmd.User)
 		}
 		options = append(options, "-D", cmd.Chroot)
 		options = append(options, cmdline...)
@@ -249,9 +404,16 @@ func (cmd Command) Run(label string, cmdline ...string) error {
 	exe := exec.Command(options[0], options[1:]...)
 	w := newCommandWrapper(label)
 
-	exe.Stdin = nil
+	exe.Dir = cmd.Dir
+	exe.Stdin = cmd.Stdin
 	exe.Stdout = w
 	exe.Stderr = w
+	if stdout != nil {
+		exe.Stdout = stdout
+	}
+	if stderr != nil {
+		exe.Stderr = stderr
+	}
 
 	defer w.flush()
 
@@ -261,21 +423,65 @@ func (cmd Command) Run(label string, cmdline ...string) error {
 
 	// Disable services start/stop for commands running in chroot
 	if cmd.ChrootMethod != CHROOT_METHOD_NONE {
-		services := ServiceHelper{cmd.Chroot}
+		services := ServiceHelper{Rootdir: cmd.Chroot, BuildID: cmd.buildID}
 		services.Deny()
 		defer services.Allow()
 	}
 
+	// Provide a minimal /dev, /proc and /sys instead of the ones of the rootfs
+	var mounts *chrootMounts
+	if cmd.ChrootMethod == CHROOT_METHOD_CHROOT && !cmd.RootfsDev {
+		devices := cmd.Devices
+		if devices == nil {
+			devices = ChrootDevices
+		}
+
+		var err error
+		mounts, err = setupChrootMounts(cmd.Chroot, devices)
+		if err != nil {
+			return err
+		}
+		// Only left to unmount if the command failed
+		defer func() {
+			if err := mounts.teardown(); err != nil {
+				log.Printf("Warning: %v", err)
+			}
+		}()
+	}
+
 	// Save the original resolv.conf and copy version from host
 	resolvsum, err := cmd.saveResolvConf()
 	if err != nil {
 		return err
 	}
 
-	if err = exe.Run(); err != nil {
+	if err = runWithDeadline(exe); err != nil {
+		w.flush()
+		if DeadlineExceeded() {
+			return fmt.Errorf("%v, %s stopped: %v", ErrDeadlineExceeded, label, err)
+		}
+		if q.qemusrc != "" && len(*w.hints) > 0 {
+			for _, h := range *w.hints {
+				log.Printf("Emulation of %s failed: %s", cmd.Architecture, h)
+			}
+			return fmt.Errorf("%v (emulating %s with %s, see the diagnostics above)", err, cmd.Architecture, q.qemusrc)
+		}
 		return err
 	}
 
+	if cmd.ChrootMethod != CHROOT_METHOD_NONE {
+		var chrootMounts []string
+		if mounts != nil {
+			chrootMounts = append(chrootMounts, mounts.mounted...)
+			if err = mounts.teardown(); err != nil {
+				return err
+			}
+		}
+		if err = cmd.verifyUnmounted(chrootMounts); err != nil {
+			return err
+		}
+	}
+
 	// Restore the original resolv.conf if not changed
 	if err = cmd.restoreResolvConf(resolvsum); err != nil {
 		return err
@@ -289,6 +495,39 @@ type qemuHelper struct {
 	qemutarget string
 }
 
+// qemu user emulation binaries for the supported architectures
+var qemuBinaries = map[string]string{
+	"armhf":    "/usr/bin/qemu-arm-static",
+	"armel":    "/usr/bin/qemu-arm-static",
+	"arm":      "/usr/bin/qemu-arm-static",
+	"arm64":    "/usr/bin/qemu-aarch64-static",
+	"mips":     "/usr/bin/qemu-mips-static",
+	"mipsel":   "/usr/bin/qemu-mipsel-static",
+	"mips64el": "/usr/bin/qemu-mips64el-static",
+	"ppc64el":  "/usr/bin/qemu-ppc64le-static",
+	"riscv64":  "/usr/bin/qemu-riscv64-static",
+	"s390x":    "/usr/bin/qemu-s390x-static",
+	"i386":     "/usr/bin/qemu-i386-static",
+	"amd64":    "/usr/bin/qemu-x86_64-static",
+	"sh4":      "/usr/bin/qemu-sh4-static",
+}
+
+// Host architectures (as GOARCH) able to run the architectures natively
+var nativeArchitectures = map[string][]string{
+	"armhf":    {"arm64", "arm"},
+	"armel":    {"arm64", "arm"},
+	"arm":      {"arm64", "arm"},
+	"arm64":    {"arm64"},
+	"mipsel":   {"mips64le", "mipsle"},
+	"mips64el": {"mips64le"},
+	"ppc64el":  {"ppc64le"},
+	"riscv64":  {"riscv64"},
+	"s390x":    {"s390x"},
+	"i386":     {"amd64", "386"},
+	"amd64":    {"amd64"},
+	"sh4":      {"sh4"},
+}
+
 func newQemuHelper(c Command) (*qemuHelper, error) {
 	q := qemuHelper{}
 
@@ -296,49 +535,20 @@ func newQemuHelper(c Command) (*qemuHelper, error) {
 		return &q, nil
 	}
 
-	switch c.Architecture {
-	case "armhf", "armel", "arm":
-		if runtime.GOARCH != "arm64" && runtime.GOARCH != "arm" {
-			q.qemusrc = "/usr/bin/qemu-arm-static"
-		}
-	case "arm64":
-		if runtime.GOARCH != "arm64" {
-			q.qemusrc = "/usr/bin/qemu-aarch64-static"
-		}
-	case "mips":
-		q.qemusrc = "/usr/bin/qemu-mips-static"
-	case "mipsel":
-		if runtime.GOARCH != "mips64le" && runtime.GOARCH != "mipsle" {
-			q.qemusrc = "/usr/bin/qemu-mipsel-static"
-		}
-	case "mips64el":
-		if runtime.GOARCH != "mips64le" {
-			q.qemusrc = "/usr/bin/qemu-mips64el-static"
-		}
-	case "riscv64":
-		if runtime.GOARCH != "riscv64" {
-			q.qemusrc = "/usr/bin/qemu-riscv64-static"
-		}
-	case "i386":
-		if runtime.GOARCH != "amd64" && runtime.GOARCH != "386" {
-			q.qemusrc = "/usr/bin/qemu-i386-static"
-		}
-	case "amd64":
-		if runtime.GOARCH != "amd64" {
-			q.qemusrc = "/usr/bin/qemu-x86_64-static"
-		}
-	case "sh4":
-		if runtime.GOARCH != "sh4" {
-			q.qemusrc = "/usr/bin/qemu-sh4-static"
-		}
-	default:
+	qemusrc, found := qemuBinaries[c.Architecture]
+	if !found {
 		return nil, fmt.Errorf("Don't know qemu for architecture %s", c.Architecture)
 	}
 
-	if q.qemusrc != "" {
-		q.qemutarget = path.Join(c.Chroot, q.qemusrc)
+	for _, native := range nativeArchitectures[c.Architecture] {
+		if runtime.GOARCH == native {
+			return &q, nil
+		}
 	}
 
+	q.qemusrc = qemusrc
+	q.qemutarget = path.Join(c.Chroot, q.qemusrc)
+
 	return &q, nil
 }
 
@@ -346,6 +556,19 @@ func (q qemuHelper) Setup() error {
 	if q.qemusrc == "" {
 		return nil
 	}
+
+	if _, err := os.Stat(q.qemusrc); err != nil {
+		return err
+	}
+
+	// Without a binfmt_misc handler, binaries fail with "Exec format error"
+	handler := "/proc/sys/fs/binfmt_misc/" + strings.TrimSuffix(path.Base(q.qemusrc), "-static")
+	if _, err := os.Stat("/proc/sys/fs/binfmt_misc/status"); err == nil {
+		if _, err := os.Stat(handler); os.IsNotExist(err) {
+			log.Printf("Warning: no binfmt_misc handler %s, emulated binaries may fail to run", handler)
+		}
+	}
+
 	return CopyFile(q.qemusrc, q.qemutarget, 0755)
 }
 
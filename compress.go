@@ -0,0 +1,131 @@
+package debos
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// Compressors writing to stdout, and the extension of their output
+var fileCompressors = map[string]struct {
+	command   []string
+	extension string
+}{
+	"gz":   {[]string{"gzip", "-c"}, ".gz"},
+	"xz":   {[]string{"xz", "-c", "-T0"}, ".xz"},
+	"zstd": {[]string{"zstd", "-c", "-q", "-T0"}, ".zst"},
+}
+
+// Size of the chunks given to the compressor, released from the source once read
+const compressChunkSize = 64 << 20
+
+// fallocate(2) modes, not exported by the syscall package
+const (
+	fallocKeepSize  = 0x01
+	fallocPunchHole = 0x02
+)
+
+// CompressedFileName returns the name of file once compressed by CompressFile
+func CompressedFileName(file, compression string) (string, error) {
+	compressor, ok := fileCompressors[compression]
+	if !ok {
+		return "", fmt.Errorf("Unsupported compression '%s'", compression)
+	}
+
+	return file + compressor.extension, nil
+}
+
+/*
+CompressFile compresses file to a new file named after the compression, e.g.
+"image.img.zst" for zstd, and removes file. The file is streamed to the
+compressor and the blocks already read are released, so the disk usage doesn't
+peak at the size of both files. The compressed file is written under a
+temporary name and only renamed once complete, but the original file is lost
+if the compression fails.
+*/
+func CompressFile(file, compression string) (string, error) {
+	output, err := CompressedFileName(file, compression)
+	if err != nil {
+		return "", err
+	}
+	compressor := fileCompressors[compression]
+
+	in, err := os.OpenFile(file, os.O_RDWR, 0)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	tmp := output + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+
+	cmd := exec.Command(compressor.command[0], compressor.command[1:]...)
+	cmd.Stdout = out
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return "", err
+	}
+	if err := startWithDeadline(cmd); err != nil {
+		return "", err
+	}
+
+	fail := func(err error) (string, error) {
+		stdin.Close()
+		cmd.Process.Kill()
+		waitWithDeadline(cmd)
+		os.Remove(tmp)
+		return "", err
+	}
+
+	buf := make([]byte, compressChunkSize)
+	punch := true
+	var offset int64
+	for {
+		n, err := io.ReadFull(in, buf)
+		if n > 0 {
+			if _, err := stdin.Write(buf[:n]); err != nil {
+				return fail(fmt.Errorf("Failed to compress %s: %v", file, err))
+			}
+
+			if punch {
+				err := syscall.Fallocate(int(in.Fd()), fallocKeepSize|fallocPunchHole, offset, int64(n))
+				if err != nil {
+					log.Printf("Can't release the blocks of %s while compressing it: %v", file, err)
+					punch = false
+				}
+			}
+			offset += int64(n)
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return fail(err)
+		}
+	}
+
+	stdin.Close()
+	if err := waitWithDeadline(cmd); err != nil {
+		os.Remove(tmp)
+		return "", fmt.Errorf("Failed to compress %s: %v", file, err)
+	}
+
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	if err := os.Rename(tmp, output); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+
+	return output, os.Remove(file)
+}
@@ -0,0 +1,167 @@
+package debos
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Time the commands get to exit once terminated, before being killed
+const deadlineGracePeriod = 10 * time.Second
+
+// Time the fakemachine gets to stop by itself, cleaning up, once the deadline passed
+const machineGracePeriod = time.Minute
+
+var ErrDeadlineExceeded = errors.New("Build deadline exceeded")
+
+// Deadline of the build and the commands it terminates once passed
+var deadline struct {
+	sync.Mutex
+	exceeded bool
+	reached  chan struct{} // Closed once the deadline passed, nil without deadline
+	running  map[*exec.Cmd]bool
+}
+
+/*
+SetBuildDeadline terminates the running commands once the duration elapsed,
+with SIGTERM then SIGKILL after a grace period. The commands started
+afterwards, e.g. by the cleanups, run normally, the build is expected to stop
+once DeadlineExceeded returns true.
+*/
+func SetBuildDeadline(d time.Duration) {
+	deadline.Lock()
+	reached := make(chan struct{})
+	deadline.reached = reached
+	deadline.Unlock()
+
+	time.AfterFunc(d, func() {
+		deadline.Lock()
+		defer deadline.Unlock()
+
+		log.Printf("Build deadline of %s exceeded, stopping the build", d)
+		deadline.exceeded = true
+		close(reached)
+		for cmd := range deadline.running {
+			terminate(cmd.Process)
+		}
+	})
+}
+
+func terminate(p *os.Process) {
+	p.Signal(syscall.SIGTERM)
+	time.AfterFunc(deadlineGracePeriod, func() {
+		// No-op if the process exited meanwhile
+		p.Kill()
+	})
+}
+
+// Processes whose parent is debos
+func childProcesses() []*os.Process {
+	var children []*os.Process
+
+	stats, _ := filepath.Glob("/proc/[0-9]*/stat")
+	for _, stat := range stats {
+		data, err := ioutil.ReadFile(stat)
+		if err != nil {
+			continue
+		}
+
+		// The fields following the command name, in parentheses, are the state and the parent
+		fields := strings.Fields(string(data[strings.LastIndex(string(data), ")")+1:]))
+		if len(fields) < 2 || fields[1] != strconv.Itoa(os.Getpid()) {
+			continue
+		}
+
+		pid, _ := strconv.Atoi(filepath.Base(filepath.Dir(stat)))
+		if p, err := os.FindProcess(pid); err == nil {
+			children = append(children, p)
+		}
+	}
+
+	return children
+}
+
+/*
+RunUntilDeadline runs f, which starts processes Command doesn't track, e.g.
+the fakemachine. The fakemachine is expected to stop by itself at the build
+deadline, if f is still running a grace period later the child processes of
+debos are terminated, so a hung machine doesn't hold the build.
+*/
+func RunUntilDeadline(f func() error) error {
+	result := make(chan error, 1)
+	go func() { result <- f() }()
+
+	deadline.Lock()
+	reached := deadline.reached
+	deadline.Unlock()
+
+	select {
+	case err := <-result:
+		return err
+	case <-reached:
+	}
+
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(machineGracePeriod):
+	}
+
+	log.Printf("Still running %s after the build deadline, terminating it", machineGracePeriod)
+	for _, p := range childProcesses() {
+		terminate(p)
+	}
+
+	return <-result
+}
+
+// DeadlineExceeded tells whether the build deadline passed
+func DeadlineExceeded() bool {
+	deadline.Lock()
+	defer deadline.Unlock()
+
+	return deadline.exceeded
+}
+
+// Run the command, terminating it if the build deadline passes meanwhile
+func runWithDeadline(cmd *exec.Cmd) error {
+	if err := startWithDeadline(cmd); err != nil {
+		return err
+	}
+
+	return waitWithDeadline(cmd)
+}
+
+// Start cmd so it gets killed once the deadline passed, waitWithDeadline has to follow
+func startWithDeadline(cmd *exec.Cmd) error {
+	deadline.Lock()
+	defer deadline.Unlock()
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	if deadline.running == nil {
+		deadline.running = map[*exec.Cmd]bool{}
+	}
+	deadline.running[cmd] = true
+
+	return nil
+}
+
+func waitWithDeadline(cmd *exec.Cmd) error {
+	err := cmd.Wait()
+
+	deadline.Lock()
+	delete(deadline.running, cmd)
+	deadline.Unlock()
+
+	return err
+}
@@ -0,0 +1,192 @@
+package debos
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Package installed in a rootfs according to the dpkg status database
+type DpkgPackage struct {
+	Package      string
+	Version      string
+	Architecture string
+	Section      string
+}
+
+// Key identifying the package, as packages of several architectures may be installed
+func (p DpkgPackage) Key() string {
+	return p.Package + ":" + p.Architecture
+}
+
+/*
+InstalledPackages returns the packages installed in rootdir, keyed by
+DpkgPackage.Key(). An empty map is returned if there is no dpkg database.
+*/
+func InstalledPackages(rootdir string) (map[string]DpkgPackage, error) {
+	packages := make(map[string]DpkgPackage)
+
+	data, err := ioutil.ReadFile(path.Join(rootdir, "var/lib/dpkg/status"))
+	if os.IsNotExist(err) {
+		return packages, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for _, stanza := range strings.Split(string(data), "\n\n") {
+		fields := make(map[string]string)
+		for _, line := range strings.Split(stanza, "\n") {
+			kv := strings.SplitN(line, ":", 2)
+			if len(kv) == 2 && !strings.HasPrefix(line, " ") {
+				fields[kv[0]] = strings.TrimSpace(kv[1])
+			}
+		}
+
+		if fields["Status"] != "install ok installed" {
+			continue
+		}
+
+		p := DpkgPackage{
+			Package:      fields["Package"],
+			Version:      fields["Version"],
+			Architecture: fields["Architecture"],
+			Section:      fields["Section"],
+		}
+		packages[p.Key()] = p
+	}
+
+	return packages, nil
+}
+
+// Files of the package state saved by SaveDpkgState
+var dpkgStateFiles = []string{"var/lib/apt/extended_states", "var/lib/apt/lists"}
+
+/*
+DpkgState is a snapshot of the package state of a rootfs: the installed
+packages, the package lists and the automatically installed flags. Restoring
+it only undoes the package changes, which is much faster than restoring the
+whole rootfs.
+*/
+type DpkgState struct {
+	dir      string
+	packages map[string]DpkgPackage
+}
+
+// SaveDpkgState saves the package state of the rootfs of the context in dir
+func SaveDpkgState(context DebosContext, dir string) (*DpkgState, error) {
+	packages, err := InstalledPackages(context.Rootdir)
+	if err != nil {
+		return nil, err
+	}
+
+	os.RemoveAll(dir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	for _, f := range dpkgStateFiles {
+		source := path.Join(context.Rootdir, f)
+		if _, err := os.Stat(source); os.IsNotExist(err) {
+			continue
+		}
+
+		destination := path.Join(dir, f)
+		if err := os.MkdirAll(path.Dir(destination), 0755); err != nil {
+			return nil, err
+		}
+		err := Command{}.Run("Snapshot", "cp", "-a", "--reflink=auto", source, destination)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &DpkgState{dir: dir, packages: packages}, nil
+}
+
+/*
+Restore purges the packages installed since the snapshot and installs again
+the previous version of the changed and removed ones, from the restored
+package lists. Changes done by the maintainer scripts, e.g. to configuration
+files of other packages, aren't undone.
+*/
+func (s *DpkgState) Restore(context DebosContext) error {
+	current, err := InstalledPackages(context.Rootdir)
+	if err != nil {
+		return err
+	}
+
+	var purge, install []string
+	for key, p := range current {
+		if old, found := s.packages[key]; !found {
+			purge = append(purge, key)
+		} else if old.Version != p.Version {
+			install = append(install, key+"="+old.Version)
+		}
+	}
+	for key, p := range s.packages {
+		if _, found := current[key]; !found {
+			install = append(install, key+"="+p.Version)
+		}
+	}
+
+	for _, f := range dpkgStateFiles {
+		saved := path.Join(s.dir, f)
+		if _, err := os.Stat(saved); os.IsNotExist(err) {
+			continue
+		}
+
+		target := path.Join(context.Rootdir, f)
+		if err := os.RemoveAll(target); err != nil {
+			return err
+		}
+		if err := (Command{}).Run("Restore", "cp", "-a", "--reflink=auto", saved, target); err != nil {
+			return err
+		}
+	}
+
+	// Caches of the package lists are outdated
+	caches, _ := filepath.Glob(path.Join(context.Rootdir, "var/cache/apt/*.bin"))
+	for _, c := range caches {
+		os.Remove(c)
+	}
+
+	if len(purge) == 0 && len(install) == 0 {
+		return nil
+	}
+
+	c := NewChrootCommandForContext(context)
+	c.AddEnv("DEBIAN_FRONTEND=noninteractive")
+	if proxy := ResolveAptProxy(context, ""); proxy != "" {
+		c.AddEnvKey("http_proxy", proxy)
+	}
+
+	if len(purge) > 0 {
+		sort.Strings(purge)
+		log.Printf("Purging %d packages installed since the snapshot", len(purge))
+		cmdline := append([]string{"dpkg", "--purge", "--force-depends", "--force-remove-essential"}, purge...)
+		if err := c.Run("dpkg", cmdline...); err != nil {
+			return err
+		}
+	}
+
+	if len(install) > 0 {
+		sort.Strings(install)
+		log.Printf("Installing %d packages changed since the snapshot", len(install))
+		cmdline := append([]string{"apt-get", "-y", "--allow-downgrades", "--no-install-recommends", "install"}, install...)
+		if err := c.Run("apt", cmdline...); err != nil {
+			return fmt.Errorf("Failed to install the packages of the snapshot: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// Remove the saved state
+func (s *DpkgState) Remove() {
+	os.RemoveAll(s.dir)
+}
@@ -0,0 +1,74 @@
+package debos
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// Hashes of the blocks of a partition of the image
+type PartitionIntegrity struct {
+	Name   string   `json:"name"`
+	Number int      `json:"number"`
+	Offset int64    `json:"offset"` // In bytes from the start of the image
+	Size   int64    `json:"size"`   // In bytes
+	SHA256 string   `json:"sha256"`
+	Blocks []string `json:"blocks"` // sha256 of each block, the last one may be shorter
+}
+
+/*
+IntegrityManifest lists the hashes of the blocks of the partitions, so the
+bootloaders and updaters can verify the flashed content range by range. It's
+requested by filesystem-deploy and filled once the partitions are unmounted.
+*/
+type IntegrityManifest struct {
+	File       string               `json:"-"` // Relative to the artifact directory
+	Hash       string               `json:"hash"`
+	BlockSize  int64                `json:"block-size"`
+	Partitions []PartitionIntegrity `json:"partitions"`
+}
+
+func (m *IntegrityManifest) Save(file string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(file, append(data, '\n'), 0644)
+}
+
+/*
+HashBlocks reads a file or block device once, returning the sha256 of its
+whole content, of each of its blocks and its size.
+*/
+func HashBlocks(file string, blockSize int64) (string, []string, int64, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", nil, 0, err
+	}
+	defer f.Close()
+
+	whole := sha256.New()
+	block := make([]byte, blockSize)
+	var blocks []string
+	var size int64
+
+	for {
+		n, err := io.ReadFull(f, block)
+		if n > 0 {
+			whole.Write(block[:n])
+			blocks = append(blocks, fmt.Sprintf("%x", sha256.Sum256(block[:n])))
+			size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return "", nil, 0, err
+		}
+	}
+
+	return fmt.Sprintf("%x", whole.Sum(nil)), blocks, size, nil
+}
@@ -0,0 +1,268 @@
+package debos
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Checksum of a downloaded file
+type LockedDownload struct {
+	URL    string `yaml:"url"`
+	SHA256 string `yaml:"sha256"`
+}
+
+// Commit a git reference was resolved to
+type LockedGit struct {
+	URL    string `yaml:"url"`
+	Ref    string `yaml:"ref,omitempty"`
+	Commit string `yaml:"commit"`
+}
+
+/*
+Lock records the external inputs resolved by a build: the checksums of the
+downloads, the commits of the git repositories and the versions of the
+installed packages (name:arch=version). It's written by --update-lock and
+enforced by --locked, for audited release builds.
+*/
+type Lock struct {
+	Downloads []LockedDownload `yaml:"downloads,omitempty"`
+	Git       []LockedGit      `yaml:"git,omitempty"`
+	Packages  []string         `yaml:"packages,omitempty"`
+
+	enforce bool
+}
+
+func LoadLock(file string, enforce bool) (*Lock, error) {
+	var l Lock
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := yaml.UnmarshalStrict(data, &l); err != nil {
+		return nil, fmt.Errorf("Failed to parse lock file %s: %v", file, err)
+	}
+	l.enforce = enforce
+
+	return &l, nil
+}
+
+// NewLock returns an empty lock, recording the inputs of the build
+func NewLock() *Lock {
+	return &Lock{}
+}
+
+// Enforced returns whether the build has to match the lock
+func (l *Lock) Enforced() bool {
+	return l.enforce
+}
+
+/*
+AptPreferences returns APT preferences pinning the locked packages to their
+version, so apt installs the locked versions or fails.
+*/
+func (l *Lock) AptPreferences() []byte {
+	var b strings.Builder
+
+	for _, p := range l.Packages {
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		fmt.Fprintf(&b, "Package: %s\nPin: version %s\nPin-Priority: 1001\n\n", kv[0], kv[1])
+	}
+
+	return []byte(b.String())
+}
+
+func (l *Lock) Save(file string) error {
+	sort.Slice(l.Downloads, func(i, j int) bool {
+		return l.Downloads[i].URL < l.Downloads[j].URL
+	})
+	sort.Slice(l.Git, func(i, j int) bool {
+		if l.Git[i].URL != l.Git[j].URL {
+			return l.Git[i].URL < l.Git[j].URL
+		}
+		return l.Git[i].Ref < l.Git[j].Ref
+	})
+	sort.Strings(l.Packages)
+
+	data, err := yaml.Marshal(l)
+	if err != nil {
+		return err
+	}
+
+	header := "# Generated by debos --update-lock, do not edit\n"
+
+	// Concurrent builds updating the same lock file mustn't leave a mix of both
+	tmp, err := ioutil.TempFile(path.Dir(file), "."+path.Base(file)+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(append([]byte(header), data...)); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), file)
+}
+
+// Locked returns an error if the lock is enforced and doesn't contain url
+func (l *Lock) Locked(url string) error {
+	if !l.enforce {
+		return nil
+	}
+
+	for _, d := range l.Downloads {
+		if d.URL == url {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Download of %s isn't in the lock", url)
+}
+
+/*
+Download records the checksum of a downloaded file or, when the lock is
+enforced, checks it matches the locked one.
+*/
+func (l *Lock) Download(url, file string) error {
+	sum, err := HashFile(file)
+	if err != nil {
+		return err
+	}
+
+	for idx, d := range l.Downloads {
+		if d.URL != url {
+			continue
+		}
+		if l.enforce && d.SHA256 != sum {
+			return fmt.Errorf("Checksum of %s doesn't match the lock: %s instead of %s", url, sum, d.SHA256)
+		}
+		l.Downloads[idx].SHA256 = sum
+		return nil
+	}
+
+	if err := l.Locked(url); err != nil {
+		return err
+	}
+
+	l.Downloads = append(l.Downloads, LockedDownload{url, sum})
+	return nil
+}
+
+/*
+Fetch downloads url to file, checked against the lock if any: the download has
+to be in an enforced lock and match its checksum, and is recorded otherwise.
+*/
+func (l *Lock) Fetch(url, file string) error {
+	if l == nil {
+		return DownloadHttpUrl(url, file)
+	}
+
+	if err := l.Locked(url); err != nil {
+		return err
+	}
+	if err := DownloadHttpUrl(url, file); err != nil {
+		return err
+	}
+
+	return l.Download(url, file)
+}
+
+/*
+LockedCommit returns the commit locked for the reference of the git repository,
+if any. When the lock is enforced, an error is returned if it's not locked.
+*/
+func (l *Lock) LockedCommit(url, ref string) (string, error) {
+	for _, g := range l.Git {
+		if g.URL == url && g.Ref == ref {
+			return g.Commit, nil
+		}
+	}
+
+	if l.enforce {
+		return "", fmt.Errorf("Git repository %s (%s) isn't in the lock", url, ref)
+	}
+
+	return "", nil
+}
+
+// Checkout records the commit the reference of the git repository resolved to
+func (l *Lock) Checkout(url, ref, commit string) {
+	for idx, g := range l.Git {
+		if g.URL == url && g.Ref == ref {
+			l.Git[idx].Commit = commit
+			return
+		}
+	}
+
+	l.Git = append(l.Git, LockedGit{url, ref, commit})
+}
+
+/*
+InstalledPackages records the packages installed in the rootfs or, when the
+lock is enforced, checks they are all locked with the same version.
+*/
+func (l *Lock) InstalledPackages(rootdir string) error {
+	installed, err := InstalledPackages(rootdir)
+	if err != nil {
+		return err
+	}
+
+	// Also keep the packages installed temporarily during the build, with
+	// their last version only so the APT preferences pin a single one
+	if !l.enforce {
+		recorded := make(map[string]int)
+		for idx, p := range l.Packages {
+			recorded[strings.SplitN(p, "=", 2)[0]] = idx
+		}
+		for key, p := range installed {
+			if idx, found := recorded[key]; found {
+				l.Packages[idx] = key + "=" + p.Version
+			} else {
+				l.Packages = append(l.Packages, key+"="+p.Version)
+			}
+		}
+		return nil
+	}
+
+	var packages []string
+	for key, p := range installed {
+		packages = append(packages, key+"="+p.Version)
+	}
+	sort.Strings(packages)
+
+	locked := make(map[string]bool)
+	for _, p := range l.Packages {
+		locked[p] = true
+	}
+
+	var unlocked []string
+	for _, p := range packages {
+		if !locked[p] {
+			unlocked = append(unlocked, p)
+		}
+	}
+	if len(unlocked) > 0 {
+		return fmt.Errorf("Packages not matching the lock: %s", strings.Join(unlocked, ", "))
+	}
+
+	return nil
+}
@@ -0,0 +1,212 @@
+package debos
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+)
+
+// Hashes of a partition of the image
+type PartitionManifest struct {
+	Name          string `json:"name"`
+	SHA256        string `json:"sha256"`
+	ContentSHA256 string `json:"content-sha256,omitempty"` // Logical content of the filesystem
+}
+
+// Package upgraded or downgraded by an action
+type PackageChange struct {
+	Package string `json:"package"`
+	From    string `json:"from"`
+	To      string `json:"to"`
+}
+
+// Packages changes in the rootfs done by an action
+type PackageTransaction struct {
+	Action    string          `json:"action"`
+	Installed []string        `json:"installed,omitempty"` // name:arch=version
+	Removed   []string        `json:"removed,omitempty"`   // name:arch=version
+	Changed   []PackageChange `json:"changed,omitempty"`
+}
+
+// Signed recipe bundle included by the recipe
+type BundleManifest struct {
+	Source string `json:"source"`
+	SHA256 string `json:"sha256"`
+	Signer string `json:"signer"` // Fingerprint of the signing key
+}
+
+/*
+Manifest records what went into the build, it's written as JSON when the
+--manifest option is used. When running in fakemachine, the manifest is
+written by the inner debos and completed by the outer one.
+*/
+type Manifest struct {
+	BuildID      string               `json:"build-id,omitempty"`
+	Partitions   []PartitionManifest  `json:"partitions,omitempty"`
+	Transactions []PackageTransaction `json:"transactions,omitempty"`
+	Bundles      []BundleManifest     `json:"bundles,omitempty"`
+}
+
+func LoadManifest(file string) (*Manifest, error) {
+	var m Manifest
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("Failed to parse manifest %s: %v", file, err)
+	}
+
+	return &m, nil
+}
+
+func (m *Manifest) Save(file string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(file, append(data, '\n'), 0644)
+}
+
+// Partition returns the manifest entry of the named partition, adding it if needed
+func (m *Manifest) Partition(name string) *PartitionManifest {
+	for idx := range m.Partitions {
+		if m.Partitions[idx].Name == name {
+			return &m.Partitions[idx]
+		}
+	}
+
+	m.Partitions = append(m.Partitions, PartitionManifest{Name: name})
+	return &m.Partitions[len(m.Partitions)-1]
+}
+
+// AddBundle records an included recipe bundle, once per source
+func (m *Manifest) AddBundle(b BundleManifest) {
+	for idx := range m.Bundles {
+		if m.Bundles[idx].Source == b.Source {
+			m.Bundles[idx] = b
+			return
+		}
+	}
+
+	m.Bundles = append(m.Bundles, b)
+}
+
+/*
+AddTransaction records the differences between the packages installed before
+and after an action, as returned by InstalledPackages. Nothing is recorded if
+the action didn't change any package.
+*/
+func (m *Manifest) AddTransaction(action string, before, after map[string]DpkgPackage) {
+	t := PackageTransaction{Action: action}
+
+	for key, p := range after {
+		old, found := before[key]
+		if !found {
+			t.Installed = append(t.Installed, key+"="+p.Version)
+		} else if old.Version != p.Version {
+			t.Changed = append(t.Changed, PackageChange{key, old.Version, p.Version})
+		}
+	}
+
+	for key, p := range before {
+		if _, found := after[key]; !found {
+			t.Removed = append(t.Removed, key+"="+p.Version)
+		}
+	}
+
+	if len(t.Installed) == 0 && len(t.Removed) == 0 && len(t.Changed) == 0 {
+		return
+	}
+
+	sort.Strings(t.Installed)
+	sort.Strings(t.Removed)
+	sort.Slice(t.Changed, func(i, j int) bool {
+		return t.Changed[i].Package < t.Changed[j].Package
+	})
+
+	m.Transactions = append(m.Transactions, t)
+}
+
+// HashFile returns the sha256 of the content of a file or block device
+func HashFile(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+/*
+HashTree returns the sha256 of the logical content of the filesystem mounted
+at root: the paths, types, permissions, owners and contents of the files.
+Filesystems mounted below root are skipped.
+*/
+func HashTree(root string) (string, error) {
+	var rootStat syscall.Stat_t
+	if err := syscall.Lstat(root, &rootStat); err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		st := info.Sys().(*syscall.Stat_t)
+		if st.Dev != rootStat.Dev {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(h, "%s\x00%o\x00%d\x00%d\x00", rel, info.Mode(), st.Uid, st.Gid)
+
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "%s\x00", target)
+		case info.Mode().IsRegular():
+			sum, err := HashFile(p)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "%s\x00", sum)
+		case info.Mode()&(os.ModeDevice|os.ModeCharDevice) != 0:
+			fmt.Fprintf(h, "%d\x00", st.Rdev)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
@@ -0,0 +1,148 @@
+package debos
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Attempts to fetch a file from a mirror, transient failures are retried
+const mirrorProbeAttempts = 3
+
+var mirrorProbeClient = &http.Client{Timeout: 30 * time.Second}
+
+var errMirrorNotFound = errors.New("not found")
+
+func fetchMirrorFile(url string) ([]byte, error) {
+	var err error
+
+	for attempt := 0; attempt < mirrorProbeAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * 2 * time.Second)
+		}
+
+		var resp *http.Response
+		resp, err = mirrorProbeClient.Get(url)
+		if err != nil {
+			continue
+		}
+
+		var data []byte
+		data, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		switch {
+		case resp.StatusCode == http.StatusNotFound:
+			return nil, errMirrorNotFound
+		case resp.StatusCode >= 500:
+			err = fmt.Errorf("status code %d", resp.StatusCode)
+		case resp.StatusCode != http.StatusOK:
+			return nil, fmt.Errorf("status code %d", resp.StatusCode)
+		case err == nil:
+			return data, nil
+		}
+	}
+
+	return nil, err
+}
+
+/*
+ProbeMirror checks mirror serves suite: its Release file has to be fetched and
+list the component for arch, and the Release file of the component has to
+match its checksum, which catches mirrors in the middle of a sync.
+*/
+func ProbeMirror(mirror, suite, component, arch string) error {
+	dists := strings.TrimSuffix(mirror, "/") + "/dists/" + suite + "/"
+
+	release, err := fetchMirrorFile(dists + "InRelease")
+	if err == errMirrorNotFound {
+		release, err = fetchMirrorFile(dists + "Release")
+	}
+	if err == errMirrorNotFound {
+		return fmt.Errorf("Mirror %s doesn't provide suite %s", mirror, suite)
+	} else if err != nil {
+		return fmt.Errorf("Failed to fetch the Release file of %s from %s: %v", suite, mirror, err)
+	}
+
+	index := fmt.Sprintf("%s/binary-%s/", component, arch)
+	var listed bool
+	var sum string
+
+	// Lines of the SHA256 field are "<sum> <size> <file>"
+	inSHA256 := false
+	scanner := bufio.NewScanner(bytes.NewReader(release))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, " ") {
+			inSHA256 = strings.HasPrefix(line, "SHA256:")
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if !inSHA256 || len(fields) != 3 || !strings.HasPrefix(fields[2], index) {
+			continue
+		}
+		listed = true
+		if fields[2] == index+"Release" {
+			sum = fields[0]
+		}
+	}
+
+	if !listed {
+		return fmt.Errorf("Mirror %s doesn't provide %s/%s for %s", mirror, component, arch, suite)
+	}
+
+	if sum == "" {
+		return nil
+	}
+
+	data, err := fetchMirrorFile(dists + index + "Release")
+	if err != nil {
+		return fmt.Errorf("Failed to fetch %sRelease of %s from %s: %v", index, suite, mirror, err)
+	}
+
+	actual := sha256.Sum256(data)
+	if hex.EncodeToString(actual[:]) != sum {
+		return fmt.Errorf("Mirror %s is inconsistent, checksum of %sRelease of %s doesn't match, it may be syncing",
+			mirror, index, suite)
+	}
+
+	return nil
+}
+
+/*
+HealthyMirrors probes the HTTP mirrors, in order, and returns the ones serving
+suite correctly. Other mirrors, e.g. file:// ones, are kept without probing.
+An error listing the failures is returned if no mirror is healthy.
+*/
+func HealthyMirrors(mirrors []string, suite, component, arch string) ([]string, error) {
+	var healthy, failures []string
+
+	for _, mirror := range mirrors {
+		if !strings.HasPrefix(mirror, "http://") && !strings.HasPrefix(mirror, "https://") {
+			healthy = append(healthy, mirror)
+			continue
+		}
+
+		if err := ProbeMirror(mirror, suite, component, arch); err != nil {
+			log.Printf("Warning: skipping mirror: %v", err)
+			failures = append(failures, err.Error())
+			continue
+		}
+		healthy = append(healthy, mirror)
+	}
+
+	if len(healthy) == 0 {
+		return nil, fmt.Errorf("No healthy mirror:\n%s", strings.Join(failures, "\n"))
+	}
+
+	return healthy, nil
+}
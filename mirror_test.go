@@ -0,0 +1,40 @@
+package debos
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProbeMirror_failures(t *testing.T) {
+	release := "SHA256:\n 0000 10 main/binary-amd64/Release\n"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/debian/dists/bookworm/InRelease":
+			fmt.Fprint(w, release)
+		case "/debian/dists/bookworm/main/binary-amd64/Release":
+			fmt.Fprint(w, "Archive: bookworm\n")
+		case "/auth/dists/bookworm/InRelease":
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	err := ProbeMirror(server.URL+"/debian", "trixie", "main", "amd64")
+	assert.EqualError(t, err, fmt.Sprintf("Mirror %s/debian doesn't provide suite trixie", server.URL))
+
+	err = ProbeMirror(server.URL+"/auth", "bookworm", "main", "amd64")
+	assert.Contains(t, err.Error(), "status code 401")
+
+	err = ProbeMirror(server.URL+"/debian", "bookworm", "contrib", "amd64")
+	assert.EqualError(t, err, fmt.Sprintf("Mirror %s/debian doesn't provide contrib/amd64 for bookworm", server.URL))
+
+	// The Release file of the component doesn't match the checksum
+	err = ProbeMirror(server.URL+"/debian", "bookworm", "main", "amd64")
+	assert.Contains(t, err.Error(), "checksum of main/binary-amd64/Release of bookworm doesn't match")
+}
@@ -4,10 +4,72 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"time"
 )
 
+/*
+Hosts probed for an apt-cacher-ng proxy: the local host, and the host as seen
+from the user mode network of fakemachine.
+*/
+var aptCacherNgHosts = []string{"127.0.0.1", "10.0.2.2"}
+
+// DetectAptCacherNg returns the URL of a reachable apt-cacher-ng, or "" if none
+func DetectAptCacherNg() string {
+	for _, host := range aptCacherNgHosts {
+		address := net.JoinHostPort(host, "3142")
+		conn, err := net.DialTimeout("tcp", address, time.Second)
+		if err != nil {
+			continue
+		}
+		conn.Close()
+
+		return fmt.Sprintf("http://%s/", address)
+	}
+
+	return ""
+}
+
+/*
+ResolveAptProxy returns the URL of the APT proxy to use, the global one of the
+context if proxy is empty, or "" if none.
+*/
+func ResolveAptProxy(context DebosContext, proxy string) string {
+	if proxy == "" {
+		proxy = context.AptProxy
+	}
+
+	if proxy == "auto" {
+		proxy = DetectAptCacherNg()
+		if proxy == "" {
+			log.Printf("No apt-cacher-ng found, not using an APT proxy")
+		}
+	}
+
+	if proxy == "none" {
+		return ""
+	}
+
+	return proxy
+}
+
+// VerifyAptProxy checks an APT proxy is an http(s) URL, 'auto' or 'none'
+func VerifyAptProxy(proxy string) error {
+	if proxy == "" || proxy == "auto" || proxy == "none" {
+		return nil
+	}
+
+	u, err := url.Parse(proxy)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("Invalid APT proxy '%s'", proxy)
+	}
+
+	return nil
+}
+
 // Function for downloading single file object with http(s) protocol
 func DownloadHttpUrl(url, filename string) error {
 	log.Printf("Download started: '%s' -> '%s'\n", url, filename)
@@ -43,3 +105,35 @@ func DownloadHttpUrl(url, filename string) error {
 
 	return nil
 }
+
+// Function for uploading a file with a http(s) PUT request
+func UploadHttpUrl(filename, url string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPut, url, f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = info.Size()
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("Upload of '%s' returned status code %d (%s)", filename, resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+
+	return nil
+}
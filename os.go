@@ -1,7 +1,9 @@
 package debos
 
 import (
+	"bytes"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path"
 )
@@ -15,6 +17,7 @@ Currently supports only debian-based family.
 
 type ServiceHelper struct {
 	Rootdir string
+	BuildID string // Build owning the policy helper
 }
 
 type ServicesManager interface {
@@ -22,6 +25,16 @@ type ServicesManager interface {
 	Deny() error
 }
 
+const policyHelperHeader = "#!/bin/sh\n# Generated by debos build "
+
+// The policy helper denying the services, marked with the build owning it
+func (s *ServiceHelper) helper() []byte {
+	return []byte(policyHelperHeader + s.BuildID + `
+
+exit 101
+`)
+}
+
 /*
 Allow() allows to start/stop services on OS level.
 */
@@ -32,6 +45,10 @@ func (s *ServiceHelper) Allow() error {
 	if _, err := os.Stat(helperFile); os.IsNotExist(err) {
 		return nil
 	}
+	// Leave the helper of another build of the same rootfs in place
+	if data, err := ioutil.ReadFile(helperFile); err == nil && !bytes.Equal(data, s.helper()) {
+		return nil
+	}
 	if err := os.Remove(helperFile); err != nil {
 		return err
 	}
@@ -44,13 +61,10 @@ Deny() prohibits to start/stop services on OS level.
 func (s *ServiceHelper) Deny() error {
 
 	helperFile := path.Join(s.Rootdir, debianPolicyHelper)
-	var helper = []byte(`#!/bin/sh
-
-exit 101
-`)
+	helper := s.helper()
 
-	if _, err := os.Stat(helperFile); os.IsExist(err) {
-		return fmt.Errorf("Policy helper file '%s' exists already", debianPolicyHelper)
+	if data, err := ioutil.ReadFile(helperFile); err == nil && bytes.HasPrefix(data, []byte(policyHelperHeader)) && !bytes.Equal(data, helper) {
+		return fmt.Errorf("Policy helper file '%s' of another build exists already", debianPolicyHelper)
 	}
 	if _, err := os.Stat(path.Dir(helperFile)); os.IsNotExist(err) {
 		// do not try to do something if ".../usr/sbin" is not exists
@@ -0,0 +1,113 @@
+package debos
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var sandboxUserRegex = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9_.-]*(:[a-zA-Z0-9_][a-zA-Z0-9_.-]*)?$`)
+
+/*
+Sandbox describes what the commands run in the chroot by an action can
+access. Sandboxes are declared in the recipe header and referenced by name by
+the actions, and set in the context while the action runs.
+*/
+type Sandbox struct {
+	Environment map[string]string // Extra environment variables
+	BindMounts  []string          `yaml:"bind-mounts"` // source[:target][:ro]
+	Network     *bool             // Network access, allowed if nil
+	Chroot      string            // Method to enter the chroot, 'nspawn' or 'chroot'
+	User        string            // User[:group] running the commands, root if empty
+}
+
+// Parse a bind mount of the sandbox
+func parseSandboxBindMount(b string) (bindMount, error) {
+	fields := strings.Split(b, ":")
+
+	readOnly := false
+	if len(fields) > 1 && fields[len(fields)-1] == "ro" {
+		readOnly = true
+		fields = fields[:len(fields)-1]
+	}
+
+	if len(fields) > 2 || !filepath.IsAbs(fields[0]) ||
+		(len(fields) == 2 && !filepath.IsAbs(fields[1])) {
+		return bindMount{}, fmt.Errorf("Invalid bind mount '%s', expected 'source[:target][:ro]' with absolute paths", b)
+	}
+
+	m := bindMount{source: fields[0], readOnly: readOnly}
+	if len(fields) == 2 {
+		m.target = fields[1]
+	}
+
+	return m, nil
+}
+
+func (s *Sandbox) Verify() error {
+	switch s.Chroot {
+	case "", "nspawn":
+	case "chroot":
+		if len(s.BindMounts) > 0 {
+			return fmt.Errorf("Bind mounts need the 'nspawn' chroot method")
+		}
+	default:
+		return fmt.Errorf("Unsupported chroot method '%s'", s.Chroot)
+	}
+
+	for _, b := range s.BindMounts {
+		if _, err := parseSandboxBindMount(b); err != nil {
+			return err
+		}
+	}
+
+	if s.User != "" && !sandboxUserRegex.MatchString(s.User) {
+		return fmt.Errorf("Invalid user '%s'", s.User)
+	}
+
+	// systemd-nspawn --user only takes a user name
+	if strings.Contains(s.User, ":") && s.Chroot != "chroot" {
+		return fmt.Errorf("User '%s' with a group needs the 'chroot' chroot method", s.User)
+	}
+
+	return nil
+}
+
+// Sources of the bind mounts, to make them available in fakemachine
+func (s *Sandbox) BindMountSources() []string {
+	var sources []string
+	for _, b := range s.BindMounts {
+		if m, err := parseSandboxBindMount(b); err == nil {
+			sources = append(sources, m.source)
+		}
+	}
+
+	return sources
+}
+
+// Restrict a command entering the chroot
+func (s *Sandbox) apply(cmd *Command) {
+	keys := make([]string, 0, len(s.Environment))
+	for k := range s.Environment {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		cmd.AddEnvKey(k, s.Environment[k])
+	}
+
+	for _, b := range s.BindMounts {
+		if m, err := parseSandboxBindMount(b); err == nil {
+			cmd.bindMounts = append(cmd.bindMounts, m)
+		}
+	}
+
+	if s.Chroot == "chroot" {
+		cmd.ChrootMethod = CHROOT_METHOD_CHROOT
+	}
+
+	cmd.PrivateNetwork = s.Network != nil && !*s.Network
+	cmd.User = s.User
+}
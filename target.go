@@ -0,0 +1,127 @@
+package debos
+
+import (
+	"fmt"
+	"strings"
+)
+
+/*
+Target describes the target system of a recipe in toolchain terms, from which
+the Debian architecture, the GNU triplet and the qemu binary are derived.
+*/
+type Target struct {
+	Arch   string // CPU family as in GNU triplets, e.g. aarch64 or arm
+	ABI    string // ABI as in GNU triplets, e.g. gnu or gnueabihf
+	Endian string // little or big, defaults to the usual endianness of Arch
+	CPU    string // Baseline CPU, e.g. cortex-a53
+}
+
+type targetArch struct {
+	arch   string
+	abi    string
+	endian string
+	dpkg   string
+}
+
+// Known combinations of CPU family, ABI and endianness with their Debian name
+var targetArchitectures = []targetArch{
+	{"aarch64", "gnu", "little", "arm64"},
+	{"arm", "gnueabihf", "little", "armhf"},
+	{"arm", "gnueabi", "little", "armel"},
+	{"x86_64", "gnu", "little", "amd64"},
+	{"i686", "gnu", "little", "i386"},
+	{"mips", "gnu", "big", "mips"},
+	{"mipsel", "gnu", "little", "mipsel"},
+	{"mips64el", "gnuabi64", "little", "mips64el"},
+	{"powerpc64le", "gnu", "little", "ppc64el"},
+	{"riscv64", "gnu", "little", "riscv64"},
+	{"s390x", "gnu", "big", "s390x"},
+	{"sh4", "gnu", "little", "sh4"},
+}
+
+func (t *Target) lookup() (*targetArch, error) {
+	abi := t.ABI
+	if abi == "" {
+		abi = "gnu"
+	}
+
+	for idx, a := range targetArchitectures {
+		if a.arch != t.Arch || a.abi != abi {
+			continue
+		}
+		if t.Endian != "" && t.Endian != a.endian {
+			continue
+		}
+		return &targetArchitectures[idx], nil
+	}
+
+	return nil, fmt.Errorf("Unsupported target %s-linux-%s (%s endian)", t.Arch, abi, t.Endian)
+}
+
+// Verify checks the target is known and fills in the defaults
+func (t *Target) Verify() error {
+	a, err := t.lookup()
+	if err != nil {
+		return err
+	}
+
+	t.ABI = a.abi
+	t.Endian = a.endian
+
+	return nil
+}
+
+// DpkgArch returns the Debian architecture of the target
+func (t *Target) DpkgArch() string {
+	a, err := t.lookup()
+	if err != nil {
+		return ""
+	}
+	return a.dpkg
+}
+
+// Triplet returns the GNU triplet of the target, e.g. aarch64-linux-gnu
+func (t *Target) Triplet() string {
+	return fmt.Sprintf("%s-linux-%s", t.Arch, t.ABI)
+}
+
+// Multiarch returns the Debian multiarch tuple of the target
+func (t *Target) Multiarch() string {
+	if t.Arch == "i686" {
+		return "i386-linux-gnu"
+	}
+	return t.Triplet()
+}
+
+// QemuBinary returns the qemu user emulation binary running the target
+func (t *Target) QemuBinary() string {
+	return qemuBinaries[t.DpkgArch()]
+}
+
+// Environment returns the toolchain environment variables of the target
+func (t *Target) Environment() map[string]string {
+	env := map[string]string{
+		"DEB_HOST_ARCH":      t.DpkgArch(),
+		"DEB_HOST_GNU_TYPE":  t.Triplet(),
+		"DEB_HOST_MULTIARCH": t.Multiarch(),
+		"CROSS_COMPILE":      t.Triplet() + "-",
+	}
+
+	if t.CPU != "" {
+		env["TARGET_CPU"] = t.CPU
+	}
+
+	return env
+}
+
+// TemplateVars returns the variables describing the target for templates
+func (t *Target) TemplateVars() map[string]string {
+	return map[string]string{
+		"target_arch":    t.Arch,
+		"target_abi":     t.ABI,
+		"target_endian":  t.Endian,
+		"target_cpu":     t.CPU,
+		"target_triplet": t.Triplet(),
+		"target_qemu":    strings.TrimPrefix(t.QemuBinary(), "/usr/bin/"),
+	}
+}
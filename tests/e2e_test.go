@@ -0,0 +1,139 @@
+//go:build e2e
+
+/*
+End-to-end tests building the reference recipes of matrix.yaml with a debos
+binary. They need root privileges and the debos runtime dependencies, so they
+only run with the e2e build tag:
+
+	go test -tags e2e -v ./tests
+
+The environment selects what is run:
+
+	DEBOS -- debos binary to use, 'debos' from the PATH by default
+	DEBOS_E2E_BACKENDS -- comma separated fakemachine backends, or
+	'nofakemachine' to run on the host. Default 'auto'.
+	DEBOS_E2E_NETWORK -- set to 'false' to skip the cases needing network access
+*/
+package tests
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+type e2eCase struct {
+	Name      string
+	Recipe    string
+	Variables map[string]string
+	Exclude   []string
+	Network   bool
+	Artifacts []string
+	Check     string
+}
+
+type e2eMatrix struct {
+	Cases []e2eCase
+}
+
+func loadMatrix(t *testing.T) e2eMatrix {
+	var m e2eMatrix
+
+	data, err := ioutil.ReadFile("matrix.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := yaml.UnmarshalStrict(data, &m); err != nil {
+		t.Fatalf("Failed to parse matrix.yaml: %v", err)
+	}
+
+	return m
+}
+
+func (c e2eCase) args(backend string, artifactdir string) []string {
+	args := []string{"--artifactdir", artifactdir}
+
+	if backend == "nofakemachine" {
+		args = append(args, "--disable-fakemachine")
+	} else {
+		args = append(args, "--fakemachine-backend", backend)
+	}
+
+	// Sorted for reproducible command lines in the logs
+	var names []string
+	for k := range c.Variables {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		args = append(args, "-t", fmt.Sprintf("%s:%s", k, c.Variables[k]))
+	}
+
+	return append(args, c.Recipe)
+}
+
+func (c e2eCase) excluded(backend string) bool {
+	for _, e := range c.Exclude {
+		if e == backend {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRecipes(t *testing.T) {
+	debos := os.Getenv("DEBOS")
+	if debos == "" {
+		debos = "debos"
+	}
+
+	backends := []string{"auto"}
+	if env := os.Getenv("DEBOS_E2E_BACKENDS"); env != "" {
+		backends = strings.Split(env, ",")
+	}
+	network := os.Getenv("DEBOS_E2E_NETWORK") != "false"
+
+	for _, backend := range backends {
+		for _, c := range loadMatrix(t).Cases {
+			c := c
+			if c.excluded(backend) || (c.Network && !network) {
+				continue
+			}
+
+			t.Run(backend+"/"+c.Name, func(t *testing.T) {
+				artifactdir, err := ioutil.TempDir("", "debos-e2e-")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer os.RemoveAll(artifactdir)
+
+				cmd := exec.Command(debos, c.args(backend, artifactdir)...)
+				out, err := cmd.CombinedOutput()
+				if err != nil {
+					t.Fatalf("%s failed: %v\n%s", strings.Join(cmd.Args, " "), err, out)
+				}
+
+				for _, a := range c.Artifacts {
+					if _, err := os.Stat(path.Join(artifactdir, a)); err != nil {
+						t.Errorf("Missing artifact %s", a)
+					}
+				}
+
+				if c.Check != "" {
+					check := exec.Command("sh", "-e", "-c", c.Check)
+					check.Dir = artifactdir
+					if out, err := check.CombinedOutput(); err != nil {
+						t.Errorf("Check failed: %v\n%s", err, out)
+					}
+				}
+			})
+		}
+	}
+}
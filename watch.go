@@ -0,0 +1,69 @@
+package debos
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/*
+WatchableAction is implemented by actions consuming files from the host (e.g.
+overlays or scripts) so the watch mode knows which paths to monitor for
+changes.
+*/
+type WatchableAction interface {
+	WatchPaths(context *DebosContext) []string
+}
+
+/*
+Watcher polls a set of files or directory trees for modifications.
+Polling is used rather than inotify to also work on network and bind mounted
+recipe directories.
+*/
+type Watcher struct {
+	stamps map[string]time.Time
+}
+
+func NewWatcher(paths ...string) *Watcher {
+	w := Watcher{stamps: make(map[string]time.Time)}
+	for _, p := range paths {
+		w.stamps[p] = latestModTime(p)
+	}
+	return &w
+}
+
+// Return the most recent modification time of path or of any file below it
+func latestModTime(p string) time.Time {
+	var latest time.Time
+
+	filepath.Walk(p, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Files may vanish while being edited, just skip them
+			return nil
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+		return nil
+	})
+
+	return latest
+}
+
+/*
+Changed returns the watched paths modified since the previous call (or since
+the watcher creation).
+*/
+func (w *Watcher) Changed() []string {
+	var changed []string
+
+	for p, stamp := range w.stamps {
+		current := latestModTime(p)
+		if !current.Equal(stamp) {
+			w.stamps[p] = current
+			changed = append(changed, p)
+		}
+	}
+
+	return changed
+}